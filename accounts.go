@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ── Operator Accounts ────────────────────────────────────────────────────────
+//
+// The admin opens accounts under /api/admin/accounts and hands each operator
+// an API key. Operators authenticate with it, or with a session token from
+// logging in with an LNURL-auth wallet linked to the account, as
+//
+//	Authorization: Bearer <API key or session token>
+//
+// An authenticated POST /api/vouchers/invoice is paid from the account
+// instead of by invoice (see handleCreateInvoice).
+
+// Credential prefixes, so a leaked token is recognisable.
+const (
+	apiKeyPrefix       = "tmk_"
+	sessionTokenPrefix = "tms_"
+)
+
+// accountLoginTTL is how long an LNURL-auth challenge can be signed and claimed.
+const accountLoginTTL = 10 * time.Minute
+
+// maxLoginStartsPerMinute limits how many login challenges one client address
+// can open a minute, as opening one needs no credential but stores a row.
+const maxLoginStartsPerMinute = 10
+
+// loginStarts counts the challenges opened per client address in the minute
+// since its first one.
+var loginStarts = struct {
+	sync.Mutex
+	windows map[string]loginWindow
+}{windows: map[string]loginWindow{}}
+
+type loginWindow struct {
+	start time.Time
+	count int
+}
+
+// allowLoginStart reports whether the client at remoteAddr may open another
+// login challenge this minute, and counts it if so.
+func allowLoginStart(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	now := time.Now()
+	loginStarts.Lock()
+	defer loginStarts.Unlock()
+	if len(loginStarts.windows) > 10_000 {
+		for h, lw := range loginStarts.windows {
+			if now.Sub(lw.start) >= time.Minute {
+				delete(loginStarts.windows, h)
+			}
+		}
+	}
+	lw := loginStarts.windows[host]
+	if now.Sub(lw.start) >= time.Minute {
+		lw = loginWindow{start: now}
+	}
+	if lw.count >= maxLoginStartsPerMinute {
+		return false
+	}
+	lw.count++
+	loginStarts.windows[host] = lw
+	return true
+}
+
+// newCredential returns a random credential with prefix and the hash it is stored under.
+func newCredential(prefix string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = prefix + hex.EncodeToString(b)
+	return token, hashCredential(token), nil
+}
+
+func hashCredential(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// errUnauthorized is returned for a credential that matches no account.
+var errUnauthorized = errors.New("invalid or expired account credential")
+
+// accountFromRequest returns the account whose API key or session token the
+// request carries, nil if it carries none, or errUnauthorized. The admin
+// token is not an account credential.
+func accountFromRequest(r *http.Request) (*CreditAccount, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" || isAdmin(r) {
+		return nil, nil
+	}
+	var a *CreditAccount
+	var err error
+	switch {
+	case strings.HasPrefix(token, apiKeyPrefix):
+		a, err = database.GetCreditAccountByAPIKey(hashCredential(token))
+	case strings.HasPrefix(token, sessionTokenPrefix):
+		a, err = database.GetCreditAccountBySession(hashCredential(token))
+	default:
+		return nil, errUnauthorized
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUnauthorized
+	}
+	return a, err
+}
+
+// requireAccount writes an error and returns nil unless the request is an
+// operator's.
+func requireAccount(w http.ResponseWriter, r *http.Request) *CreditAccount {
+	a, err := accountFromRequest(r)
+	if err != nil && !errors.Is(err, errUnauthorized) {
+		log.Printf("accountFromRequest: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return nil
+	}
+	if a == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return nil
+	}
+	return a
+}
+
+// accountJSON is the operator-facing representation of an account.
+func accountJSON(a *CreditAccount) map[string]any {
+	return map[string]any{
+		"id":                a.ID,
+		"name":              a.Name,
+		"balance_msats":     a.BalanceMsats,
+		"low_balance_msats": a.LowBalanceMsats,
+		"low_balance":       a.BalanceMsats < a.LowBalanceMsats,
+		"wallet_linked":     a.LinkingKey != "",
+		"created_at":        a.CreatedAt,
+	}
+}
+
+// ── /api/account ─────────────────────────────────────────────────────────────
+
+func handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	if a := requireAccount(w, r); a != nil {
+		writeJSON(w, http.StatusOK, accountJSON(a))
+	}
+}
+
+// handleAccountStatement returns the account's recent debits and credits.
+func handleAccountStatement(w http.ResponseWriter, r *http.Request) {
+	a := requireAccount(w, r)
+	if a == nil {
+		return
+	}
+	entries, err := database.GetAccountStatement(a.ID, 500)
+	if err != nil {
+		log.Printf("GetAccountStatement: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"account": accountJSON(a),
+		"entries": orEmptySlice(entries),
+	})
+}
+
+// handleCreateAccountTopup returns an invoice that credits the account
+// with its amount once paid.
+func handleCreateAccountTopup(w http.ResponseWriter, r *http.Request) {
+	a := requireAccount(w, r)
+	if a == nil {
+		return
+	}
+	var req struct {
+		AmountSats int64 `json:"amount_sats"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if req.AmountSats < 1 || req.AmountSats > cfg.MaxAccountTopupSats {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("amount_sats must be between 1 and %d", cfg.MaxAccountTopupSats),
+		})
+		return
+	}
+	msats := req.AmountSats * 1000
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	inv, err := blitziClient.CreateInvoice(ctx, msats, "TipMe: top up "+a.Name)
+	if err != nil {
+		log.Printf("blitzi CreateInvoice (top-up): %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to create payment invoice"})
+		return
+	}
+	if err := database.InsertAccountTopup(inv.PaymentHash, a.ID, msats); err != nil {
+		log.Printf("InsertAccountTopup: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+
+	go func() {
+		bgCtx, bgCancel := context.WithTimeout(context.Background(), time.Hour)
+		defer bgCancel()
+		paid := blitziClient.WaitForPayment(bgCtx, inv.PaymentHash) == nil
+		if err := database.SettleAccountTopup(inv.PaymentHash, paid); err != nil {
+			log.Printf("SettleAccountTopup (account=%s): %v", a.ID, err)
+			return
+		}
+		if paid {
+			log.Printf("accounts: %s topped up with %d sats", a.ID, req.AmountSats)
+		}
+	}()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"invoice":      inv.Invoice,
+		"payment_hash": inv.PaymentHash,
+		"amount_sats":  req.AmountSats,
+	})
+}
+
+// handleAccountTopupStatus reports whether a top-up is pending, paid or expired.
+func handleAccountTopupStatus(w http.ResponseWriter, r *http.Request) {
+	a := requireAccount(w, r)
+	if a == nil {
+		return
+	}
+	status, err := database.GetAccountTopupStatus(r.PathValue("payment_hash"), a.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("GetAccountTopupStatus: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// ── LNURL-auth (LUD-04) ──────────────────────────────────────────────────────
+//
+// A browser asks for a challenge, shows it as an LNURL and polls until the
+// operator's wallet has signed it. Logging in hands the browser a session
+// token for the account linked to the wallet's key; an operator already
+// authenticated by API key links their wallet the same way.
+
+// startAccountLogin opens a challenge for action and returns its k1 and LNURL.
+func startAccountLogin(w http.ResponseWriter, accountID, action string) {
+	k1, err := newK1()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	if err := database.InsertAccountLogin(k1, accountID, action); err != nil {
+		log.Printf("InsertAccountLogin: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	q := url.Values{"tag": {"login"}, "k1": {k1}, "action": {action}}
+	lnurl, err := EncodeLNURL(cfg.BaseURL + "/lnurl-auth?" + q.Encode())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"k1": k1, "lnurl": lnurl})
+}
+
+func handleStartAccountLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowLoginStart(r.RemoteAddr) {
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many login attempts; try again in a minute"})
+		return
+	}
+	startAccountLogin(w, "", AccountLoginAction)
+}
+
+func handleStartAccountLink(w http.ResponseWriter, r *http.Request) {
+	if a := requireAccount(w, r); a != nil {
+		startAccountLogin(w, a.ID, AccountLinkAction)
+	}
+}
+
+// handleAccountLoginStatus is polled by the browser. Once the wallet has
+// signed a login, the first poll receives the session token.
+func handleAccountLoginStatus(w http.ResponseWriter, r *http.Request) {
+	l, err := database.GetAccountLogin(r.PathValue("k1"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && time.Since(l.CreatedAt) > accountLoginTTL && !l.Verified) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found or expired"})
+		return
+	} else if err != nil {
+		log.Printf("GetAccountLogin: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	switch {
+	case !l.Verified:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pending"})
+		return
+	case l.Action == AccountLinkAction:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "linked"})
+		return
+	case l.Claimed || time.Since(l.CreatedAt) > accountLoginTTL:
+		writeJSON(w, http.StatusGone, map[string]string{"error": "this login has already been used"})
+		return
+	}
+
+	token, hash, err := newCredential(sessionTokenPrefix)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(cfg.AccountSessionSecs) * time.Second).UTC()
+	if _, err := database.ClaimAccountSession(l.K1, hash, expiresAt); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusGone, map[string]string{"error": "this login has already been used"})
+		return
+	} else if err != nil {
+		log.Printf("ClaimAccountSession: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":     "logged_in",
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// handleLNURLAuth is the wallet's callback: it checks the signature of k1
+// by key and completes the challenge.
+func handleLNURLAuth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	k1Hex, sigHex, keyHex := q.Get("k1"), q.Get("sig"), strings.ToLower(q.Get("key"))
+	k1, err1 := hex.DecodeString(k1Hex)
+	sig, err2 := hex.DecodeString(sigHex)
+	key, err3 := hex.DecodeString(keyHex)
+	if q.Get("tag") != "login" || err1 != nil || err2 != nil || err3 != nil || len(k1) != 32 {
+		lnurlError(w, "invalid request")
+		return
+	}
+	l, err := database.GetAccountLogin(k1Hex)
+	if err != nil || l.Verified || time.Since(l.CreatedAt) > accountLoginTTL {
+		lnurlError(w, "unknown or expired challenge")
+		return
+	}
+	if !secp256k1Verify(k1, sig, key) {
+		lnurlError(w, "invalid signature")
+		return
+	}
+	err = database.VerifyAccountLogin(k1Hex, keyHex)
+	if errors.Is(err, ErrUnknownLinkingKey) || errors.Is(err, ErrLinkingKeyTaken) {
+		lnurlError(w, err.Error())
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		lnurlError(w, "unknown or expired challenge")
+		return
+	} else if err != nil {
+		log.Printf("VerifyAccountLogin: %v", err)
+		lnurlError(w, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// ── /api/admin/accounts ──────────────────────────────────────────────────────
+
+type creditAccountRequest struct {
+	Name           string `json:"name"`
+	LowBalanceSats *int64 `json:"low_balance_sats"` // default ACCOUNT_LOW_BALANCE_SATS
+	LinkingKey     string `json:"linking_key"`      // optional LNURL-auth key to link up front
+}
+
+// handleCreateCreditAccount opens an account and returns it with its API
+// key; this is the only time the key is shown.
+func handleCreateCreditAccount(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req creditAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	a := &CreditAccount{
+		ID:              uuid.New().String(),
+		Name:            strings.TrimSpace(req.Name),
+		LinkingKey:      strings.ToLower(strings.TrimSpace(req.LinkingKey)),
+		LowBalanceMsats: cfg.AccountLowBalanceSats * 1000,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if a.Name == "" || len(a.Name) > 80 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name must be between 1 and 80 characters"})
+		return
+	}
+	if req.LowBalanceSats != nil {
+		if *req.LowBalanceSats < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "low_balance_sats must not be negative"})
+			return
+		}
+		a.LowBalanceMsats = *req.LowBalanceSats * 1000
+	}
+	if a.LinkingKey != "" && !nodePubkeyRE.MatchString(a.LinkingKey) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "linking_key must be a hex compressed public key"})
+		return
+	}
+	apiKey, hash, err := newCredential(apiKeyPrefix)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	if err := database.InsertCreditAccount(a, hash); err != nil {
+		log.Printf("InsertCreditAccount: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("accounts: %s (%s) opened", a.ID, a.Name)
+	resp := accountJSON(a)
+	resp["api_key"] = apiKey
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func handleListCreditAccounts(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	accounts, err := database.GetCreditAccounts()
+	if err != nil {
+		log.Printf("GetCreditAccounts: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmptySlice(accounts))
+}
+
+// handleRotateAccountAPIKey replaces an account's API key, e.g. after it
+// leaked, and returns the new one.
+func handleRotateAccountAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	apiKey, hash, err := newCredential(apiKeyPrefix)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	id := r.PathValue("id")
+	if err := database.SetAccountAPIKey(id, hash); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("SetAccountAPIKey: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("accounts: %s API key rotated", id)
+	writeJSON(w, http.StatusOK, map[string]string{"api_key": apiKey})
+}
+
+// creditAccountsHTML renders the admin page's operator account section.
+func creditAccountsHTML() (string, error) {
+	accounts, err := database.GetCreditAccounts()
+	if err != nil || len(accounts) == 0 {
+		return "", err
+	}
+	var rows strings.Builder
+	var low int
+	for _, a := range accounts {
+		status := "ok"
+		if a.BalanceMsats < a.LowBalanceMsats {
+			status, low = "low", low+1
+		}
+		rows.WriteString(fmt.Sprintf(`<tr><td title="%s">%s</td><td>%d sats</td><td>%d sats</td><td>%s</td></tr>`,
+			html.EscapeString(a.ID), html.EscapeString(a.Name), a.BalanceMsats/1000, a.LowBalanceMsats/1000, status))
+	}
+	var badge string
+	if low > 0 {
+		badge = fmt.Sprintf(`<div class="badge-warn">⚠ %d account(s) below their low-balance threshold</div>`, low)
+	}
+	return fmt.Sprintf(`<hr><div class="section-title">Operator Accounts</div>%s<table><thead><tr><th>Account</th><th>Balance</th><th>Warn below</th><th>Status</th></tr></thead><tbody>%s</tbody></table>`,
+		badge, rows.String()), nil
+}
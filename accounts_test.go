@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestStartAccountLoginRateLimit checks that one address can only open so
+// many login challenges a minute, without holding up other addresses.
+func TestStartAccountLoginRateLimit(t *testing.T) {
+	useTestServer(t)
+	loginStarts.Lock()
+	clear(loginStarts.windows)
+	loginStarts.Unlock()
+
+	start := func(addr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/account/login", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handleStartAccountLogin(rec, req)
+		return rec.Code
+	}
+	for i := range maxLoginStartsPerMinute {
+		if code := start("203.0.113.7:1000"); code != http.StatusOK {
+			t.Fatalf("login %d = %d, want 200", i+1, code)
+		}
+	}
+	if code := start("203.0.113.7:2000"); code != http.StatusTooManyRequests {
+		t.Errorf("login over the limit = %d, want 429", code)
+	}
+	if code := start("198.51.100.1:1000"); code != http.StatusOK {
+		t.Errorf("login from another address = %d, want 200", code)
+	}
+}
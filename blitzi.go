@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -107,9 +108,10 @@ func (c *BlitziClient) GetBalance(ctx context.Context) (int64, error) {
 	return result.BalanceMsats, nil
 }
 
-// PayInvoice asks blitzi to pay a BOLT-11 invoice.
+// PayInvoice asks blitzi to pay a BOLT-11 invoice and returns the routing fee
+// it reports, if any.
 // Retries up to 3 times on "no gateway found" errors with a 2s sleep between attempts.
-func (c *BlitziClient) PayInvoice(ctx context.Context, bolt11 string) error {
+func (c *BlitziClient) PayInvoice(ctx context.Context, bolt11 string) (int64, error) {
 	body, _ := json.Marshal(map[string]any{"invoice": bolt11})
 
 	const maxAttempts = 3
@@ -120,37 +122,74 @@ func (c *BlitziClient) PayInvoice(ctx context.Context, bolt11 string) error {
 			if strings.Contains(err.Error(), "no gateway found") && attempt < maxAttempts {
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
+					return 0, ctx.Err()
 				case <-time.After(2 * time.Second):
 				}
 				lastErr = err
 				continue
 			}
-			return err
+			return 0, err
 		}
+		// fee_msats is optional: without it the fee is taken as 0 here and
+		// booked by reconciliation, if blitzi lists it there.
 		var result struct {
-			Success bool   `json:"success"`
-			Error   string `json:"error"`
+			Success  bool   `json:"success"`
+			Error    string `json:"error"`
+			FeeMsats int64  `json:"fee_msats"`
 		}
 		if err := json.Unmarshal(resp, &result); err != nil {
 			// Some blitzi builds return empty body on success; treat as success.
-			return nil
+			return 0, nil
 		}
 		if !result.Success && result.Error != "" {
 			if strings.Contains(result.Error, "no gateway found") && attempt < maxAttempts {
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
+					return 0, ctx.Err()
 				case <-time.After(2 * time.Second):
 				}
 				lastErr = fmt.Errorf("blitzi pay error: %s", result.Error)
 				continue
 			}
-			return fmt.Errorf("blitzi pay error: %s", result.Error)
+			return 0, fmt.Errorf("blitzi pay error: %s", result.Error)
 		}
-		return nil
+		return result.FeeMsats, nil
 	}
-	return lastErr
+	return 0, lastErr
+}
+
+// BlitziPayment is an entry in blitzi's payment history.
+type BlitziPayment struct {
+	PaymentHash string `json:"payment_hash"`
+	Direction   string `json:"direction"` // "incoming" or "outgoing"
+	AmountMsats int64  `json:"amount_msats"`
+	FeeMsats    int64  `json:"fee_msats"`
+	Status      string `json:"status"`     // "pending", "succeeded" or "failed"
+	CreatedAt   int64  `json:"created_at"` // unix seconds
+}
+
+// ErrNoPaymentHistory is returned by ListPayments when blitzi has no
+// payment history endpoint, as builds before it was added don't.
+var ErrNoPaymentHistory = errors.New("blitzi has no payment history (GET /payments not found)")
+
+// ListPayments returns the incoming and outgoing payments blitzi has made or
+// received since the given time.
+func (c *BlitziClient) ListPayments(ctx context.Context, since time.Time) ([]BlitziPayment, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/payments?since=%d", since.Unix()), nil)
+	var statusErr *blitziStatusError
+	if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+		return nil, ErrNoPaymentHistory
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Payments []BlitziPayment `json:"payments"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, fmt.Errorf("decode payments: %w", err)
+	}
+	return result.Payments, nil
 }
 
 // do executes an authenticated HTTP request to blitzi and returns the response body.
@@ -181,7 +220,18 @@ func (c *BlitziClient) do(ctx context.Context, method, path string, body []byte)
 		return nil, fmt.Errorf("read blitzi response: %w", err)
 	}
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("blitzi %s %s status %d: %s", method, path, resp.StatusCode, respBody)
+		return nil, &blitziStatusError{method, path, resp.StatusCode, string(respBody)}
 	}
 	return respBody, nil
 }
+
+// blitziStatusError is an HTTP error status from blitzi.
+type blitziStatusError struct {
+	Method, Path string
+	Status       int
+	Body         string
+}
+
+func (e *blitziStatusError) Error() string {
+	return fmt.Sprintf("blitzi %s %s status %d: %s", e.Method, e.Path, e.Status, e.Body)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ── BOLT-11 decoding ─────────────────────────────────────────────────────────
+
+// bolt11AmountMsats returns the amount encoded in a BOLT-11 invoice's
+// human-readable part, or 0 if the invoice leaves the amount to the payer.
+// Only the prefix is parsed; the signature is left to the paying node.
+func bolt11AmountMsats(invoice string) (int64, error) {
+	invoice = strings.ToLower(strings.TrimSpace(invoice))
+	invoice = strings.TrimPrefix(invoice, "lightning:")
+
+	sep := strings.LastIndexByte(invoice, '1')
+	if sep < 0 || !strings.HasPrefix(invoice, "ln") {
+		return 0, fmt.Errorf("not a BOLT-11 invoice")
+	}
+	hrp := invoice[2:sep]
+
+	// The currency prefix (bc, tb, bcrt, ...) runs up to the first digit.
+	i := strings.IndexAny(hrp, "0123456789")
+	if i < 0 {
+		return 0, nil
+	}
+	amount := hrp[i:]
+
+	var multiplier byte
+	if last := amount[len(amount)-1]; last < '0' || last > '9' {
+		multiplier = last
+		amount = amount[:len(amount)-1]
+	}
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid invoice amount %q", hrp[i:])
+	}
+
+	// Amounts are in BTC, scaled by the multiplier; 1 BTC = 1e11 msats.
+	const maxMsats = 21_000_000 * 100_000_000_000
+	if multiplier == 'p' {
+		if n%10 != 0 {
+			return 0, fmt.Errorf("invoice amount %q is not a whole number of msats", hrp[i:])
+		}
+		return n / 10, nil
+	}
+	factors := map[byte]int64{0: 100_000_000_000, 'm': 100_000_000, 'u': 100_000, 'n': 100}
+	factor, ok := factors[multiplier]
+	if !ok {
+		return 0, fmt.Errorf("invalid invoice amount multiplier %q", multiplier)
+	}
+	if n > maxMsats/factor {
+		return 0, fmt.Errorf("invoice amount %q out of range", hrp[i:])
+	}
+	return n * factor, nil
+}
+
+// bolt11Payee returns the payee node's public key, hex-encoded in compressed
+// form, recovered from a BOLT-11 invoice's signature. If the invoice names its
+// payee explicitly with an n field, that key must match the signature.
+func bolt11Payee(invoice string) (string, error) {
+	hrp, data, sigWords, err := bolt11Words(invoice)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := convertBits(sigWords, 5, 8, false)
+	if err != nil || len(sig) != 65 {
+		return "", fmt.Errorf("invalid invoice signature")
+	}
+	msg, err := convertBits(data, 5, 8, true)
+	if err != nil {
+		return "", fmt.Errorf("decode invoice: %w", err)
+	}
+	hash := sha256.Sum256(append([]byte(hrp), msg...))
+	pubkey, err := secp256k1Recover(hash[:], sig[:64], sig[64])
+	if err != nil {
+		return "", err
+	}
+	payee := hex.EncodeToString(pubkey)
+
+	// Tagged fields follow the timestamp: type, 10-bit length, then data.
+	for i := 7; i+3 <= len(data); {
+		tag, n := data[i], int(data[i+1])<<5|int(data[i+2])
+		i += 3
+		if i+n > len(data) {
+			return "", fmt.Errorf("invalid invoice field length")
+		}
+		if tag == 19 && n == 53 { // n: payee node id
+			if explicit, err := convertBits(data[i:i+n], 5, 8, false); err == nil &&
+				hex.EncodeToString(explicit) != payee {
+				return "", fmt.Errorf("invoice signature does not match its payee")
+			}
+		}
+		i += n
+	}
+	return payee, nil
+}
+
+// bolt11PaymentHash returns the hex payment hash of a BOLT-11 invoice.
+func bolt11PaymentHash(invoice string) (string, error) {
+	_, data, _, err := bolt11Words(invoice)
+	if err != nil {
+		return "", err
+	}
+	for i := 7; i+3 <= len(data); {
+		tag, n := data[i], int(data[i+1])<<5|int(data[i+2])
+		i += 3
+		if i+n > len(data) {
+			return "", fmt.Errorf("invalid invoice field length")
+		}
+		if tag == 1 && n == 52 { // p: payment hash
+			hash, err := convertBits(data[i:i+n], 5, 8, false)
+			if err != nil {
+				return "", fmt.Errorf("invalid payment hash: %w", err)
+			}
+			return hex.EncodeToString(hash), nil
+		}
+		i += n
+	}
+	return "", fmt.Errorf("invoice has no payment hash")
+}
+
+// bolt11Words decodes a BOLT-11 invoice into its human-readable part, its data
+// words (timestamp and tagged fields) and its signature words, verifying the
+// bech32 checksum.
+func bolt11Words(invoice string) (hrp string, data, sigWords []byte, err error) {
+	invoice = strings.ToLower(strings.TrimSpace(invoice))
+	invoice = strings.TrimPrefix(invoice, "lightning:")
+
+	sep := strings.LastIndexByte(invoice, '1')
+	if sep < 0 || !strings.HasPrefix(invoice, "ln") {
+		return "", nil, nil, fmt.Errorf("not a BOLT-11 invoice")
+	}
+	hrp = invoice[:sep]
+	var vals []byte
+	for _, c := range invoice[sep+1:] {
+		idx := strings.IndexRune(bech32Charset, c)
+		if idx < 0 {
+			return "", nil, nil, fmt.Errorf("invalid bech32 character: %q", c)
+		}
+		vals = append(vals, byte(idx))
+	}
+	// 7 words of timestamp, 104 of signature and 6 of checksum.
+	if len(vals) < 7+104+6 {
+		return "", nil, nil, fmt.Errorf("invoice too short")
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), vals...)) != 1 {
+		return "", nil, nil, fmt.Errorf("invalid invoice checksum")
+	}
+	vals = vals[:len(vals)-6]
+	return hrp, vals[:len(vals)-104], vals[len(vals)-104:], nil
+}
+
+// ── secp256k1 public key recovery ────────────────────────────────────────────
+//
+// Just enough elliptic curve arithmetic to recover the key that signed an
+// invoice, and to check an LNURL-auth signature. Affine coordinates keep it
+// short; it runs once per withdrawal or login.
+
+var (
+	secpP, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secpN, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+)
+
+// secpPoint is an affine curve point; a nil x is the point at infinity.
+type secpPoint struct{ x, y *big.Int }
+
+func secpAdd(a, b secpPoint) secpPoint {
+	if a.x == nil {
+		return b
+	}
+	if b.x == nil {
+		return a
+	}
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		if sum := new(big.Int).Add(a.y, b.y); sum.Mod(sum, secpP).Sign() == 0 {
+			return secpPoint{}
+		}
+		// Doubling: λ = 3x² / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		den.Mod(den, secpP)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	}
+	lambda.Mod(lambda, secpP)
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, secpP)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda).Sub(y, a.y).Mod(y, secpP)
+	return secpPoint{x, y}
+}
+
+func secpMul(p secpPoint, k *big.Int) secpPoint {
+	var r secpPoint
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = secpAdd(r, r)
+		if k.Bit(i) == 1 {
+			r = secpAdd(r, p)
+		}
+	}
+	return r
+}
+
+// secp256k1Recover returns the compressed public key that produced the
+// compact signature sig (r || s) over hash with the given recovery id.
+func secp256k1Recover(hash, sig []byte, recID byte) ([]byte, error) {
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if recID > 3 || r.Sign() == 0 || s.Sign() == 0 || r.Cmp(secpN) >= 0 || s.Cmp(secpN) >= 0 {
+		return nil, fmt.Errorf("invalid invoice signature")
+	}
+
+	// R is the point with x = r (+ n for recovery ids 2 and 3) and y of the given parity.
+	x := new(big.Int).Set(r)
+	if recID >= 2 {
+		x.Add(x, secpN)
+	}
+	if x.Cmp(secpP) >= 0 {
+		return nil, fmt.Errorf("invalid invoice signature")
+	}
+	ySq := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	ySq.Add(ySq, big.NewInt(7)).Mod(ySq, secpP)
+	y := new(big.Int).Exp(ySq, new(big.Int).Rsh(new(big.Int).Add(secpP, big.NewInt(1)), 2), secpP)
+	if new(big.Int).Exp(y, big.NewInt(2), secpP).Cmp(ySq) != 0 {
+		return nil, fmt.Errorf("invalid invoice signature")
+	}
+	if y.Bit(0) != uint(recID&1) {
+		y.Sub(secpP, y)
+	}
+
+	// Q = r⁻¹ (sR − eG)
+	e := new(big.Int).SetBytes(hash)
+	e.Neg(e).Mod(e, secpN)
+	rInv := new(big.Int).ModInverse(r, secpN)
+	sR := secpMul(secpPoint{x, y}, s)
+	eG := secpMul(secpPoint{secpGx, secpGy}, e)
+	q := secpMul(secpAdd(sR, eG), rInv)
+	if q.x == nil {
+		return nil, fmt.Errorf("invalid invoice signature")
+	}
+
+	out := make([]byte, 33)
+	out[0] = 2 + byte(q.y.Bit(0))
+	q.x.FillBytes(out[1:])
+	return out, nil
+}
+
+// secp256k1Verify reports whether the DER-encoded ECDSA signature sig over
+// hash was made by the compressed public key pubkey, as LNURL-auth wallets
+// sign their k1. Like libsecp256k1, it only accepts the low-S form of a
+// signature, so that each has a single encoding.
+func secp256k1Verify(hash, sig, pubkey []byte) bool {
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) > 0 {
+		return false
+	}
+	r, s := rs.R, rs.S
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(secpN) >= 0 || s.Cmp(new(big.Int).Rsh(secpN, 1)) > 0 {
+		return false
+	}
+	q, ok := secpDecompress(pubkey)
+	if !ok {
+		return false
+	}
+
+	// u₁G + u₂Q must have x ≡ r (mod n), with u₁ = e/s and u₂ = r/s.
+	sInv := new(big.Int).ModInverse(s, secpN)
+	u1 := new(big.Int).SetBytes(hash)
+	u1.Mul(u1, sInv).Mod(u1, secpN)
+	u2 := new(big.Int).Mul(r, sInv)
+	u2.Mod(u2, secpN)
+	p := secpAdd(secpMul(secpPoint{secpGx, secpGy}, u1), secpMul(q, u2))
+	if p.x == nil {
+		return false
+	}
+	return new(big.Int).Mod(p.x, secpN).Cmp(r) == 0
+}
+
+// secpDecompress returns the point of a 33-byte compressed public key.
+func secpDecompress(pubkey []byte) (secpPoint, bool) {
+	if len(pubkey) != 33 || (pubkey[0] != 2 && pubkey[0] != 3) {
+		return secpPoint{}, false
+	}
+	x := new(big.Int).SetBytes(pubkey[1:])
+	if x.Cmp(secpP) >= 0 {
+		return secpPoint{}, false
+	}
+	ySq := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	ySq.Add(ySq, big.NewInt(7)).Mod(ySq, secpP)
+	y := new(big.Int).Exp(ySq, new(big.Int).Rsh(new(big.Int).Add(secpP, big.NewInt(1)), 2), secpP)
+	if new(big.Int).Exp(y, big.NewInt(2), secpP).Cmp(ySq) != 0 {
+		return secpPoint{}, false
+	}
+	if y.Bit(0) != uint(pubkey[0]&1) {
+		y.Sub(secpP, y)
+	}
+	return secpPoint{x, y}, true
+}
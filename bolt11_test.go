@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Examples from the BOLT-11 specification, all signed by the same node.
+const (
+	specPayee = "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+
+	// "Please make a donation of any amount using payment_hash 0001020304050607080900010203040506070809000102030405060708090102 to me @03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+	specDonation = "lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql"
+
+	// The same, as first published, before payment secrets.
+	specDonationLegacy = "lnbc1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq8rkx3yf5tcsyz3d73gafnh3cax9rn449d9p5uxz9ezhhypd0elx87sjle52x86fux2ypatgddc6k63n7erqz25le42c4u4ecky03ylcqca784w"
+
+	// "Please send $3 for a cup of coffee to the same peer, within one minute"
+	specCoffee = "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh"
+
+	specPaymentHash = "0001020304050607080900010203040506070809000102030405060708090102"
+)
+
+func TestBolt11SpecExamples(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		invoice string
+		msats   int64
+	}{
+		{"donation", specDonation, 0},
+		{"legacy donation", specDonationLegacy, 0},
+		{"coffee", specCoffee, 250_000_000},
+		{"coffee with URI prefix", "LIGHTNING:" + strings.ToUpper(specCoffee), 250_000_000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payee, err := bolt11Payee(tc.invoice)
+			if err != nil || payee != specPayee {
+				t.Errorf("bolt11Payee = %s, %v; want %s", payee, err, specPayee)
+			}
+			hash, err := bolt11PaymentHash(tc.invoice)
+			if err != nil || hash != specPaymentHash {
+				t.Errorf("bolt11PaymentHash = %s, %v; want %s", hash, err, specPaymentHash)
+			}
+			msats, err := bolt11AmountMsats(tc.invoice)
+			if err != nil || msats != tc.msats {
+				t.Errorf("bolt11AmountMsats = %d, %v; want %d", msats, err, tc.msats)
+			}
+		})
+	}
+}
+
+// reencodeInvoice rebuilds an invoice from its parts with a valid checksum,
+// so that tests reach the signature check.
+func reencodeInvoice(hrp string, data, sigWords []byte) string {
+	words := append(append([]byte{}, data...), sigWords...)
+	words = append(words, bech32CreateChecksum(hrp, words)...)
+	var sb strings.Builder
+	sb.WriteString(hrp + "1")
+	for _, w := range words {
+		sb.WriteByte(bech32Charset[w])
+	}
+	return sb.String()
+}
+
+// withPayeeField appends an n field naming pubkey to an invoice's data words.
+func withPayeeField(t *testing.T, data []byte, pubkey string) []byte {
+	t.Helper()
+	key, err := hex.DecodeString(pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := convertBits(key, 8, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := append([]byte{19, byte(len(words) >> 5), byte(len(words) & 31)}, words...)
+	return append(append([]byte{}, data...), field...)
+}
+
+func TestBolt11PayeeRejectsBadSignatures(t *testing.T) {
+	hrp, data, sigWords, err := bolt11Words(specDonation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reencodeInvoice(hrp, data, sigWords); got != specDonation {
+		t.Fatalf("reencodeInvoice changed the invoice: %s", got)
+	}
+
+	corrupted := append([]byte{}, sigWords...)
+	corrupted[10] ^= 1
+
+	// Without an n field a corrupted signature yields some other key, which
+	// can never pass for the real payee.
+	if payee, err := bolt11Payee(reencodeInvoice(hrp, data, corrupted)); err == nil && payee == specPayee {
+		t.Error("corrupted signature recovered the payee")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		invoice string
+	}{
+		{"corrupted signature", reencodeInvoice(hrp, withPayeeField(t, data, specPayee), corrupted)},
+		{"fields added after signing", reencodeInvoice(hrp, withPayeeField(t, data, specPayee), sigWords)},
+		{"bad checksum", specDonation[:len(specDonation)-1] + "q"},
+		{"truncated", specDonation[:100]},
+		{"not an invoice", "lnurl1dp68gurn8ghj7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if payee, err := bolt11Payee(tc.invoice); err == nil {
+				t.Errorf("bolt11Payee = %s, want an error", payee)
+			}
+		})
+	}
+}
+
+func TestSecp256k1RecoverRejectsInvalidSignatures(t *testing.T) {
+	hash := make([]byte, 32)
+	valid := func() []byte {
+		sig := make([]byte, 64)
+		sig[31], sig[63] = 1, 1
+		return sig
+	}
+	for _, tc := range []struct {
+		name  string
+		sig   func() []byte
+		recID byte
+	}{
+		{"zero r", func() []byte { s := valid(); s[31] = 0; return s }, 0},
+		{"zero s", func() []byte { s := valid(); s[63] = 0; return s }, 0},
+		{"r not below n", func() []byte { s := valid(); secpN.FillBytes(s[:32]); return s }, 0},
+		{"s not below n", func() []byte { s := valid(); secpN.FillBytes(s[32:]); return s }, 0},
+		{"recovery id out of range", valid, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if key, err := secp256k1Recover(hash, tc.sig(), tc.recID); err == nil {
+				t.Errorf("secp256k1Recover = %x, want an error", key)
+			}
+		})
+	}
+}
+
+// An LNURL-auth style signature, made outside this package with textbook
+// ECDSA from a fixed key and nonce.
+const (
+	testAuthPubkey = "026f4d73bf083f2df407cfd54d53d44c79072bbd4749fd8059f52cbfe95ff47676"
+	testAuthHash   = "01cf3eb932a9f1c8c0bff7a05463a877be8b6a1ad6312f35d43e490c42274269"
+	testAuthSig    = "3044022017f53289eac961e5adc858d3ca50dab056ddca7a1a906c0815a0369312d1aa4902201ac1ec3a4fda19a79bd2c0b9d03523dfbc532c97cb82fdba554edacd652ab9ca"
+	// The same signature with s replaced by n - s, which verifies
+	// mathematically but isn't in the canonical low-S form.
+	testAuthSigHighS = "3045022017f53289eac961e5adc858d3ca50dab056ddca7a1a906c0815a0369312d1aa49022100e53e13c5b025e658642d3f462fcadc1efe5bb04ee3c5a2816a8383bf6b0b8777"
+)
+
+func TestSecp256k1Verify(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	flip := func(s string, i int) []byte {
+		b := unhex(s)
+		b[i] ^= 1
+		return b
+	}
+	hash, sig, pubkey := unhex(testAuthHash), unhex(testAuthSig), unhex(testAuthPubkey)
+	if !secp256k1Verify(hash, sig, pubkey) {
+		t.Fatal("valid signature rejected")
+	}
+
+	offCurve := make([]byte, 33) // x = 5 has no point on the curve
+	offCurve[0], offCurve[32] = 2, 5
+	otherParity := unhex(testAuthPubkey)
+	otherParity[0] = 3
+	for _, tc := range []struct {
+		name              string
+		hash, sig, pubkey []byte
+	}{
+		{"tampered hash", flip(testAuthHash, 31), sig, pubkey},
+		{"tampered r", hash, flip(testAuthSig, 10), pubkey},
+		{"tampered s", hash, flip(testAuthSig, 60), pubkey},
+		{"high S", hash, unhex(testAuthSigHighS), pubkey},
+		{"trailing data", hash, append(unhex(testAuthSig), 0), pubkey},
+		{"not DER", hash, sig[2:], pubkey},
+		{"other key", hash, sig, unhex(specPayee)},
+		{"negated key", hash, sig, otherParity},
+		{"point not on the curve", hash, sig, offCurve},
+		{"uncompressed key prefix", hash, sig, append([]byte{4}, pubkey[1:]...)},
+		{"short key", hash, sig, pubkey[:32]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if secp256k1Verify(tc.hash, tc.sig, tc.pubkey) {
+				t.Error("signature accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ── Boltcard (NTAG 424 DNA SUN) ──────────────────────────────────────────────
+//
+// A boltcard's URL carries two SUN parameters: p, the card UID and tap
+// counter encrypted under the card's K1, and c, a truncated AES-CMAC over
+// them under a session key derived from K2. Each tap's counter is higher
+// than the last, so a recorded URL can't be replayed.
+//
+// A card is linked to one voucher. A verified tap opens an LNURL-withdraw
+// session for it with a callback of its own, so the voucher's withdraw
+// secret never reaches the point of sale. Cards always withdraw the invoice
+// amount, up to a rolling 24-hour limit per card, so a gift voucher on a card
+// is spent down tap by tap rather than claimed in one go.
+
+// boltcardTap is the verified content of one tap.
+type boltcardTap struct {
+	UID     string // hex, 7 bytes
+	Counter uint32
+}
+
+// verifyBoltcardSUN decrypts p with k1 and checks c with k2, all hex-encoded.
+func verifyBoltcardSUN(k1Hex, k2Hex, pHex, cHex string) (*boltcardTap, error) {
+	k1, err1 := hex.DecodeString(k1Hex)
+	k2, err2 := hex.DecodeString(k2Hex)
+	p, err3 := hex.DecodeString(pHex)
+	c, err4 := hex.DecodeString(cHex)
+	if err1 != nil || err2 != nil || len(k1) != 16 || len(k2) != 16 {
+		return nil, fmt.Errorf("invalid card keys")
+	}
+	if err3 != nil || err4 != nil || len(p) != 16 || len(c) != 8 {
+		return nil, fmt.Errorf("invalid p or c parameter")
+	}
+
+	// p is a single AES block with a zero IV: tag 0xC7, 7-byte UID, 3-byte little-endian counter.
+	block, err := aes.NewCipher(k1)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 16)
+	block.Decrypt(plain, p)
+	if plain[0] != 0xC7 {
+		return nil, fmt.Errorf("p does not decrypt with this card's key")
+	}
+	uid, ctr := plain[1:8], plain[8:11]
+
+	// The session MAC key is the CMAC of SV2 = 3CC3 0001 0080 || UID || counter.
+	sv2 := append([]byte{0x3C, 0xC3, 0x00, 0x01, 0x00, 0x80}, uid...)
+	sv2 = append(sv2, ctr...)
+	ks, err := aesCMAC(k2, sv2)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := aesCMAC(ks, nil)
+	if err != nil {
+		return nil, err
+	}
+	// c is the odd-indexed bytes of the full MAC.
+	truncated := make([]byte, 8)
+	for i := range truncated {
+		truncated[i] = mac[2*i+1]
+	}
+	if subtle.ConstantTimeCompare(truncated, c) != 1 {
+		return nil, fmt.Errorf("invalid card signature")
+	}
+
+	return &boltcardTap{
+		UID:     hex.EncodeToString(uid),
+		Counter: uint32(ctr[0]) | uint32(ctr[1])<<8 | uint32(ctr[2])<<16,
+	}, nil
+}
+
+// ── POST /api/vouchers/:pay_id/boltcards ─────────────────────────────────────
+
+// handleCreateBoltcard issues a new card for a voucher and returns its keys in
+// the format card programming apps read. Like rekeying, it is allowed for the
+// batch owner and for the admin.
+func handleCreateBoltcard(w http.ResponseWriter, r *http.Request) {
+	payID := r.PathValue("pay_id")
+	var body struct {
+		PaymentHash    string `json:"payment_hash"`
+		Name           string `json:"name"`
+		DailyLimitSats int64  `json:"daily_limit_sats"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+	}
+
+	v, err := database.GetVoucherByPayID(payID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	isOwner := isVoucherOwner(v, body.PaymentHash)
+	if !isOwner && !isAdmin(r) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if !v.Active {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "voucher is no longer active"})
+		return
+	}
+	if v.IsAutoPayout() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": autoPayoutReason(v)})
+		return
+	}
+	if v.HasPIN() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "PIN-protected vouchers cannot be linked to a card"})
+		return
+	}
+	limit := cfg.BoltcardDailyLimitSats
+	if body.DailyLimitSats != 0 {
+		if body.DailyLimitSats < 1 || body.DailyLimitSats > cfg.BoltcardDailyLimitSats {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("daily_limit_sats must be between 1 and %d", cfg.BoltcardDailyLimitSats),
+			})
+			return
+		}
+		limit = body.DailyLimitSats
+	}
+
+	card := &Boltcard{CardID: uuid.New().String(), PayID: payID, DailyLimitMsats: limit * 1000}
+	for i := range card.Keys {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		card.Keys[i] = hex.EncodeToString(key)
+	}
+	if err := database.InsertBoltcard(card); err != nil {
+		log.Printf("InsertBoltcard (pay_id=%s): %v", payID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("boltcard %s issued for voucher %s (by owner=%v)", card.CardID, payID, isOwner)
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "TipMe card"
+	}
+	base := strings.TrimPrefix(strings.TrimPrefix(cfg.BaseURL, "https://"), "http://")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"protocol_name":    "new_bolt_card_response",
+		"protocol_version": 1,
+		"card_name":        name,
+		"card_id":          card.CardID,
+		"daily_limit_sats": limit,
+		"lnurlw_base":      "lnurlw://" + base + "/boltcard/" + card.CardID,
+		"k0":               card.Keys[0],
+		"k1":               card.Keys[1],
+		"k2":               card.Keys[2],
+		"k3":               card.Keys[3],
+		"k4":               card.Keys[4],
+	})
+}
+
+// ── DELETE /api/vouchers/:pay_id/boltcards/:card_id ──────────────────────────
+
+// handleDisableBoltcard stops a lost or retired card from being used.
+func handleDisableBoltcard(w http.ResponseWriter, r *http.Request) {
+	payID, cardID := r.PathValue("pay_id"), r.PathValue("card_id")
+	var body struct {
+		PaymentHash string `json:"payment_hash"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+	}
+
+	v, err := database.GetVoucherByPayID(payID)
+	if err != nil || (!isVoucherOwner(v, body.PaymentHash) && !isAdmin(r)) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err := database.DisableBoltcard(payID, cardID); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("DisableBoltcard (card_id=%s): %v", cardID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("boltcard %s disabled", cardID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "disabled"})
+}
+
+// ── GET /boltcard/:card_id (tap) ─────────────────────────────────────────────
+
+// handleBoltcardTap verifies a tap and answers with an LNURL-withdraw request
+// for up to the card's remaining daily limit.
+func handleBoltcardTap(w http.ResponseWriter, r *http.Request) {
+	cardID := r.PathValue("card_id")
+	card, err := database.GetBoltcard(cardID)
+	if err != nil || !card.Enabled {
+		lnurlError(w, "card not found")
+		return
+	}
+	tap, err := verifyBoltcardSUN(card.Keys[1], card.Keys[2], r.URL.Query().Get("p"), r.URL.Query().Get("c"))
+	if err != nil {
+		log.Printf("boltcard %s: rejected tap: %v", cardID, err)
+		lnurlError(w, "invalid card tap")
+		return
+	}
+	if err := database.RecordBoltcardTap(cardID, tap.UID, tap.Counter); errors.Is(err, ErrBoltcardReplay) {
+		log.Printf("boltcard %s: replayed or foreign tap (uid=%s counter=%d)", cardID, tap.UID, tap.Counter)
+		lnurlError(w, "this tap has already been used, please tap the card again")
+		return
+	} else if err != nil {
+		log.Printf("RecordBoltcardTap: %v", err)
+		lnurlError(w, "database error")
+		return
+	}
+
+	v, err := database.GetVoucherByPayID(card.PayID)
+	if err != nil {
+		lnurlError(w, "voucher not found")
+		return
+	}
+	if reason := cardVoucherReason(v); reason != "" {
+		lnurlError(w, reason)
+		return
+	}
+	spent, err := database.BoltcardSpent(cardID)
+	if err != nil {
+		log.Printf("BoltcardSpent: %v", err)
+		lnurlError(w, "database error")
+		return
+	}
+	maxWithdrawable := min(v.TotalPaidMsats, card.DailyLimitMsats-spent)
+	if maxWithdrawable < 1000 {
+		lnurlError(w, "this card has reached its daily limit")
+		return
+	}
+
+	k1, err := newK1()
+	if err != nil {
+		lnurlError(w, "internal error")
+		return
+	}
+	if err := database.InsertBoltcardSession(k1, v.WithdrawID, cardID); err != nil {
+		log.Printf("InsertBoltcardSession: %v", err)
+		lnurlError(w, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tag":                "withdrawRequest",
+		"callback":           fmt.Sprintf("%s/boltcard/%s/callback", cfg.BaseURL, cardID),
+		"k1":                 k1,
+		"defaultDescription": "TipMe card payment",
+		"minWithdrawable":    1000,
+		"maxWithdrawable":    maxWithdrawable,
+	})
+}
+
+// cardVoucherReason explains why a card's voucher can't pay right now, or
+// returns "" if it can.
+func cardVoucherReason(v *Voucher) string {
+	switch {
+	case !v.IsActive():
+		return "voucher is not active"
+	case v.TotalPaidMsats <= 0:
+		return "voucher has no balance"
+	case v.IsTimeLocked():
+		return timeLockedReason(v)
+	case v.IsAutoPayout():
+		return autoPayoutReason(v)
+	}
+	return ""
+}
+
+// ── GET /boltcard/:card_id/callback ──────────────────────────────────────────
+
+func handleBoltcardCallback(w http.ResponseWriter, r *http.Request) {
+	cardID := r.PathValue("card_id")
+	k1 := r.URL.Query().Get("k1")
+	pr := r.URL.Query().Get("pr")
+	if k1 == "" || pr == "" {
+		lnurlError(w, "missing k1 or pr parameter")
+		return
+	}
+
+	card, err := database.GetBoltcard(cardID)
+	if err != nil || !card.Enabled {
+		lnurlError(w, "card not found")
+		return
+	}
+	v, err := database.GetVoucherByPayID(card.PayID)
+	if err != nil {
+		lnurlError(w, "voucher not found")
+		return
+	}
+	if _, err := database.ValidateAndUseWithdrawSession(k1, v.WithdrawID, cardID); err != nil {
+		lnurlError(w, "invalid or already-used k1: "+err.Error())
+		return
+	}
+	if reason := cardVoucherReason(v); reason != "" {
+		lnurlError(w, reason)
+		return
+	}
+	if reason := spendRestriction(v, pr, ""); reason != "" {
+		lnurlError(w, reason)
+		return
+	}
+	amount, err := bolt11AmountMsats(pr)
+	if err != nil || amount == 0 {
+		lnurlError(w, "invoice must specify an amount")
+		return
+	}
+
+	id, err := database.DebitVoucherByCard(v.PayID, cardID, amount, card.DailyLimitMsats)
+	switch {
+	case errors.Is(err, ErrDailyLimit):
+		lnurlError(w, "amount exceeds the card's daily limit")
+		return
+	case errors.Is(err, ErrInsufficientBalance):
+		lnurlError(w, "amount exceeds voucher balance")
+		return
+	case err != nil:
+		log.Printf("DebitVoucherByCard (card_id=%s): %v", cardID, err)
+		lnurlError(w, "database error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+	if err := settlePartial(v, id, amount, func(ref string) error { return payInvoice(ctx, pr, ref) }); err != nil {
+		log.Printf("PayInvoice boltcard (card_id=%s): %v", cardID, err)
+		lnurlError(w, "payment failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// ── AES-CMAC ─────────────────────────────────────────────────────────────────
+
+// aesCMAC computes the AES-CMAC (RFC 4493) of msg under key.
+func aesCMAC(key, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subkeys: L = AES(0), K1 = L·x, K2 = K1·x in GF(2^128).
+	double := func(in []byte) []byte {
+		out := make([]byte, 16)
+		var carry byte
+		for i := 15; i >= 0; i-- {
+			out[i] = in[i]<<1 | carry
+			carry = in[i] >> 7
+		}
+		if in[0]&0x80 != 0 {
+			out[15] ^= 0x87
+		}
+		return out
+	}
+	l := make([]byte, 16)
+	block.Encrypt(l, l)
+	k1 := double(l)
+	k2 := double(k1)
+
+	// Pad an empty or partial last block and mix in the matching subkey.
+	n := (len(msg) + 15) / 16
+	last := make([]byte, 16)
+	if n > 0 && len(msg)%16 == 0 {
+		copy(last, msg[(n-1)*16:])
+		subtle.XORBytes(last, last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*16:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		subtle.XORBytes(last, last, k2)
+	}
+
+	mac := make([]byte, 16)
+	cbc := cipher.NewCBCEncrypter(block, make([]byte, 16))
+	if n > 1 {
+		prefix := make([]byte, (n-1)*16)
+		cbc.CryptBlocks(prefix, msg[:(n-1)*16])
+	}
+	cbc.CryptBlocks(mac, last)
+	return mac, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// The test card from the boltcard specification.
+const (
+	specCardK1 = "0c3b25d92b38ae443229dd59ad34b85d"
+	specCardK2 = "b45775776cb224c75bcde7ca3704e933"
+	specCardP  = "4E2E289D945A66BB13377A728884E867"
+	specCardC  = "E19CCB1FED8892CE"
+)
+
+func TestVerifyBoltcardSUN(t *testing.T) {
+	tap, err := verifyBoltcardSUN(specCardK1, specCardK2, specCardP, specCardC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tap.UID != "04996c6a926980" || tap.Counter != 3 {
+		t.Errorf("tap = %+v, want UID 04996c6a926980 and counter 3", *tap)
+	}
+
+	otherKey := strings.Repeat("00", 16)
+	for _, tc := range []struct {
+		name         string
+		k1, k2, p, c string
+	}{
+		{"wrong MAC", specCardK1, specCardK2, specCardP, "E19CCB1FED8892CF"},
+		{"MAC of another tap", specCardK1, specCardK2, specCardP, "0000000000000000"},
+		{"wrong K1", otherKey, specCardK2, specCardP, specCardC},
+		{"wrong K2", specCardK1, otherKey, specCardP, specCardC},
+		{"tampered p", specCardK1, specCardK2, "5E2E289D945A66BB13377A728884E867", specCardC},
+		{"short c", specCardK1, specCardK2, specCardP, "E19CCB1F"},
+		{"p not hex", specCardK1, specCardK2, "not hex", specCardC},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tap, err := verifyBoltcardSUN(tc.k1, tc.k2, tc.p, tc.c); err == nil {
+				t.Errorf("verifyBoltcardSUN = %+v, want an error", *tap)
+			}
+		})
+	}
+}
+
+func TestAESCMAC(t *testing.T) {
+	// RFC 4493, section 4.
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	msg, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710")
+	for _, tc := range []struct {
+		len  int
+		want string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	} {
+		mac, err := aesCMAC(key, msg[:tc.len])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(mac); got != tc.want {
+			t.Errorf("AES-CMAC of %d bytes = %s, want %s", tc.len, got, tc.want)
+		}
+	}
+}
+
+// TestBoltcardTapReplay taps the specification's card twice with the same
+// URL: the first tap opens a withdrawal, the second is refused.
+func TestBoltcardTapReplay(t *testing.T) {
+	useTestServer(t)
+	_, vouchers := createTestBatch(t, testDB(), 1)
+	fundTestVoucher(t, testDB(), vouchers[0].PayID, 10_000)
+	card := &Boltcard{
+		CardID:          uuid.New().String(),
+		PayID:           vouchers[0].PayID,
+		Keys:            [5]string{"", specCardK1, specCardK2},
+		DailyLimitMsats: 10_000,
+	}
+	if err := database.InsertBoltcard(card); err != nil {
+		t.Fatal(err)
+	}
+
+	tap := func() map[string]any {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/boltcard/"+card.CardID+"?p="+specCardP+"&c="+specCardC, nil)
+		req.SetPathValue("card_id", card.CardID)
+		rec := httptest.NewRecorder()
+		handleBoltcardTap(rec, req)
+		var resp map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		return resp
+	}
+	if resp := tap(); resp["tag"] != "withdrawRequest" {
+		t.Fatalf("first tap = %v, want a withdraw request", resp)
+	}
+	if resp := tap(); resp["status"] != "ERROR" || !strings.Contains(resp["reason"].(string), "already been used") {
+		t.Errorf("replayed tap = %v, want it refused", resp)
+	}
+
+	stored, err := database.GetBoltcard(card.CardID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.UID != "04996c6a926980" || stored.Counter != 3 {
+		t.Errorf("card remembers UID %s and counter %d, want 04996c6a926980 and 3", stored.UID, stored.Counter)
+	}
+	if err := database.RecordBoltcardTap(card.CardID, "04000000000000", 4); !errors.Is(err, ErrBoltcardReplay) {
+		t.Errorf("tap from another card's UID = %v, want ErrBoltcardReplay", err)
+	}
+	if err := database.RecordBoltcardTap(card.CardID, stored.UID, 4); err != nil {
+		t.Errorf("tap with the next counter: %v", err)
+	}
+}
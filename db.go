@@ -1,22 +1,103 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	_ "modernc.org/sqlite"
 )
 
-// DB wraps sql.DB with our application queries.
+// DB wraps sql.DB with our application queries, written for its dialect
+// (store.go).
 type DB struct {
 	*sql.DB
+	dialect *dialect
 }
 
+// Batch groups the vouchers created by one creation request and carries the
+// context (name, message, tags) shown alongside them.
+type Batch struct {
+	ID               string
+	Name             string
+	OwnerNote        string
+	Message          string
+	Tags             []string
+	LightningAddress string
+	Count            int
+	ExpirySeconds    int64
+	FeeMsats         int64
+	Kind             string // the kind of the batch's vouchers
+	CreatedAt        time.Time
+
+	// What happens to balances left when the batch's vouchers expire:
+	// refund to LightningAddress, donate to PolicyCharity, or split with
+	// DonatePercent going to PolicyCharity.
+	ExpiryPolicy  string
+	PolicyCharity string
+	DonatePercent int
+
+	// FundingDonatePercent of every payment into the batch's vouchers goes
+	// to FundingCharity; zero disables the split.
+	FundingCharity       string
+	FundingDonatePercent int
+
+	// Closed-loop batches can only be spent with approved payees: invoices
+	// from one of AllowedPayees (hex node public keys) or Lightning
+	// addresses and LNURL-pay links on one of AllowedDomains.
+	AllowedPayees  []string
+	AllowedDomains []string
+
+	// Currency is the fiat currency amounts are also shown in; empty for sats only.
+	Currency string
+
+	// FeeOverride replaces the fee schedule's funding fees for payments into
+	// the batch's vouchers; nil for none. Only the admin sets it.
+	FeeOverride *FundingFees
+
+	// OwnerEmail is notified about the batch's vouchers unless the owner has
+	// unsubscribed with the link carrying EmailToken. Neither is read back
+	// by GetBatch.
+	OwnerEmail string
+	EmailToken string
+}
+
+// IsClosedLoop reports whether the batch restricts where its vouchers can be spent.
+func (b *Batch) IsClosedLoop() bool {
+	return len(b.AllowedPayees) > 0 || len(b.AllowedDomains) > 0
+}
+
+// AllowsPayee reports whether the batch's vouchers may pay an invoice from node pubkey.
+func (b *Batch) AllowsPayee(pubkey string) bool {
+	return !b.IsClosedLoop() || slices.Contains(b.AllowedPayees, strings.ToLower(pubkey))
+}
+
+// AllowsDomain reports whether the batch's vouchers may pay a Lightning
+// address or LNURL-pay link hosted on domain.
+func (b *Batch) AllowsDomain(domain string) bool {
+	return !b.IsClosedLoop() || slices.Contains(b.AllowedDomains, strings.ToLower(domain))
+}
+
+// Expiry policies for a batch.
+const (
+	PolicyRefund = "refund"
+	PolicyDonate = "donate"
+	PolicySplit  = "split"
+)
+
 // VoucherCreationRequest represents a pending voucher batch creation.
 type VoucherCreationRequest struct {
 	PaymentHash      string
+	BatchID          string
 	LightningAddress string
 	Count            int
 	ExpirySeconds    int64
@@ -30,51 +111,157 @@ type Voucher struct {
 	PayID            string
 	WithdrawID       string
 	CreationHash     string
+	BatchID          string
 	LightningAddress string
 	TotalPaidMsats   int64
 	LastFundedAt     *time.Time
 	ExpirySeconds    int64
 	Active           bool
 	CreatedAt        time.Time
+	Pin              string // the PIN itself, only until the owner has been shown it
+	PinHash          string // empty if the voucher is not PIN protected
+	PinLockedUntil   *time.Time
+	PinLockouts      int        // lockouts so far; each lasts twice as long as the one before
+	ClaimableAfter   *time.Time // nil if the voucher can be claimed straight away
+	Kind             string     // KindGift, KindTipJar, KindForward or KindPool
+	LastWithdrawnAt  *time.Time // last partial withdrawal from a tip jar or forward
+	ForwardFailures  int        // consecutive failed forwards
+	ForwardRetryAt   *time.Time // no forward is attempted before this
+}
+
+// Voucher kinds. Gift vouchers are claimed once in full; tip jars accumulate
+// tips indefinitely and allow repeated partial withdrawals; forward vouchers
+// pass every tip on to their Lightning address as it arrives; pool vouchers
+// split their balance between the batch's pool members on a schedule.
+const (
+	KindGift    = "gift"
+	KindTipJar  = "tipjar"
+	KindForward = "forward"
+	KindPool    = "pool"
+)
+
+// HasPIN reports whether a PIN must be entered to claim the voucher.
+func (v *Voucher) HasPIN() bool {
+	return v.PinHash != ""
+}
+
+// IsTipJar reports whether the voucher is a persistent tip jar.
+func (v *Voucher) IsTipJar() bool {
+	return v.Kind == KindTipJar
+}
+
+// IsForward reports whether the voucher auto-forwards its tips.
+func (v *Voucher) IsForward() bool {
+	return v.Kind == KindForward
+}
+
+// IsPool reports whether the voucher is a group tip pool.
+func (v *Voucher) IsPool() bool {
+	return v.Kind == KindPool
+}
+
+// IsAutoPayout reports whether the voucher pays out by itself and so can't be claimed.
+func (v *Voucher) IsAutoPayout() bool {
+	return v.IsForward() || v.IsPool()
+}
+
+// IsPersistent reports whether the voucher is exempt from absolute expiry.
+func (v *Voucher) IsPersistent() bool {
+	return v.IsTipJar() || v.IsAutoPayout()
 }
 
-// IsActive checks all three active conditions.
+// IsActive checks the voucher is not deactivated and has not expired.
 func (v *Voucher) IsActive() bool {
 	if !v.Active {
 		return false
 	}
-	now := time.Now()
-	// 1-year absolute expiry from creation.
-	if now.After(v.CreatedAt.Add(time.Duration(cfg.VoucherAbsoluteExpirySecs) * time.Second)) {
-		return false
+	return !time.Now().After(v.ExpiresAt())
+}
+
+// ExpiresAt returns when the voucher stops being active: the earlier of its
+// absolute expiry and its relative expiry after the last funding. For
+// time-locked vouchers the relative expiry never falls before the release
+// date plus the relative expiry, so the recipient always gets the full window.
+// Tip jars, forward and pool vouchers have no absolute expiry and only lapse after
+// ExpirySeconds without any funding or withdrawal.
+func (v *Voucher) ExpiresAt() time.Time {
+	if v.IsPersistent() {
+		last := v.CreatedAt
+		for _, t := range []*time.Time{v.LastFundedAt, v.LastWithdrawnAt} {
+			if t != nil && t.After(last) {
+				last = *t
+			}
+		}
+		return last.Add(time.Duration(v.ExpirySeconds) * time.Second)
 	}
-	// Relative funding expiry.
+	expiry := v.CreatedAt.Add(time.Duration(cfg.VoucherAbsoluteExpirySecs) * time.Second)
 	if v.LastFundedAt != nil {
-		if now.After(v.LastFundedAt.Add(time.Duration(v.ExpirySeconds) * time.Second)) {
-			return false
+		rel := v.LastFundedAt.Add(time.Duration(v.ExpirySeconds) * time.Second)
+		if v.ClaimableAfter != nil {
+			if unlocked := v.ClaimableAfter.Add(time.Duration(v.ExpirySeconds) * time.Second); unlocked.After(rel) {
+				rel = unlocked
+			}
+		}
+		if rel.Before(expiry) {
+			expiry = rel
 		}
 	}
-	return true
+	return expiry
 }
 
-func initDB(path string) (*DB, error) {
-	sqlDB, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)&_pragma=busy_timeout(5000)")
+// IsTimeLocked reports whether the voucher's release date is still in the future.
+func (v *Voucher) IsTimeLocked() bool {
+	return v.ClaimableAfter != nil && time.Now().Before(*v.ClaimableAfter)
+}
+
+// openSQLite opens the SQLite database at path without touching its schema.
+func openSQLite(path string) (*DB, error) {
+	// _time_format=sqlite stores time.Time values in a format strftime() understands.
+	sqlDB, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)&_pragma=busy_timeout(5000)&_time_format=sqlite")
 	if err != nil {
 		return nil, err
 	}
 	// SQLite handles one writer at a time; serialise writes in the app layer.
 	sqlDB.SetMaxOpenConns(1)
+	return &DB{sqlDB, sqliteDialect}, nil
+}
 
-	db := &DB{sqlDB}
-	if err := db.createSchema(); err != nil {
-		sqlDB.Close()
+// initDB opens the configured store for the server. Pending migrations are
+// applied if migrate is set; otherwise the schema must already be current.
+func initDB(migrate bool) (Store, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	if migrate {
+		_, err = db.Migrate()
+	} else {
+		err = db.CheckSchema()
+	}
+	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("schema: %w", err)
 	}
 	return db, nil
 }
 
-func (db *DB) createSchema() error {
+// migrateBaseline is migration 1: the schema as it stood before migrations
+// were versioned. Databases from before then already have some or all of
+// it, so every step tolerates having been done.
+func migrateBaseline(tx *Tx) error {
 	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS batches (
+			id                TEXT PRIMARY KEY,
+			name              TEXT NOT NULL DEFAULT '',
+			owner_note        TEXT NOT NULL DEFAULT '',
+			message           TEXT NOT NULL DEFAULT '',
+			tags              TEXT NOT NULL DEFAULT '',
+			lightning_address TEXT NOT NULL,
+			count             INTEGER NOT NULL,
+			expiry_seconds    INTEGER NOT NULL,
+			fee_msats         INTEGER NOT NULL,
+			created_at        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE TABLE IF NOT EXISTS voucher_creation_requests (
 			payment_hash      TEXT PRIMARY KEY,
 			lightning_address TEXT NOT NULL,
@@ -110,44 +297,377 @@ func (db *DB) createSchema() error {
 		)`,
 		`CREATE TABLE IF NOT EXISTS withdraw_sessions (
 			k1          TEXT PRIMARY KEY,
-			withdraw_id TEXT NOT NULL REFERENCES vouchers(withdraw_id),
+			withdraw_id TEXT NOT NULL REFERENCES vouchers(withdraw_id) DEFERRABLE INITIALLY IMMEDIATE,
 			created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			used        INTEGER NOT NULL DEFAULT 0,
 			used_at     DATETIME
 		)`,
+		`CREATE TABLE IF NOT EXISTS voucher_withdrawals (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			pay_id       TEXT NOT NULL REFERENCES vouchers(pay_id),
+			amount_msats INTEGER NOT NULL,
+			status       TEXT NOT NULL DEFAULT 'pending',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS charity_payouts (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			charity      TEXT NOT NULL,
+			pay_id       TEXT REFERENCES vouchers(pay_id),
+			source       TEXT NOT NULL,
+			amount_msats INTEGER NOT NULL,
+			status       TEXT NOT NULL DEFAULT 'pending',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			paid_at      DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_charity_payouts_status ON charity_payouts(status, charity)`,
+		`CREATE TABLE IF NOT EXISTS pool_members (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			batch_id    TEXT NOT NULL REFERENCES batches(id),
+			address     TEXT NOT NULL,
+			weight      INTEGER NOT NULL,
+			owed_msats  INTEGER NOT NULL DEFAULT 0,
+			created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pool_members_batch_id ON pool_members(batch_id)`,
+		`CREATE TABLE IF NOT EXISTS pool_distributions (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			pay_id          TEXT NOT NULL REFERENCES vouchers(pay_id),
+			balance_msats   INTEGER NOT NULL,
+			allocated_msats INTEGER NOT NULL,
+			remainder_msats INTEGER NOT NULL,
+			created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS pool_payouts (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			member_id    INTEGER NOT NULL REFERENCES pool_members(id),
+			amount_msats INTEGER NOT NULL,
+			status       TEXT NOT NULL DEFAULT 'pending',
+			error        TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			settled_at   DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pool_payouts_member_id ON pool_payouts(member_id)`,
+		`CREATE TABLE IF NOT EXISTS voucher_rekeys (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			pay_id          TEXT NOT NULL REFERENCES vouchers(pay_id),
+			old_withdraw_id TEXT NOT NULL,
+			new_withdraw_id TEXT NOT NULL,
+			created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS boltcards (
+			card_id           TEXT PRIMARY KEY,
+			pay_id            TEXT NOT NULL REFERENCES vouchers(pay_id),
+			k0                TEXT NOT NULL,
+			k1                TEXT NOT NULL,
+			k2                TEXT NOT NULL,
+			k3                TEXT NOT NULL,
+			k4                TEXT NOT NULL,
+			uid               TEXT NOT NULL DEFAULT '',
+			counter           INTEGER NOT NULL DEFAULT 0,
+			daily_limit_msats INTEGER NOT NULL,
+			enabled           INTEGER NOT NULL DEFAULT 1,
+			created_at        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_boltcards_pay_id ON boltcards(pay_id)`,
+		`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id         TEXT PRIMARY KEY,
+			batch_id   TEXT NOT NULL DEFAULT '',
+			url        TEXT NOT NULL,
+			secret     TEXT NOT NULL,
+			events     TEXT NOT NULL DEFAULT '',
+			active     INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions(id),
+			event_id        TEXT NOT NULL,
+			event_type      TEXT NOT NULL,
+			payload         TEXT NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'pending',
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_status     INTEGER NOT NULL DEFAULT 0,
+			last_error      TEXT NOT NULL DEFAULT '',
+			created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			delivered_at    DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`,
+		`CREATE TABLE IF NOT EXISTS email_outbox (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			batch_id        TEXT NOT NULL REFERENCES batches(id),
+			to_addr         TEXT NOT NULL,
+			subject         TEXT NOT NULL,
+			body            TEXT NOT NULL,
+			unsubscribe_url TEXT NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'pending',
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_error      TEXT NOT NULL DEFAULT '',
+			created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			sent_at         DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(status, next_attempt_at)`,
+		`CREATE TABLE IF NOT EXISTS ledger_entries (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			txn_id       TEXT NOT NULL,
+			kind         TEXT NOT NULL,
+			account      TEXT NOT NULL,
+			amount_msats INTEGER NOT NULL,
+			ref          TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account)`,
+		`CREATE INDEX IF NOT EXISTS idx_ledger_entries_txn_id ON ledger_entries(txn_id)`,
+		`CREATE TABLE IF NOT EXISTS voucher_reminders (
+			pay_id       TEXT NOT NULL REFERENCES vouchers(pay_id),
+			lead_seconds INTEGER NOT NULL,
+			expires_at   DATETIME NOT NULL,
+			sent_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (pay_id, lead_seconds, expires_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS outgoing_payments (
+			payment_hash TEXT PRIMARY KEY,
+			ref          TEXT NOT NULL,
+			amount_msats INTEGER NOT NULL,
+			fee_msats    INTEGER NOT NULL DEFAULT 0,
+			status       TEXT NOT NULL DEFAULT 'pending',
+			error        TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			settled_at   DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_outgoing_payments_created_at ON outgoing_payments(created_at)`,
+		`CREATE TABLE IF NOT EXISTS reconcile_runs (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			window_start  DATETIME NOT NULL,
+			incoming      INTEGER NOT NULL DEFAULT 0,
+			outgoing      INTEGER NOT NULL DEFAULT 0,
+			matched       INTEGER NOT NULL DEFAULT 0,
+			discrepancies INTEGER NOT NULL DEFAULT 0,
+			error         TEXT NOT NULL DEFAULT '',
+			created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS reconcile_discrepancies (
+			id             INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind           TEXT NOT NULL,
+			direction      TEXT NOT NULL,
+			payment_hash   TEXT NOT NULL,
+			ref            TEXT NOT NULL DEFAULT '',
+			backend_msats  INTEGER NOT NULL DEFAULT 0,
+			recorded_msats INTEGER NOT NULL DEFAULT 0,
+			detail         TEXT NOT NULL DEFAULT '',
+			payment_at     DATETIME NOT NULL,
+			last_run_id    INTEGER NOT NULL REFERENCES reconcile_runs(id),
+			first_seen_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			resolved_at    DATETIME,
+			dismissed_at   DATETIME,
+			UNIQUE (kind, payment_hash)
+		)`,
+		`CREATE TABLE IF NOT EXISTS promo_codes (
+			code             TEXT PRIMARY KEY,
+			discount_percent INTEGER NOT NULL DEFAULT 0,
+			discount_sats    INTEGER NOT NULL DEFAULT 0,
+			max_uses         INTEGER NOT NULL DEFAULT 0,
+			max_vouchers     INTEGER NOT NULL DEFAULT 0,
+			expires_at       DATETIME,
+			note             TEXT NOT NULL DEFAULT '',
+			active           INTEGER NOT NULL DEFAULT 1,
+			created_at       DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS promo_redemptions (
+			id             INTEGER PRIMARY KEY AUTOINCREMENT,
+			code           TEXT NOT NULL REFERENCES promo_codes(code),
+			payment_hash   TEXT NOT NULL UNIQUE REFERENCES voucher_creation_requests(payment_hash),
+			batch_id       TEXT NOT NULL REFERENCES batches(id),
+			voucher_count  INTEGER NOT NULL,
+			fee_msats      INTEGER NOT NULL,
+			discount_msats INTEGER NOT NULL,
+			created_at     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code ON promo_redemptions(code)`,
+		`CREATE TABLE IF NOT EXISTS credit_accounts (
+			id                 TEXT PRIMARY KEY,
+			name               TEXT NOT NULL,
+			api_key_hash       TEXT NOT NULL UNIQUE,
+			linking_key        TEXT NOT NULL DEFAULT '',
+			balance_msats      INTEGER NOT NULL DEFAULT 0,
+			low_balance_msats  INTEGER NOT NULL DEFAULT 0,
+			low_balance_warned INTEGER NOT NULL DEFAULT 0,
+			created_at         DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_credit_accounts_linking_key ON credit_accounts(linking_key) WHERE linking_key!=''`,
+		`CREATE TABLE IF NOT EXISTS account_entries (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id    TEXT NOT NULL REFERENCES credit_accounts(id),
+			kind          TEXT NOT NULL,
+			amount_msats  INTEGER NOT NULL,
+			balance_msats INTEGER NOT NULL,
+			ref           TEXT NOT NULL DEFAULT '',
+			created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_account_entries_account_id ON account_entries(account_id)`,
+		`CREATE TABLE IF NOT EXISTS account_topups (
+			payment_hash TEXT PRIMARY KEY,
+			account_id   TEXT NOT NULL REFERENCES credit_accounts(id),
+			amount_msats INTEGER NOT NULL,
+			status       TEXT NOT NULL DEFAULT 'pending',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			paid_at      DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS account_logins (
+			k1          TEXT PRIMARY KEY,
+			account_id  TEXT NOT NULL DEFAULT '',
+			action      TEXT NOT NULL,
+			linking_key TEXT NOT NULL DEFAULT '',
+			verified    INTEGER NOT NULL DEFAULT 0,
+			claimed     INTEGER NOT NULL DEFAULT 0,
+			created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS account_sessions (
+			token_hash TEXT PRIMARY KEY,
+			account_id TEXT NOT NULL REFERENCES credit_accounts(id),
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
 	}
 	for _, s := range stmts {
-		if _, err := db.Exec(s); err != nil {
+		if _, err := tx.Exec(tx.dialect.ddl(s)); err != nil {
 			n := len(s); if n > 40 { n = 40 }
 			return fmt.Errorf("exec %q: %w", s[:n], err)
 		}
 	}
 
-	// Migrations: add columns that may not exist on older DBs.
-	for _, col := range []string{
-		`ALTER TABLE vouchers ADD COLUMN deactivation_reason TEXT`,
-		`ALTER TABLE vouchers ADD COLUMN deactivated_msats INTEGER NOT NULL DEFAULT 0`,
+	// Columns added to tables that older databases created without them.
+	// New schema changes belong in a migration of their own (migrations.go).
+	for _, col := range []struct{ table, name, def string }{
+		{"vouchers", "deactivation_reason", "TEXT"},
+		{"vouchers", "deactivated_msats", "INTEGER NOT NULL DEFAULT 0"},
+		{"voucher_creation_requests", "batch_id", "TEXT REFERENCES batches(id)"},
+		{"vouchers", "batch_id", "TEXT REFERENCES batches(id)"},
+		{"vouchers", "pin", "TEXT"},
+		{"vouchers", "pin_failures", "INTEGER NOT NULL DEFAULT 0"},
+		{"vouchers", "pin_locked_until", "DATETIME"},
+		{"withdraw_sessions", "pin_verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"vouchers", "claimable_after", "DATETIME"},
+		{"batches", "expiry_policy", "TEXT NOT NULL DEFAULT 'refund'"},
+		{"batches", "policy_charity", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "donate_percent", "INTEGER NOT NULL DEFAULT 0"},
+		{"batches", "funding_charity", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "funding_donate_percent", "INTEGER NOT NULL DEFAULT 0"},
+		{"pay_invoices", "charity_msats", "INTEGER NOT NULL DEFAULT 0"},
+		{"vouchers", "kind", "TEXT NOT NULL DEFAULT 'gift'"},
+		{"vouchers", "last_withdrawn_at", "DATETIME"},
+		{"vouchers", "forward_failures", "INTEGER NOT NULL DEFAULT 0"},
+		{"vouchers", "forward_retry_at", "DATETIME"},
+		{"batches", "allowed_payees", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "allowed_domains", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "currency", "TEXT NOT NULL DEFAULT ''"},
+		{"pay_invoices", "fiat_cents", "INTEGER NOT NULL DEFAULT 0"},
+		{"pay_invoices", "quote_currency", "TEXT NOT NULL DEFAULT ''"},
+		{"pay_invoices", "quote_amount", "INTEGER NOT NULL DEFAULT 0"},
+		{"pay_invoices", "quote_btc_price", "REAL NOT NULL DEFAULT 0"},
+		{"withdraw_sessions", "card_id", "TEXT NOT NULL DEFAULT ''"},
+		{"voucher_withdrawals", "card_id", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "owner_email", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "email_token", "TEXT NOT NULL DEFAULT ''"},
+		{"batches", "email_opt_out", "INTEGER NOT NULL DEFAULT 0"},
+		{"voucher_creation_requests", "account_id", "TEXT REFERENCES credit_accounts(id)"},
 	} {
-		if _, err := db.Exec(col); err != nil && !isDuplicateColumn(err) {
-			return fmt.Errorf("migration %q: %w", col, err)
+		if err := addColumn(tx, col.table, col.name, col.def); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", col.table, col.name, err)
+		}
+	}
+	for _, s := range tx.dialect.appendOnly("ledger_entries") {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("ledger triggers: %w", err)
 		}
 	}
-	return nil
-}
 
-func isDuplicateColumn(err error) bool {
-	return err != nil && strings.Contains(err.Error(), "duplicate column name")
+	// Backfill: give batches created before the batches table existed a row of
+	// their own, keyed by the creation payment hash.
+	for _, s := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_vouchers_batch_id ON vouchers(batch_id)`,
+		`INSERT INTO batches (id, lightning_address, count, expiry_seconds, fee_msats, created_at)
+		 SELECT payment_hash, lightning_address, count, expiry_seconds, fee_msats, created_at
+		 FROM voucher_creation_requests WHERE batch_id IS NULL
+		 ON CONFLICT DO NOTHING`,
+		`UPDATE voucher_creation_requests SET batch_id=payment_hash WHERE batch_id IS NULL`,
+		`UPDATE vouchers SET batch_id=creation_request_hash WHERE batch_id IS NULL AND creation_request_hash IS NOT NULL`,
+	} {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("backfill batches: %w", err)
+		}
+	}
+	if err := openLedgerTx(tx); err != nil {
+		return fmt.Errorf("open ledger: %w", err)
+	}
+	return nil
 }
 
 // ── Voucher Creation Requests ────────────────────────────────────────────────
 
-func (db *DB) InsertCreationRequest(paymentHash, address string, count int, expirySecs, feeMsats int64) error {
-	_, err := db.Exec(
-		`INSERT INTO voucher_creation_requests (payment_hash, lightning_address, count, expiry_seconds, fee_msats)
-		 VALUES (?, ?, ?, ?, ?)`,
-		paymentHash, address, count, expirySecs, feeMsats,
-	)
-	return err
+// InsertCreationRequest stores the batch, its pool members if any, and the
+// pending creation request that will fill it once paymentHash is paid. A
+// non-nil promo is redeemed in the same transaction, failing with one of the
+// ErrPromo errors if the code can no longer be used for the batch.
+func (db *DB) InsertCreationRequest(paymentHash string, b *Batch, members []PoolMember, promo *PromoRedemption) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO batches (id, name, owner_note, message, tags, lightning_address, count, expiry_seconds, fee_msats, kind,
+		                      expiry_policy, policy_charity, donate_percent, funding_charity, funding_donate_percent,
+		                      allowed_payees, allowed_domains, currency, owner_email, email_token)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.ID, b.Name, b.OwnerNote, b.Message, strings.Join(b.Tags, ","),
+		b.LightningAddress, b.Count, b.ExpirySeconds, b.FeeMsats, b.Kind,
+		b.ExpiryPolicy, b.PolicyCharity, b.DonatePercent, b.FundingCharity, b.FundingDonatePercent,
+		strings.Join(b.AllowedPayees, ","), strings.Join(b.AllowedDomains, ","), b.Currency,
+		b.OwnerEmail, b.EmailToken,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO voucher_creation_requests (payment_hash, batch_id, lightning_address, count, expiry_seconds, fee_msats)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		paymentHash, b.ID, b.LightningAddress, b.Count, b.ExpirySeconds, b.FeeMsats,
+	); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if _, err := tx.Exec(
+			`INSERT INTO pool_members (batch_id, address, weight) VALUES (?, ?, ?)`,
+			b.ID, m.Address, m.Weight,
+		); err != nil {
+			return err
+		}
+	}
+	if promo != nil {
+		if err := lockRow(tx, "promo_codes", "code", promo.Code); err != nil {
+			return err
+		}
+		p, err := getPromoCode(tx, promo.Code)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPromoInvalid
+		} else if err != nil {
+			return err
+		}
+		if err := p.Check(b.Count); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO promo_redemptions (code, payment_hash, batch_id, voucher_count, fee_msats, discount_msats)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			p.Code, paymentHash, b.ID, b.Count, b.FeeMsats, promo.DiscountMsats,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (db *DB) UpdateCreationRequestStatus(paymentHash, status string) error {
@@ -160,13 +680,13 @@ func (db *DB) UpdateCreationRequestStatus(paymentHash, status string) error {
 
 func (db *DB) GetCreationRequest(paymentHash string) (*VoucherCreationRequest, error) {
 	row := db.QueryRow(
-		`SELECT payment_hash, lightning_address, count, expiry_seconds, fee_msats, status, created_at
+		`SELECT payment_hash, COALESCE(batch_id, ''), lightning_address, count, expiry_seconds, fee_msats, status, created_at
 		 FROM voucher_creation_requests WHERE payment_hash=?`,
 		paymentHash,
 	)
 	var req VoucherCreationRequest
 	if err := row.Scan(
-		&req.PaymentHash, &req.LightningAddress, &req.Count,
+		&req.PaymentHash, &req.BatchID, &req.LightningAddress, &req.Count,
 		&req.ExpirySeconds, &req.FeeMsats, &req.Status, &req.CreatedAt,
 	); err != nil {
 		return nil, err
@@ -174,9 +694,161 @@ func (db *DB) GetCreationRequest(paymentHash string) (*VoucherCreationRequest, e
 	return &req, nil
 }
 
+// ── Batches ──────────────────────────────────────────────────────────────────
+
+const batchColumns = `id, name, owner_note, message, tags, lightning_address, count, expiry_seconds, fee_msats, created_at,
+	expiry_policy, policy_charity, donate_percent, funding_charity, funding_donate_percent, allowed_payees, allowed_domains, currency,
+	fee_override, kind`
+
+func (db *DB) GetBatch(id string) (*Batch, error) {
+	return scanBatch(db.QueryRow(`SELECT `+batchColumns+` FROM batches WHERE id=?`, id))
+}
+
+// UpdateBatchDetails replaces the owner-editable fields of a batch: its
+// descriptive fields and its allowlist.
+func (db *DB) UpdateBatchDetails(b *Batch) error {
+	_, err := db.Exec(
+		`UPDATE batches SET name=?, owner_note=?, message=?, tags=?, allowed_payees=?, allowed_domains=? WHERE id=?`,
+		b.Name, b.OwnerNote, b.Message, strings.Join(b.Tags, ","),
+		strings.Join(b.AllowedPayees, ","), strings.Join(b.AllowedDomains, ","), b.ID,
+	)
+	return err
+}
+
+// scanBatch reads batchColumns, followed by any extra columns into extra.
+func scanBatch(row rowScanner, extra ...any) (*Batch, error) {
+	var b Batch
+	var tags, payees, domains, feeOverride string
+	dest := []any{
+		&b.ID, &b.Name, &b.OwnerNote, &b.Message, &tags, &b.LightningAddress,
+		&b.Count, &b.ExpirySeconds, &b.FeeMsats, &b.CreatedAt,
+		&b.ExpiryPolicy, &b.PolicyCharity, &b.DonatePercent, &b.FundingCharity, &b.FundingDonatePercent,
+		&payees, &domains, &b.Currency, &feeOverride, &b.Kind,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if tags != "" {
+		b.Tags = strings.Split(tags, ",")
+	}
+	if payees != "" {
+		b.AllowedPayees = strings.Split(payees, ",")
+	}
+	if domains != "" {
+		b.AllowedDomains = strings.Split(domains, ",")
+	}
+	if feeOverride != "" {
+		b.FeeOverride = &FundingFees{}
+		if err := json.Unmarshal([]byte(feeOverride), b.FeeOverride); err != nil {
+			return nil, fmt.Errorf("batch %s fee override: %w", b.ID, err)
+		}
+	}
+	return &b, nil
+}
+
+// SetBatchFeeOverride replaces the funding fees of batch id with f, or
+// goes back to the fee schedule's if f is nil. It returns sql.ErrNoRows if
+// there is no such batch.
+func (db *DB) SetBatchFeeOverride(id string, f *FundingFees) error {
+	var override string
+	if f != nil {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		override = string(data)
+	}
+	res, err := db.Exec(`UPDATE batches SET fee_override=? WHERE id=?`, override, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ImportBatchFeeOverrides stores overrides, by batch ID, for the batches
+// that have none yet, and returns how many it stored.
+func (db *DB) ImportBatchFeeOverrides(overrides map[string]FundingFees) (int, error) {
+	n := 0
+	for id, f := range overrides {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return n, err
+		}
+		res, err := db.Exec(`UPDATE batches SET fee_override=? WHERE id=? AND fee_override=''`, string(data), id)
+		if err != nil {
+			return n, err
+		}
+		if rows, _ := res.RowsAffected(); rows > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetBatchFeeOverrides returns the batches with a fee override, newest first.
+func (db *DB) GetBatchFeeOverrides() ([]*Batch, error) {
+	rows, err := db.Query(`SELECT ` + batchColumns + ` FROM batches WHERE fee_override!='' ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*Batch
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+// BatchStats summarises one batch for the admin page.
+type BatchStats struct {
+	Batch
+	VoucherCount int
+	FundedCount  int
+	LockedMsats  int64
+}
+
+// GetRecentBatchStats returns the most recently created batches with their voucher totals.
+func (db *DB) GetRecentBatchStats(limit int) ([]*BatchStats, error) {
+	rows, err := db.Query(
+		`SELECT `+batchColumns+`, voucher_count, funded_count, locked_msats
+		 FROM batches JOIN (
+		   SELECT batch_id,
+		          COUNT(*) AS voucher_count,
+		          SUM(CASE WHEN active=1 AND total_paid_msats>0 THEN 1 ELSE 0 END) AS funded_count,
+		          SUM(CASE WHEN active=1 THEN total_paid_msats ELSE 0 END) AS locked_msats
+		   FROM vouchers GROUP BY batch_id
+		 ) AS counts ON batch_id=id
+		 ORDER BY created_at DESC LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*BatchStats
+	for rows.Next() {
+		var s BatchStats
+		b, err := scanBatch(rows, &s.VoucherCount, &s.FundedCount, &s.LockedMsats)
+		if err != nil {
+			return nil, err
+		}
+		s.Batch = *b
+		result = append(result, &s)
+	}
+	return result, rows.Err()
+}
+
 // ── Vouchers ─────────────────────────────────────────────────────────────────
 
-func (db *DB) InsertVouchers(payIDs, withdrawIDs []string, creationHash, address string, expirySecs int64) error {
+// InsertVouchers stores newly created vouchers for a paid creation request.
+func (db *DB) InsertVouchers(creationHash string, vouchers []*Voucher) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -184,27 +856,55 @@ func (db *DB) InsertVouchers(payIDs, withdrawIDs []string, creationHash, address
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(
-		`INSERT INTO vouchers (pay_id, withdraw_id, creation_request_hash, lightning_address, expiry_seconds)
-		 VALUES (?, ?, ?, ?, ?)`,
+		`INSERT INTO vouchers (pay_id, withdraw_id, creation_request_hash, batch_id, lightning_address, expiry_seconds,
+		                       pin, pin_reveal, claimable_after, kind, seq)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 	)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for i := range payIDs {
-		if _, err := stmt.Exec(payIDs[i], withdrawIDs[i], creationHash, address, expirySecs); err != nil {
+	for i, v := range vouchers {
+		var pin, reveal sql.NullString
+		if v.Pin != "" {
+			hash, err := hashPIN(v.Pin)
+			if err != nil {
+				return err
+			}
+			pin = sql.NullString{String: hash, Valid: true}
+			reveal = sql.NullString{String: v.Pin, Valid: true}
+		}
+		var claimableAfter sql.NullTime
+		if v.ClaimableAfter != nil {
+			claimableAfter = sql.NullTime{Time: v.ClaimableAfter.UTC(), Valid: true}
+		}
+		if _, err := stmt.Exec(
+			v.PayID, v.WithdrawID, creationHash, v.BatchID, v.LightningAddress, v.ExpirySeconds,
+			pin, reveal, claimableAfter, v.Kind, i+1,
+		); err != nil {
 			return err
 		}
 	}
+	var feeMsats int64
+	if err := tx.QueryRow(
+		`SELECT fee_msats FROM voucher_creation_requests WHERE payment_hash=?`, creationHash,
+	).Scan(&feeMsats); err != nil {
+		return err
+	}
+	if err := PostLedgerTx(tx, LedgerCreationFee, creationHash,
+		LedgerEntry{AccountLightning, feeMsats},
+		LedgerEntry{AccountCreationFees, -feeMsats},
+	); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
 func (db *DB) GetVouchersByCreationHash(hash string) ([]*Voucher, error) {
 	rows, err := db.Query(
-		`SELECT pay_id, withdraw_id, creation_request_hash, lightning_address,
-		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at
-		 FROM vouchers WHERE creation_request_hash=? ORDER BY rowid`,
+		`SELECT `+voucherColumns+`
+		 FROM vouchers WHERE creation_request_hash=? ORDER BY seq, pay_id`,
 		hash,
 	)
 	if err != nil {
@@ -214,10 +914,18 @@ func (db *DB) GetVouchersByCreationHash(hash string) ([]*Voucher, error) {
 	return scanVouchers(rows)
 }
 
+// ForgetRevealedPINs drops the PINs of a batch's vouchers once its owner has
+// been shown them, leaving only their hashes.
+func (db *DB) ForgetRevealedPINs(creationHash string) error {
+	_, err := db.Exec(
+		`UPDATE vouchers SET pin_reveal=NULL WHERE creation_request_hash=? AND pin_reveal IS NOT NULL`, creationHash,
+	)
+	return err
+}
+
 func (db *DB) GetVoucherByPayID(payID string) (*Voucher, error) {
 	row := db.QueryRow(
-		`SELECT pay_id, withdraw_id, creation_request_hash, lightning_address,
-		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at
+		`SELECT `+voucherColumns+`
 		 FROM vouchers WHERE pay_id=?`,
 		payID,
 	)
@@ -226,33 +934,86 @@ func (db *DB) GetVoucherByPayID(payID string) (*Voucher, error) {
 
 func (db *DB) GetVoucherByWithdrawID(withdrawID string) (*Voucher, error) {
 	row := db.QueryRow(
-		`SELECT pay_id, withdraw_id, creation_request_hash, lightning_address,
-		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at
+		`SELECT `+voucherColumns+`
 		 FROM vouchers WHERE withdraw_id=?`,
 		withdrawID,
 	)
 	return scanVoucher(row)
 }
 
+// RekeyVoucher moves a voucher to a new withdraw_id. Withdraw sessions issued
+// for the old one are marked used and follow the voucher, and the change is
+// recorded in voucher_rekeys.
+func (db *DB) RekeyVoucher(payID, oldWithdrawID, newWithdrawID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// withdraw_sessions references vouchers(withdraw_id); let parent and
+	// children change within the transaction and check them at commit.
+	if _, err := tx.Exec(tx.dialect.deferForeignKeys); err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		`UPDATE vouchers SET withdraw_id=? WHERE pay_id=? AND withdraw_id=?`,
+		newWithdrawID, payID, oldWithdrawID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("voucher %s was changed concurrently", payID)
+	}
+	if _, err := tx.Exec(
+		`UPDATE withdraw_sessions SET withdraw_id=?, used=1, used_at=COALESCE(used_at, CURRENT_TIMESTAMP)
+		 WHERE withdraw_id=?`,
+		newWithdrawID, oldWithdrawID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO voucher_rekeys (pay_id, old_withdraw_id, new_withdraw_id) VALUES (?, ?, ?)`,
+		payID, oldWithdrawID, newWithdrawID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // getVoucherByPayIDTx reads a voucher inside an existing transaction.
-func getVoucherByPayIDTx(tx *sql.Tx, payID string) (*Voucher, error) {
+func getVoucherByPayIDTx(tx *Tx, payID string) (*Voucher, error) {
 	row := tx.QueryRow(
-		`SELECT pay_id, withdraw_id, creation_request_hash, lightning_address,
-		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at
-		 FROM vouchers WHERE pay_id=?`,
+		`SELECT `+voucherColumns+`
+		 FROM vouchers WHERE pay_id=?`+tx.dialect.lockRows,
 		payID,
 	)
 	return scanVoucher(row)
 }
 
-func scanVoucher(row *sql.Row) (*Voucher, error) {
+// voucherColumns is the column list read by scanVoucher.
+const voucherColumns = `pay_id, withdraw_id, creation_request_hash, batch_id, lightning_address,
+		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at,
+		        pin, pin_reveal, pin_locked_until, pin_lockouts, claimable_after, kind, last_withdrawn_at,
+		        forward_failures, forward_retry_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVoucher(row rowScanner) (*Voucher, error) {
 	var v Voucher
 	var lastFunded sql.NullTime
 	var activeInt int
-	var creationHash sql.NullString
+	var creationHash, batchID, pin, pinReveal sql.NullString
+	var pinLocked, claimableAfter, lastWithdrawn, forwardRetry sql.NullTime
 	if err := row.Scan(
-		&v.PayID, &v.WithdrawID, &creationHash, &v.LightningAddress,
+		&v.PayID, &v.WithdrawID, &creationHash, &batchID, &v.LightningAddress,
 		&v.TotalPaidMsats, &lastFunded, &v.ExpirySeconds, &activeInt, &v.CreatedAt,
+		&pin, &pinReveal, &pinLocked, &v.PinLockouts, &claimableAfter, &v.Kind, &lastWithdrawn,
+		&v.ForwardFailures, &forwardRetry,
 	); err != nil {
 		return nil, err
 	}
@@ -260,75 +1021,350 @@ func scanVoucher(row *sql.Row) (*Voucher, error) {
 	if lastFunded.Valid {
 		v.LastFundedAt = &lastFunded.Time
 	}
-	if creationHash.Valid {
-		v.CreationHash = creationHash.String
+	if pinLocked.Valid {
+		v.PinLockedUntil = &pinLocked.Time
+	}
+	if lastWithdrawn.Valid {
+		v.LastWithdrawnAt = &lastWithdrawn.Time
+	}
+	if forwardRetry.Valid {
+		v.ForwardRetryAt = &forwardRetry.Time
 	}
+	if claimableAfter.Valid {
+		v.ClaimableAfter = &claimableAfter.Time
+	}
+	v.PinHash = pin.String
+	v.Pin = pinReveal.String
+	v.CreationHash = creationHash.String
+	v.BatchID = batchID.String
 	return &v, nil
 }
 
 func scanVouchers(rows *sql.Rows) ([]*Voucher, error) {
 	var vouchers []*Voucher
 	for rows.Next() {
-		var v Voucher
-		var lastFunded sql.NullTime
-		var activeInt int
-		var creationHash sql.NullString
-		if err := rows.Scan(
-			&v.PayID, &v.WithdrawID, &creationHash, &v.LightningAddress,
-			&v.TotalPaidMsats, &lastFunded, &v.ExpirySeconds, &activeInt, &v.CreatedAt,
-		); err != nil {
+		v, err := scanVoucher(rows)
+		if err != nil {
 			return nil, err
 		}
-		v.Active = activeInt == 1
-		if lastFunded.Valid {
-			v.LastFundedAt = &lastFunded.Time
-		}
-		if creationHash.Valid {
-			v.CreationHash = creationHash.String
-		}
-		vouchers = append(vouchers, &v)
+		vouchers = append(vouchers, v)
 	}
 	return vouchers, rows.Err()
 }
 
-// CreditVoucherTx credits a voucher and marks its invoice paid inside a transaction.
-func CreditVoucherTx(tx *sql.Tx, payID string, creditedMsats int64, paymentHash string) error {
-	if _, err := tx.Exec(
+// CreditVoucherTx credits a voucher and marks its invoice paid inside a
+// transaction, queueing a voucher.funded event with it.
+func CreditVoucherTx(tx *Tx, payID string, creditedMsats int64, paymentHash string) error {
+	var amountMsats, charityMsats int64
+	if err := tx.QueryRow(
+		`UPDATE pay_invoices SET paid=1, paid_at=CURRENT_TIMESTAMP WHERE payment_hash=?
+		 RETURNING amount_msats, charity_msats`,
+		paymentHash,
+	).Scan(&amountMsats, &charityMsats); err != nil {
+		return err
+	}
+	// The charity share is posted by InsertCharityPayoutTx.
+	feeMsats := amountMsats - creditedMsats - charityMsats
+	return fundVoucherTx(tx, payID, creditedMsats, feeMsats, paymentHash, map[string]any{"payment_hash": paymentHash})
+}
+
+// fundVoucherTx credits a voucher with creditedMsats of a payment into the
+// node that also carried feeMsats in fees, posting it under ref and queueing
+// a voucher.funded event with the extra data.
+func fundVoucherTx(tx *Tx, payID string, creditedMsats, feeMsats int64, ref string, extra map[string]any) error {
+	var first bool
+	if err := tx.QueryRow(
+		`SELECT last_funded_at IS NULL FROM vouchers WHERE pay_id=?`+tx.dialect.lockRows, payID,
+	).Scan(&first); err != nil {
+		return err
+	}
+	var balance int64
+	if err := tx.QueryRow(
 		`UPDATE vouchers SET total_paid_msats=total_paid_msats+?, last_funded_at=CURRENT_TIMESTAMP
-		 WHERE pay_id=?`,
+		 WHERE pay_id=? RETURNING total_paid_msats`,
 		creditedMsats, payID,
+	).Scan(&balance); err != nil {
+		return err
+	}
+	if err := PostLedgerTx(tx, LedgerFunding, ref,
+		LedgerEntry{AccountLightning, creditedMsats + feeMsats},
+		LedgerEntry{voucherAccount(payID), -creditedMsats},
+		LedgerEntry{AccountFundingFees, -feeMsats},
 	); err != nil {
 		return err
 	}
-	_, err := tx.Exec(
-		`UPDATE pay_invoices SET paid=1, paid_at=CURRENT_TIMESTAMP WHERE payment_hash=?`,
-		paymentHash,
-	)
-	return err
+	data := map[string]any{
+		"amount_msats":  creditedMsats,
+		"balance_msats": balance,
+		"first_funding": first,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	return EnqueueEventTx(tx, EventVoucherFunded, "", payID, data)
 }
 
-// DeactivateVoucherTx zeroes balance, records reason and amount, marks active=0 inside a transaction.
-func DeactivateVoucherTx(tx *sql.Tx, payID, reason string, msats int64) error {
-	_, err := tx.Exec(
-		`UPDATE vouchers SET total_paid_msats=0, active=0, deactivation_reason=?, deactivated_msats=? WHERE pay_id=?`,
-		reason, msats, payID,
-	)
-	return err
-}
+// ErrVoucherChanged is returned when a voucher was deactivated, spent or
+// topped up after the caller read it.
+var ErrVoucherChanged = errors.New("voucher changed since it was read")
 
-// DeactivateVoucher zeroes balance, records reason and amount, marks active=0 (standalone).
-func (db *DB) DeactivateVoucher(payID, reason string, msats int64) error {
-	_, err := db.Exec(
-		`UPDATE vouchers SET total_paid_msats=0, active=0, deactivation_reason=?, deactivated_msats=? WHERE pay_id=?`,
+// LockVoucherTx locks a voucher for the rest of tx, failing with
+// ErrVoucherChanged unless it is still active with a balance of msats.
+func LockVoucherTx(tx *Tx, payID string, msats int64) error {
+	var active bool
+	var balance int64
+	if err := tx.QueryRow(
+		`SELECT active, total_paid_msats FROM vouchers WHERE pay_id=?`+tx.dialect.lockRows, payID,
+	).Scan(&active, &balance); err != nil {
+		return err
+	}
+	if !active || balance != msats {
+		return ErrVoucherChanged
+	}
+	return nil
+}
+
+// DeactivateVoucherTx zeroes balance, records reason and amount, marks active=0
+// and queues a voucher.deactivated event, inside a transaction. It fails with
+// ErrVoucherChanged if the voucher is already inactive.
+func DeactivateVoucherTx(tx *Tx, payID, reason string, msats int64) error {
+	var active bool
+	var balance int64
+	if err := tx.QueryRow(
+		`SELECT active, total_paid_msats FROM vouchers WHERE pay_id=?`+tx.dialect.lockRows, payID,
+	).Scan(&active, &balance); err != nil {
+		return err
+	}
+	if !active {
+		return ErrVoucherChanged
+	}
+	kind := deactivationKinds[reason]
+	if kind == "" {
+		kind = reason
+	}
+	if err := PostLedgerTx(tx, kind, payID,
+		LedgerEntry{voucherAccount(payID), balance},
+		LedgerEntry{AccountLightning, -balance},
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE vouchers SET total_paid_msats=0, active=0, deactivation_reason=?, deactivated_msats=? WHERE pay_id=?`,
 		reason, msats, payID,
-	)
-	return err
+	); err != nil {
+		return err
+	}
+	return EnqueueEventTx(tx, EventVoucherDeactivated, "", payID, map[string]any{
+		"reason":       reason,
+		"amount_msats": msats,
+	})
+}
+
+// DeactivateVoucher is DeactivateVoucherTx in its own transaction.
+func (db *DB) DeactivateVoucher(payID, reason string, msats int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := DeactivateVoucherTx(tx, payID, reason, msats); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // ReactivateVoucher restores a voucher's balance and marks it active again.
 // Used when a refund payment definitively fails so the job retries next run.
 func (db *DB) ReactivateVoucher(payID string, balanceMsats int64) error {
-	_, err := db.Exec(
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := ReactivateVoucherTx(tx, payID, balanceMsats); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ErrInsufficientBalance is returned when a withdrawal exceeds a voucher's balance.
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// DebitVoucher takes msats from an active voucher's balance for a partial
+// withdrawal and records it as pending, returning the withdrawal id. The
+// balance is debited before paying, for the same reason vouchers are
+// deactivated before paying out in full.
+func (db *DB) DebitVoucher(payID string, msats int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	id, err := debitVoucherTx(tx, payID, "", msats)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// ErrDailyLimit is returned when a boltcard payment would exceed the card's daily limit.
+var ErrDailyLimit = errors.New("daily limit exceeded")
+
+// DebitVoucherByCard is DebitVoucher for a boltcard tap. The withdrawal is
+// recorded against the card and refused if, together with the card's other
+// withdrawals in the last 24 hours that haven't failed, it would exceed
+// limitMsats.
+func (db *DB) DebitVoucherByCard(payID, cardID string, msats, limitMsats int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := lockRow(tx, "boltcards", "card_id", cardID); err != nil {
+		return 0, err
+	}
+	spent, err := boltcardSpent(tx, cardID)
+	if err != nil {
+		return 0, err
+	}
+	if spent+msats > limitMsats {
+		return 0, ErrDailyLimit
+	}
+	id, err := debitVoucherTx(tx, payID, cardID, msats)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func debitVoucherTx(tx *Tx, payID, cardID string, msats int64) (int64, error) {
+	res, err := tx.Exec(
+		`UPDATE vouchers SET total_paid_msats=total_paid_msats-?, last_withdrawn_at=CURRENT_TIMESTAMP
+		 WHERE pay_id=? AND active=1 AND total_paid_msats>=?`,
+		msats, payID, msats,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrInsufficientBalance
+	}
+	var id int64
+	if err := tx.QueryRow(
+		`INSERT INTO voucher_withdrawals (pay_id, amount_msats, card_id) VALUES (?, ?, ?) RETURNING id`, payID, msats, cardID,
+	).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, PostLedgerTx(tx, LedgerWithdrawal, fmt.Sprintf("withdrawal:%d", id),
+		LedgerEntry{voucherAccount(payID), msats},
+		LedgerEntry{AccountLightning, -msats},
+	)
+}
+
+// SettleWithdrawalTx marks a pending withdrawal, or one whose outcome is
+// unknown, paid or, if the payment definitively failed, returns its amount to
+// the voucher.
+func SettleWithdrawalTx(tx *Tx, id int64, paid bool) error {
+	if paid {
+		_, err := tx.Exec(`UPDATE voucher_withdrawals SET status='paid' WHERE id=? AND status IN ('pending', 'unknown')`, id)
+		return err
+	}
+	var payID string
+	var msats int64
+	if err := tx.QueryRow(
+		`UPDATE voucher_withdrawals SET status='failed' WHERE id=? AND status IN ('pending', 'unknown')
+		 RETURNING pay_id, amount_msats`, id,
+	).Scan(&payID, &msats); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE vouchers SET total_paid_msats=total_paid_msats+? WHERE pay_id=?`, msats, payID); err != nil {
+		return err
+	}
+	return PostLedgerTx(tx, LedgerWithdrawalReversal, fmt.Sprintf("withdrawal:%d", id),
+		LedgerEntry{AccountLightning, msats},
+		LedgerEntry{voucherAccount(payID), -msats},
+	)
+}
+
+// SettleWithdrawal is SettleWithdrawalTx in its own transaction.
+func (db *DB) SettleWithdrawal(id int64, paid bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := SettleWithdrawalTx(tx, id, paid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkWithdrawalUnknown records that a pending withdrawal's payment timed
+// out, leaving its outcome to reconciliation.
+func (db *DB) MarkWithdrawalUnknown(id int64) error {
+	_, err := db.Exec(`UPDATE voucher_withdrawals SET status='unknown' WHERE id=? AND status='pending'`, id)
+	return err
+}
+
+// SettleUnknownWithdrawal settles withdrawal id as SettleWithdrawal does if
+// its outcome is unknown, and reports whether it was.
+func (db *DB) SettleUnknownWithdrawal(id int64, paid bool) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRow(`SELECT status FROM voucher_withdrawals WHERE id=?`+tx.dialect.lockRows, id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && status != "unknown") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := SettleWithdrawalTx(tx, id, paid); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetUnsentWithdrawals returns the ids of withdrawals whose outcome has been
+// unknown since before cutoff and for which no payment was ever started.
+func (db *DB) GetUnsentWithdrawals(cutoff time.Time) ([]int64, error) {
+	rows, err := db.Query(
+		`SELECT id FROM voucher_withdrawals w
+		 WHERE status='unknown' AND `+db.dialect.epoch("created_at")+` < ?
+		   AND NOT EXISTS (SELECT 1 FROM outgoing_payments o WHERE o.ref='withdrawal:'||w.id)
+		 ORDER BY id`, cutoff.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ReactivateVoucherTx is ReactivateVoucher inside a transaction.
+func ReactivateVoucherTx(tx *Tx, payID string, balanceMsats int64) error {
+	var before int64
+	if err := tx.QueryRow(`SELECT total_paid_msats FROM vouchers WHERE pay_id=?`+tx.dialect.lockRows, payID).Scan(&before); err != nil {
+		return err
+	}
+	if err := PostLedgerTx(tx, LedgerReactivation, payID,
+		LedgerEntry{AccountLightning, balanceMsats - before},
+		LedgerEntry{voucherAccount(payID), before - balanceMsats},
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
 		`UPDATE vouchers SET total_paid_msats=?, active=1, deactivation_reason=NULL, deactivated_msats=0 WHERE pay_id=?`,
 		balanceMsats, payID,
 	)
@@ -336,18 +1372,30 @@ func (db *DB) ReactivateVoucher(payID string, balanceMsats int64) error {
 }
 
 // GetExpiredVouchersForRefund returns active vouchers that have balance and have crossed
-// either their relative or absolute expiry boundary.
+// either their relative or absolute expiry boundary. A time-locked voucher's relative
+// expiry is not reached until expiry_seconds after its release date.
 func (db *DB) GetExpiredVouchersForRefund() ([]*Voucher, error) {
+	epoch := db.dialect.epoch
+	now := epoch("CURRENT_TIMESTAMP")
 	rows, err := db.Query(
-		`SELECT pay_id, withdraw_id, creation_request_hash, lightning_address,
-		        total_paid_msats, last_funded_at, expiry_seconds, active, created_at
+		`SELECT `+voucherColumns+`
 		 FROM vouchers
 		 WHERE active=1 AND total_paid_msats>0
 		 AND (
-		   (last_funded_at IS NOT NULL
-		    AND (CAST(strftime('%s','now') AS INTEGER) - CAST(strftime('%s',last_funded_at) AS INTEGER)) >= expiry_seconds)
+		   (kind NOT IN ('tipjar','forward','pool') AND (
+		     (last_funded_at IS NOT NULL
+		      AND (`+now+` - `+epoch("last_funded_at")+`) >= expiry_seconds
+		      AND (claimable_after IS NULL
+		           OR (`+now+` - `+epoch("claimable_after")+`) >= expiry_seconds))
+		     OR
+		     ((`+now+` - `+epoch("created_at")+`) >= ?)
+		   ))
 		   OR
-		   ((CAST(strftime('%s','now') AS INTEGER) - CAST(strftime('%s',created_at) AS INTEGER)) >= ?)
+		   (kind IN ('tipjar','forward','pool')
+		    AND (`+now+` - `+db.dialect.greatest(
+			epoch("created_at"),
+			"COALESCE("+epoch("last_funded_at")+", 0)",
+			"COALESCE("+epoch("last_withdrawn_at")+", 0)")+`) >= expiry_seconds)
 		 )`,
 		cfg.VoucherAbsoluteExpirySecs,
 	)
@@ -358,125 +1406,2452 @@ func (db *DB) GetExpiredVouchersForRefund() ([]*Voucher, error) {
 	return scanVouchers(rows)
 }
 
-// ── Audit ─────────────────────────────────────────────────────────────────────
+// GetVouchersWithBalance returns active vouchers holding a balance.
+func (db *DB) GetVouchersWithBalance() ([]*Voucher, error) {
+	rows, err := db.Query(
+		`SELECT ` + voucherColumns + ` FROM vouchers WHERE active=1 AND total_paid_msats>0`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanVouchers(rows)
+}
 
-type AuditStats struct {
-	TotalVoucherCount   int
-	FundedVoucherCount  int
-	TotalLockedMsats    int64
-	ClaimedCount        int
-	ClaimedMsats        int64
-	RefundedCount       int
-	RefundedMsats       int64
+// GetForwardableVouchers returns active forward vouchers holding a balance
+// that are not waiting out a retry backoff.
+func (db *DB) GetForwardableVouchers() ([]*Voucher, error) {
+	rows, err := db.Query(
+		`SELECT `+voucherColumns+`
+		 FROM vouchers
+		 WHERE active=1 AND kind='forward' AND total_paid_msats>0
+		 AND (forward_retry_at IS NULL OR forward_retry_at <= ?)`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanVouchers(rows)
 }
 
-func (db *DB) GetAuditStats() (*AuditStats, error) {
-	var s AuditStats
-	err := db.QueryRow(`
-		SELECT
-			COUNT(*),
-			SUM(CASE WHEN active=1 AND total_paid_msats>0 THEN 1 ELSE 0 END),
-			COALESCE(SUM(CASE WHEN active=1 THEN total_paid_msats ELSE 0 END), 0),
-			COALESCE(SUM(CASE WHEN deactivation_reason='claimed' THEN 1 ELSE 0 END), 0),
-			COALESCE(SUM(CASE WHEN deactivation_reason='claimed' THEN deactivated_msats ELSE 0 END), 0),
-			COALESCE(SUM(CASE WHEN deactivation_reason='refunded' THEN 1 ELSE 0 END), 0),
-			COALESCE(SUM(CASE WHEN deactivation_reason='refunded' THEN deactivated_msats ELSE 0 END), 0)
-		FROM vouchers
-	`).Scan(
-		&s.TotalVoucherCount, &s.FundedVoucherCount, &s.TotalLockedMsats,
-		&s.ClaimedCount, &s.ClaimedMsats,
-		&s.RefundedCount, &s.RefundedMsats,
+// SetForwardRetry records a forward voucher's consecutive failures and when
+// to try again; zero failures and a nil retryAt clear the backoff.
+func (db *DB) SetForwardRetry(payID string, failures int, retryAt *time.Time) error {
+	var at sql.NullTime
+	if retryAt != nil {
+		at = sql.NullTime{Time: retryAt.UTC(), Valid: true}
+	}
+	_, err := db.Exec(
+		`UPDATE vouchers SET forward_failures=?, forward_retry_at=? WHERE pay_id=?`,
+		failures, at, payID,
 	)
-	return &s, err
+	return err
 }
 
-// ── Pay Invoices ──────────────────────────────────────────────────────────────
+// ── Tip Pools ─────────────────────────────────────────────────────────────────
+//
+// A pool voucher's balance is periodically allocated to its batch's members
+// in proportion to their weights. Allocated shares move from the voucher into
+// each member's owed_msats and are paid out from there in whole sats, so a
+// member whose payment fails or whose share is still too small keeps it.
 
-// PayInvoice represents a single funding transaction for a voucher.
-type PayInvoice struct {
-	PayID         string
-	AmountMsats   int64
-	CreditedMsats int64
-	PaidAt        time.Time
+// PoolMember is one recipient of a tip pool.
+type PoolMember struct {
+	ID        int64  `json:"id"`
+	Address   string `json:"address"`
+	Weight    int64  `json:"weight"`
+	OwedMsats int64  `json:"owed_msats"`
 }
 
-func (db *DB) GetPaidInvoicesByPayID(payID string) ([]*PayInvoice, error) {
-	rows, err := db.Query(
-		`SELECT pay_id, amount_msats, credited_msats, paid_at
-		 FROM pay_invoices WHERE pay_id=? AND paid=1 ORDER BY paid_at`,
-		payID,
-	)
+// PoolPayout is one payment to a pool member.
+type PoolPayout struct {
+	ID          int64      `json:"id"`
+	MemberID    int64      `json:"member_id"`
+	Address     string     `json:"address"`
+	AmountMsats int64      `json:"amount_msats"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SettledAt   *time.Time `json:"settled_at,omitempty"`
+}
+
+// GetPoolMembers returns a batch's pool members in the order they were added.
+func (db *DB) GetPoolMembers(batchID string) ([]PoolMember, error) {
+	return getPoolMembers(db, `WHERE batch_id=?`, batchID)
+}
+
+// GetPayablePoolMembers returns the members owed at least one whole sat.
+func (db *DB) GetPayablePoolMembers() ([]PoolMember, error) {
+	return getPoolMembers(db, `WHERE owed_msats>=1000`)
+}
+
+func getPoolMembers(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, where string, args ...any) ([]PoolMember, error) {
+	rows, err := q.Query(`SELECT id, address, weight, owed_msats FROM pool_members `+where+` ORDER BY id`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var result []*PayInvoice
+	var members []PoolMember
 	for rows.Next() {
-		var inv PayInvoice
-		if err := rows.Scan(&inv.PayID, &inv.AmountMsats, &inv.CreditedMsats, &inv.PaidAt); err != nil {
+		var m PoolMember
+		if err := rows.Scan(&m.ID, &m.Address, &m.Weight, &m.OwedMsats); err != nil {
 			return nil, err
 		}
-		result = append(result, &inv)
+		members = append(members, m)
 	}
-	return result, rows.Err()
-}
-
-func (db *DB) InsertPayInvoice(id, payID, paymentHash string, amountMsats, creditedMsats int64) error {
-	_, err := db.Exec(
-		`INSERT INTO pay_invoices (id, pay_id, payment_hash, amount_msats, credited_msats)
-		 VALUES (?, ?, ?, ?, ?)`,
-		id, payID, paymentHash, amountMsats, creditedMsats,
-	)
-	return err
+	return members, rows.Err()
 }
 
-// ── Withdraw Sessions ─────────────────────────────────────────────────────────
-
-func (db *DB) InsertWithdrawSession(k1, withdrawID string) error {
-	_, err := db.Exec(
-		`INSERT INTO withdraw_sessions (k1, withdraw_id) VALUES (?, ?)`,
-		k1, withdrawID,
+// GetDistributablePools returns active pool vouchers holding a balance.
+func (db *DB) GetDistributablePools() ([]*Voucher, error) {
+	rows, err := db.Query(
+		`SELECT ` + voucherColumns + ` FROM vouchers WHERE active=1 AND kind='pool' AND total_paid_msats>0`,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanVouchers(rows)
 }
 
-// ValidateAndUseWithdrawSession checks k1 is unused and belongs to withdrawID,
-// marks it used, and returns the associated payID — all in one transaction.
-func (db *DB) ValidateAndUseWithdrawSession(k1, withdrawID string) (payID string, err error) {
+// AllocatePool splits a pool voucher's current balance between its batch's
+// members by weight and moves each share into the member's owed balance.
+// Rounding remainders stay on the voucher for the next distribution and are
+// recorded with the distribution. It returns the amount allocated.
+func (db *DB) AllocatePool(payID string) (int64, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 	defer tx.Rollback()
 
-	// Verify k1 belongs to this withdraw_id and is unused.
-	var used int
-	var storedWithdrawID string
+	var batchID string
+	var balance int64
 	if err := tx.QueryRow(
-		`SELECT withdraw_id, used FROM withdraw_sessions WHERE k1=?`, k1,
-	).Scan(&storedWithdrawID, &used); err != nil {
-		return "", fmt.Errorf("k1 not found")
+		`SELECT COALESCE(batch_id, ''), total_paid_msats FROM vouchers WHERE pay_id=? AND active=1 AND kind='pool'`+tx.dialect.lockRows,
+		payID,
+	).Scan(&batchID, &balance); err != nil {
+		return 0, err
 	}
-	if storedWithdrawID != withdrawID {
-		return "", fmt.Errorf("k1 mismatch")
+	members, err := getPoolMembers(tx, `WHERE batch_id=?`, batchID)
+	if err != nil {
+		return 0, err
 	}
-	if used != 0 {
-		return "", fmt.Errorf("k1 already used")
+	var totalWeight int64
+	for _, m := range members {
+		totalWeight += m.Weight
+	}
+	if balance <= 0 || totalWeight <= 0 {
+		return 0, nil
 	}
 
-	// Mark k1 used.
+	var allocated int64
+	var entries []LedgerEntry
+	for _, m := range members {
+		share := balance * m.Weight / totalWeight
+		if share == 0 {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE pool_members SET owed_msats=owed_msats+? WHERE id=?`, share, m.ID); err != nil {
+			return 0, err
+		}
+		entries = append(entries, LedgerEntry{poolMemberAccount(m.ID), -share})
+		allocated += share
+	}
+	if allocated == 0 {
+		return 0, nil
+	}
+	entries = append(entries, LedgerEntry{voucherAccount(payID), allocated})
+	if err := PostLedgerTx(tx, LedgerPoolAllocation, payID, entries...); err != nil {
+		return 0, err
+	}
 	if _, err := tx.Exec(
-		`UPDATE withdraw_sessions SET used=1, used_at=CURRENT_TIMESTAMP WHERE k1=?`, k1,
+		`UPDATE vouchers SET total_paid_msats=total_paid_msats-?, last_withdrawn_at=CURRENT_TIMESTAMP WHERE pay_id=?`,
+		allocated, payID,
 	); err != nil {
-		return "", err
+		return 0, err
 	}
+	if _, err := tx.Exec(
+		`INSERT INTO pool_distributions (pay_id, balance_msats, allocated_msats, remainder_msats) VALUES (?, ?, ?, ?)`,
+		payID, balance, allocated, balance-allocated,
+	); err != nil {
+		return 0, err
+	}
+	return allocated, tx.Commit()
+}
 
-	// Get the pay_id for the voucher.
+// StartPoolPayout debits msats from a member's owed balance and records a
+// pending payout, returning its id.
+func (db *DB) StartPoolPayout(memberID, msats int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE pool_members SET owed_msats=owed_msats-? WHERE id=? AND owed_msats>=?`,
+		msats, memberID, msats,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrInsufficientBalance
+	}
+	var id int64
 	if err := tx.QueryRow(
-		`SELECT pay_id FROM vouchers WHERE withdraw_id=?`, withdrawID,
-	).Scan(&payID); err != nil {
-		return "", fmt.Errorf("voucher not found for withdraw_id")
+		`INSERT INTO pool_payouts (member_id, amount_msats) VALUES (?, ?) RETURNING id`, memberID, msats,
+	).Scan(&id); err != nil {
+		return 0, err
+	}
+	if err := PostLedgerTx(tx, LedgerPoolPayout, fmt.Sprintf("pool_payout:%d", id),
+		LedgerEntry{poolMemberAccount(memberID), msats},
+		LedgerEntry{AccountLightning, -msats},
+	); err != nil {
+		return 0, err
 	}
+	return id, tx.Commit()
+}
 
-	return payID, tx.Commit()
+// SettlePoolPayout marks a pending payout paid or, if the payment
+// definitively failed, records why and returns the amount to the member.
+func (db *DB) SettlePoolPayout(id int64, payErr error) error {
+	if payErr == nil {
+		_, err := db.Exec(
+			`UPDATE pool_payouts SET status='paid', settled_at=CURRENT_TIMESTAMP WHERE id=? AND status='pending'`, id,
+		)
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var memberID, msats int64
+	if err := tx.QueryRow(
+		`UPDATE pool_payouts SET status='failed', error=?, settled_at=CURRENT_TIMESTAMP
+		 WHERE id=? AND status='pending' RETURNING member_id, amount_msats`,
+		payErr.Error(), id,
+	).Scan(&memberID, &msats); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE pool_members SET owed_msats=owed_msats+? WHERE id=?`, msats, memberID); err != nil {
+		return err
+	}
+	if err := PostLedgerTx(tx, LedgerPoolReversal, fmt.Sprintf("pool_payout:%d", id),
+		LedgerEntry{AccountLightning, msats},
+		LedgerEntry{poolMemberAccount(memberID), -msats},
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPoolPayouts returns a batch's most recent pool payouts, newest first.
+func (db *DB) GetPoolPayouts(batchID string, limit int) ([]PoolPayout, error) {
+	rows, err := db.Query(
+		`SELECT p.id, p.member_id, m.address, p.amount_msats, p.status, p.error, p.created_at, p.settled_at
+		 FROM pool_payouts p JOIN pool_members m ON m.id=p.member_id
+		 WHERE m.batch_id=? ORDER BY p.id DESC LIMIT ?`,
+		batchID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payouts []PoolPayout
+	for rows.Next() {
+		var p PoolPayout
+		var settled sql.NullTime
+		if err := rows.Scan(&p.ID, &p.MemberID, &p.Address, &p.AmountMsats, &p.Status, &p.Error, &p.CreatedAt, &settled); err != nil {
+			return nil, err
+		}
+		if settled.Valid {
+			p.SettledAt = &settled.Time
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+// ── Audit ─────────────────────────────────────────────────────────────────────
+
+type AuditStats struct {
+	TotalVoucherCount   int
+	FundedVoucherCount  int
+	TotalLockedMsats    int64
+	ClaimedCount        int
+	ClaimedMsats        int64
+	RefundedCount       int
+	RefundedMsats       int64
+}
+
+func (db *DB) GetAuditStats() (*AuditStats, error) {
+	var s AuditStats
+	err := db.QueryRow(`
+		SELECT
+			COUNT(*),
+			SUM(CASE WHEN active=1 AND total_paid_msats>0 THEN 1 ELSE 0 END),
+			COALESCE(SUM(CASE WHEN active=1 THEN total_paid_msats ELSE 0 END), 0)
+				+ (SELECT COALESCE(SUM(owed_msats), 0) FROM pool_members),
+			COALESCE(SUM(CASE WHEN deactivation_reason='claimed' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN deactivation_reason='claimed' THEN deactivated_msats ELSE 0 END), 0)
+				+ (SELECT COALESCE(SUM(amount_msats), 0) FROM voucher_withdrawals WHERE status!='failed')
+				+ (SELECT COALESCE(SUM(amount_msats), 0) FROM pool_payouts WHERE status!='failed'),
+			COALESCE(SUM(CASE WHEN deactivation_reason IN ('refunded','split_on_expiry') THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE
+				WHEN deactivation_reason='refunded' THEN deactivated_msats
+				WHEN deactivation_reason='split_on_expiry' THEN deactivated_msats - (
+					SELECT COALESCE(SUM(amount_msats), 0) FROM charity_payouts c
+					WHERE c.pay_id=vouchers.pay_id AND c.source='expiry' AND c.status!='cancelled')
+				ELSE 0 END), 0)
+		FROM vouchers
+	`).Scan(
+		&s.TotalVoucherCount, &s.FundedVoucherCount, &s.TotalLockedMsats,
+		&s.ClaimedCount, &s.ClaimedMsats,
+		&s.RefundedCount, &s.RefundedMsats,
+	)
+	return &s, err
+}
+
+// ── Charity Payouts ───────────────────────────────────────────────────────────
+//
+// charity_payouts is the charity-payable ledger: amounts owed to a configured
+// charity accrue as pending rows and are paid out in aggregate.
+
+// InsertCharityPayoutTx records an amount owed to a charity inside a
+// transaction. status is pending, or paid for amounts sent directly.
+// A pending amount is moved from the node's funds into the charity payable.
+func InsertCharityPayoutTx(tx *Tx, charity, payID, source, status string, msats int64) error {
+	if _, err := tx.Exec(
+		`INSERT INTO charity_payouts (charity, pay_id, source, amount_msats, status, paid_at)
+		 VALUES (?, ?, ?, ?, ?, CASE WHEN ?='paid' THEN CURRENT_TIMESTAMP END)`,
+		charity, payID, source, msats, status, status,
+	); err != nil {
+		return err
+	}
+	if status != "pending" {
+		return nil
+	}
+	return PostLedgerTx(tx, LedgerCharityAccrual, payID,
+		LedgerEntry{AccountLightning, msats},
+		LedgerEntry{charityAccount(charity), -msats},
+	)
+}
+
+// CancelPendingCharityPayoutsTx cancels a voucher's not-yet-paid payouts from source.
+func CancelPendingCharityPayoutsTx(tx *Tx, payID, source string) error {
+	rows, err := tx.Query(
+		`UPDATE charity_payouts SET status='cancelled' WHERE pay_id=? AND source=? AND status='pending'
+		 RETURNING charity, amount_msats`,
+		payID, source,
+	)
+	if err != nil {
+		return err
+	}
+	var entries []LedgerEntry
+	for rows.Next() {
+		var charity string
+		var msats int64
+		if err := rows.Scan(&charity, &msats); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, LedgerEntry{charityAccount(charity), msats}, LedgerEntry{AccountLightning, -msats})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return PostLedgerTx(tx, LedgerCharityCancel, payID, entries...)
+}
+
+// PendingCharityPayouts lists the charities with pending payouts and the ids of those rows.
+func (db *DB) PendingCharityPayouts() (map[string][]int64, error) {
+	rows, err := db.Query(`SELECT charity, id FROM charity_payouts WHERE status='pending' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := map[string][]int64{}
+	for rows.Next() {
+		var charity string
+		var id int64
+		if err := rows.Scan(&charity, &id); err != nil {
+			return nil, err
+		}
+		result[charity] = append(result[charity], id)
+	}
+	return result, rows.Err()
+}
+
+// SetCharityPayoutsStatus moves payout rows between statuses (pending/paid)
+// and returns their total. Rows not currently in from are left alone.
+func (db *DB) SetCharityPayoutsStatus(ids []int64, from, to string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, id := range ids {
+		var charity string
+		var msats int64
+		err := tx.QueryRow(
+			`UPDATE charity_payouts SET status=?, paid_at=CASE WHEN ?='paid' THEN CURRENT_TIMESTAMP ELSE NULL END
+			 WHERE id=? AND status=? RETURNING charity, amount_msats`,
+			to, to, id, from,
+		).Scan(&charity, &msats)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Paying out settles the payable; restoring a failed payout reopens it.
+		kind, sign := LedgerCharityPayout, int64(1)
+		if to == "pending" {
+			kind, sign = LedgerCharityReversal, -1
+		}
+		if err := PostLedgerTx(tx, kind, fmt.Sprintf("charity_payout:%d", id),
+			LedgerEntry{charityAccount(charity), sign * msats},
+			LedgerEntry{AccountLightning, -sign * msats},
+		); err != nil {
+			return 0, err
+		}
+		total += msats
+	}
+	return total, tx.Commit()
+}
+
+// CharityTotals summarises what has been paid and is owed to one charity.
+type CharityTotals struct {
+	Charity      string
+	FundingMsats int64 // accrued from funding splits
+	ExpiryMsats  int64 // accrued from expired balances
+	ClaimMsats   int64 // donated by recipients claiming their voucher
+	PaidMsats    int64
+	PendingMsats int64
+}
+
+func (db *DB) GetCharityTotals() ([]*CharityTotals, error) {
+	rows, err := db.Query(`
+		SELECT charity,
+		       COALESCE(SUM(CASE WHEN source='funding' THEN amount_msats ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN source='expiry' THEN amount_msats ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN source='claim' THEN amount_msats ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN status='paid' THEN amount_msats ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN status='pending' THEN amount_msats ELSE 0 END), 0)
+		FROM charity_payouts WHERE status!='cancelled'
+		GROUP BY charity ORDER BY charity`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*CharityTotals
+	for rows.Next() {
+		var t CharityTotals
+		if err := rows.Scan(&t.Charity, &t.FundingMsats, &t.ExpiryMsats, &t.ClaimMsats, &t.PaidMsats, &t.PendingMsats); err != nil {
+			return nil, err
+		}
+		result = append(result, &t)
+	}
+	return result, rows.Err()
+}
+
+// ── Pay Invoices ──────────────────────────────────────────────────────────────
+
+// PayInvoice represents a single funding transaction for a voucher.
+type PayInvoice struct {
+	PayID         string
+	AmountMsats   int64
+	CreditedMsats int64
+	CharityMsats  int64
+	FiatCents     int64 // credited amount in the batch currency when the invoice was created
+	Quote         *PayQuote
+	PaidAt        time.Time
+}
+
+// PayQuote records the conversion of a payment requested in fiat (LUD-21).
+type PayQuote struct {
+	Currency string
+	Amount   int64   // hundredths of Currency
+	BTCPrice float64 // price of one bitcoin in Currency
+	Msats    int64
+}
+
+func (db *DB) GetPaidInvoicesByPayID(payID string) ([]*PayInvoice, error) {
+	rows, err := db.Query(
+		`SELECT pay_id, amount_msats, credited_msats, charity_msats, fiat_cents,
+		        quote_currency, quote_amount, quote_btc_price, paid_at
+		 FROM pay_invoices WHERE pay_id=? AND paid=1 ORDER BY paid_at`,
+		payID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*PayInvoice
+	for rows.Next() {
+		var inv PayInvoice
+		var q PayQuote
+		if err := rows.Scan(&inv.PayID, &inv.AmountMsats, &inv.CreditedMsats, &inv.CharityMsats, &inv.FiatCents,
+			&q.Currency, &q.Amount, &q.BTCPrice, &inv.PaidAt); err != nil {
+			return nil, err
+		}
+		if q.Currency != "" {
+			q.Msats = inv.AmountMsats
+			inv.Quote = &q
+		}
+		result = append(result, &inv)
+	}
+	return result, rows.Err()
+}
+
+// InsertPayInvoice records a funding invoice; quote is nil unless the amount was requested in fiat.
+func (db *DB) InsertPayInvoice(id, payID, paymentHash string, amountMsats, creditedMsats, charityMsats, fiatCents int64, quote *PayQuote) error {
+	var q PayQuote
+	if quote != nil {
+		q = *quote
+	}
+	_, err := db.Exec(
+		`INSERT INTO pay_invoices (id, pay_id, payment_hash, amount_msats, credited_msats, charity_msats, fiat_cents,
+		                           quote_currency, quote_amount, quote_btc_price)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, payID, paymentHash, amountMsats, creditedMsats, charityMsats, fiatCents,
+		q.Currency, q.Amount, q.BTCPrice,
+	)
+	return err
+}
+
+// ── Withdraw Sessions ─────────────────────────────────────────────────────────
+
+func (db *DB) InsertWithdrawSession(k1, withdrawID string) error {
+	_, err := db.Exec(
+		`INSERT INTO withdraw_sessions (k1, withdraw_id) VALUES (?, ?)`,
+		k1, withdrawID,
+	)
+	return err
+}
+
+// DeleteExpiredWithdrawSessions deletes withdraw sessions, used or not, opened
+// longer than ttl ago, and returns how many there were.
+func (db *DB) DeleteExpiredWithdrawSessions(ttl time.Duration) (int64, error) {
+	res, err := db.Exec(
+		`DELETE FROM withdraw_sessions WHERE `+db.dialect.epoch("created_at")+` < ?`,
+		time.Now().Add(-ttl).Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ErrPinLocked is returned by CheckVoucherPIN while a voucher is locked out.
+var ErrPinLocked = errors.New("too many wrong PIN attempts")
+
+// CheckVoucherPIN compares pin against the voucher's PIN hash. A correct PIN
+// clears the failure and lockout counts and opens a PIN-verified withdraw
+// session under k1. A wrong PIN counts towards a lockout: once maxAttempts is
+// reached the voucher is locked, for lockout the first time and twice as long
+// each time after, up to maxLockout. A voucher is never locked for good, so
+// whoever holds its QR can't spoil it by guessing on purpose. It returns the
+// attempts left before the next lockout.
+func (db *DB) CheckVoucherPIN(withdrawID, pin, k1 string, maxAttempts int, lockout, maxLockout time.Duration) (ok bool, attemptsLeft int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	var stored sql.NullString
+	var failures, lockouts int
+	var lockedUntil sql.NullTime
+	if err := tx.QueryRow(
+		`SELECT pin, pin_failures, pin_locked_until, pin_lockouts FROM vouchers WHERE withdraw_id=?`+tx.dialect.lockRows, withdrawID,
+	).Scan(&stored, &failures, &lockedUntil, &lockouts); err != nil {
+		return false, 0, err
+	}
+	if !stored.Valid {
+		return false, 0, fmt.Errorf("voucher is not PIN protected")
+	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return false, 0, ErrPinLocked
+	}
+
+	if pinMatches(stored.String, pin) {
+		if _, err := tx.Exec(
+			`UPDATE vouchers SET pin_failures=0, pin_lockouts=0, pin_locked_until=NULL WHERE withdraw_id=?`, withdrawID,
+		); err != nil {
+			return false, 0, err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO withdraw_sessions (k1, withdraw_id, pin_verified) VALUES (?, ?, 1)`, k1, withdrawID,
+		); err != nil {
+			return false, 0, err
+		}
+		return true, maxAttempts, tx.Commit()
+	}
+
+	failures++
+	var locked any
+	if failures >= maxAttempts {
+		failures = 0
+		lockouts++
+		locked = time.Now().Add(min(lockout<<min(lockouts-1, 16), maxLockout)).UTC()
+	}
+	if _, err := tx.Exec(
+		`UPDATE vouchers SET pin_failures=?, pin_lockouts=?, pin_locked_until=? WHERE withdraw_id=?`,
+		failures, lockouts, locked, withdrawID,
+	); err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	if locked != nil {
+		return false, 0, ErrPinLocked
+	}
+	return false, maxAttempts - failures, nil
+}
+
+// hashPIN returns a salted hash of pin, as hex(salt):hex(sha256(salt+pin)).
+// With only 10000 four-digit PINs, anyone holding the hash can find the PIN
+// by trying them all, however slow the hash. It only keeps PINs out of sight
+// in the database and its backups; the lockouts in CheckVoucherPIN are what
+// protect them.
+func hashPIN(pin string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(pinDigest(salt, pin)), nil
+}
+
+// pinMatches reports, in constant time, whether pin hashes to stored.
+func pinMatches(stored, pin string) bool {
+	saltHex, digestHex, ok := strings.Cut(stored, ":")
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pinDigest(salt, pin), digest) == 1
+}
+
+func pinDigest(salt []byte, pin string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(pin))
+	return h.Sum(nil)
+}
+
+// GetPinSession reports whether k1 is an unused PIN-verified session for
+// withdrawID that is younger than ttl.
+func (db *DB) GetPinSession(k1, withdrawID string, ttl time.Duration) (bool, error) {
+	var used, verified int
+	var createdAt time.Time
+	err := db.QueryRow(
+		`SELECT used, pin_verified, created_at FROM withdraw_sessions WHERE k1=? AND withdraw_id=?`, k1, withdrawID,
+	).Scan(&used, &verified, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return used == 0 && verified == 1 && time.Since(createdAt) < ttl, nil
+}
+
+// InsertBoltcardSession opens a withdraw session for a verified boltcard tap.
+func (db *DB) InsertBoltcardSession(k1, withdrawID, cardID string) error {
+	_, err := db.Exec(
+		`INSERT INTO withdraw_sessions (k1, withdraw_id, card_id) VALUES (?, ?, ?)`,
+		k1, withdrawID, cardID,
+	)
+	return err
+}
+
+// ValidateAndUseWithdrawSession checks k1 is unused and belongs to withdrawID
+// and, for boltcard sessions, to cardID ("" for any other session). It marks
+// k1 used and returns the associated payID — all in one transaction.
+func (db *DB) ValidateAndUseWithdrawSession(k1, withdrawID, cardID string) (payID string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Verify k1 belongs to this withdraw_id and is unused.
+	var used, pinVerified int
+	var storedWithdrawID, storedCardID string
+	var createdAt time.Time
+	if err := tx.QueryRow(
+		`SELECT withdraw_id, card_id, used, pin_verified, created_at FROM withdraw_sessions WHERE k1=?`+tx.dialect.lockRows, k1,
+	).Scan(&storedWithdrawID, &storedCardID, &used, &pinVerified, &createdAt); err != nil {
+		return "", fmt.Errorf("k1 not found")
+	}
+	if storedWithdrawID != withdrawID || storedCardID != cardID {
+		return "", fmt.Errorf("k1 mismatch")
+	}
+	if used != 0 {
+		return "", fmt.Errorf("k1 already used")
+	}
+	if time.Since(createdAt) >= time.Duration(cfg.WithdrawSessionSecs)*time.Second {
+		return "", fmt.Errorf("k1 expired")
+	}
+
+	// PIN-protected vouchers only accept sessions opened with the PIN.
+	var pin sql.NullString
+	if err := tx.QueryRow(
+		`SELECT pin FROM vouchers WHERE withdraw_id=?`, withdrawID,
+	).Scan(&pin); err != nil {
+		return "", fmt.Errorf("voucher not found for withdraw_id")
+	}
+	if pin.Valid && (pinVerified == 0 || time.Since(createdAt) >= time.Duration(cfg.PinSessionSecs)*time.Second) {
+		return "", fmt.Errorf("PIN required")
+	}
+
+	// Mark k1 used.
+	if _, err := tx.Exec(
+		`UPDATE withdraw_sessions SET used=1, used_at=CURRENT_TIMESTAMP WHERE k1=?`, k1,
+	); err != nil {
+		return "", err
+	}
+
+	// Get the pay_id for the voucher.
+	if err := tx.QueryRow(
+		`SELECT pay_id FROM vouchers WHERE withdraw_id=?`, withdrawID,
+	).Scan(&payID); err != nil {
+		return "", fmt.Errorf("voucher not found for withdraw_id")
+	}
+
+	return payID, tx.Commit()
+}
+
+// ── Boltcards ────────────────────────────────────────────────────────────────
+
+// Boltcard is an NTAG 424 DNA card that withdraws from a voucher when tapped.
+type Boltcard struct {
+	CardID          string
+	PayID           string
+	Keys            [5]string // K0–K4, hex
+	UID             string    // learned from the first verified tap
+	Counter         uint32
+	DailyLimitMsats int64
+	Enabled         bool
+	CreatedAt       time.Time
+}
+
+// ErrBoltcardReplay is returned for a tap whose counter isn't above the last
+// accepted one, or whose UID doesn't match the card's.
+var ErrBoltcardReplay = errors.New("card tap already used")
+
+func (db *DB) InsertBoltcard(c *Boltcard) error {
+	_, err := db.Exec(
+		`INSERT INTO boltcards (card_id, pay_id, k0, k1, k2, k3, k4, daily_limit_msats) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.CardID, c.PayID, c.Keys[0], c.Keys[1], c.Keys[2], c.Keys[3], c.Keys[4], c.DailyLimitMsats,
+	)
+	return err
+}
+
+func (db *DB) GetBoltcard(cardID string) (*Boltcard, error) {
+	c := &Boltcard{}
+	var enabled int
+	err := db.QueryRow(
+		`SELECT card_id, pay_id, k0, k1, k2, k3, k4, uid, counter, daily_limit_msats, enabled, created_at
+		 FROM boltcards WHERE card_id=?`, cardID,
+	).Scan(&c.CardID, &c.PayID, &c.Keys[0], &c.Keys[1], &c.Keys[2], &c.Keys[3], &c.Keys[4],
+		&c.UID, &c.Counter, &c.DailyLimitMsats, &enabled, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Enabled = enabled == 1
+	return c, nil
+}
+
+// DisableBoltcard stops a card of the voucher payID from being used again.
+func (db *DB) DisableBoltcard(payID, cardID string) error {
+	res, err := db.Exec(`UPDATE boltcards SET enabled=0 WHERE card_id=? AND pay_id=?`, cardID, payID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RecordBoltcardTap accepts a verified tap if its counter is above the last
+// one accepted and its UID matches the card's, remembering the UID on the
+// first tap.
+func (db *DB) RecordBoltcardTap(cardID, uid string, counter uint32) error {
+	res, err := db.Exec(
+		`UPDATE boltcards SET counter=?, uid=?
+		 WHERE card_id=? AND enabled=1 AND counter<? AND (uid='' OR uid=?)`,
+		counter, uid, cardID, counter, uid,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBoltcardReplay
+	}
+	return nil
+}
+
+// BoltcardSpent returns what a card has withdrawn in the last 24 hours,
+// counting pending withdrawals.
+func (db *DB) BoltcardSpent(cardID string) (int64, error) {
+	return boltcardSpent(db, cardID)
+}
+
+func boltcardSpent(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, cardID string) (int64, error) {
+	var spent int64
+	err := q.QueryRow(
+		`SELECT COALESCE(SUM(amount_msats), 0) FROM voucher_withdrawals
+		 WHERE card_id=? AND status!='failed' AND created_at > ?`, cardID, time.Now().UTC().Add(-24*time.Hour),
+	).Scan(&spent)
+	return spent, err
+}
+
+// ── Webhooks ─────────────────────────────────────────────────────────────────
+//
+// Events are written to webhook_deliveries, one row per matching
+// subscription, in the same transaction as the change they describe where
+// there is one. The row is the outbox: the webhook worker delivers it,
+// retrying with backoff until it succeeds or is given up on as dead.
+
+// WebhookSubscription receives the events of one batch, or of every batch if
+// BatchID is empty.
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	BatchID   string    `json:"batch_id,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"` // empty for all
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	URL            string          `json:"url"`
+	Secret         string          `json:"-"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"` // pending, delivered or dead
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatus     int             `json:"last_status"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+func (db *DB) InsertWebhookSubscription(s *WebhookSubscription) error {
+	_, err := db.Exec(
+		`INSERT INTO webhook_subscriptions (id, batch_id, url, secret, events) VALUES (?, ?, ?, ?, ?)`,
+		s.ID, s.BatchID, s.URL, s.Secret, strings.Join(s.Events, ","),
+	)
+	return err
+}
+
+// GetWebhookSubscriptions returns the active subscriptions of a batch, or
+// the global ones if batchID is empty. Secrets are left out.
+func (db *DB) GetWebhookSubscriptions(batchID string) ([]WebhookSubscription, error) {
+	rows, err := db.Query(
+		`SELECT id, batch_id, url, events, created_at FROM webhook_subscriptions
+		 WHERE active=1 AND batch_id=? ORDER BY created_at`, batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		var events string
+		if err := rows.Scan(&s.ID, &s.BatchID, &s.URL, &events, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.Events = []string{}
+		if events != "" {
+			s.Events = strings.Split(events, ",")
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteWebhookSubscription deactivates a subscription of batchID ("" for a
+// global one). Deliveries still queued for it are not sent.
+func (db *DB) DeleteWebhookSubscription(id, batchID string) error {
+	res, err := db.Exec(
+		`UPDATE webhook_subscriptions SET active=0 WHERE id=? AND batch_id=? AND active=1`, id, batchID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnqueueEventTx queues an event for every subscription that wants it: the
+// global ones and those of its batch. If batchID is empty it is looked up
+// from payID.
+func EnqueueEventTx(tx *Tx, eventType, batchID, payID string, data map[string]any) error {
+	if batchID == "" && payID != "" {
+		var b sql.NullString
+		if err := tx.QueryRow(`SELECT batch_id FROM vouchers WHERE pay_id=?`, payID).Scan(&b); err != nil {
+			return err
+		}
+		batchID = b.String
+	}
+	now := time.Now().UTC()
+	eventID := uuid.New().String()
+	payload, err := json.Marshal(map[string]any{
+		"id":         eventID,
+		"type":       eventType,
+		"created_at": now.Format(time.RFC3339),
+		"batch_id":   batchID,
+		"pay_id":     payID,
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, next_attempt_at)
+		 SELECT id, ?, ?, ?, ? FROM webhook_subscriptions
+		 WHERE active=1 AND (batch_id='' OR batch_id=?) AND (events='' OR ','||events||',' LIKE ?)`,
+		eventID, eventType, string(payload), now, batchID, "%,"+eventType+",%",
+	)
+	if err != nil {
+		return err
+	}
+	return queueOwnerEmailTx(tx, eventType, batchID, payID, data)
+}
+
+// EnqueueEvent is EnqueueEventTx in its own transaction.
+func (db *DB) EnqueueEvent(eventType, batchID, payID string, data map[string]any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := EnqueueEventTx(tx, eventType, batchID, payID, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = `d.id, d.subscription_id, s.url, s.secret, d.event_id, d.event_type, d.payload, d.status,
+	d.attempts, d.next_attempt_at, d.last_status, d.last_error, d.created_at, d.delivered_at`
+
+// ClaimDueWebhookDeliveries claims up to limit pending deliveries whose next
+// attempt is due, oldest first, for the next lease (see claimDue).
+func (db *DB) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ids, err := claimDue(tx, "webhook_deliveries", lease,
+		`SELECT id FROM webhook_deliveries
+		 WHERE status='pending' AND next_attempt_at <= ?
+		   AND subscription_id IN (SELECT id FROM webhook_subscriptions WHERE active=1)
+		 ORDER BY id LIMIT ?`,
+		time.Now().UTC(), limit,
+	)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	deliveries, err := queryWebhookDeliveries(tx, `WHERE d.id IN (`+placeholders(len(ids))+`) ORDER BY d.id`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, tx.Commit()
+}
+
+// claimDue claims the outbox rows of table that query selects, by moving
+// their next attempt a lease into the future, and returns their ids. Other
+// workers pass over claimed rows, even before tx commits, until the lease
+// runs out; that only happens if the claimer dies before recording its
+// attempt, as recording it sets the next attempt afresh.
+func claimDue(tx *Tx, table string, lease time.Duration, query string, args ...any) ([]any, error) {
+	rows, err := tx.Query(query+tx.dialect.skipLocked, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	until := time.Now().Add(lease).UTC()
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE `+table+` SET next_attempt_at=? WHERE id=?`, until, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// placeholders returns n comma-separated placeholders, for an IN list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// GetWebhookDeliveries returns the most recent deliveries, optionally only
+// those with status.
+func (db *DB) GetWebhookDeliveries(status string, limit int) ([]WebhookDelivery, error) {
+	return queryWebhookDeliveries(db,
+		`WHERE (?='' OR d.status=?) ORDER BY d.id DESC LIMIT ?`, status, status, limit,
+	)
+}
+
+func queryWebhookDeliveries(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, where string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := q.Query(
+		`SELECT `+webhookDeliveryColumns+`
+		 FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id=d.subscription_id `+where, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.URL, &d.Secret, &d.EventID, &d.EventType, &payload, &d.Status,
+			&d.Attempts, &d.NextAttemptAt, &d.LastStatus, &d.LastError, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkWebhookDelivered records a successful delivery.
+func (db *DB) MarkWebhookDelivered(id int64, httpStatus int) error {
+	_, err := db.Exec(
+		`UPDATE webhook_deliveries SET status='delivered', attempts=attempts+1, last_status=?, last_error='',
+		 delivered_at=CURRENT_TIMESTAMP WHERE id=?`,
+		httpStatus, id,
+	)
+	return err
+}
+
+// MarkWebhookFailed records a failed attempt and when to try again; a nil
+// retryAt gives up and moves the delivery to the dead letters.
+func (db *DB) MarkWebhookFailed(id int64, httpStatus int, errMsg string, retryAt *time.Time) error {
+	status, next := "dead", time.Now().UTC()
+	if retryAt != nil {
+		status, next = "pending", retryAt.UTC()
+	}
+	_, err := db.Exec(
+		`UPDATE webhook_deliveries SET status=?, attempts=attempts+1, next_attempt_at=?, last_status=?, last_error=?
+		 WHERE id=?`,
+		status, next, httpStatus, errMsg, id,
+	)
+	return err
+}
+
+// PostponeWebhookDeliveries moves the next attempt of claimed deliveries to
+// at without counting an attempt, e.g. when their endpoint is down.
+func (db *DB) PostponeWebhookDeliveries(ids []int64, at time.Time) error {
+	args := []any{at.UTC()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := db.Exec(
+		`UPDATE webhook_deliveries SET next_attempt_at=? WHERE status='pending' AND id IN (`+placeholders(len(ids))+`)`, args...,
+	)
+	return err
+}
+
+// ReplayWebhookDelivery queues a delivery to be sent again straight away,
+// with a fresh set of attempts.
+func (db *DB) ReplayWebhookDelivery(id int64) error {
+	res, err := db.Exec(
+		`UPDATE webhook_deliveries SET status='pending', attempts=0, next_attempt_at=?, delivered_at=NULL WHERE id=?`,
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetWebhookDeliveryCounts returns the number of deliveries in each status.
+func (db *DB) GetWebhookDeliveryCounts() (map[string]int, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM webhook_deliveries GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// ── Expiry Reminders ─────────────────────────────────────────────────────────
+
+// RecordExpiryReminder records the reminder for v at leadSecs before
+// expiresAt and emits its voucher.expiring event. It returns false if that
+// reminder was already sent.
+func (db *DB) RecordExpiryReminder(v *Voucher, leadSecs int64, expiresAt time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`INSERT INTO voucher_reminders (pay_id, lead_seconds, expires_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		v.PayID, leadSecs, expiresAt.UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	err = EnqueueEventTx(tx, EventVoucherExpiring, v.BatchID, v.PayID, map[string]any{
+		"expires_at":    expiresAt.UTC(),
+		"balance_msats": v.TotalPaidMsats,
+		"lead_seconds":  leadSecs,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ── Email Outbox ─────────────────────────────────────────────────────────────
+
+// OutboxEmail is one rendered notification waiting to be sent.
+type OutboxEmail struct {
+	ID             int64
+	BatchID        string
+	To             string
+	Subject        string
+	Body           string
+	UnsubscribeURL string
+	Attempts       int
+}
+
+// EmailRecipient is who a batch's notifications go to, with what the
+// templates need to know about the batch.
+type EmailRecipient struct {
+	Address      string
+	Token        string
+	OptedOut     bool
+	BatchName    string
+	CreationHash string
+}
+
+// getEmailRecipientTx returns a batch's notification address ("" if it has none).
+func getEmailRecipientTx(tx *Tx, batchID string) (*EmailRecipient, error) {
+	var r EmailRecipient
+	err := tx.QueryRow(
+		`SELECT b.owner_email, b.email_token, b.email_opt_out, b.name, COALESCE(c.payment_hash, '')
+		 FROM batches b LEFT JOIN voucher_creation_requests c ON c.batch_id=b.id
+		 WHERE b.id=? LIMIT 1`, batchID,
+	).Scan(&r.Address, &r.Token, &r.OptedOut, &r.BatchName, &r.CreationHash)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func insertEmailTx(tx *Tx, e *OutboxEmail) error {
+	_, err := tx.Exec(
+		`INSERT INTO email_outbox (batch_id, to_addr, subject, body, unsubscribe_url, next_attempt_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		e.BatchID, e.To, e.Subject, e.Body, e.UnsubscribeURL, time.Now().UTC(),
+	)
+	return err
+}
+
+// ClaimDueEmails claims up to limit pending emails whose next attempt is due,
+// oldest first, for the next lease (see claimDue).
+func (db *DB) ClaimDueEmails(limit int, lease time.Duration) ([]OutboxEmail, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ids, err := claimDue(tx, "email_outbox", lease,
+		`SELECT id FROM email_outbox WHERE status='pending' AND next_attempt_at <= ? ORDER BY id LIMIT ?`,
+		time.Now().UTC(), limit,
+	)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	rows, err := tx.Query(
+		`SELECT id, batch_id, to_addr, subject, body, unsubscribe_url, attempts FROM email_outbox
+		 WHERE id IN (`+placeholders(len(ids))+`) ORDER BY id`, ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var emails []OutboxEmail
+	for rows.Next() {
+		var e OutboxEmail
+		if err := rows.Scan(&e.ID, &e.BatchID, &e.To, &e.Subject, &e.Body, &e.UnsubscribeURL, &e.Attempts); err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return emails, tx.Commit()
+}
+
+// MarkEmailSent records a sent email.
+func (db *DB) MarkEmailSent(id int64) error {
+	_, err := db.Exec(
+		`UPDATE email_outbox SET status='sent', attempts=attempts+1, last_error='', sent_at=CURRENT_TIMESTAMP WHERE id=?`, id,
+	)
+	return err
+}
+
+// MarkEmailFailed records a failed attempt and when to try again; a nil
+// retryAt gives up on the email.
+func (db *DB) MarkEmailFailed(id int64, errMsg string, retryAt *time.Time) error {
+	status, next := "dead", time.Now().UTC()
+	if retryAt != nil {
+		status, next = "pending", retryAt.UTC()
+	}
+	_, err := db.Exec(
+		`UPDATE email_outbox SET status=?, attempts=attempts+1, next_attempt_at=?, last_error=? WHERE id=?`,
+		status, next, errMsg, id,
+	)
+	return err
+}
+
+// UnsubscribeBatchEmail stops notifications for the batch whose email token
+// is token, cancelling any that haven't been sent yet.
+func (db *DB) UnsubscribeBatchEmail(token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var batchID string
+	if err := tx.QueryRow(
+		`UPDATE batches SET email_opt_out=1 WHERE email_token=? AND email_token!='' RETURNING id`, token,
+	).Scan(&batchID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE email_outbox SET status='cancelled' WHERE batch_id=? AND status='pending'`, batchID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ── Ledger ───────────────────────────────────────────────────────────────────
+//
+// ledger_entries is an append-only, double-entry journal of every msat the
+// service holds. A posting is a set of entries sharing a txn_id whose amounts
+// sum to zero: debits are positive and credits negative, so liabilities and
+// revenue carry negative balances. Postings are written in the same
+// transaction as the balance change they record, so vouchers.total_paid_msats,
+// pool_members.owed_msats and pending charity_payouts can always be derived
+// from, and checked against, the ledger.
+
+// Ledger accounts. Per-voucher, per-charity, per-pool-member and
+// per-operator-account liabilities are sub-accounts, see voucherAccount,
+// charityAccount, poolMemberAccount and creditAccount.
+const (
+	AccountLightning    = "assets:lightning" // funds held by blitzi
+	AccountCreationFees = "revenue:creation_fees"
+	AccountFundingFees  = "revenue:funding_fees"
+	AccountRouting      = "expenses:routing"
+	// AccountPayerRefunds holds payments for vouchers that closed while
+	// their invoice was open, until they are refunded to the payer.
+	AccountPayerRefunds = "liabilities:payer_refunds"
+)
+
+func voucherAccount(payID string) string { return "liabilities:vouchers:" + payID }
+func charityAccount(name string) string  { return "liabilities:charities:" + name }
+func poolMemberAccount(id int64) string  { return fmt.Sprintf("liabilities:pool_members:%d", id) }
+func creditAccount(id string) string     { return "liabilities:accounts:" + id }
+
+// Posting kinds, recorded with each entry.
+const (
+	LedgerOpeningBalance     = "opening_balance"
+	LedgerCreationFee        = "creation_fee"
+	LedgerFunding            = "funding"
+	LedgerLateFunding        = "late_funding" // paid into a voucher that had closed
+	LedgerPayerRefund        = "payer_refund"
+	LedgerClaim              = "claim"
+	LedgerRefund             = "refund"
+	LedgerDonation           = "donation"
+	LedgerReactivation       = "reactivation"
+	LedgerWithdrawal         = "withdrawal"
+	LedgerWithdrawalReversal = "withdrawal_reversal"
+	LedgerCharityAccrual     = "charity_accrual"
+	LedgerCharityCancel      = "charity_cancel"
+	LedgerCharityPayout      = "charity_payout"
+	LedgerCharityReversal    = "charity_payout_reversal"
+	LedgerPoolAllocation     = "pool_allocation"
+	LedgerPoolPayout         = "pool_payout"
+	LedgerPoolReversal       = "pool_payout_reversal"
+	LedgerRoutingFee         = "routing_fee"
+	LedgerAccountTopup       = "account_topup"
+	LedgerAccountSpend       = "account_spend" // paid from an operator account as if by invoice
+	LedgerAccountRefund      = "account_refund"
+)
+
+// deactivationKinds maps a voucher's deactivation reason to the posting kind
+// that records its balance leaving.
+var deactivationKinds = map[string]string{
+	"claimed":              LedgerClaim,
+	"timeout_assumed_paid": LedgerClaim,
+	"refunded":             LedgerRefund,
+	"split_on_expiry":      LedgerRefund,
+	"donated":              LedgerDonation,
+	"donated_on_expiry":    LedgerDonation,
+}
+
+// LedgerEntry is one leg of a posting. Msats is positive for a debit and
+// negative for a credit.
+type LedgerEntry struct {
+	Account string
+	Msats   int64
+}
+
+// PostLedgerTx writes a balanced posting of kind inside a transaction. ref
+// ties it to what caused it, e.g. a payment hash or withdrawal id.
+func PostLedgerTx(tx *Tx, kind, ref string, entries ...LedgerEntry) error {
+	var sum int64
+	for _, e := range entries {
+		sum += e.Msats
+	}
+	if sum != 0 {
+		return fmt.Errorf("unbalanced %s posting (ref=%s): off by %d msats", kind, ref, sum)
+	}
+	txnID := uuid.New().String()
+	for _, e := range entries {
+		if e.Msats == 0 {
+			continue
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO ledger_entries (txn_id, kind, account, amount_msats, ref) VALUES (?, ?, ?, ?, ?)`,
+			txnID, kind, e.Account, e.Msats, ref,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostLedger is PostLedgerTx in its own transaction.
+func (db *DB) PostLedger(kind, ref string, entries ...LedgerEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := PostLedgerTx(tx, kind, ref, entries...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// openLedgerTx posts opening balances for everything held before the ledger
+// existed, once, when the journal is still empty.
+func openLedgerTx(tx *Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM ledger_entries`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+
+	var entries []LedgerEntry
+	var total int64
+	collect := func(query string, account func(string) string) error {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			var msats int64
+			if err := rows.Scan(&key, &msats); err != nil {
+				return err
+			}
+			entries = append(entries, LedgerEntry{account(key), -msats})
+			total += msats
+		}
+		return rows.Err()
+	}
+	if err := collect(`SELECT pay_id, total_paid_msats FROM vouchers WHERE total_paid_msats!=0`, voucherAccount); err != nil {
+		return err
+	}
+	if err := collect(`SELECT CAST(id AS TEXT), owed_msats FROM pool_members WHERE owed_msats!=0`,
+		func(id string) string { return "liabilities:pool_members:" + id }); err != nil {
+		return err
+	}
+	if err := collect(`SELECT charity, SUM(amount_msats) FROM charity_payouts WHERE status='pending' GROUP BY charity`,
+		charityAccount); err != nil {
+		return err
+	}
+	if total == 0 {
+		return nil
+	}
+	entries = append(entries, LedgerEntry{AccountLightning, total})
+	return PostLedgerTx(tx, LedgerOpeningBalance, "", entries...)
+}
+
+// LedgerBalance returns an account's balance: debits less credits.
+func (db *DB) LedgerBalance(account string) (int64, error) {
+	var msats int64
+	err := db.QueryRow(
+		`SELECT COALESCE(SUM(amount_msats), 0) FROM ledger_entries WHERE account=?`, account,
+	).Scan(&msats)
+	return msats, err
+}
+
+// LedgerAccountBalance is one line of the ledger summary.
+type LedgerAccountBalance struct {
+	Account string `json:"account"`
+	Msats   int64  `json:"balance_msats"` // debits less credits
+}
+
+// GetLedgerSummary returns the balance of every account, with the per-voucher,
+// per-charity and per-pool-member liabilities rolled up into their parents.
+func (db *DB) GetLedgerSummary() ([]LedgerAccountBalance, error) {
+	rows, err := db.Query(`
+		SELECT CASE
+		         WHEN account LIKE 'liabilities:vouchers:%' THEN 'liabilities:vouchers'
+		         WHEN account LIKE 'liabilities:charities:%' THEN 'liabilities:charities'
+		         WHEN account LIKE 'liabilities:pool_members:%' THEN 'liabilities:pool_members'
+		         ELSE account
+		       END AS parent,
+		       SUM(amount_msats)
+		FROM ledger_entries GROUP BY parent ORDER BY parent`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []LedgerAccountBalance
+	for rows.Next() {
+		var b LedgerAccountBalance
+		if err := rows.Scan(&b.Account, &b.Msats); err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+// LedgerKindTotal is the volume posted under one kind.
+type LedgerKindTotal struct {
+	Kind     string `json:"kind"`
+	Postings int64  `json:"postings"`
+	Msats    int64  `json:"volume_msats"` // sum of the debits
+}
+
+// GetLedgerKindTotals returns the number and volume of postings of each kind.
+func (db *DB) GetLedgerKindTotals() ([]LedgerKindTotal, error) {
+	rows, err := db.Query(`
+		SELECT kind, COUNT(DISTINCT txn_id), SUM(CASE WHEN amount_msats>0 THEN amount_msats ELSE 0 END)
+		FROM ledger_entries GROUP BY kind ORDER BY kind`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []LedgerKindTotal
+	for rows.Next() {
+		var t LedgerKindTotal
+		if err := rows.Scan(&t.Kind, &t.Postings, &t.Msats); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// LedgerMismatch is a balance that disagrees with the ledger.
+type LedgerMismatch struct {
+	Account     string `json:"account"`
+	LedgerMsats int64  `json:"ledger_msats"` // owed according to the ledger
+	StoredMsats int64  `json:"stored_msats"` // owed according to the balance column
+}
+
+// CheckLedger compares every stored balance with the one derived from the
+// ledger and returns the ones that disagree. Unbalanced postings are
+// reported against the account "txn:<txn_id>".
+func (db *DB) CheckLedger() ([]LedgerMismatch, error) {
+	var result []LedgerMismatch
+	for _, q := range []string{
+		`SELECT 'liabilities:vouchers:'||v.pay_id, COALESCE(-SUM(l.amount_msats), 0), v.total_paid_msats
+		 FROM vouchers v LEFT JOIN ledger_entries l ON l.account='liabilities:vouchers:'||v.pay_id
+		 GROUP BY v.pay_id HAVING COALESCE(-SUM(l.amount_msats), 0) != v.total_paid_msats`,
+		`SELECT 'liabilities:pool_members:'||m.id, COALESCE(-SUM(l.amount_msats), 0), m.owed_msats
+		 FROM pool_members m LEFT JOIN ledger_entries l ON l.account='liabilities:pool_members:'||m.id
+		 GROUP BY m.id HAVING COALESCE(-SUM(l.amount_msats), 0) != m.owed_msats`,
+		`SELECT account, SUM(ledger), SUM(stored) FROM (
+		   SELECT account, -amount_msats AS ledger, 0 AS stored FROM ledger_entries
+		   WHERE account LIKE 'liabilities:charities:%'
+		   UNION ALL
+		   SELECT 'liabilities:charities:'||charity, 0, amount_msats FROM charity_payouts WHERE status='pending'
+		 ) AS charities GROUP BY account HAVING SUM(ledger) != SUM(stored)`,
+		`SELECT 'liabilities:accounts:'||a.id, COALESCE(-SUM(l.amount_msats), 0), a.balance_msats
+		 FROM credit_accounts a LEFT JOIN ledger_entries l ON l.account='liabilities:accounts:'||a.id
+		 GROUP BY a.id HAVING COALESCE(-SUM(l.amount_msats), 0) != a.balance_msats`,
+		`SELECT 'txn:'||txn_id, SUM(amount_msats), 0 FROM ledger_entries
+		 GROUP BY txn_id HAVING SUM(amount_msats) != 0`,
+	} {
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var m LedgerMismatch
+			if err := rows.Scan(&m.Account, &m.LedgerMsats, &m.StoredMsats); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result = append(result, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ── Reconciliation ───────────────────────────────────────────────────────────
+
+// StartOutgoingPayment records a payment about to be sent, under the ref of
+// the record it settles. A retried invoice starts over as pending.
+func (db *DB) StartOutgoingPayment(paymentHash, ref string, amountMsats int64) error {
+	_, err := db.Exec(
+		`INSERT INTO outgoing_payments (payment_hash, ref, amount_msats) VALUES (?, ?, ?)
+		 ON CONFLICT(payment_hash) DO UPDATE SET ref=excluded.ref, amount_msats=excluded.amount_msats,
+		   fee_msats=0, status='pending', error='', created_at=CURRENT_TIMESTAMP, settled_at=NULL`,
+		paymentHash, ref, amountMsats,
+	)
+	return err
+}
+
+// SettleOutgoingPayment records the outcome of a payment: succeeded with
+// feeMsats in routing fees if payErr is nil, failed otherwise.
+func (db *DB) SettleOutgoingPayment(paymentHash string, feeMsats int64, payErr error) error {
+	status, errText := "succeeded", ""
+	if payErr != nil {
+		status, errText, feeMsats = "failed", payErr.Error(), 0
+	}
+	_, err := db.Exec(
+		`UPDATE outgoing_payments SET status=?, error=?, fee_msats=?, settled_at=CURRENT_TIMESTAMP
+		 WHERE payment_hash=?`,
+		status, errText, feeMsats, paymentHash,
+	)
+	return err
+}
+
+// RecordedPayment is a payment as this database records it.
+type RecordedPayment struct {
+	Direction   string // "incoming" or "outgoing"
+	PaymentHash string
+	Ref         string // "batch:<id>", "voucher:<pay_id>" or "account:<id>" for incoming payments
+	AmountMsats int64
+	Status      string
+	Settled     bool // credited if incoming, succeeded if outgoing
+	At          time.Time
+}
+
+// FindIncomingPayment returns the creation request, funding invoice or
+// account top-up paid by paymentHash, or sql.ErrNoRows. A funding invoice
+// refunded to the payer because its voucher had closed counts as settled.
+func (db *DB) FindIncomingPayment(paymentHash string) (*RecordedPayment, error) {
+	p := RecordedPayment{Direction: "incoming", PaymentHash: paymentHash}
+	var accountID string
+	err := db.QueryRow(
+		`SELECT account_id, amount_msats, status, created_at FROM account_topups WHERE payment_hash=?`,
+		paymentHash,
+	).Scan(&accountID, &p.AmountMsats, &p.Status, &p.At)
+	if err == nil {
+		p.Ref, p.Settled = "account:"+accountID, p.Status == "paid"
+		return &p, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	var batchID string
+	err = db.QueryRow(
+		`SELECT COALESCE(batch_id, ''), fee_msats, status, created_at FROM voucher_creation_requests WHERE payment_hash=?`,
+		paymentHash,
+	).Scan(&batchID, &p.AmountMsats, &p.Status, &p.At)
+	if err == nil {
+		p.Ref, p.Settled = "batch:"+batchID, p.Status == "complete"
+		return &p, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	var payID string
+	var paid, lateFunded bool
+	if err := db.QueryRow(
+		`SELECT pay_id, amount_msats, paid, created_at,
+		        EXISTS (SELECT 1 FROM ledger_entries WHERE kind=? AND ref=pay_invoices.payment_hash)
+		 FROM pay_invoices WHERE payment_hash=?`,
+		LedgerLateFunding, paymentHash,
+	).Scan(&payID, &p.AmountMsats, &paid, &p.At, &lateFunded); err != nil {
+		return nil, err
+	}
+	p.Ref = "voucher:" + payID
+	switch {
+	case paid:
+		p.Status, p.Settled = "paid", true
+	case lateFunded:
+		p.Status, p.Settled = "refunded to payer", true
+	default:
+		p.Status = "unpaid"
+	}
+	return &p, nil
+}
+
+// GetOutgoingPayment returns the recorded payment with paymentHash, or sql.ErrNoRows.
+func (db *DB) GetOutgoingPayment(paymentHash string) (*RecordedPayment, error) {
+	p := RecordedPayment{Direction: "outgoing", PaymentHash: paymentHash}
+	if err := db.QueryRow(
+		`SELECT ref, amount_msats, status, created_at FROM outgoing_payments WHERE payment_hash=?`,
+		paymentHash,
+	).Scan(&p.Ref, &p.AmountMsats, &p.Status, &p.At); err != nil {
+		return nil, err
+	}
+	p.Settled = p.Status == "succeeded"
+	return &p, nil
+}
+
+// SettledPaymentsSince returns the payments this database believes have
+// moved money since the given time: credited creation requests, funding
+// invoices and account top-ups, and succeeded outgoing payments. Batches
+// created without a fee or paid from an operator account had no invoice to
+// pay.
+func (db *DB) SettledPaymentsSince(since time.Time) ([]RecordedPayment, error) {
+	var result []RecordedPayment
+	for _, q := range []struct{ dir, query string }{
+		{"incoming", `SELECT payment_hash, 'batch:'||COALESCE(batch_id, ''), fee_msats, status, created_at
+		 FROM voucher_creation_requests
+		 WHERE status='complete' AND fee_msats > 0 AND account_id IS NULL AND created_at >= ?`},
+		{"incoming", `SELECT payment_hash, 'voucher:'||pay_id, amount_msats, 'paid', paid_at
+		 FROM pay_invoices WHERE paid=1 AND paid_at >= ?`},
+		{"incoming", `SELECT payment_hash, 'account:'||account_id, amount_msats, status, paid_at
+		 FROM account_topups WHERE status='paid' AND paid_at >= ?`},
+		{"outgoing", `SELECT payment_hash, ref, amount_msats, status, created_at
+		 FROM outgoing_payments WHERE status='succeeded' AND created_at >= ?`},
+	} {
+		rows, err := db.Query(q.query, since.UTC())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			p := RecordedPayment{Direction: q.dir, Settled: true}
+			if err := rows.Scan(&p.PaymentHash, &p.Ref, &p.AmountMsats, &p.Status, &p.At); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result = append(result, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ReconcileRun summarises one pass of the reconciliation job.
+type ReconcileRun struct {
+	ID            int64     `json:"id"`
+	WindowStart   time.Time `json:"window_start"`
+	Incoming      int       `json:"incoming"` // payments listed by the backend
+	Outgoing      int       `json:"outgoing"`
+	Matched       int       `json:"matched"`
+	Discrepancies int       `json:"discrepancies"`
+	Error         string    `json:"error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Discrepancy is a payment on which the backend and this database disagree.
+type Discrepancy struct {
+	ID            int64     `json:"id"`
+	Kind          string    `json:"kind"`
+	Direction     string    `json:"direction"`
+	PaymentHash   string    `json:"payment_hash"`
+	Ref           string    `json:"ref,omitempty"`
+	BackendMsats  int64     `json:"backend_msats"`
+	RecordedMsats int64     `json:"recorded_msats"`
+	Detail        string    `json:"detail"`
+	PaymentAt     time.Time `json:"payment_at"`
+	FirstSeenAt   time.Time `json:"first_seen_at"`
+	LastSeenAt    time.Time `json:"last_seen_at"`
+}
+
+// SaveReconcileRun stores a run and its discrepancies. Discrepancies already
+// known are updated rather than duplicated, and open ones for payments inside
+// the run's window that it no longer found are marked resolved. Dismissed
+// discrepancies stay dismissed.
+func (db *DB) SaveReconcileRun(run *ReconcileRun, found []Discrepancy) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(
+		`INSERT INTO reconcile_runs (window_start, incoming, outgoing, matched, discrepancies, error)
+		 VALUES (?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		run.WindowStart.UTC(), run.Incoming, run.Outgoing, run.Matched, run.Discrepancies, run.Error,
+	).Scan(&run.ID, &run.CreatedAt); err != nil {
+		return err
+	}
+	if run.Error != "" {
+		return tx.Commit()
+	}
+	for _, d := range found {
+		if _, err := tx.Exec(
+			`INSERT INTO reconcile_discrepancies (kind, direction, payment_hash, ref, backend_msats, recorded_msats,
+			                                      detail, payment_at, last_run_id)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			 ON CONFLICT(kind, payment_hash) DO UPDATE SET ref=excluded.ref, backend_msats=excluded.backend_msats,
+			   recorded_msats=excluded.recorded_msats, detail=excluded.detail, last_run_id=excluded.last_run_id,
+			   last_seen_at=CURRENT_TIMESTAMP, resolved_at=NULL,
+			   first_seen_at=CASE WHEN resolved_at IS NULL THEN first_seen_at ELSE CURRENT_TIMESTAMP END`,
+			d.Kind, d.Direction, d.PaymentHash, d.Ref, d.BackendMsats, d.RecordedMsats,
+			d.Detail, d.PaymentAt.UTC(), run.ID,
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		`UPDATE reconcile_discrepancies SET resolved_at=CURRENT_TIMESTAMP
+		 WHERE resolved_at IS NULL AND last_run_id < ? AND payment_at >= ?`,
+		run.ID, run.WindowStart.UTC(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLastReconcileRun returns the most recent run, or sql.ErrNoRows.
+func (db *DB) GetLastReconcileRun() (*ReconcileRun, error) {
+	var run ReconcileRun
+	if err := db.QueryRow(
+		`SELECT id, window_start, incoming, outgoing, matched, discrepancies, error, created_at
+		 FROM reconcile_runs ORDER BY id DESC LIMIT 1`,
+	).Scan(&run.ID, &run.WindowStart, &run.Incoming, &run.Outgoing, &run.Matched,
+		&run.Discrepancies, &run.Error, &run.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// GetOpenDiscrepancies returns the unresolved discrepancies, newest payment first.
+func (db *DB) GetOpenDiscrepancies() ([]Discrepancy, error) {
+	rows, err := db.Query(
+		`SELECT id, kind, direction, payment_hash, ref, backend_msats, recorded_msats, detail,
+		        payment_at, first_seen_at, last_seen_at
+		 FROM reconcile_discrepancies WHERE resolved_at IS NULL AND dismissed_at IS NULL
+		 ORDER BY payment_at DESC, id DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Discrepancy
+	for rows.Next() {
+		var d Discrepancy
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Direction, &d.PaymentHash, &d.Ref, &d.BackendMsats,
+			&d.RecordedMsats, &d.Detail, &d.PaymentAt, &d.FirstSeenAt, &d.LastSeenAt); err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// DismissDiscrepancy hides an open discrepancy that has been dealt with by
+// hand, or returns sql.ErrNoRows.
+func (db *DB) DismissDiscrepancy(id int64) error {
+	res, err := db.Exec(
+		`UPDATE reconcile_discrepancies SET dismissed_at=CURRENT_TIMESTAMP
+		 WHERE id=? AND resolved_at IS NULL AND dismissed_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ── Promo Codes ──────────────────────────────────────────────────────────────
+//
+// A promo code discounts the creation fee of the batches created with it.
+// Each batch created with a code is a redemption; redemptions whose creation
+// invoice expired unpaid no longer count towards the code's limits.
+
+// PromoCode takes DiscountPercent off a batch's creation fee, then
+// DiscountSats off what is left.
+type PromoCode struct {
+	Code            string     `json:"code"`
+	DiscountPercent int64      `json:"discount_percent"`
+	DiscountSats    int64      `json:"discount_sats"`
+	MaxUses         int        `json:"max_uses"`     // batches; 0 for no limit
+	MaxVouchers     int        `json:"max_vouchers"` // vouchers across all its batches; 0 for no limit
+	ExpiresAt       *time.Time `json:"expires_at"`
+	Note            string     `json:"note"`
+	Active          bool       `json:"active"`
+	CreatedAt       time.Time  `json:"created_at"`
+
+	// Redemptions so far, excluding those whose invoice expired unpaid.
+	Uses          int   `json:"uses"`
+	Vouchers      int   `json:"vouchers"`
+	DiscountMsats int64 `json:"discount_msats"`
+}
+
+// PromoRedemption is one batch created with a promo code.
+type PromoRedemption struct {
+	Code          string    `json:"code"`
+	PaymentHash   string    `json:"payment_hash"`
+	BatchID       string    `json:"batch_id"`
+	VoucherCount  int       `json:"voucher_count"`
+	FeeMsats      int64     `json:"fee_msats"` // paid after the discount
+	DiscountMsats int64     `json:"discount_msats"`
+	Status        string    `json:"status"` // the creation request's
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+var (
+	ErrPromoInvalid = errors.New("unknown or disabled promo code")
+	ErrPromoExpired = errors.New("promo code has expired")
+	ErrPromoUsedUp  = errors.New("promo code has been used up")
+)
+
+// Check reports whether the code can be used for a batch of count vouchers.
+func (p *PromoCode) Check(count int) error {
+	if !p.Active {
+		return ErrPromoInvalid
+	}
+	if p.ExpiresAt != nil && !time.Now().Before(*p.ExpiresAt) {
+		return ErrPromoExpired
+	}
+	if p.MaxUses > 0 && p.Uses >= p.MaxUses {
+		return ErrPromoUsedUp
+	}
+	if p.MaxVouchers > 0 && p.Vouchers+count > p.MaxVouchers {
+		if p.Vouchers >= p.MaxVouchers {
+			return ErrPromoUsedUp
+		}
+		return fmt.Errorf("%w: it covers only %d more voucher(s)", ErrPromoUsedUp, p.MaxVouchers-p.Vouchers)
+	}
+	return nil
+}
+
+// Discount returns how many sats the code takes off a fee of feeSats.
+func (p *PromoCode) Discount(feeSats int64) int64 {
+	rest := feeSats * (100 - p.DiscountPercent) / 100
+	rest = max(rest-p.DiscountSats, 0)
+	return feeSats - rest
+}
+
+func (db *DB) InsertPromoCode(p *PromoCode) error {
+	_, err := db.Exec(
+		`INSERT INTO promo_codes (code, discount_percent, discount_sats, max_uses, max_vouchers, expires_at, note)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.Code, p.DiscountPercent, p.DiscountSats, p.MaxUses, p.MaxVouchers, p.ExpiresAt, p.Note,
+	)
+	return err
+}
+
+const promoCodeQuery = `SELECT p.code, p.discount_percent, p.discount_sats, p.max_uses, p.max_vouchers, p.expires_at,
+	p.note, p.active, p.created_at,
+	COUNT(r.id), COALESCE(SUM(r.voucher_count), 0), COALESCE(SUM(r.discount_msats), 0)
+	FROM promo_codes p
+	LEFT JOIN promo_redemptions r ON r.code=p.code AND r.payment_hash IN (
+		SELECT payment_hash FROM voucher_creation_requests WHERE status!='expired')`
+
+func scanPromoCode(row rowScanner) (*PromoCode, error) {
+	var p PromoCode
+	var expiresAt sql.NullTime
+	if err := row.Scan(&p.Code, &p.DiscountPercent, &p.DiscountSats, &p.MaxUses, &p.MaxVouchers, &expiresAt,
+		&p.Note, &p.Active, &p.CreatedAt, &p.Uses, &p.Vouchers, &p.DiscountMsats); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		p.ExpiresAt = &expiresAt.Time
+	}
+	return &p, nil
+}
+
+// GetPromoCode returns a code with its redemption counts, or sql.ErrNoRows.
+func (db *DB) GetPromoCode(code string) (*PromoCode, error) {
+	return getPromoCode(db, code)
+}
+
+func getPromoCode(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, code string) (*PromoCode, error) {
+	return scanPromoCode(q.QueryRow(promoCodeQuery+` WHERE p.code=? GROUP BY p.code`, code))
+}
+
+// GetPromoCodes returns every code, newest first.
+func (db *DB) GetPromoCodes() ([]*PromoCode, error) {
+	rows, err := db.Query(promoCodeQuery + ` GROUP BY p.code ORDER BY p.created_at DESC, p.code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*PromoCode
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// DisablePromoCode stops a code from being redeemed, or returns sql.ErrNoRows.
+func (db *DB) DisablePromoCode(code string) error {
+	res, err := db.Exec(`UPDATE promo_codes SET active=0 WHERE code=? AND active=1`, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetPromoRedemptions returns a code's redemptions, newest first.
+func (db *DB) GetPromoRedemptions(code string) ([]PromoRedemption, error) {
+	rows, err := db.Query(
+		`SELECT r.code, r.payment_hash, r.batch_id, r.voucher_count, r.fee_msats, r.discount_msats,
+		        COALESCE(c.status, ''), r.created_at
+		 FROM promo_redemptions r LEFT JOIN voucher_creation_requests c ON c.payment_hash=r.payment_hash
+		 WHERE r.code=? ORDER BY r.id DESC`, code,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []PromoRedemption
+	for rows.Next() {
+		var r PromoRedemption
+		if err := rows.Scan(&r.Code, &r.PaymentHash, &r.BatchID, &r.VoucherCount, &r.FeeMsats,
+			&r.DiscountMsats, &r.Status, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// ── Operator Accounts ────────────────────────────────────────────────────────
+//
+// Operators who create batches often keep a prepaid credit account instead
+// of paying an invoice per batch. Its balance is topped up by Lightning and
+// drawn on for creation fees and pre-funding; account_entries is its
+// statement. Money spent from an account is posted as if it had been paid by
+// invoice: it leaves the account's liability for the node's funds, from where
+// the usual creation-fee and funding postings take it.
+
+// CreditAccount is an operator's prepaid account. Its API key is only
+// stored hashed, and is not part of it.
+type CreditAccount struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	LinkingKey       string    `json:"linking_key"` // LNURL-auth public key; empty if none is linked
+	BalanceMsats     int64     `json:"balance_msats"`
+	LowBalanceMsats  int64     `json:"low_balance_msats"`  // warn when the balance drops below this
+	LowBalanceWarned bool      `json:"low_balance_warned"` // warned, and not topped up since
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// AccountEntry is one line of an account's statement. AmountMsats is
+// positive for a credit and negative for a debit.
+type AccountEntry struct {
+	ID           int64     `json:"id"`
+	Kind         string    `json:"kind"`
+	AmountMsats  int64     `json:"amount_msats"`
+	BalanceMsats int64     `json:"balance_msats"` // after the entry
+	Ref          string    `json:"ref"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Statement entry kinds.
+const (
+	AccountEntryTopup       = "topup"
+	AccountEntryCreationFee = "creation_fee"
+	AccountEntryPrefund     = "prefund"
+	AccountEntryRefund      = "refund"
+)
+
+const creditAccountColumns = `id, name, linking_key, balance_msats, low_balance_msats, low_balance_warned, created_at`
+
+func scanCreditAccount(row rowScanner) (*CreditAccount, error) {
+	var a CreditAccount
+	if err := row.Scan(&a.ID, &a.Name, &a.LinkingKey, &a.BalanceMsats, &a.LowBalanceMsats,
+		&a.LowBalanceWarned, &a.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (db *DB) InsertCreditAccount(a *CreditAccount, apiKeyHash string) error {
+	_, err := db.Exec(
+		`INSERT INTO credit_accounts (id, name, api_key_hash, linking_key, low_balance_msats) VALUES (?, ?, ?, ?, ?)`,
+		a.ID, a.Name, apiKeyHash, a.LinkingKey, a.LowBalanceMsats,
+	)
+	return err
+}
+
+// SetAccountAPIKey replaces an account's API key, or returns sql.ErrNoRows.
+func (db *DB) SetAccountAPIKey(id, apiKeyHash string) error {
+	res, err := db.Exec(`UPDATE credit_accounts SET api_key_hash=? WHERE id=?`, apiKeyHash, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (db *DB) GetCreditAccount(id string) (*CreditAccount, error) {
+	return scanCreditAccount(db.QueryRow(`SELECT `+creditAccountColumns+` FROM credit_accounts WHERE id=?`, id))
+}
+
+// GetCreditAccountByAPIKey returns the account whose API key hashes to
+// apiKeyHash, or sql.ErrNoRows.
+func (db *DB) GetCreditAccountByAPIKey(apiKeyHash string) (*CreditAccount, error) {
+	return scanCreditAccount(db.QueryRow(
+		`SELECT `+creditAccountColumns+` FROM credit_accounts WHERE api_key_hash=?`, apiKeyHash,
+	))
+}
+
+// GetCreditAccountBySession returns the account logged in with the session
+// token hashing to tokenHash, or sql.ErrNoRows if there is none or it expired.
+func (db *DB) GetCreditAccountBySession(tokenHash string) (*CreditAccount, error) {
+	return scanCreditAccount(db.QueryRow(
+		`SELECT `+creditAccountColumns+` FROM credit_accounts
+		 WHERE id=(SELECT account_id FROM account_sessions WHERE token_hash=? AND expires_at > ?)`,
+		tokenHash, time.Now().UTC(),
+	))
+}
+
+// GetCreditAccounts returns every account, largest balance first.
+func (db *DB) GetCreditAccounts() ([]*CreditAccount, error) {
+	rows, err := db.Query(`SELECT ` + creditAccountColumns + ` FROM credit_accounts ORDER BY balance_msats DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*CreditAccount
+	for rows.Next() {
+		a, err := scanCreditAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// GetAccountStatement returns an account's most recent entries, newest first.
+func (db *DB) GetAccountStatement(accountID string, limit int) ([]AccountEntry, error) {
+	rows, err := db.Query(
+		`SELECT id, kind, amount_msats, balance_msats, ref, created_at FROM account_entries
+		 WHERE account_id=? ORDER BY id DESC LIMIT ?`, accountID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AccountEntry
+	for rows.Next() {
+		var e AccountEntry
+		if err := rows.Scan(&e.ID, &e.Kind, &e.AmountMsats, &e.BalanceMsats, &e.Ref, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// creditAccountTx adds msats to an account's balance, posting them as
+// received into the node's funds. An account topped back up to its
+// low-balance threshold can be warned again.
+func creditAccountTx(tx *Tx, accountID, kind, ledgerKind, ref string, msats int64) error {
+	var balance int64
+	if err := tx.QueryRow(
+		`UPDATE credit_accounts SET balance_msats=balance_msats+?,
+		   low_balance_warned=CASE WHEN balance_msats+? >= low_balance_msats THEN 0 ELSE low_balance_warned END
+		 WHERE id=? RETURNING balance_msats`,
+		msats, msats, accountID,
+	).Scan(&balance); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO account_entries (account_id, kind, amount_msats, balance_msats, ref) VALUES (?, ?, ?, ?, ?)`,
+		accountID, kind, msats, balance, ref,
+	); err != nil {
+		return err
+	}
+	return PostLedgerTx(tx, ledgerKind, ref,
+		LedgerEntry{AccountLightning, msats},
+		LedgerEntry{creditAccount(accountID), -msats},
+	)
+}
+
+// debitAccountTx takes msats from an account's balance, or fails with
+// ErrInsufficientBalance, posting them as paid into the node's funds. The
+// first debit that takes the balance below the account's threshold queues
+// an account.low_balance event.
+func debitAccountTx(tx *Tx, accountID, kind, ref string, msats int64) error {
+	if msats == 0 {
+		return nil
+	}
+	var balance, threshold int64
+	var warned bool
+	err := tx.QueryRow(
+		`UPDATE credit_accounts SET balance_msats=balance_msats-? WHERE id=? AND balance_msats>=?
+		 RETURNING balance_msats, low_balance_msats, low_balance_warned`,
+		msats, accountID, msats,
+	).Scan(&balance, &threshold, &warned)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInsufficientBalance
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO account_entries (account_id, kind, amount_msats, balance_msats, ref) VALUES (?, ?, ?, ?, ?)`,
+		accountID, kind, -msats, balance, ref,
+	); err != nil {
+		return err
+	}
+	if err := PostLedgerTx(tx, LedgerAccountSpend, ref,
+		LedgerEntry{creditAccount(accountID), msats},
+		LedgerEntry{AccountLightning, -msats},
+	); err != nil {
+		return err
+	}
+	if balance >= threshold || warned {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE credit_accounts SET low_balance_warned=1 WHERE id=?`, accountID); err != nil {
+		return err
+	}
+	return EnqueueEventTx(tx, EventAccountLowBalance, "", "", map[string]any{
+		"account_id":        accountID,
+		"balance_msats":     balance,
+		"low_balance_msats": threshold,
+	})
+}
+
+// InsertAccountTopup records an invoice for topping up an account.
+func (db *DB) InsertAccountTopup(paymentHash, accountID string, msats int64) error {
+	_, err := db.Exec(
+		`INSERT INTO account_topups (payment_hash, account_id, amount_msats) VALUES (?, ?, ?)`,
+		paymentHash, accountID, msats,
+	)
+	return err
+}
+
+// GetAccountTopupStatus returns the status of one of an account's top-ups,
+// or sql.ErrNoRows.
+func (db *DB) GetAccountTopupStatus(paymentHash, accountID string) (string, error) {
+	var status string
+	err := db.QueryRow(
+		`SELECT status FROM account_topups WHERE payment_hash=? AND account_id=?`, paymentHash, accountID,
+	).Scan(&status)
+	return status, err
+}
+
+// SettleAccountTopup credits a paid top-up to its account, or marks an
+// unpaid one expired. A top-up is only settled once.
+func (db *DB) SettleAccountTopup(paymentHash string, paid bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status := "expired"
+	if paid {
+		status = "paid"
+	}
+	var accountID string
+	var msats int64
+	if err := tx.QueryRow(
+		`UPDATE account_topups SET status=?, paid_at=CASE WHEN ?='paid' THEN CURRENT_TIMESTAMP END
+		 WHERE payment_hash=? AND status='pending' RETURNING account_id, amount_msats`,
+		status, status, paymentHash,
+	).Scan(&accountID, &msats); err != nil {
+		return err
+	}
+	if paid {
+		if err := creditAccountTx(tx, accountID, AccountEntryTopup, LedgerAccountTopup, paymentHash, msats); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PayCreationFromAccount pays a pending creation request's fee from an
+// account, or fails with ErrInsufficientBalance.
+func (db *DB) PayCreationFromAccount(accountID, paymentHash string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var feeMsats int64
+	if err := tx.QueryRow(
+		`UPDATE voucher_creation_requests SET account_id=? WHERE payment_hash=? AND status='pending'
+		 RETURNING fee_msats`,
+		accountID, paymentHash,
+	).Scan(&feeMsats); err != nil {
+		return err
+	}
+	if err := debitAccountTx(tx, accountID, AccountEntryCreationFee, paymentHash, feeMsats); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefundCreationToAccount returns the fee of a creation request paid from an
+// account that failed to produce its vouchers.
+func (db *DB) RefundCreationToAccount(paymentHash string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var accountID string
+	var feeMsats int64
+	if err := tx.QueryRow(
+		`SELECT account_id, fee_msats FROM voucher_creation_requests
+		 WHERE payment_hash=? AND status='expired' AND account_id IS NOT NULL`+tx.dialect.lockRows, paymentHash,
+	).Scan(&accountID, &feeMsats); err != nil {
+		return err
+	}
+	if feeMsats > 0 {
+		if err := creditAccountTx(tx, accountID, AccountEntryRefund, LedgerAccountRefund, paymentHash, feeMsats); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PrefundVouchers pays q.AmountMsats from an account into each of the
+// vouchers payIDs, split as a Lightning payment would be. It funds all of
+// them or, failing with ErrInsufficientBalance if the balance runs out part
+// way, none: the account row stays locked from the first debit to the
+// commit, so no other spend can come in between.
+func (db *DB) PrefundVouchers(accountID string, payIDs []string, charity string, q FundingQuote) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, payID := range payIDs {
+		if err := debitAccountTx(tx, accountID, AccountEntryPrefund, payID, q.AmountMsats); err != nil {
+			return err
+		}
+		if err := fundVoucherTx(tx, payID, q.CreditedMsats, q.FeeMsats, payID, map[string]any{
+			"account_id": accountID,
+		}); err != nil {
+			return err
+		}
+		if q.CharityMsats > 0 {
+			if err := InsertCharityPayoutTx(tx, charity, payID, "funding", "pending", q.CharityMsats); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Account logins: an LNURL-auth challenge k1 that a wallet signs, either to
+// log in to the account linked to its key or, for AccountLinkAction, to link
+// its key to AccountID.
+const (
+	AccountLoginAction = "login"
+	AccountLinkAction  = "link"
+)
+
+// AccountLogin is an LNURL-auth challenge.
+type AccountLogin struct {
+	K1         string
+	AccountID  string // the account logged in to or linked; empty until verified for logins
+	Action     string
+	LinkingKey string
+	Verified   bool
+	Claimed    bool // a session token has been issued for it
+	CreatedAt  time.Time
+}
+
+func (db *DB) InsertAccountLogin(k1, accountID, action string) error {
+	_, err := db.Exec(
+		`INSERT INTO account_logins (k1, account_id, action) VALUES (?, ?, ?)`, k1, accountID, action,
+	)
+	return err
+}
+
+// DeleteExpiredAccountLogins deletes login challenges older than ttl, which
+// can no longer be signed or claimed.
+func (db *DB) DeleteExpiredAccountLogins(ttl time.Duration) (int64, error) {
+	res, err := db.Exec(
+		`DELETE FROM account_logins WHERE `+db.dialect.epoch("created_at")+` < ?`,
+		time.Now().Add(-ttl).Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (db *DB) GetAccountLogin(k1 string) (*AccountLogin, error) {
+	var l AccountLogin
+	if err := db.QueryRow(
+		`SELECT k1, account_id, action, linking_key, verified, claimed, created_at FROM account_logins WHERE k1=?`, k1,
+	).Scan(&l.K1, &l.AccountID, &l.Action, &l.LinkingKey, &l.Verified, &l.Claimed, &l.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ErrUnknownLinkingKey is returned for a login signed by a key no account is linked to.
+var ErrUnknownLinkingKey = errors.New("no operator account is linked to this key")
+
+// ErrLinkingKeyTaken is returned when linking a key another account already has.
+var ErrLinkingKeyTaken = errors.New("this key is already linked to another account")
+
+// VerifyAccountLogin completes a challenge signed by linkingKey: a login
+// is bound to the account linked to the key, and a link stores the key on
+// its account. A challenge is only verified once.
+func (db *DB) VerifyAccountLogin(k1, linkingKey string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var accountID, action string
+	if err := tx.QueryRow(
+		`SELECT account_id, action FROM account_logins WHERE k1=? AND verified=0`+tx.dialect.lockRows, k1,
+	).Scan(&accountID, &action); err != nil {
+		return err
+	}
+	var owner string
+	err = tx.QueryRow(`SELECT id FROM credit_accounts WHERE linking_key=?`, linkingKey).Scan(&owner)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	switch action {
+	case AccountLoginAction:
+		if owner == "" {
+			return ErrUnknownLinkingKey
+		}
+		accountID = owner
+	case AccountLinkAction:
+		if owner != "" && owner != accountID {
+			return ErrLinkingKeyTaken
+		}
+		if _, err := tx.Exec(`UPDATE credit_accounts SET linking_key=? WHERE id=?`, linkingKey, accountID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		`UPDATE account_logins SET account_id=?, linking_key=?, verified=1 WHERE k1=?`, accountID, linkingKey, k1,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimAccountSession issues the session of a verified login: it stores
+// tokenHash as a session of the login's account until expiresAt, once, and
+// returns the account's ID. A login that is not verified or already claimed
+// returns sql.ErrNoRows.
+func (db *DB) ClaimAccountSession(k1, tokenHash string, expiresAt time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var accountID string
+	if err := tx.QueryRow(
+		`UPDATE account_logins SET claimed=1 WHERE k1=? AND action=? AND verified=1 AND claimed=0
+		 RETURNING account_id`, k1, AccountLoginAction,
+	).Scan(&accountID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO account_sessions (token_hash, account_id, expires_at) VALUES (?, ?, ?)`,
+		tokenHash, accountID, expiresAt.UTC(),
+	); err != nil {
+		return "", err
+	}
+	return accountID, tx.Commit()
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// ── Fee Schedule ─────────────────────────────────────────────────────────────
+//
+// Creation and funding fees follow a schedule loaded from FEE_SCHEDULE_FILE,
+// or built from the flat FEE_PER_VOUCHER_SATS, TIPJAR_FEE_SATS,
+// FUNDING_FEE_MIN_MSATS and FUNDING_FEE_PERCENT settings if none is given.
+// A schedule file looks like:
+//
+//	{
+//	  "creation": {
+//	    "per_voucher_sats": 10, "per_tipjar_sats": 100, "max_sats": 500,
+//	    "tiers": [{"min_count": 10, "discount_percent": 20}]
+//	  },
+//	  "funding": {
+//	    "brackets": [
+//	      {"min_sats": 0, "base_msats": 2000, "rate": 0.004},
+//	      {"min_sats": 100000, "base_msats": 0, "rate": 0.002}
+//	    ],
+//	    "max_msats": 1000000
+//	  },
+//	  "fee_free_charities": ["Lightning Kids"]
+//	}
+//
+// Fees are never charged on money going to a fee-free charity: batches that
+// donate every unclaimed sat to one are created for free, and the share of
+// each payment a batch passes on to one carries no funding fee.
+//
+// The admin can replace the funding fees of a single batch with an override,
+// kept with the batch in the database (see /api/admin/batches/:id/fees).
+// Overrides used to be set in the file's "batch_overrides", by batch ID;
+// those are still read, and copied to their batches at startup.
+
+// FeeSchedule prices voucher creation and funding.
+type FeeSchedule struct {
+	Creation         CreationFees           `json:"creation"`
+	Funding          FundingFees            `json:"funding"`
+	FeeFreeCharities []string               `json:"fee_free_charities"`
+	BatchOverrides   map[string]FundingFees `json:"batch_overrides"` // by batch ID; only imported, see importBatchFeeOverrides
+}
+
+// CreationFees prices a batch per voucher, with discounts for larger batches.
+type CreationFees struct {
+	PerVoucherSats int64          `json:"per_voucher_sats"` // gift, forward and pool vouchers
+	PerTipJarSats  int64          `json:"per_tipjar_sats"`
+	Tiers          []CreationTier `json:"tiers"`
+	MaxSats        int64          `json:"max_sats"` // cap on a batch's fee; 0 for none
+}
+
+// CreationTier discounts batches of at least MinCount vouchers.
+type CreationTier struct {
+	MinCount        int   `json:"min_count"`
+	DiscountPercent int64 `json:"discount_percent"`
+}
+
+// FundingFees prices a payment into a voucher by the bracket its amount falls in.
+type FundingFees struct {
+	Brackets []FundingBracket `json:"brackets"`
+	MaxMsats int64            `json:"max_msats"` // cap on a payment's fee; 0 for none
+}
+
+// FundingBracket charges payments of at least MinSats a base fee plus a
+// fraction of the amount.
+type FundingBracket struct {
+	MinSats   int64   `json:"min_sats"`
+	BaseMsats int64   `json:"base_msats"`
+	Rate      float64 `json:"rate"` // e.g. 0.004 for 0.4%
+}
+
+var fees *FeeSchedule
+
+// newFeeSchedule loads FEE_SCHEDULE_FILE, or builds the schedule from the
+// flat fee settings if it isn't set.
+func newFeeSchedule() (*FeeSchedule, error) {
+	s := &FeeSchedule{
+		Creation: CreationFees{PerVoucherSats: cfg.FeePerVoucherSats, PerTipJarSats: cfg.TipJarFeeSats},
+		Funding: FundingFees{Brackets: []FundingBracket{
+			{BaseMsats: cfg.FundingFeeMinMsats, Rate: cfg.FundingFeePercent},
+		}},
+	}
+	if cfg.FeeScheduleFile != "" {
+		data, err := os.ReadFile(cfg.FeeScheduleFile)
+		if err != nil {
+			return nil, err
+		}
+		// Settings the file leaves out keep their flat values.
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", cfg.FeeScheduleFile, err)
+		}
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(s.Creation.Tiers, func(a, b CreationTier) int { return a.MinCount - b.MinCount })
+	s.Funding.sort()
+	for id, o := range s.BatchOverrides {
+		o.sort()
+		s.BatchOverrides[id] = o
+	}
+	return s, nil
+}
+
+func (s *FeeSchedule) validate() error {
+	c := s.Creation
+	if c.PerVoucherSats < 0 || c.PerTipJarSats < 0 || c.MaxSats < 0 {
+		return fmt.Errorf("creation fees must not be negative")
+	}
+	for _, t := range c.Tiers {
+		if t.MinCount < 1 || t.DiscountPercent < 0 || t.DiscountPercent > 100 {
+			return fmt.Errorf("creation tiers need a min_count of at least 1 and a discount_percent between 0 and 100")
+		}
+	}
+	if err := s.Funding.validate(); err != nil {
+		return err
+	}
+	for id, o := range s.BatchOverrides {
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("batch override %s: %w", id, err)
+		}
+	}
+	for _, name := range s.FeeFreeCharities {
+		if _, ok := findCharity(name); !ok {
+			return fmt.Errorf("fee-free charity %q is not a configured charity", name)
+		}
+	}
+	return nil
+}
+
+func (f FundingFees) validate() error {
+	if len(f.Brackets) == 0 {
+		return fmt.Errorf("funding fees need at least one bracket")
+	}
+	if f.MaxMsats < 0 {
+		return fmt.Errorf("funding max_msats must not be negative")
+	}
+	for _, b := range f.Brackets {
+		if b.MinSats < 0 || b.BaseMsats < 0 || b.Rate < 0 || b.Rate >= 1 {
+			return fmt.Errorf("funding brackets need non-negative amounts and a rate below 1")
+		}
+	}
+	return nil
+}
+
+func (f FundingFees) sort() {
+	slices.SortFunc(f.Brackets, func(a, b FundingBracket) int { return int(a.MinSats - b.MinSats) })
+}
+
+// fee returns the fee on a payment of amountMsats: the bracket with the
+// highest minimum the amount reaches, capped at MaxMsats.
+func (f FundingFees) fee(amountMsats int64) int64 {
+	var fee int64
+	for _, b := range f.Brackets { // lowest minimum first
+		if amountMsats < b.MinSats*1000 {
+			break
+		}
+		fee = b.BaseMsats + int64(math.Floor(float64(amountMsats)*b.Rate))
+	}
+	if f.MaxMsats > 0 {
+		fee = min(fee, f.MaxMsats)
+	}
+	return fee
+}
+
+// isFeeFree reports whether charity is exempt from fees.
+func (s *FeeSchedule) isFeeFree(charity string) bool {
+	return charity != "" && slices.Contains(s.FeeFreeCharities, charity)
+}
+
+// CreationQuote is the fee for creating a batch.
+type CreationQuote struct {
+	Count           int   `json:"count"`
+	PerVoucherSats  int64 `json:"per_voucher_sats"` // before any discount
+	DiscountPercent int64 `json:"discount_percent"`
+	FeeSats         int64 `json:"fee_sats"`
+	Waived          bool  `json:"waived"`     // donates to a fee-free charity
+	PromoSats       int64 `json:"promo_sats"` // promo code discount, already taken off FeeSats
+}
+
+// applyPromo takes the discount of promo code code off the quote, returning
+// the redemption to record with the batch, or nil if there was no fee to
+// discount.
+func (q *CreationQuote) applyPromo(code string) (*PromoRedemption, error) {
+	promo, err := promoDiscount(code, q.Count, q.FeeSats)
+	if err != nil || promo == nil {
+		return nil, err
+	}
+	q.PromoSats = promo.DiscountMsats / 1000
+	q.FeeSats -= q.PromoSats
+	return promo, nil
+}
+
+// CreationFee quotes the fee for count vouchers of kind. A batch whose
+// expired balances all go to a fee-free charity is created for free.
+func (s *FeeSchedule) CreationFee(kind string, count int, expiryPolicy, charity string) CreationQuote {
+	q := CreationQuote{Count: count, PerVoucherSats: s.Creation.PerVoucherSats}
+	if kind == KindTipJar {
+		q.PerVoucherSats = s.Creation.PerTipJarSats
+	}
+	if expiryPolicy == PolicyDonate && s.isFeeFree(charity) {
+		q.Waived = true
+		return q
+	}
+	for _, t := range s.Creation.Tiers { // smallest batches first
+		if count >= t.MinCount {
+			q.DiscountPercent = t.DiscountPercent
+		}
+	}
+	q.FeeSats = q.PerVoucherSats * int64(count) * (100 - q.DiscountPercent) / 100
+	if s.Creation.MaxSats > 0 {
+		q.FeeSats = min(q.FeeSats, s.Creation.MaxSats)
+	}
+	return q
+}
+
+// FundingQuote splits a payment into a voucher between fee, charity and voucher.
+type FundingQuote struct {
+	AmountMsats   int64 `json:"amount_msats"`
+	FeeMsats      int64 `json:"fee_msats"`
+	CharityMsats  int64 `json:"charity_msats"`
+	CreditedMsats int64 `json:"credited_msats"`
+}
+
+// FundingFee splits a payment of amountMsats into a voucher of batch b, which
+// is nil for vouchers created before batches existed. The batch's override
+// replaces the funding fees if it has one. The charity share is taken after
+// the fee, unless the charity is fee-free, in which case the fee is only
+// charged on the rest.
+func (s *FeeSchedule) FundingFee(b *Batch, amountMsats int64) FundingQuote {
+	q := FundingQuote{AmountMsats: amountMsats}
+	f, percent := s.Funding, int64(0)
+	if b != nil {
+		if b.FeeOverride != nil {
+			f = *b.FeeOverride
+		}
+		percent = int64(b.FundingDonatePercent)
+	}
+	if percent > 0 && s.isFeeFree(b.FundingCharity) {
+		q.CharityMsats = amountMsats * percent / 100
+		q.FeeMsats = f.fee(amountMsats - q.CharityMsats)
+	} else {
+		q.FeeMsats = f.fee(amountMsats)
+		q.CharityMsats = (amountMsats - q.FeeMsats) * percent / 100
+	}
+	q.CreditedMsats = amountMsats - q.FeeMsats - q.CharityMsats
+	return q
+}
+
+// importBatchFeeOverrides copies the fee schedule file's batch overrides to
+// the batches that have none in the database, where they are managed now.
+func importBatchFeeOverrides() {
+	if len(fees.BatchOverrides) == 0 {
+		return
+	}
+	n, err := database.ImportBatchFeeOverrides(fees.BatchOverrides)
+	if err != nil {
+		log.Printf("ImportBatchFeeOverrides: %v", err)
+		return
+	}
+	log.Printf("fees: %d of %d batch_overrides in %s copied to their batches; manage them with /api/admin/batches/{id}/fees and remove them from the file",
+		n, len(fees.BatchOverrides), cfg.FeeScheduleFile)
+}
+
+// ── /api/admin/batches/:id/fees ──────────────────────────────────────────────
+
+// handleListFeeOverrides returns the batches whose funding fees are overridden.
+func handleListFeeOverrides(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	batches, err := database.GetBatchFeeOverrides()
+	if err != nil {
+		log.Printf("GetBatchFeeOverrides: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	type override struct {
+		BatchID string       `json:"batch_id"`
+		Name    string       `json:"name"`
+		Funding *FundingFees `json:"funding"`
+	}
+	result := []override{}
+	for _, b := range batches {
+		result = append(result, override{b.ID, b.Name, b.FeeOverride})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleGetBatchFees returns the funding fees that apply to a batch, and
+// whether they are an override.
+func handleGetBatchFees(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	b, err := database.GetBatch(r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "batch not found"})
+		return
+	} else if err != nil {
+		log.Printf("GetBatch: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	funding := fees.Funding
+	if b.FeeOverride != nil {
+		funding = *b.FeeOverride
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"funding": funding, "override": b.FeeOverride != nil})
+}
+
+// handleSetBatchFees overrides a batch's funding fees with the ones in the
+// body, shaped like the schedule's "funding".
+func handleSetBatchFees(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var f FundingFees
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if err := f.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	f.sort()
+	setBatchFeeOverride(w, r.PathValue("id"), &f)
+}
+
+// handleDeleteBatchFees puts a batch back on the fee schedule's funding fees.
+func handleDeleteBatchFees(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) {
+		setBatchFeeOverride(w, r.PathValue("id"), nil)
+	}
+}
+
+func setBatchFeeOverride(w http.ResponseWriter, id string, f *FundingFees) {
+	if err := database.SetBatchFeeOverride(id, f); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "batch not found"})
+		return
+	} else if err != nil {
+		log.Printf("SetBatchFeeOverride: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	funding := fees.Funding
+	if f != nil {
+		funding = *f
+		log.Printf("fees: funding fees of batch %s overridden", id)
+	} else {
+		log.Printf("fees: funding fee override of batch %s removed", id)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"funding": funding, "override": f != nil})
+}
+
+// ── GET /api/fees/quote ──────────────────────────────────────────────────────
+
+// handleFeeQuote quotes the creation fee for a batch described by the query
+// (kind, count, expiry_policy, charity, promo_code), and, if amount_sats is given, how a
+// payment of that amount into one of its vouchers would be split
+// (funding_charity, funding_donate_percent).
+func handleFeeQuote(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count < 1 || count > cfg.MaxVouchersPerRequest {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("count must be between 1 and %d", cfg.MaxVouchersPerRequest),
+		})
+		return
+	}
+	kind := q.Get("kind")
+	switch kind {
+	case "":
+		kind = KindGift
+	case KindGift, KindTipJar, KindForward, KindPool:
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "kind must be gift, tipjar, forward or pool"})
+		return
+	}
+	creation := fees.CreationFee(kind, count, q.Get("expiry_policy"), q.Get("charity"))
+	if code := normalizePromoCode(q.Get("promo_code")); code != "" {
+		if _, err := creation.applyPromo(code); isPromoError(err) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("applyPromo: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+			return
+		}
+	}
+	resp := map[string]any{"creation": creation}
+
+	if s := q.Get("amount_sats"); s != "" {
+		amount, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || amount < cfg.MinVoucherPayAmountSats || amount > cfg.MaxVoucherPayAmountSats {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("amount_sats must be between %d and %d", cfg.MinVoucherPayAmountSats, cfg.MaxVoucherPayAmountSats),
+			})
+			return
+		}
+		b := &Batch{FundingCharity: q.Get("funding_charity")}
+		if b.FundingCharity != "" {
+			percent, err := strconv.Atoi(q.Get("funding_donate_percent"))
+			if err != nil || percent < 1 || percent > 99 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "funding_donate_percent must be between 1 and 99"})
+				return
+			}
+			b.FundingDonatePercent = percent
+		}
+		resp["funding"] = fees.FundingFee(b, amount*1000)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
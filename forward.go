@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ── Auto-forwarding ──────────────────────────────────────────────────────────
+//
+// Forward vouchers pass their balance on to their Lightning address. The
+// balance itself is the durable queue: amounts below the target's minSendable
+// accumulate until they can be sent, and failed forwards are returned to the
+// balance and retried with exponential backoff.
+
+// forwardNudge wakes the forwarding worker early, e.g. right after a credit.
+var forwardNudge = make(chan struct{}, 1)
+
+// nudgeForwarder asks the forwarding worker to run soon without blocking.
+func nudgeForwarder() {
+	select {
+	case forwardNudge <- struct{}{}:
+	default:
+	}
+}
+
+func runForwardLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.ForwardIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		runJob("forward", forwardBalances)
+		select {
+		case <-ticker.C:
+		case <-forwardNudge:
+		}
+	}
+}
+
+// forwardBalances forwards every eligible forward voucher's balance.
+func forwardBalances() {
+	vouchers, err := database.GetForwardableVouchers()
+	if err != nil {
+		log.Printf("forwarder: GetForwardableVouchers: %v", err)
+		return
+	}
+	for _, v := range vouchers {
+		if err := forwardVoucher(v); err != nil {
+			failures := v.ForwardFailures + 1
+			backoff := time.Duration(cfg.ForwardIntervalSecs) * time.Second << min(failures, 10)
+			backoff = min(backoff, 6*time.Hour)
+			retryAt := time.Now().Add(backoff)
+			log.Printf("forwarder: pay_id=%s failed (%d in a row), retrying after %s: %v",
+				v.PayID, failures, retryAt.UTC().Format(time.RFC3339), err)
+			if dbErr := database.SetForwardRetry(v.PayID, failures, &retryAt); dbErr != nil {
+				log.Printf("forwarder: SetForwardRetry pay_id=%s: %v", v.PayID, dbErr)
+			}
+			continue
+		}
+		if v.ForwardFailures > 0 {
+			if err := database.SetForwardRetry(v.PayID, 0, nil); err != nil {
+				log.Printf("forwarder: SetForwardRetry pay_id=%s: %v", v.PayID, err)
+			}
+		}
+	}
+}
+
+// forwardVoucher sends as much of a forward voucher's balance as its target accepts.
+func forwardVoucher(v *Voucher) error {
+	params, err := resolvePayParams(v.LightningAddress)
+	if err != nil {
+		return err
+	}
+	msats := min(v.TotalPaidMsats, params.MaxSendable) / 1000 * 1000
+	if msats == 0 || msats < params.MinSendable {
+		return nil // keep accumulating
+	}
+
+	log.Printf("forwarder: forwarding %d msats to %s (pay_id=%s)", msats, v.LightningAddress, v.PayID)
+	return withdrawPartial(v, msats, func(ref string) error { return payViaCallback(params, msats, ref) })
+}
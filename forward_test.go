@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestForwardBalances checks that a forward voucher's balance accumulates
+// until its target accepts it, and that a failed forward keeps the balance
+// and is retried after a backoff.
+func TestForwardBalances(t *testing.T) {
+	useTestServer(t)
+	payee := usePayee(t)
+	payee.MinSendable.Store(10_000)
+	cfg.ForwardIntervalSecs = 60
+
+	hash := createBatch(t, `{"kind":"forward","lightning_address":"`+payee.LNURL+`","count":1}`)["payment_hash"].(string)
+	vouchers, err := database.GetVouchersByCreationHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payID := vouchers[0].PayID
+	voucher := func() *Voucher {
+		t.Helper()
+		v, err := database.GetVoucherByPayID(payID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// 5000 msats is below the payee's minSendable, 11500 isn't; only whole
+	// sats are forwarded.
+	fundTestVoucher(t, testDB(), payID, 5000)
+	forwardBalances()
+	if got := payee.Amounts(); len(got) != 0 {
+		t.Errorf("forwarded %v msats below minSendable", got)
+	}
+	fundTestVoucher(t, testDB(), payID, 6500)
+	forwardBalances()
+	if got := payee.Amounts(); !slices.Equal(got, []int64{11_000}) {
+		t.Errorf("forwarded %v msats, want the 11000 accumulated", got)
+	}
+	if v := voucher(); v.TotalPaidMsats != 500 {
+		t.Errorf("voucher holds %d msats after forwarding, want 500", v.TotalPaidMsats)
+	}
+
+	// A refused forward backs off for twice the interval.
+	payee.Refuse.Store(true)
+	fundTestVoucher(t, testDB(), payID, 20_000)
+	forwardBalances()
+	v := voucher()
+	if v.TotalPaidMsats != 20_500 || v.ForwardFailures != 1 || v.ForwardRetryAt == nil {
+		t.Fatalf("voucher after a failed forward: %d msats, %d failures, retry at %v; want 20500 msats kept and a retry",
+			v.TotalPaidMsats, v.ForwardFailures, v.ForwardRetryAt)
+	}
+	if wait := time.Until(*v.ForwardRetryAt); wait < 110*time.Second || wait > 120*time.Second {
+		t.Errorf("retry in %s, want 2m", wait)
+	}
+	forwardable, err := database.GetForwardableVouchers()
+	if err != nil || len(forwardable) != 0 {
+		t.Errorf("forwardable vouchers %v, %v; want none while backing off", forwardable, err)
+	}
+
+	// Once the backoff is over the balance is forwarded and the failures cleared.
+	payee.Refuse.Store(false)
+	past := time.Now().Add(-time.Second)
+	if err := database.SetForwardRetry(payID, 1, &past); err != nil {
+		t.Fatal(err)
+	}
+	forwardBalances()
+	if got := payee.Amounts(); !slices.Equal(got, []int64{11_000, 20_000}) {
+		t.Errorf("forwarded %v msats, want 11000 then 20000", got)
+	}
+	if v := voucher(); v.TotalPaidMsats != 500 || v.ForwardFailures != 0 || v.ForwardRetryAt != nil {
+		t.Errorf("voucher after the retry: %d msats, %d failures, retry at %v; want 500 msats and no backoff",
+			v.TotalPaidMsats, v.ForwardFailures, v.ForwardRetryAt)
+	}
+	checkTestLedger(t, testDB())
+}
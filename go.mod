@@ -4,6 +4,7 @@ go 1.22.0
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.10.9
 	modernc.org/sqlite v1.29.6
 )
 
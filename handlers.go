@@ -3,15 +3,20 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
-	"math"
+	"math/big"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +25,11 @@ import (
 
 var lightningAddressRE = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
 
+var (
+	nodePubkeyRE = regexp.MustCompile(`^0[23][0-9a-f]{64}$`)
+	domainRE     = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9\-]*[a-z0-9])?)+$`)
+)
+
 // writeJSON serialises v as JSON and writes it to w.
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
@@ -43,16 +53,135 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		charities = []Charity{}
 	}
 	writeJSON(w, http.StatusOK, map[string]any{
-		"charities": charities,
+		"charities":          charities,
+		"currencies":         cfg.Currencies,
+		"fee_free_charities": orEmptySlice(fees.FeeFreeCharities),
 	})
 }
 
 // ── POST /api/vouchers/invoice ───────────────────────────────────────────────
 
 type createInvoiceRequest struct {
-	LightningAddress string `json:"lightning_address"`
-	Count            int    `json:"count"`
-	ExpirySeconds    int64  `json:"expiry_seconds"`
+	LightningAddress string       `json:"lightning_address"`
+	Count            int          `json:"count"`
+	Kind             string       `json:"kind"` // gift (default), tipjar, forward or pool
+	ExpirySeconds    int64        `json:"expiry_seconds"`
+	PinProtected     bool         `json:"pin_protected"`
+	ClaimableAfter   string       `json:"claimable_after"` // RFC 3339; empty for no time lock
+	ExpiryPolicy     string       `json:"expiry_policy"`   // refund (default), donate or split
+	Charity          string       `json:"charity"`         // configured charity name for donate/split
+	DonatePercent    int          `json:"donate_percent"`  // charity's share for split, 1-99
+	FundingCharity   string       `json:"funding_charity"` // configured charity receiving a share of every payment
+	FundingPercent   int          `json:"funding_donate_percent"`
+	PoolMembers      []PoolMember `json:"pool_members"` // recipients of a pool's tips
+	Currency         string       `json:"currency"`     // display currency; empty for sats only
+	OwnerEmail       string       `json:"owner_email"`  // notified about the batch; optional
+	PromoCode        string       `json:"promo_code"`   // discounts the creation fee; optional
+	PrefundSats      int64        `json:"prefund_sats"` // paid into each voucher from the operator account
+	batchDetails
+}
+
+// maxPoolMembers and maxPoolWeight bound a tip pool's member list.
+const (
+	maxPoolMembers = 50
+	maxPoolWeight  = 1000
+)
+
+// isPayTarget reports whether s is a Lightning address or a LNURL-pay link.
+func isPayTarget(s string) bool {
+	return lightningAddressRE.MatchString(s) || strings.HasPrefix(strings.ToLower(strings.TrimSpace(s)), "lnurl1")
+}
+
+// findCharity returns the configured charity with the given name.
+func findCharity(name string) (Charity, bool) {
+	for _, c := range cfg.Charities {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Charity{}, false
+}
+
+// batchDetails are the owner-editable fields of a batch: its descriptive
+// fields and the allowlist of where its vouchers can be spent.
+type batchDetails struct {
+	Name           string   `json:"name"`
+	OwnerNote      string   `json:"owner_note"`
+	Message        string   `json:"message"`
+	Tags           []string `json:"tags"`
+	AllowedPayees  []string `json:"allowed_payees"`  // hex node public keys
+	AllowedDomains []string `json:"allowed_domains"` // Lightning address / LNURL-pay hosts
+}
+
+// maxAllowlistEntries bounds each of a batch's allowlists.
+const maxAllowlistEntries = 50
+
+// canRestrictPayees reports whether vouchers of kind can be closed-loop.
+// Forward and pool vouchers only pay their owner's addresses, so an
+// allowlist would mean nothing for them.
+func canRestrictPayees(kind string) bool {
+	return kind == KindGift || kind == KindTipJar
+}
+
+const errPayeeRestrictionKind = "only gift vouchers and tip jars can be restricted to approved payees"
+
+// validate normalises the details in place and checks them.
+func (d *batchDetails) validate() error {
+	d.Name = strings.TrimSpace(d.Name)
+	d.OwnerNote = strings.TrimSpace(d.OwnerNote)
+	d.Message = strings.TrimSpace(d.Message)
+	if len(d.Name) > 80 {
+		return fmt.Errorf("name must be at most 80 characters")
+	}
+	if len(d.OwnerNote) > 500 {
+		return fmt.Errorf("owner_note must be at most 500 characters")
+	}
+	if len(d.Message) > 140 {
+		return fmt.Errorf("message must be at most 140 characters")
+	}
+	var tags []string
+	for _, t := range d.Tags {
+		t = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(t, ",", " ")))
+		if t == "" {
+			continue
+		}
+		if len(t) > 32 {
+			return fmt.Errorf("tags must be at most 32 characters each")
+		}
+		tags = append(tags, t)
+	}
+	if len(tags) > 10 {
+		return fmt.Errorf("at most 10 tags are allowed")
+	}
+	d.Tags = tags
+
+	var err error
+	if d.AllowedPayees, err = normalizeAllowlist(d.AllowedPayees, nodePubkeyRE, "allowed_payees", "a node public key"); err != nil {
+		return err
+	}
+	if d.AllowedDomains, err = normalizeAllowlist(d.AllowedDomains, domainRE, "allowed_domains", "a domain name"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// normalizeAllowlist lowercases and de-duplicates entries, checking each against re.
+func normalizeAllowlist(entries []string, re *regexp.Regexp, field, what string) ([]string, error) {
+	var out []string
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || slices.Contains(out, e) {
+			continue
+		}
+		if !re.MatchString(e) {
+			return nil, fmt.Errorf("%s: %q is not %s", field, e, what)
+		}
+		out = append(out, e)
+	}
+	if len(out) > maxAllowlistEntries {
+		return nil, fmt.Errorf("%s may have at most %d entries", field, maxAllowlistEntries)
+	}
+	return out, nil
 }
 
 func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
@@ -63,9 +192,59 @@ func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate.
-	isLightningAddr := lightningAddressRE.MatchString(req.LightningAddress)
-	isLNURL := strings.HasPrefix(strings.ToLower(strings.TrimSpace(req.LightningAddress)), "lnurl1")
-	if !isLightningAddr && !isLNURL {
+	switch req.ExpiryPolicy {
+	case "", PolicyRefund:
+		req.ExpiryPolicy, req.Charity, req.DonatePercent = PolicyRefund, "", 0
+	case PolicyDonate, PolicySplit:
+		if _, ok := findCharity(req.Charity); !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "charity must be one of the configured charities"})
+			return
+		}
+		if req.ExpiryPolicy == PolicyDonate {
+			req.DonatePercent = 100
+		} else if req.DonatePercent < 1 || req.DonatePercent > 99 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "donate_percent must be between 1 and 99"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expiry_policy must be refund, donate or split"})
+		return
+	}
+	if req.FundingCharity == "" {
+		req.FundingPercent = 0
+	} else if _, ok := findCharity(req.FundingCharity); !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "funding_charity must be one of the configured charities"})
+		return
+	} else if req.FundingPercent < 1 || req.FundingPercent > 99 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "funding_donate_percent must be between 1 and 99"})
+		return
+	}
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if req.Currency != "" && !isSupportedCurrency(req.Currency) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "currency must be one of " + strings.Join(cfg.Currencies, ", "),
+		})
+		return
+	}
+	var emailToken string
+	if req.OwnerEmail = strings.TrimSpace(req.OwnerEmail); req.OwnerEmail != "" {
+		addr, err := mail.ParseAddress(req.OwnerEmail)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid owner_email"})
+			return
+		}
+		req.OwnerEmail = addr.Address
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		emailToken = hex.EncodeToString(token)
+	}
+	// Expired balances of donating batches never reach the creator, so they
+	// need no address unless their vouchers forward tips to it.
+	addressOptional := req.ExpiryPolicy == PolicyDonate && req.Kind != KindForward
+	if (req.LightningAddress != "" || !addressOptional) && !isPayTarget(req.LightningAddress) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{
 			"error": "invalid lightning_address: must be a Lightning address (user@domain) or a LNURL-pay link (lnurl1...)",
 		})
@@ -77,27 +256,231 @@ func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	if req.ExpirySeconds <= 3600 || req.ExpirySeconds > cfg.VoucherAbsoluteExpirySecs {
+	switch req.Kind {
+	case "":
+		req.Kind = KindGift
+	case KindGift:
+	case KindTipJar, KindForward, KindPool:
+		if req.ClaimableAfter != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "only gift vouchers can be time-locked"})
+			return
+		}
+		if req.Kind != KindTipJar && req.PinProtected {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": req.Kind + " vouchers cannot be claimed, so cannot have a PIN"})
+			return
+		}
+		// Persistent vouchers only lapse after a long period without activity.
+		req.ExpirySeconds = cfg.TipJarInactivitySecs
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "kind must be gift, tipjar, forward or pool"})
+		return
+	}
+	if req.Kind != KindPool {
+		req.PoolMembers = nil
+	} else if len(req.PoolMembers) < 2 || len(req.PoolMembers) > maxPoolMembers {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("pool_members must list between 2 and %d members", maxPoolMembers),
+		})
+		return
+	}
+	if (len(req.AllowedPayees) > 0 || len(req.AllowedDomains) > 0) && !canRestrictPayees(req.Kind) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": errPayeeRestrictionKind})
+		return
+	}
+	for i := range req.PoolMembers {
+		m := &req.PoolMembers[i]
+		m.Address = strings.TrimSpace(m.Address)
+		if !isPayTarget(m.Address) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("pool member %q must be a Lightning address or a LNURL-pay link", m.Address),
+			})
+			return
+		}
+		if m.Weight < 1 || m.Weight > maxPoolWeight {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("pool member weights must be between 1 and %d", maxPoolWeight),
+			})
+			return
+		}
+	}
+	if req.Kind == KindGift && (req.ExpirySeconds <= 3600 || req.ExpirySeconds > cfg.VoucherAbsoluteExpirySecs) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{
 			"error": fmt.Sprintf("expiry_seconds must be between 3600 and %d", cfg.VoucherAbsoluteExpirySecs),
 		})
 		return
 	}
+	if err := req.batchDetails.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// Operators with a credit account pay from it instead of by invoice.
+	account, err := accountFromRequest(r)
+	if errors.Is(err, errUnauthorized) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("accountFromRequest: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	if req.PrefundSats != 0 {
+		if account == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prefund_sats needs an operator account"})
+			return
+		}
+		if req.PrefundSats < cfg.MinVoucherPayAmountSats || req.PrefundSats > cfg.MaxVoucherPayAmountSats {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("prefund_sats must be between %d and %d", cfg.MinVoucherPayAmountSats, cfg.MaxVoucherPayAmountSats),
+			})
+			return
+		}
+	}
+	var claimableAfter *time.Time
+	if req.ClaimableAfter != "" {
+		t, err := time.Parse(time.RFC3339, req.ClaimableAfter)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "claimable_after must be an RFC 3339 timestamp"})
+			return
+		}
+		// The recipient must get a full relative-expiry window before the absolute expiry.
+		latest := time.Now().Add(time.Duration(cfg.VoucherAbsoluteExpirySecs-req.ExpirySeconds) * time.Second)
+		if !t.After(time.Now()) || t.After(latest) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("claimable_after must be in the future and no later than %s", latest.UTC().Format(time.RFC3339)),
+			})
+			return
+		}
+		claimableAfter = &t
+	}
 
-	feeSats := cfg.FeePerVoucherSats * int64(req.Count)
-	feeMsats := feeSats * 1000
+	quote := fees.CreationFee(req.Kind, req.Count, req.ExpiryPolicy, req.Charity)
+	var promo *PromoRedemption
+	if req.PromoCode = normalizePromoCode(req.PromoCode); req.PromoCode != "" {
+		var err error
+		if promo, err = quote.applyPromo(req.PromoCode); isPromoError(err) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("applyPromo: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+			return
+		}
+	}
+	feeSats, feeMsats := quote.FeeSats, quote.FeeSats*1000
+	description := fmt.Sprintf("TipMe: create %d voucher(s)", req.Count)
+	if req.Kind == KindTipJar {
+		description = fmt.Sprintf("TipMe: create %d tip jar(s)", req.Count)
+	}
+
+	batch := &Batch{
+		ID:               uuid.New().String(),
+		Name:             req.Name,
+		OwnerNote:        req.OwnerNote,
+		Message:          req.Message,
+		Tags:             req.Tags,
+		LightningAddress: req.LightningAddress,
+		Count:            req.Count,
+		ExpirySeconds:    req.ExpirySeconds,
+		FeeMsats:         feeMsats,
+		Kind:             req.Kind,
+		ExpiryPolicy:     req.ExpiryPolicy,
+		PolicyCharity:    req.Charity,
+		DonatePercent:    req.DonatePercent,
+
+		FundingCharity:       req.FundingCharity,
+		FundingDonatePercent: req.FundingPercent,
+		AllowedPayees:        req.AllowedPayees,
+		AllowedDomains:       req.AllowedDomains,
+		Currency:             req.Currency,
+		OwnerEmail:           req.OwnerEmail,
+		EmailToken:           emailToken,
+	}
+
+	// With no fee to pay, or an operator account to pay it from, there is no
+	// invoice: the batch is filled at once, under a random hash standing in
+	// for the invoice's payment hash.
+	if feeMsats == 0 || account != nil {
+		prefund := fees.FundingFee(batch, req.PrefundSats*1000)
+		if req.PrefundSats > 0 && prefund.CreditedMsats <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prefund_sats is too small to cover the funding fee"})
+			return
+		}
+		if account != nil {
+			if need := feeMsats + int64(req.Count)*prefund.AmountMsats; account.BalanceMsats < need {
+				writeJSON(w, http.StatusPaymentRequired, map[string]string{
+					"error": fmt.Sprintf("insufficient account balance: %d sats needed, %d sats available", need/1000, account.BalanceMsats/1000),
+				})
+				return
+			}
+		}
+		hash := make([]byte, 32)
+		if _, err := rand.Read(hash); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		paymentHash := hex.EncodeToString(hash)
+		if err := database.InsertCreationRequest(paymentHash, batch, req.PoolMembers, promo); isPromoError(err) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("InsertCreationRequest: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+			return
+		}
+		if account != nil {
+			if err := database.PayCreationFromAccount(account.ID, paymentHash); err != nil {
+				if dbErr := database.UpdateCreationRequestStatus(paymentHash, "expired"); dbErr != nil {
+					log.Printf("UpdateCreationRequestStatus: %v", dbErr)
+				}
+				if errors.Is(err, ErrInsufficientBalance) {
+					writeJSON(w, http.StatusPaymentRequired, map[string]string{"error": "insufficient account balance"})
+					return
+				}
+				log.Printf("PayCreationFromAccount: %v", err)
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+				return
+			}
+		}
+		vouchers := fillBatch(paymentHash, batch, &req, claimableAfter)
+		if vouchers == nil {
+			// fillBatch expired the request, which also frees any promo code use.
+			if account != nil {
+				if err := database.RefundCreationToAccount(paymentHash); err != nil {
+					log.Printf("RefundCreationToAccount: %v", err)
+				}
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create vouchers"})
+			return
+		}
+		resp := map[string]any{
+			"invoice":      "",
+			"payment_hash": paymentHash,
+			"fee_sats":     feeSats,
+			"fee_fiat":     fiatEquivalent(feeMsats, req.Currency),
+			"promo_sats":   quote.PromoSats,
+		}
+		if account != nil {
+			resp["account_id"] = account.ID
+			resp["prefunded"] = prefundVouchers(account, batch, vouchers, prefund)
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
-	inv, err := blitziClient.CreateInvoice(ctx, feeMsats, fmt.Sprintf("TipMe: create %d voucher(s)", req.Count))
+	inv, err := blitziClient.CreateInvoice(ctx, feeMsats, description)
 	if err != nil {
 		log.Printf("blitzi CreateInvoice: %v", err)
 		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to create payment invoice"})
 		return
 	}
-
-	if err := database.InsertCreationRequest(inv.PaymentHash, req.LightningAddress, req.Count, req.ExpirySeconds, feeMsats); err != nil {
+	if err := database.InsertCreationRequest(inv.PaymentHash, batch, req.PoolMembers, promo); isPromoError(err) {
+		// The code was used up while the invoice was being created.
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
 		log.Printf("InsertCreationRequest: %v", err)
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
 		return
@@ -115,35 +498,103 @@ func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-
-		// Payment confirmed — create vouchers.
-		payIDs := make([]string, req.Count)
-		withdrawIDs := make([]string, req.Count)
-		for i := 0; i < req.Count; i++ {
-			payIDs[i] = uuid.New().String()
-			withdrawIDs[i] = uuid.New().String()
-		}
-
-		if err := database.InsertVouchers(payIDs, withdrawIDs, inv.PaymentHash, req.LightningAddress, req.ExpirySeconds); err != nil {
-			log.Printf("InsertVouchers: %v", err)
-			if dbErr := database.UpdateCreationRequestStatus(inv.PaymentHash, "expired"); dbErr != nil {
-				log.Printf("UpdateCreationRequestStatus: %v", dbErr)
-			}
-			return
-		}
-
-		if err := database.UpdateCreationRequestStatus(inv.PaymentHash, "complete"); err != nil {
-			log.Printf("UpdateCreationRequestStatus complete: %v", err)
-		}
+		fillBatch(inv.PaymentHash, batch, &req, claimableAfter)
 	}()
 
 	writeJSON(w, http.StatusOK, map[string]any{
 		"invoice":      inv.Invoice,
 		"payment_hash": inv.PaymentHash,
 		"fee_sats":     feeSats,
+		"fee_fiat":     fiatEquivalent(feeMsats, req.Currency),
+		"promo_sats":   quote.PromoSats,
 	})
 }
 
+// generatePIN returns a random 4-digit claim PIN.
+func generatePIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", n.Int64()), nil
+}
+
+// prefundVouchers pays q.AmountMsats from account into each voucher and
+// returns how many were funded: all of them, or none if the balance no
+// longer covers them all.
+func prefundVouchers(account *CreditAccount, batch *Batch, vouchers []*Voucher, q FundingQuote) int {
+	if q.AmountMsats == 0 {
+		return 0
+	}
+	payIDs := make([]string, len(vouchers))
+	for i, v := range vouchers {
+		payIDs[i] = v.PayID
+	}
+	if err := database.PrefundVouchers(account.ID, payIDs, batch.FundingCharity, q); err != nil {
+		log.Printf("PrefundVouchers (account=%s batch=%s): %v", account.ID, batch.ID, err)
+		return 0
+	}
+	nudgeWebhooks()
+	nudgeMailer()
+	if slices.ContainsFunc(vouchers, (*Voucher).IsForward) {
+		nudgeForwarder()
+	}
+	return len(vouchers)
+}
+
+// fillBatch creates the vouchers of a batch whose creation request,
+// paymentHash, has been paid, completes the request and returns them, or
+// nil if they could not be created.
+func fillBatch(paymentHash string, batch *Batch, req *createInvoiceRequest, claimableAfter *time.Time) []*Voucher {
+	emitEvent(EventBatchPaid, batch.ID, "", map[string]any{
+		"count":     req.Count,
+		"kind":      req.Kind,
+		"fee_msats": batch.FeeMsats,
+	})
+
+	vouchers := make([]*Voucher, req.Count)
+	for i := range vouchers {
+		vouchers[i] = &Voucher{
+			PayID:            uuid.New().String(),
+			WithdrawID:       uuid.New().String(),
+			BatchID:          batch.ID,
+			LightningAddress: req.LightningAddress,
+			ExpirySeconds:    req.ExpirySeconds,
+			ClaimableAfter:   claimableAfter,
+			Kind:             req.Kind,
+		}
+		if req.PinProtected {
+			pin, err := generatePIN()
+			if err != nil {
+				log.Printf("generatePIN: %v", err)
+				if dbErr := database.UpdateCreationRequestStatus(paymentHash, "expired"); dbErr != nil {
+					log.Printf("UpdateCreationRequestStatus: %v", dbErr)
+				}
+				return nil
+			}
+			vouchers[i].Pin = pin
+		}
+	}
+
+	if err := database.InsertVouchers(paymentHash, vouchers); err != nil {
+		log.Printf("InsertVouchers: %v", err)
+		if dbErr := database.UpdateCreationRequestStatus(paymentHash, "expired"); dbErr != nil {
+			log.Printf("UpdateCreationRequestStatus: %v", dbErr)
+		}
+		return nil
+	}
+
+	if err := database.UpdateCreationRequestStatus(paymentHash, "complete"); err != nil {
+		log.Printf("UpdateCreationRequestStatus complete: %v", err)
+	}
+	payIDs := make([]string, len(vouchers))
+	for i, v := range vouchers {
+		payIDs[i] = v.PayID
+	}
+	emitEvent(EventBatchCompleted, batch.ID, "", map[string]any{"count": req.Count, "pay_ids": payIDs})
+	return vouchers
+}
+
 // ── GET /api/vouchers/status/:payment_hash ───────────────────────────────────
 
 func handleVoucherStatus(w http.ResponseWriter, r *http.Request) {
@@ -167,50 +618,328 @@ func handleVoucherStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type voucherResp struct {
-		LNURLPay          string `json:"lnurl_pay"`
-		LNURLWithdraw     string `json:"lnurl_withdraw"`
-		PayInfoURL        string `json:"pay_info_url"`
-		WithdrawInfoURL   string `json:"withdraw_info_url"`
-		LightningAddress  string `json:"lightning_address"`
-		AbsoluteExpiry    string `json:"absolute_expiry"`
-		RelativeExpirySec int64  `json:"relative_expiry_seconds"`
-	}
-
-	resp := make([]voucherResp, 0, len(vouchers))
+	resp := make([]*voucherResp, 0, len(vouchers))
 	for _, v := range vouchers {
-		payURL := fmt.Sprintf("%s/pay/%s", cfg.BaseURL, v.PayID)
-		withURL := fmt.Sprintf("%s/withdraw/%s", cfg.BaseURL, v.WithdrawID)
-
-		lnurlPay, err := EncodeLNURL(payURL)
+		vr, err := newVoucherResp(v)
 		if err != nil {
-			log.Printf("EncodeLNURL pay: %v", err)
-			continue
-		}
-		lnurlWith, err := EncodeLNURL(withURL)
-		if err != nil {
-			log.Printf("EncodeLNURL withdraw: %v", err)
+			log.Printf("newVoucherResp: %v", err)
 			continue
 		}
+		resp = append(resp, vr)
+	}
 
-		absExpiry := v.CreatedAt.Add(time.Duration(cfg.VoucherAbsoluteExpirySecs) * time.Second)
-		resp = append(resp, voucherResp{
-			LNURLPay:          lnurlPay,
-			LNURLWithdraw:     lnurlWith,
-			PayInfoURL:        fmt.Sprintf("%s/pay/info?lightning=%s", cfg.BaseURL, lnurlPay),
-			WithdrawInfoURL:   fmt.Sprintf("%s/withdraw/info?lightning=%s", cfg.BaseURL, lnurlWith),
-			LightningAddress:  v.LightningAddress,
-			AbsoluteExpiry:    absExpiry.UTC().Format(time.RFC3339),
-			RelativeExpirySec: v.ExpirySeconds,
-		})
+	batch, err := database.GetBatch(creq.BatchID)
+	if err != nil {
+		log.Printf("GetBatch: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+
+	batchResp := batchJSON(batch)
+	// Tip limits in the batch currency, for the printed vouchers.
+	if minFiat := fiatEquivalent(cfg.MinVoucherPayAmountSats*1000, batch.Currency); minFiat != "" {
+		batchResp["fiat_range"] = map[string]string{
+			"min": minFiat,
+			"max": fiatEquivalent(cfg.MaxVoucherPayAmountSats*1000, batch.Currency),
+		}
 	}
 
+	// PINs are returned until the owner's page confirms it has shown them
+	// (see handleForgetBatchPINs).
 	writeJSON(w, http.StatusOK, map[string]any{
 		"status":   "complete",
+		"batch":    batchResp,
 		"vouchers": resp,
 	})
 }
 
+// voucherResp is the printable representation of a voucher.
+type voucherResp struct {
+	PayID             string `json:"pay_id"`
+	LNURLPay          string `json:"lnurl_pay"`
+	LNURLWithdraw     string `json:"lnurl_withdraw"`
+	PayInfoURL        string `json:"pay_info_url"`
+	WithdrawInfoURL   string `json:"withdraw_info_url"`
+	LightningAddress  string `json:"lightning_address"`
+	Kind              string `json:"kind"`
+	AbsoluteExpiry    string `json:"absolute_expiry,omitempty"` // empty for tip jars and forwards
+	RelativeExpirySec int64  `json:"relative_expiry_seconds"`
+	PinProtected      bool   `json:"pin_protected"`
+	Pin               string `json:"pin,omitempty"` // only until the owner has been shown it
+	ClaimableAfter    string `json:"claimable_after,omitempty"`
+}
+
+func newVoucherResp(v *Voucher) (*voucherResp, error) {
+	payURL := fmt.Sprintf("%s/pay/%s", cfg.BaseURL, v.PayID)
+	withURL := fmt.Sprintf("%s/withdraw/%s", cfg.BaseURL, v.WithdrawID)
+
+	lnurlPay, err := EncodeLNURL(payURL)
+	if err != nil {
+		return nil, fmt.Errorf("encode pay lnurl: %w", err)
+	}
+	lnurlWith, err := EncodeLNURL(withURL)
+	if err != nil {
+		return nil, fmt.Errorf("encode withdraw lnurl: %w", err)
+	}
+
+	var absExpiry string
+	if !v.IsPersistent() {
+		absExpiry = v.CreatedAt.Add(time.Duration(cfg.VoucherAbsoluteExpirySecs) * time.Second).UTC().Format(time.RFC3339)
+	}
+	var claimableAfter string
+	if v.ClaimableAfter != nil {
+		claimableAfter = v.ClaimableAfter.UTC().Format(time.RFC3339)
+	}
+	return &voucherResp{
+		PayID:             v.PayID,
+		LNURLPay:          lnurlPay,
+		LNURLWithdraw:     lnurlWith,
+		PayInfoURL:        fmt.Sprintf("%s/pay/info?lightning=%s", cfg.BaseURL, lnurlPay),
+		WithdrawInfoURL:   fmt.Sprintf("%s/withdraw/info?lightning=%s", cfg.BaseURL, lnurlWith),
+		LightningAddress:  v.LightningAddress,
+		Kind:              v.Kind,
+		AbsoluteExpiry:    absExpiry,
+		RelativeExpirySec: v.ExpirySeconds,
+		PinProtected:      v.HasPIN(),
+		Pin:               v.Pin,
+		ClaimableAfter:    claimableAfter,
+	}, nil
+}
+
+// ── POST /api/vouchers/:pay_id/rekey ─────────────────────────────────────────
+
+// handleRekeyVoucher replaces a voucher's withdraw secret after it has leaked.
+// The pay side and balance are untouched; every outstanding withdraw session for
+// the old secret is invalidated. Allowed for the batch owner (who proves it with
+// the creation payment hash) and for the admin.
+func handleRekeyVoucher(w http.ResponseWriter, r *http.Request) {
+	payID := r.PathValue("pay_id")
+	var body struct {
+		PaymentHash string `json:"payment_hash"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+	}
+
+	v, err := database.GetVoucherByPayID(payID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	isOwner := isVoucherOwner(v, body.PaymentHash)
+	if !isOwner && !isAdmin(r) {
+		// Don't reveal whether the voucher exists to unauthorised callers.
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if !v.Active {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "voucher is no longer active"})
+		return
+	}
+
+	newWithdrawID := uuid.New().String()
+	if err := database.RekeyVoucher(payID, v.WithdrawID, newWithdrawID); err != nil {
+		log.Printf("RekeyVoucher (pay_id=%s): %v", payID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("voucher %s re-keyed (by owner=%v)", payID, isOwner)
+
+	v.WithdrawID = newWithdrawID
+	vr, err := newVoucherResp(v)
+	if err != nil {
+		log.Printf("newVoucherResp: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, vr)
+}
+
+// isVoucherOwner reports whether paymentHash is the payment hash of the
+// voucher's creation invoice, which only the batch owner knows.
+func isVoucherOwner(v *Voucher, paymentHash string) bool {
+	return paymentHash != "" && v.CreationHash != "" &&
+		subtle.ConstantTimeCompare([]byte(paymentHash), []byte(v.CreationHash)) == 1
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+func isAdmin(r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// ── GET/PATCH /api/batches/:payment_hash ────────────────────────────────────
+//
+// Batches are addressed by the payment hash of their creation invoice, which
+// only the creator knows.
+
+// batchJSON is the owner-facing representation of a batch.
+func batchJSON(b *Batch) map[string]any {
+	orEmpty := func(s []string) []string {
+		if s == nil {
+			return []string{}
+		}
+		return s
+	}
+	return map[string]any{
+		"id":                b.ID,
+		"name":              b.Name,
+		"owner_note":        b.OwnerNote,
+		"message":           b.Message,
+		"tags":              orEmpty(b.Tags),
+		"lightning_address": b.LightningAddress,
+		"count":             b.Count,
+		"expiry_seconds":    b.ExpirySeconds,
+		"fee_sats":          b.FeeMsats / 1000,
+		"created_at":        b.CreatedAt.UTC().Format(time.RFC3339),
+		"expiry_policy":     b.ExpiryPolicy,
+		"charity":           b.PolicyCharity,
+		"donate_percent":    b.DonatePercent,
+
+		"funding_charity":        b.FundingCharity,
+		"funding_donate_percent": b.FundingDonatePercent,
+		"allowed_payees":         orEmpty(b.AllowedPayees),
+		"allowed_domains":        orEmpty(b.AllowedDomains),
+		"currency":               b.Currency,
+	}
+}
+
+// batchForPaymentHash resolves the batch owned by a creation payment hash,
+// writing a JSON error and returning nil if there is none.
+func batchForPaymentHash(w http.ResponseWriter, paymentHash string) *Batch {
+	creq, err := database.GetCreationRequest(paymentHash)
+	if err != nil || creq.BatchID == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return nil
+	}
+	batch, err := database.GetBatch(creq.BatchID)
+	if err != nil {
+		log.Printf("GetBatch: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return nil
+	}
+	return batch
+}
+
+func handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	batch := batchForPaymentHash(w, r.PathValue("payment_hash"))
+	if batch == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, batchJSON(batch))
+}
+
+// handleGetBatchPool returns a pool batch's members, with what each is still
+// owed, and its most recent payouts.
+func handleGetBatchPool(w http.ResponseWriter, r *http.Request) {
+	batch := batchForPaymentHash(w, r.PathValue("payment_hash"))
+	if batch == nil {
+		return
+	}
+	members, err := database.GetPoolMembers(batch.ID)
+	if err != nil {
+		log.Printf("GetPoolMembers: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	if len(members) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not a tip pool"})
+		return
+	}
+	payouts, err := database.GetPoolPayouts(batch.ID, 100)
+	if err != nil {
+		log.Printf("GetPoolPayouts: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	if payouts == nil {
+		payouts = []PoolPayout{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"members": members, "payouts": payouts})
+}
+
+func handleUpdateBatch(w http.ResponseWriter, r *http.Request) {
+	batch := batchForPaymentHash(w, r.PathValue("payment_hash"))
+	if batch == nil {
+		return
+	}
+
+	// Start from the stored values so omitted fields are left unchanged.
+	details := batchDetails{
+		Name: batch.Name, OwnerNote: batch.OwnerNote, Message: batch.Message, Tags: batch.Tags,
+		AllowedPayees: batch.AllowedPayees, AllowedDomains: batch.AllowedDomains,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if err := details.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if (len(details.AllowedPayees) > 0 || len(details.AllowedDomains) > 0) && !canRestrictPayees(batch.Kind) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": errPayeeRestrictionKind})
+		return
+	}
+	batch.Name, batch.OwnerNote, batch.Message, batch.Tags = details.Name, details.OwnerNote, details.Message, details.Tags
+	batch.AllowedPayees, batch.AllowedDomains = details.AllowedPayees, details.AllowedDomains
+	if err := database.UpdateBatchDetails(batch); err != nil {
+		log.Printf("UpdateBatchDetails: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, batchJSON(batch))
+}
+
+// handleForgetBatchPINs drops the claim PINs of a batch's vouchers, leaving
+// only their hashes. The creation page calls it once it has shown them, so a
+// status response lost on the way doesn't lose them.
+func handleForgetBatchPINs(w http.ResponseWriter, r *http.Request) {
+	paymentHash := r.PathValue("payment_hash")
+	if _, err := database.GetCreationRequest(paymentHash); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err := database.ForgetRevealedPINs(paymentHash); err != nil {
+		log.Printf("ForgetRevealedPINs: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "forgotten"})
+}
+
+// batchContextHTML renders a voucher's batch name and message for the info
+// pages, or an empty string if the batch has neither.
+func batchContextHTML(batchID string) string {
+	if batchID == "" {
+		return ""
+	}
+	b, err := database.GetBatch(batchID)
+	if err != nil {
+		log.Printf("GetBatch (batch_id=%s): %v", batchID, err)
+		return ""
+	}
+	if b.Name == "" && b.Message == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(`<div class="batch">`)
+	if b.Name != "" {
+		sb.WriteString(`<div class="batch-name">` + html.EscapeString(b.Name) + `</div>`)
+	}
+	if b.Message != "" {
+		sb.WriteString(`<div class="batch-msg">` + html.EscapeString(b.Message) + `</div>`)
+	}
+	sb.WriteString(`</div>`)
+	return sb.String()
+}
+
 // ── GET /pay/:pay_id (LNURL-Pay step 1) ─────────────────────────────────────
 
 func handleLNURLPay(w http.ResponseWriter, r *http.Request) {
@@ -230,14 +959,18 @@ func handleLNURLPay(w http.ResponseWriter, r *http.Request) {
 	lnurlEncoded, _ := EncodeLNURL(payURL)
 	callbackURL := fmt.Sprintf("%s/pay/%s/callback", cfg.BaseURL, payID)
 	infoURL := fmt.Sprintf("%s/pay/info?lightning=%s", cfg.BaseURL, lnurlEncoded)
-	writeJSON(w, http.StatusOK, map[string]any{
+	resp := map[string]any{
 		"tag":         "payRequest",
 		"callback":    callbackURL,
 		"minSendable": cfg.MinVoucherPayAmountSats * 1000,
 		"maxSendable": cfg.MaxVoucherPayAmountSats * 1000,
 		"metadata":    `[["text/plain","Tip via TipMe"]]`,
 		"url":         infoURL,
-	})
+	}
+	if currencies := lud21Currencies(batchCurrency(v)); len(currencies) > 0 {
+		resp["currencies"] = currencies
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // ── GET /pay/:pay_id/callback (LNURL-Pay step 2) ────────────────────────────
@@ -250,10 +983,32 @@ func handleLNURLPayCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// LUD-21: amount=<hundredths>.<CODE> asks for a fiat amount, converted at today's rate.
 	var amountMsats int64
-	if _, err := fmt.Sscan(amountStr, &amountMsats); err != nil || amountMsats <= 0 {
+	var quote *PayQuote
+	if value, code, ok := strings.Cut(amountStr, "."); ok {
+		cents, err := strconv.ParseInt(value, 10, 64)
+		code = strings.ToUpper(code)
+		if err != nil || cents <= 0 || !isSupportedCurrency(code) {
+			lnurlError(w, "invalid amount")
+			return
+		}
+		if quote, err = quoteFiat(cents, code); err != nil {
+			log.Printf("quoteFiat (pay callback, %s): %v", code, err)
+			lnurlError(w, "no exchange rate available for "+code)
+			return
+		}
+		amountMsats = quote.Msats
+	} else if n, err := strconv.ParseInt(amountStr, 10, 64); err != nil || n <= 0 {
 		lnurlError(w, "invalid amount")
 		return
+	} else {
+		amountMsats = n
+	}
+	if amountMsats < cfg.MinVoucherPayAmountSats*1000 || amountMsats > cfg.MaxVoucherPayAmountSats*1000 {
+		lnurlError(w, fmt.Sprintf("amount must be between %d and %d sats",
+			cfg.MinVoucherPayAmountSats, cfg.MaxVoucherPayAmountSats))
+		return
 	}
 
 	// Re-check active conditions.
@@ -267,14 +1022,33 @@ func handleLNURLPayCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate fee.
-	feeMsats := int64(float64(cfg.FundingFeeMinMsats) + math.Floor(float64(amountMsats)*cfg.FundingFeePercent))
-	creditedMsats := amountMsats - feeMsats
+	// Split the payment between the fee, the batch's charity share if it
+	// has one, and the voucher.
+	var batch *Batch
+	var charity, currency string
+	if v.BatchID != "" {
+		if batch, err = database.GetBatch(v.BatchID); err != nil {
+			log.Printf("GetBatch (pay callback): %v", err)
+			lnurlError(w, "database error")
+			return
+		}
+		charity, currency = batch.FundingCharity, batch.Currency
+	}
+	split := fees.FundingFee(batch, amountMsats)
+	creditedMsats, charityMsats := split.CreditedMsats, split.CharityMsats
 	if creditedMsats <= 0 {
 		lnurlError(w, "amount too small to cover fee")
 		return
 	}
 
+	// Lock in the credit's fiat value at today's rate.
+	var fiatValue int64
+	if currency != "" {
+		if fiatValue, err = fiatCents(creditedMsats, currency); err != nil {
+			log.Printf("fiatCents (pay callback, %s): %v", currency, err)
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
@@ -287,7 +1061,7 @@ func handleLNURLPayCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	invoiceID := uuid.New().String()
-	if err := database.InsertPayInvoice(invoiceID, payID, inv.PaymentHash, amountMsats, creditedMsats); err != nil {
+	if err := database.InsertPayInvoice(invoiceID, payID, inv.PaymentHash, amountMsats, creditedMsats, charityMsats, fiatValue, quote); err != nil {
 		log.Printf("InsertPayInvoice: %v", err)
 		lnurlError(w, "database error")
 		return
@@ -323,16 +1097,44 @@ func handleLNURLPayCallback(w http.ResponseWriter, r *http.Request) {
 				log.Printf("CreditVoucherTx: %v", err)
 				return
 			}
+			if charityMsats > 0 {
+				if err := InsertCharityPayoutTx(tx, charity, payID, "funding", "pending", charityMsats); err != nil {
+					log.Printf("InsertCharityPayoutTx: %v", err)
+					return
+				}
+			}
 			if err := tx.Commit(); err != nil {
 				log.Printf("Commit credit: %v", err)
+				return
+			}
+			nudgeWebhooks()
+			nudgeMailer()
+			if voucher.IsForward() {
+				nudgeForwarder()
 			}
 		} else {
 			// Voucher became inactive while invoice was open — refund the payer.
 			tx.Rollback()
+			refundMsats := creditedMsats + charityMsats
+			if err := database.PostLedger(LedgerLateFunding, inv.PaymentHash,
+				LedgerEntry{AccountLightning, amountMsats},
+				LedgerEntry{AccountFundingFees, refundMsats - amountMsats},
+				LedgerEntry{AccountPayerRefunds, -refundMsats},
+			); err != nil {
+				log.Printf("PostLedger late funding (pay_id=%s): %v", payID, err)
+			}
+			refundTo := refundAddress(voucher)
 			log.Printf("voucher %s became inactive after payment; attempting refund of %d msats to %s",
-				payID, creditedMsats, voucher.LightningAddress)
-			if err := RefundToLightningAddress(voucher.LightningAddress, creditedMsats); err != nil {
+				payID, refundMsats, refundTo)
+			if err := RefundToLightningAddress(refundTo, refundMsats, "payer_refund:"+inv.PaymentHash); err != nil {
 				log.Printf("refund failed for pay_id=%s: %v", payID, err)
+				return
+			}
+			if err := database.PostLedger(LedgerPayerRefund, inv.PaymentHash,
+				LedgerEntry{AccountPayerRefunds, refundMsats},
+				LedgerEntry{AccountLightning, -refundMsats},
+			); err != nil {
+				log.Printf("PostLedger payer refund (pay_id=%s): %v", payID, err)
 			}
 		}
 	}()
@@ -361,38 +1163,135 @@ func handleLNURLWithdraw(w http.ResponseWriter, r *http.Request) {
 		lnurlError(w, "voucher has no balance")
 		return
 	}
-
-	// Generate a random k1.
-	k1Bytes := make([]byte, 32)
-	if _, err := rand.Read(k1Bytes); err != nil {
-		lnurlError(w, "internal error")
+	if v.IsTimeLocked() {
+		lnurlError(w, timeLockedReason(v))
 		return
 	}
-	k1 := hex.EncodeToString(k1Bytes)
-
-	if err := database.InsertWithdrawSession(k1, withdrawID); err != nil {
-		log.Printf("InsertWithdrawSession: %v", err)
-		lnurlError(w, "database error")
+	if v.IsAutoPayout() {
+		lnurlError(w, autoPayoutReason(v))
 		return
 	}
 
+	var k1 string
+	if v.HasPIN() {
+		// PIN-protected: only the k1 handed out by the claim page is accepted.
+		k1 = r.URL.Query().Get("k1")
+		ok, err := database.GetPinSession(k1, withdrawID, time.Duration(cfg.PinSessionSecs)*time.Second)
+		if err != nil {
+			log.Printf("GetPinSession: %v", err)
+			lnurlError(w, "database error")
+			return
+		}
+		if !ok {
+			lnurlError(w, "this voucher is PIN protected: open the claim page and enter the PIN first")
+			return
+		}
+	} else {
+		var err error
+		if k1, err = newK1(); err != nil {
+			lnurlError(w, "internal error")
+			return
+		}
+		if err := database.InsertWithdrawSession(k1, withdrawID); err != nil {
+			log.Printf("InsertWithdrawSession: %v", err)
+			lnurlError(w, "database error")
+			return
+		}
+	}
+
 	withURL := fmt.Sprintf("%s/withdraw/%s", cfg.BaseURL, withdrawID)
 	lnurlEncoded, _ := EncodeLNURL(withURL)
 	callbackURL := fmt.Sprintf("%s/withdraw/%s/callback", cfg.BaseURL, withdrawID)
 	infoURL := fmt.Sprintf("%s/withdraw/info?lightning=%s", cfg.BaseURL, lnurlEncoded)
 	balance := v.TotalPaidMsats
 
+	// Gift vouchers are claimed in full; tip jars allow any amount up to the balance.
+	minWithdrawable, description := balance, "TipMe withdrawal"
+	if v.IsTipJar() {
+		minWithdrawable, description = min(1000, balance), "TipMe tip jar withdrawal"
+	}
+
 	writeJSON(w, http.StatusOK, map[string]any{
 		"tag":                "withdrawRequest",
 		"callback":           callbackURL,
 		"k1":                 k1,
-		"defaultDescription": "TipMe withdrawal",
-		"minWithdrawable":    balance,
+		"defaultDescription": description,
+		"minWithdrawable":    minWithdrawable,
 		"maxWithdrawable":    balance,
 		"url":                infoURL,
 	})
 }
 
+// autoPayoutReason explains why a forward or pool voucher can't be withdrawn from.
+func autoPayoutReason(v *Voucher) string {
+	if v.IsPool() {
+		return "this voucher shares its tips between a group automatically and cannot be claimed"
+	}
+	return "this voucher forwards its tips automatically and cannot be claimed"
+}
+
+// closedLoopBatch returns the voucher's batch if it restricts where the
+// voucher can be spent, or nil if it doesn't.
+func closedLoopBatch(v *Voucher) (*Batch, error) {
+	if v.BatchID == "" {
+		return nil, nil
+	}
+	b, err := database.GetBatch(v.BatchID)
+	if err != nil {
+		return nil, err
+	}
+	if !b.IsClosedLoop() {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// spendRestriction checks that a closed-loop voucher may pay invoice, or
+// Lightning address dest if invoice is empty, and otherwise explains where
+// the voucher can be spent. It returns "" if the payment is allowed.
+func spendRestriction(v *Voucher, invoice, dest string) string {
+	b, err := closedLoopBatch(v)
+	if err != nil {
+		// Fail closed: an unrestricted payment can't be taken back.
+		log.Printf("closedLoopBatch (pay_id=%s): %v", v.PayID, err)
+		return "could not check where this voucher can be spent, please try again"
+	}
+	if b == nil {
+		return ""
+	}
+	if invoice != "" {
+		if payee, err := bolt11Payee(invoice); err == nil && b.AllowsPayee(payee) {
+			return ""
+		}
+	} else if domain, err := payTargetDomain(dest); err == nil && b.AllowsDomain(domain) {
+		return ""
+	}
+	return "this voucher can only be spent with approved merchants: " + allowedPayeesText(b)
+}
+
+// allowedPayeesText lists where a closed-loop batch's vouchers can be spent.
+func allowedPayeesText(b *Batch) string {
+	where := slices.Clone(b.AllowedDomains)
+	for _, p := range b.AllowedPayees {
+		where = append(where, "node "+p[:12]+"…")
+	}
+	return strings.Join(where, ", ")
+}
+
+// timeLockedReason explains to a wallet why a time-locked voucher can't be claimed yet.
+func timeLockedReason(v *Voucher) string {
+	return "this voucher can be claimed from " + v.ClaimableAfter.UTC().Format("2 Jan 2006 15:04 UTC")
+}
+
+// newK1 returns a random LNURL-withdraw session key.
+func newK1() (string, error) {
+	k1Bytes := make([]byte, 32)
+	if _, err := rand.Read(k1Bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(k1Bytes), nil
+}
+
 // ── GET /withdraw/:withdraw_id/callback (LNURL-Withdraw step 2) ─────────────
 
 func handleLNURLWithdrawCallback(w http.ResponseWriter, r *http.Request) {
@@ -406,7 +1305,7 @@ func handleLNURLWithdrawCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate k1 and mark used atomically; get the payID.
-	payID, err := database.ValidateAndUseWithdrawSession(k1, withdrawID)
+	payID, err := database.ValidateAndUseWithdrawSession(k1, withdrawID, "")
 	if err != nil {
 		lnurlError(w, "invalid or already-used k1: "+err.Error())
 		return
@@ -426,12 +1325,43 @@ func handleLNURLWithdrawCallback(w http.ResponseWriter, r *http.Request) {
 		lnurlError(w, "voucher has no balance")
 		return
 	}
+	if v.IsTimeLocked() {
+		lnurlError(w, timeLockedReason(v))
+		return
+	}
+	if v.IsAutoPayout() {
+		lnurlError(w, autoPayoutReason(v))
+		return
+	}
+	if reason := spendRestriction(v, pr, ""); reason != "" {
+		lnurlError(w, reason)
+		return
+	}
 
 	// Pay the invoice via blitzi.
 	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
 	defer cancel()
 
-	if err := blitziClient.PayInvoice(ctx, pr); err != nil {
+	if v.IsTipJar() {
+		// Partial withdrawal: the invoice amount is debited, the jar stays open.
+		amount, err := bolt11AmountMsats(pr)
+		if err != nil || amount == 0 {
+			lnurlError(w, "invoice must specify an amount")
+			return
+		}
+		err = withdrawPartial(v, amount, func(ref string) error { return payInvoice(ctx, pr, ref) })
+		if errors.Is(err, ErrInsufficientBalance) {
+			lnurlError(w, "amount exceeds voucher balance")
+		} else if err != nil {
+			log.Printf("PayInvoice tip jar withdraw (withdraw_id=%s): %v", withdrawID, err)
+			lnurlError(w, "payment failed")
+		} else {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+		}
+		return
+	}
+
+	if err := payInvoice(ctx, pr, "claim:"+payID); err != nil {
 		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 			// Timeout — assume paid to prevent wallet showing failure for a payment that may have succeeded.
 			log.Printf("CRITICAL: withdraw payment timed out for withdraw_id=%s (%d msats), assuming paid: %v",
@@ -439,6 +1369,7 @@ func handleLNURLWithdrawCallback(w http.ResponseWriter, r *http.Request) {
 			if deactErr := database.DeactivateVoucher(payID, "timeout_assumed_paid", v.TotalPaidMsats); deactErr != nil {
 				log.Printf("CRITICAL: failed to deactivate withdraw_id=%s after timeout: %v", withdrawID, deactErr)
 			}
+			emitClaimed(v, v.TotalPaidMsats, false)
 			writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
 		} else {
 			// Definitive failure — voucher stays active so the user can retry.
@@ -448,74 +1379,275 @@ func handleLNURLWithdrawCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Payment succeeded — deactivate the voucher.
+	// Payment succeeded — deactivate the voucher.
+	emitClaimed(v, v.TotalPaidMsats, false)
+	tx, err := database.Begin()
+	if err != nil {
+		log.Printf("Begin tx (deactivate withdraw_id=%s): %v", withdrawID, err)
+		// Payment was sent but we couldn't deactivate — log and return OK to wallet.
+		log.Printf("CRITICAL: voucher %s paid out but not deactivated", payID)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := DeactivateVoucherTx(tx, payID, "claimed", v.TotalPaidMsats); err != nil {
+		log.Printf("DeactivateVoucherTx: %v", err)
+		tx.Rollback()
+		log.Printf("CRITICAL: voucher %s paid out but not deactivated", payID)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("CRITICAL: Commit deactivate for payID=%s failed: %v", payID, err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// withdrawPartial debits msats from a tip jar or forward voucher, pays it
+// with pay, which is given the withdrawal's ref, and settles the withdrawal. As with full claims, a payment that
+// times out is assumed to have been made.
+func withdrawPartial(v *Voucher, msats int64, pay func(ref string) error) error {
+	id, err := database.DebitVoucher(v.PayID, msats)
+	if err != nil {
+		return err
+	}
+	return settlePartial(v, id, msats, pay)
+}
+
+// settlePartial pays the debited withdrawal id with pay and settles it.
+func settlePartial(v *Voucher, id, msats int64, pay func(ref string) error) error {
+	if err := pay(fmt.Sprintf("withdrawal:%d", id)); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			log.Printf("CRITICAL: partial withdrawal timed out for pay_id=%s (%d msats), assuming paid until reconciled: %v",
+				v.PayID, msats, err)
+			if err := database.MarkWithdrawalUnknown(id); err != nil {
+				log.Printf("MarkWithdrawalUnknown (pay_id=%s): %v", v.PayID, err)
+			}
+			if !cfg.ReconcileEnabled {
+				log.Printf("CRITICAL: reconciliation is off, so withdrawal %d stays unresolved until its payment is checked in blitzi", id)
+			}
+			emitClaimed(v, msats, true)
+			return nil
+		}
+		if settleErr := database.SettleWithdrawal(id, false); settleErr != nil {
+			log.Printf("CRITICAL: failed to return %d msats to voucher pay_id=%s: %v", msats, v.PayID, settleErr)
+		}
+		return err
+	}
+	if err := database.SettleWithdrawal(id, true); err != nil {
+		log.Printf("SettleWithdrawal (pay_id=%s): %v", v.PayID, err)
+	}
+	emitClaimed(v, msats, true)
+	return nil
+}
+
+// ── Automated Refund Job ─────────────────────────────────────────────────────
+//
+// Expired balances follow their batch's expiry policy: refunded to the
+// creator, donated to a charity, or split between the two. Donations accrue
+// in charity_payouts and are paid out by the charity payout job.
+
+func runRefundJob(ctx context.Context) error {
+	expired, err := database.GetExpiredVouchersForRefund()
+	if err != nil {
+		return fmt.Errorf("GetExpiredVouchersForRefund: %w", err)
+	}
+
+	log.Printf("refund job: found %d expired voucher(s) with balance", len(expired))
+
+	for _, v := range expired {
+		policy, charity, percent := PolicyRefund, "", 0
+		if v.BatchID != "" {
+			b, err := database.GetBatch(v.BatchID)
+			if err != nil {
+				log.Printf("refund job: GetBatch pay_id=%s: %v", v.PayID, err)
+				continue
+			}
+			policy, charity, percent = b.ExpiryPolicy, b.PolicyCharity, b.DonatePercent
+		}
+		switch policy {
+		case PolicyDonate:
+			donateExpiredVoucher(v, charity)
+		case PolicySplit:
+			refundExpiredVoucher(v, charity, v.TotalPaidMsats*int64(percent)/100)
+		default:
+			refundExpiredVoucher(v, "", 0)
+		}
+	}
+	return nil
+}
+
+// refundAddress is where money that can no longer reach a voucher goes: its
+// owner's address, or the charity of a donating batch that has none.
+func refundAddress(v *Voucher) string {
+	if v.LightningAddress != "" || v.BatchID == "" {
+		return v.LightningAddress
+	}
+	b, err := database.GetBatch(v.BatchID)
+	if err != nil {
+		log.Printf("refundAddress: GetBatch pay_id=%s: %v", v.PayID, err)
+		return ""
+	}
+	if c, ok := findCharity(b.PolicyCharity); ok {
+		return c.Address
+	}
+	return ""
+}
+
+// donateExpiredVoucher moves a voucher's whole balance to the charity payable.
+func donateExpiredVoucher(v *Voucher, charity string) {
+	log.Printf("refund job: donating %d msats to %s (pay_id=%s)", v.TotalPaidMsats, charity, v.PayID)
+
+	tx, err := database.Begin()
+	if err != nil {
+		log.Printf("refund job: begin tx: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := LockVoucherTx(tx, v.PayID, v.TotalPaidMsats); err != nil {
+		log.Printf("refund job: skipping pay_id=%s: %v", v.PayID, err)
+		return
+	}
+	if err := DeactivateVoucherTx(tx, v.PayID, "donated_on_expiry", v.TotalPaidMsats); err != nil {
+		log.Printf("refund job: DeactivateVoucherTx pay_id=%s: %v", v.PayID, err)
+		return
+	}
+	if err := InsertCharityPayoutTx(tx, charity, v.PayID, "expiry", "pending", v.TotalPaidMsats); err != nil {
+		log.Printf("refund job: InsertCharityPayoutTx pay_id=%s: %v", v.PayID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("refund job: commit pay_id=%s: %v", v.PayID, err)
+	}
+}
+
+// refundExpiredVoucher pays a voucher's balance back to its creator, less
+// donateMsats which is owed to charity instead.
+func refundExpiredVoucher(v *Voucher, charity string, donateMsats int64) {
+	reason := "refunded"
+	if donateMsats > 0 {
+		reason = "split_on_expiry"
+	}
+	refundMsats := v.TotalPaidMsats - donateMsats
+
+	log.Printf("refund job: refunding %d msats to %s (pay_id=%s)",
+		refundMsats, v.LightningAddress, v.PayID)
+
+	// Deactivate before paying to prevent double-payment if the
+	// payment succeeds but the HTTP response times out. The voucher must
+	// still be as listed: another instance may have refunded it already, or
+	// it may have been tipped or claimed since.
+	tx, err := database.Begin()
+	if err != nil {
+		log.Printf("refund job: begin tx: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := LockVoucherTx(tx, v.PayID, v.TotalPaidMsats); err != nil {
+		log.Printf("refund job: skipping pay_id=%s: %v", v.PayID, err)
+		return
+	}
+	if err := DeactivateVoucherTx(tx, v.PayID, reason, v.TotalPaidMsats); err != nil {
+		log.Printf("refund job: DeactivateVoucherTx pay_id=%s: %v", v.PayID, err)
+		return
+	}
+	if donateMsats > 0 {
+		if err := InsertCharityPayoutTx(tx, charity, v.PayID, "expiry", "pending", donateMsats); err != nil {
+			log.Printf("refund job: InsertCharityPayoutTx pay_id=%s: %v", v.PayID, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("refund job: commit pay_id=%s: %v", v.PayID, err)
+		return
+	}
+
+	if err := RefundToLightningAddress(v.LightningAddress, refundMsats, "refund:"+v.PayID); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			// Unknown outcome — keep deactivated, flag for manual recovery.
+			log.Printf("CRITICAL: refund payment outcome unknown for pay_id=%s (%d msats owed to %s): %v",
+				v.PayID, refundMsats, v.LightningAddress, err)
+		} else {
+			// Definitive failure — restore voucher so the job retries next run.
+			log.Printf("refund job: payment failed for pay_id=%s, re-activating: %v", v.PayID, err)
+			if reErr := reactivateExpiredVoucher(v); reErr != nil {
+				log.Printf("CRITICAL: refund job: failed to re-activate pay_id=%s (%d msats owed to %s): %v",
+					v.PayID, v.TotalPaidMsats, v.LightningAddress, reErr)
+			}
+		}
+		return
+	}
+
+	log.Printf("refund job: successfully refunded and deactivated pay_id=%s", v.PayID)
+	emitEvent(EventVoucherRefunded, v.BatchID, v.PayID, map[string]any{
+		"refund_msats":  refundMsats,
+		"donated_msats": donateMsats,
+		"address":       v.LightningAddress,
+	})
+}
+
+// reactivateExpiredVoucher restores a voucher's full balance and withdraws
+// any charity share recorded alongside its deactivation.
+func reactivateExpiredVoucher(v *Voucher) error {
 	tx, err := database.Begin()
 	if err != nil {
-		log.Printf("Begin tx (deactivate withdraw_id=%s): %v", withdrawID, err)
-		// Payment was sent but we couldn't deactivate — log and return OK to wallet.
-		log.Printf("CRITICAL: voucher %s paid out but not deactivated", payID)
-		writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
-		return
+		return err
 	}
 	defer tx.Rollback()
-
-	if err := DeactivateVoucherTx(tx, payID, "claimed", v.TotalPaidMsats); err != nil {
-		log.Printf("DeactivateVoucherTx: %v", err)
-		tx.Rollback()
-		log.Printf("CRITICAL: voucher %s paid out but not deactivated", payID)
-		writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
-		return
+	if err := ReactivateVoucherTx(tx, v.PayID, v.TotalPaidMsats); err != nil {
+		return err
 	}
-
-	if err := tx.Commit(); err != nil {
-		log.Printf("CRITICAL: Commit deactivate for payID=%s failed: %v", payID, err)
+	if err := CancelPendingCharityPayoutsTx(tx, v.PayID, "expiry"); err != nil {
+		return err
 	}
-
-	writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+	return tx.Commit()
 }
 
-// ── Automated Refund Job ─────────────────────────────────────────────────────
+// ── Charity Payout Job ───────────────────────────────────────────────────────
 
-func runRefundJob(ctx context.Context) error {
-	expired, err := database.GetExpiredVouchersForRefund()
+// payCharityPayouts pays each charity's pending total in a single payment.
+func payCharityPayouts() {
+	pending, err := database.PendingCharityPayouts()
 	if err != nil {
-		return fmt.Errorf("GetExpiredVouchersForRefund: %w", err)
+		log.Printf("charity payouts: PendingCharityPayouts: %v", err)
+		return
 	}
+	for name, ids := range pending {
+		c, ok := findCharity(name)
+		if !ok {
+			log.Printf("charity payouts: %q is no longer configured, leaving %d payout(s) pending", name, len(ids))
+			continue
+		}
 
-	log.Printf("refund job: found %d expired voucher(s) with balance", len(expired))
-
-	for _, v := range expired {
-		func(v *Voucher) {
-			log.Printf("refund job: refunding %d msats to %s (pay_id=%s)",
-				v.TotalPaidMsats, v.LightningAddress, v.PayID)
-
-			// Deactivate before paying to prevent double-payment if the
-			// payment succeeds but the HTTP response times out.
-			if err := database.DeactivateVoucher(v.PayID, "refunded", v.TotalPaidMsats); err != nil {
-				log.Printf("refund job: DeactivateVoucher pay_id=%s: %v", v.PayID, err)
-				return
-			}
+		// Mark paid before paying, mirroring deactivate-before-refund.
+		total, err := database.SetCharityPayoutsStatus(ids, "pending", "paid")
+		if err != nil {
+			log.Printf("charity payouts: SetCharityPayoutsStatus %s: %v", name, err)
+			continue
+		}
+		if total == 0 {
+			continue
+		}
 
-			if err := RefundToLightningAddress(v.LightningAddress, v.TotalPaidMsats); err != nil {
-				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-					// Unknown outcome — keep deactivated, flag for manual recovery.
-					log.Printf("CRITICAL: refund payment outcome unknown for pay_id=%s (%d msats owed to %s): %v",
-						v.PayID, v.TotalPaidMsats, v.LightningAddress, err)
-				} else {
-					// Definitive failure — restore voucher so the job retries next run.
-					log.Printf("refund job: payment failed for pay_id=%s, re-activating: %v", v.PayID, err)
-					if reErr := database.ReactivateVoucher(v.PayID, v.TotalPaidMsats); reErr != nil {
-						log.Printf("CRITICAL: refund job: failed to re-activate pay_id=%s (%d msats owed to %s): %v",
-							v.PayID, v.TotalPaidMsats, v.LightningAddress, reErr)
-					}
+		log.Printf("charity payouts: paying %d msats to %s (%s)", total, name, c.Address)
+		if err := RefundToLightningAddress(c.Address, total, "charity:"+name); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				log.Printf("CRITICAL: charity payout outcome unknown for %s (%d msats owed to %s): %v",
+					name, total, c.Address, err)
+			} else {
+				log.Printf("charity payouts: payment to %s failed, will retry: %v", name, err)
+				if _, reErr := database.SetCharityPayoutsStatus(ids, "paid", "pending"); reErr != nil {
+					log.Printf("CRITICAL: charity payouts: failed to restore pending payouts for %s (%d msats owed to %s): %v",
+						name, total, c.Address, reErr)
 				}
-				return
 			}
-
-			log.Printf("refund job: successfully refunded and deactivated pay_id=%s", v.PayID)
-		}(v)
+			continue
+		}
+		log.Printf("charity payouts: paid %s", name)
 	}
-	return nil
 }
 
 // ── Admin Audit Page ─────────────────────────────────────────────────────────
@@ -550,9 +1682,25 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 		refundedSats = stats.RefundedMsats / 1000
 	}
 
+	var charityHTML string
+	var pendingCharitySats int64
+	charities, err := database.GetCharityTotals()
+	if err != nil {
+		dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+	} else if len(charities) > 0 {
+		var rows strings.Builder
+		for _, c := range charities {
+			pendingCharitySats += c.PendingMsats / 1000
+			rows.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%d sats</td><td>%d sats</td><td>%d sats</td><td>%d sats</td><td>%d sats</td></tr>`,
+				html.EscapeString(c.Charity), c.FundingMsats/1000, c.ExpiryMsats/1000, c.ClaimMsats/1000, c.PaidMsats/1000, c.PendingMsats/1000))
+		}
+		charityHTML = fmt.Sprintf(`<hr><div class="section-title">Charity Donations</div><table><thead><tr><th>Charity</th><th>From tips</th><th>From expiry</th><th>From claims</th><th>Paid</th><th>Pending</th></tr></thead><tbody>%s</tbody></table>`, rows.String())
+	}
+
 	var solvencyHTML string
 	if blitziErr == nil && dbErr == nil {
-		diff := balanceSats - lockedSats
+		// Donations awaiting payout are still owed.
+		diff := balanceSats - lockedSats - pendingCharitySats
 		if diff >= 0 {
 			solvencyHTML = fmt.Sprintf(`<div class="badge-ok">✓ Solvent — %d sats surplus</div>`, diff)
 		} else {
@@ -560,12 +1708,62 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var batchesHTML string
+	batches, err := database.GetRecentBatchStats(20)
+	if err != nil {
+		dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+	} else if len(batches) > 0 {
+		var rows strings.Builder
+		for _, b := range batches {
+			name := b.Name
+			if name == "" {
+				name = "Untitled"
+			}
+			var tags string
+			if len(b.Tags) > 0 {
+				tags = `<div class="tags">` + html.EscapeString(strings.Join(b.Tags, " · ")) + `</div>`
+			}
+			rows.WriteString(fmt.Sprintf(`<tr><td>%s%s</td><td>%s</td><td>%d / %d</td><td>%d sats</td></tr>`,
+				html.EscapeString(name), tags,
+				b.CreatedAt.UTC().Format("2 Jan 2006"),
+				b.FundedCount, b.VoucherCount,
+				b.LockedMsats/1000,
+			))
+		}
+		batchesHTML = fmt.Sprintf(`<hr><div class="section-title">Recent Batches</div><table><thead><tr><th>Batch</th><th>Created</th><th>Funded</th><th>Locked</th></tr></thead><tbody>%s</tbody></table>`, rows.String())
+	}
+
+	var webhooksHTML string
+	counts, err := database.GetWebhookDeliveryCounts()
+	if err != nil {
+		dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+	} else if len(counts) > 0 {
+		webhooksHTML = fmt.Sprintf(`<hr><div class="section-title">Webhooks</div><table><thead><tr><th>Delivered</th><th>Pending</th><th>Dead letters</th></tr></thead><tbody><tr><td>%d</td><td>%d</td><td>%d</td></tr></tbody></table>`,
+			counts["delivered"], counts["pending"], counts["dead"])
+	}
+
+	// The page itself is public; sections naming accounts, payments or
+	// customers are only rendered for the admin.
+	var ledger, reconciliation, accounts string
+	if isAdmin(r) {
+		if ledger, err = ledgerHTML(); err != nil {
+			dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+		}
+		if reconciliation, err = reconciliationHTML(); err != nil {
+			dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+		}
+		if accounts, err = creditAccountsHTML(); err != nil {
+			dbErrHTML += fmt.Sprintf(`<p class="err">DB error: %s</p>`, err.Error())
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprintf(w, adminHTML,
 		lockedSats, balanceSats, solvencyHTML,
 		fundedCount, totalCount,
 		claimedSats, claimedCount,
 		refundedSats, refundedCount,
+		charityHTML, batchesHTML, accounts, webhooksHTML, ledger, reconciliation,
 		blitziErrHTML, dbErrHTML,
 	)
 }
@@ -615,16 +1813,7 @@ func handlePayInfo(w http.ResponseWriter, r *http.Request) {
 
 	var timeRemainingHTML string
 	if isActive {
-		now := time.Now()
-		absExpiry := v.CreatedAt.Add(time.Duration(cfg.VoucherAbsoluteExpirySecs) * time.Second)
-		effectiveExpiry := absExpiry
-		if v.LastFundedAt != nil {
-			relExpiry := v.LastFundedAt.Add(time.Duration(v.ExpirySeconds) * time.Second)
-			if relExpiry.Before(effectiveExpiry) {
-				effectiveExpiry = relExpiry
-			}
-		}
-		remaining := effectiveExpiry.Sub(now)
+		remaining := time.Until(v.ExpiresAt())
 		days := int(remaining.Hours()) / 24
 		hours := int(remaining.Hours()) % 24
 		var remainStr string
@@ -633,23 +1822,69 @@ func handlePayInfo(w http.ResponseWriter, r *http.Request) {
 		} else {
 			remainStr = fmt.Sprintf("%dh", hours)
 		}
-		timeRemainingHTML = fmt.Sprintf(`<div><div class="stat-label">Expires in</div><div class="stat-value">%s</div></div>`, remainStr)
+		label := "Expires in"
+		if v.IsPersistent() {
+			label = "Refunded if idle for"
+		}
+		timeRemainingHTML = fmt.Sprintf(`<div><div class="stat-label">%s</div><div class="stat-value">%s</div></div>`, label, remainStr)
+		if v.IsTimeLocked() {
+			timeRemainingHTML += fmt.Sprintf(`<div><div class="stat-label">Claimable from</div><div class="stat-value">%s</div></div>`,
+				v.ClaimableAfter.UTC().Format("2 Jan 2006"))
+		}
+	}
+
+	var donatedMsats int64
+	for _, inv := range invoices {
+		donatedMsats += inv.CharityMsats
+	}
+	if donatedMsats > 0 {
+		var charity string
+		if b, err := database.GetBatch(v.BatchID); err == nil {
+			charity = b.FundingCharity
+		}
+		timeRemainingHTML += fmt.Sprintf(`<div><div class="stat-label">Donated to %s</div><div class="stat-value">%d sats</div></div>`,
+			html.EscapeString(charity), donatedMsats/1000)
+	}
+	if v.IsPool() {
+		if members, err := database.GetPoolMembers(v.BatchID); err != nil {
+			log.Printf("GetPoolMembers: %v", err)
+		} else {
+			timeRemainingHTML += fmt.Sprintf(`<div><div class="stat-label">Shared between</div><div class="stat-value">%d people</div></div>`,
+				len(members))
+		}
+	}
+
+	currency := batchCurrency(v)
+	var fundedCents int64
+	for _, inv := range invoices {
+		fundedCents += inv.FiatCents
+	}
+	if fundedCents > 0 {
+		timeRemainingHTML += fmt.Sprintf(`<div><div class="stat-label">Funded worth</div><div class="stat-value">%s</div></div>`,
+			formatFiat(fundedCents, currency))
 	}
 
 	var txHTML string
 	if len(invoices) > 0 {
 		var rows strings.Builder
 		for _, inv := range invoices {
-			rows.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d sats</td></tr>",
+			var fiat string
+			if inv.Quote != nil {
+				fiat = " (tipped " + formatFiat(inv.Quote.Amount, inv.Quote.Currency) + ")"
+			} else if inv.FiatCents > 0 {
+				fiat = " (" + formatFiat(inv.FiatCents, currency) + ")"
+			}
+			rows.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d sats%s</td></tr>",
 				inv.PaidAt.UTC().Format("2 Jan 2006 15:04 UTC"),
-				inv.CreditedMsats/1000,
+				inv.CreditedMsats/1000, fiat,
 			))
 		}
 		txHTML = fmt.Sprintf(`<hr><div class="section-label">Funding History</div><table><thead><tr><th>Date</th><th>Amount</th></tr></thead><tbody>%s</tbody></table>`, rows.String())
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, payInfoHTML, badgeClass, badgeText, balanceSats, timeRemainingHTML, txHTML, lightning)
+	fmt.Fprintf(w, payInfoHTML, batchContextHTML(v.BatchID), badgeClass, badgeText,
+		balanceSats, fiatHTML(v.TotalPaidMsats, currency, "stat-sub"), timeRemainingHTML, txHTML, lightning)
 }
 
 // ── Withdraw Info Page ───────────────────────────────────────────────────────
@@ -683,9 +1918,430 @@ func handleWithdrawInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	renderWithdrawInfo(w, v, claimHTMLFor(v, ""))
+}
+
+// claimHTMLFor renders the claim section for a voucher as it stands: a
+// countdown while time-locked, the PIN prompt for PIN vouchers, or the claim
+// options otherwise.
+func claimHTMLFor(v *Voucher, errMsg string) string {
+	if v.IsTimeLocked() {
+		return countdownHTML(*v.ClaimableAfter)
+	}
+	if v.IsForward() {
+		return `<p class="qr-hint">⚡ Tips to this voucher are passed straight on to its owner, so there is nothing to claim here.</p>`
+	}
+	if v.IsPool() {
+		return `<p class="qr-hint">👥 Tips to this voucher are shared out between the group automatically, so there is nothing to claim here.</p>`
+	}
+	if v.HasPIN() {
+		return pinFormHTML(v, errMsg)
+	}
+	return claimOptionsHTML(v, withdrawLNURL(v.WithdrawID), "", errMsg)
+}
+
+// claimOptionsHTML renders the claim QR for qrLNURL followed by the
+// server-side claim forms. On PIN vouchers they carry the PIN-verified
+// withdraw session k1; on others the claim opens a session when submitted.
+func claimOptionsHTML(v *Voucher, qrLNURL, k1, errMsg string) string {
+	var sb strings.Builder
+	if errMsg != "" {
+		sb.WriteString(`<div class="pin-err">` + html.EscapeString(errMsg) + `</div>`)
+	}
+	sb.WriteString(withdrawQRHTML(qrLNURL))
+	if v.TotalPaidMsats <= 0 || !v.IsActive() {
+		return sb.String()
+	}
+	var hidden string
+	if k1 != "" {
+		hidden = fmt.Sprintf(`<input type="hidden" name="k1" value="%s">`, html.EscapeString(k1))
+	}
+	sb.WriteString(fmt.Sprintf(`<hr><form class="alt-claim" method="POST" action="/withdraw/%s/claim">%s
+<label class="alt-label" for="address">Can't scan? Send the sats to your Lightning address instead:</label>
+<input id="address" name="address" type="text" placeholder="you@wallet.com or lnurl1..." autocomplete="off" required>
+<button type="submit">⚡ Send to my address</button>
+</form>`, html.EscapeString(v.WithdrawID), hidden))
+	// Closed-loop vouchers can only be donated to charities on their allowlist.
+	charities := cfg.Charities
+	if b, err := closedLoopBatch(v); err != nil || b != nil {
+		charities = slices.DeleteFunc(slices.Clone(charities), func(c Charity) bool {
+			domain, domErr := payTargetDomain(c.Address)
+			return err != nil || domErr != nil || !b.AllowsDomain(domain)
+		})
+	}
+	if len(charities) > 0 {
+		sb.WriteString(`<hr><div class="alt-claim"><div class="alt-label">No wallet? Let your sats do good instead:</div>`)
+		for _, c := range charities {
+			sb.WriteString(fmt.Sprintf(`<form method="POST" action="/withdraw/%s/donate">%s<input type="hidden" name="charity" value="%s"><button type="submit">💝 Donate to %s</button></form>`,
+				html.EscapeString(v.WithdrawID), hidden, html.EscapeString(c.Name), html.EscapeString(c.Name)))
+		}
+		sb.WriteString(`</div>`)
+	}
+	return sb.String()
+}
+
+// countdownHTML renders a live countdown to a time-locked voucher's release date.
+func countdownHTML(until time.Time) string {
+	return fmt.Sprintf(`<div class="countdown">
+<div class="countdown-label">🎁 This gift unlocks on %s</div>
+<div class="countdown-value" id="countdown"></div>
+<p class="qr-hint">Come back to this page then to claim your sats.</p>
+</div>
+<script>
+(function(){
+const until=%d,el=document.getElementById('countdown');
+function tick(){
+let s=Math.max(0,Math.floor((until-Date.now())/1000));
+if(s===0){location.reload();return;}
+const d=Math.floor(s/86400);s%%=86400;const h=Math.floor(s/3600);s%%=3600;const m=Math.floor(s/60);s%%=60;
+el.textContent=(d?d+'d ':'')+h+'h '+m+'m '+s+'s';
+}
+tick();setInterval(tick,1000);
+})();
+</script>`, until.UTC().Format("2 Jan 2006 15:04 UTC"), until.UnixMilli())
+}
+
+func renderWithdrawInfo(w http.ResponseWriter, v *Voucher, claimHTML string) {
 	balanceSats := v.TotalPaidMsats / 1000
+	note := "⚠️ This voucher can only be claimed once. Have your wallet ready before scanning."
+	if v.IsTipJar() {
+		note = "🫙 This is a tip jar: withdraw as much as you like, as often as you like. It keeps collecting tips in between."
+	} else if v.IsForward() {
+		note = "⚡ This voucher forwards every tip to its owner's Lightning address."
+	} else if v.IsPool() {
+		note = "👥 This is a tip pool: its tips are split between the group on a regular schedule."
+	}
+	if b, err := closedLoopBatch(v); err == nil && b != nil {
+		note += "<br>🏪 Only spendable with approved merchants: " + html.EscapeString(allowedPayeesText(b))
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, withdrawInfoHTML, balanceSats, lightning)
+	fmt.Fprintf(w, withdrawInfoHTML, batchContextHTML(v.BatchID), balanceSats,
+		fiatHTML(v.TotalPaidMsats, batchCurrency(v), "fiat"), claimHTML, note)
+}
+
+// batchCurrency returns the display currency of the voucher's batch, if any.
+func batchCurrency(v *Voucher) string {
+	if v.BatchID == "" {
+		return ""
+	}
+	b, err := database.GetBatch(v.BatchID)
+	if err != nil {
+		log.Printf("GetBatch (batch_id=%s): %v", v.BatchID, err)
+		return ""
+	}
+	return b.Currency
+}
+
+// fiatHTML renders the current fiat equivalent of msats as a div of class
+// class, or an empty string without a currency or rate.
+func fiatHTML(msats int64, currency, class string) string {
+	fiat := fiatEquivalent(msats, currency)
+	if fiat == "" {
+		return ""
+	}
+	return `<div class="` + class + `">≈ ` + html.EscapeString(fiat) + `</div>`
+}
+
+// withdrawLNURL is the voucher's LNURL-withdraw string, as printed on it.
+func withdrawLNURL(withdrawID string) string {
+	lnurl, _ := EncodeLNURL(fmt.Sprintf("%s/withdraw/%s", cfg.BaseURL, withdrawID))
+	return lnurl
+}
+
+// withdrawQRHTML renders the scannable claim QR for an LNURL-withdraw string.
+func withdrawQRHTML(lnurl string) string {
+	// json.Marshal escapes <, > and &, so the string can't close the script.
+	text, _ := json.Marshal(lnurl)
+	return fmt.Sprintf(`<div class="qr-wrap">
+<div id="qr"></div>
+<p class="qr-hint">Scan with Blink or any Lightning wallet to claim your sats</p>
+</div>
+<script>
+new QRCode(document.getElementById('qr'),{text:%s,width:200,height:200,correctLevel:QRCode.CorrectLevel.M});
+</script>`, text)
+}
+
+// pinFormHTML renders the PIN prompt shown in place of the claim QR.
+func pinFormHTML(v *Voucher, errMsg string) string {
+	if v.PinLockedUntil != nil && time.Now().Before(*v.PinLockedUntil) {
+		return fmt.Sprintf(`<div class="pin-err">🔒 Too many wrong PINs. Try again after %s.</div>`,
+			v.PinLockedUntil.UTC().Format("2 Jan 2006 15:04 UTC"))
+	}
+	var errHTML string
+	if errMsg != "" {
+		errHTML = `<div class="pin-err">` + html.EscapeString(errMsg) + `</div>`
+	}
+	return fmt.Sprintf(`<form class="pin-form" method="POST" action="/withdraw/%s/pin">
+<label for="pin">🔒 Enter the PIN you were given with this voucher</label>
+<input id="pin" name="pin" type="password" inputmode="numeric" autocomplete="off" maxlength="8" required autofocus>
+<button type="submit">Unlock</button>
+%s
+</form>`, html.EscapeString(v.WithdrawID), errHTML)
+}
+
+// ── POST /withdraw/:withdraw_id/pin ──────────────────────────────────────────
+
+// handleWithdrawPIN exchanges a correct PIN for a short-lived k1 and shows the
+// claim QR for it.
+func handleWithdrawPIN(w http.ResponseWriter, r *http.Request) {
+	withdrawID := r.PathValue("withdraw_id")
+	pin := strings.TrimSpace(r.FormValue("pin"))
+
+	v, err := database.GetVoucherByWithdrawID(withdrawID)
+	if err != nil {
+		http.Error(w, "voucher not found", http.StatusNotFound)
+		return
+	}
+	if v.IsTimeLocked() {
+		renderWithdrawInfo(w, v, countdownHTML(*v.ClaimableAfter))
+		return
+	}
+	if !v.HasPIN() {
+		renderWithdrawInfo(w, v, claimHTMLFor(v, ""))
+		return
+	}
+
+	k1, err := newK1()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ok, attemptsLeft, err := database.CheckVoucherPIN(withdrawID, pin, k1, cfg.PinMaxAttempts,
+		time.Duration(cfg.PinLockoutSecs)*time.Second, time.Duration(cfg.PinMaxLockoutSecs)*time.Second)
+	if errors.Is(err, ErrPinLocked) {
+		log.Printf("PIN lockout for withdraw_id=%s", withdrawID)
+		if v, err = database.GetVoucherByWithdrawID(withdrawID); err != nil {
+			http.Error(w, "voucher not found", http.StatusNotFound)
+			return
+		}
+		renderWithdrawInfo(w, v, pinFormHTML(v, ""))
+		return
+	}
+	if err != nil {
+		log.Printf("CheckVoucherPIN: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		renderWithdrawInfo(w, v, pinFormHTML(v,
+			fmt.Sprintf("Wrong PIN. %d attempt(s) left before the voucher is locked.", attemptsLeft)))
+		return
+	}
+
+	unlocked, err := EncodeLNURL(fmt.Sprintf("%s/withdraw/%s?k1=%s", cfg.BaseURL, withdrawID, k1))
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	renderWithdrawInfo(w, v, claimOptionsHTML(v, unlocked, k1, "")+
+		fmt.Sprintf(`<p class="qr-hint">This code is valid for %d minutes.</p>`, cfg.PinSessionSecs/60))
+}
+
+// ── POST /withdraw/:withdraw_id/claim ────────────────────────────────────────
+
+// handleWithdrawClaim pays a voucher's balance to a Lightning address or
+// LNURL-pay link typed in by the recipient.
+func handleWithdrawClaim(w http.ResponseWriter, r *http.Request) {
+	withdrawID := r.PathValue("withdraw_id")
+	address := strings.TrimSpace(r.FormValue("address"))
+	isLightningAddr := lightningAddressRE.MatchString(address)
+	isLNURL := strings.HasPrefix(strings.ToLower(address), "lnurl1")
+	if !isLightningAddr && !isLNURL {
+		rerenderClaim(w, withdrawID,
+			claimError("enter a Lightning address (you@wallet.com) or a LNURL-pay link (lnurl1...)"))
+		return
+	}
+
+	v, paid, err := claimServerSide(withdrawID, r.FormValue("k1"), address, "claimed", nil)
+	if err != nil {
+		rerenderClaim(w, withdrawID, err)
+		return
+	}
+
+	renderWithdrawInfo(w, remainingAfter(v, paid), fmt.Sprintf(`<div class="receipt">
+<div class="receipt-title">⚡ Sent!</div>
+<p><strong>%d sats</strong> are on their way to <strong>%s</strong>.</p>
+<p class="qr-hint">%s</p>
+</div>`, paid/1000, html.EscapeString(address), time.Now().UTC().Format("2 Jan 2006 15:04 UTC")))
+}
+
+// ── POST /withdraw/:withdraw_id/donate ───────────────────────────────────────
+
+// handleWithdrawDonate pays a voucher's balance to a configured charity on the
+// recipient's behalf.
+func handleWithdrawDonate(w http.ResponseWriter, r *http.Request) {
+	withdrawID := r.PathValue("withdraw_id")
+	c, ok := findCharity(r.FormValue("charity"))
+	if !ok {
+		http.Error(w, "unknown charity", http.StatusBadRequest)
+		return
+	}
+
+	v, paid, err := claimServerSide(withdrawID, r.FormValue("k1"), c.Address, "donated",
+		func(tx *Tx, v *Voucher, msats int64) error {
+			return InsertCharityPayoutTx(tx, c.Name, v.PayID, "claim", "paid", msats)
+		})
+	if err != nil {
+		rerenderClaim(w, withdrawID, err)
+		return
+	}
+
+	receipt := fmt.Sprintf(`<div class="receipt">
+<div class="receipt-title">💝 Thank you!</div>
+<p><strong>%d sats</strong> went to <strong>%s</strong> on your behalf.</p>
+<p class="qr-hint">%s</p>
+</div>`, paid/1000, html.EscapeString(c.Name), time.Now().UTC().Format("2 Jan 2006 15:04 UTC"))
+	if c.WebURL != "" {
+		receipt += fmt.Sprintf(`<p class="qr-hint"><a href="%s" target="_blank" rel="noopener">Learn more about %s</a></p>`,
+			html.EscapeString(c.WebURL), html.EscapeString(c.Name))
+	}
+	renderWithdrawInfo(w, remainingAfter(v, paid), receipt)
+}
+
+// remainingAfter is the voucher as it stands after a server-side claim of
+// paid msats, for rendering the receipt.
+func remainingAfter(v *Voucher, paid int64) *Voucher {
+	after := *v
+	after.TotalPaidMsats = 0
+	if v.IsTipJar() {
+		after.TotalPaidMsats = v.TotalPaidMsats - paid
+	}
+	return &after
+}
+
+// claimError is a server-side claim failure that is safe to show the recipient.
+type claimError string
+
+func (e claimError) Error() string { return string(e) }
+
+// claimServerSide pays a voucher's full balance to dest on the recipient's
+// behalf and returns the amount paid. It spends withdraw session k1 and
+// deactivates the voucher with reason exactly like the LNURL-withdraw
+// callback, so a voucher can't be claimed twice across the two paths. Tip
+// jars are emptied instead, and stay open. record, if set, runs inside the
+// transaction that settles the claim.
+func claimServerSide(withdrawID, k1, dest, reason string, record func(tx *Tx, v *Voucher, msats int64) error) (*Voucher, int64, error) {
+	// Server-side claims spend a withdraw session just like a wallet would.
+	// PIN vouchers bring the one the PIN opened.
+	if k1 == "" {
+		var err error
+		if k1, err = newK1(); err == nil {
+			err = database.InsertWithdrawSession(k1, withdrawID)
+		}
+		if err != nil {
+			log.Printf("InsertWithdrawSession (withdraw_id=%s): %v", withdrawID, err)
+			return nil, 0, claimError("this page has expired, please try again")
+		}
+	}
+	payID, err := database.ValidateAndUseWithdrawSession(k1, withdrawID, "")
+	if err != nil {
+		return nil, 0, claimError("this page has expired, please try again")
+	}
+
+	v, err := database.GetVoucherByWithdrawID(withdrawID)
+	if err != nil {
+		return nil, 0, claimError("voucher not found")
+	}
+	if !v.IsActive() {
+		return nil, 0, claimError("this voucher is no longer active")
+	}
+	if v.TotalPaidMsats <= 0 {
+		return nil, 0, claimError("this voucher has no balance")
+	}
+	if v.IsTimeLocked() {
+		return nil, 0, claimError(timeLockedReason(v))
+	}
+	if v.IsAutoPayout() {
+		return nil, 0, claimError(autoPayoutReason(v))
+	}
+	if reason := spendRestriction(v, "", dest); reason != "" {
+		return nil, 0, claimError(reason)
+	}
+
+	if v.IsTipJar() {
+		// Only whole sats are sent, so only whole sats are debited.
+		msats := v.TotalPaidMsats / 1000 * 1000
+		if msats == 0 {
+			return nil, 0, claimError("this voucher has no balance")
+		}
+		if err := withdrawPartial(v, msats, func(ref string) error { return PayLightningAddress(dest, msats, ref) }); err != nil {
+			log.Printf("%s payment (withdraw_id=%s): %v", reason, withdrawID, err)
+			return nil, 0, claimPaymentError(err)
+		}
+		if record != nil {
+			tx, err := database.Begin()
+			if err == nil {
+				defer tx.Rollback()
+				if err = record(tx, v, msats); err == nil {
+					err = tx.Commit()
+				}
+			}
+			if err != nil {
+				log.Printf("CRITICAL: tip jar %s paid %d msats to %s but it was not recorded: %v", payID, msats, dest, err)
+			}
+		}
+		return v, msats, nil
+	}
+
+	if err := PayLightningAddress(dest, v.TotalPaidMsats, "claim:"+payID); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			// Unknown outcome — treat as paid, as the withdraw callback does.
+			log.Printf("CRITICAL: %s payment timed out for withdraw_id=%s (%d msats to %s), assuming paid: %v",
+				reason, withdrawID, v.TotalPaidMsats, dest, err)
+			if deactErr := database.DeactivateVoucher(payID, "timeout_assumed_paid", v.TotalPaidMsats); deactErr != nil {
+				log.Printf("CRITICAL: failed to deactivate withdraw_id=%s after timeout: %v", withdrawID, deactErr)
+			}
+			emitClaimed(v, v.TotalPaidMsats, false)
+			return v, v.TotalPaidMsats, nil
+		}
+		// Definitive failure — voucher stays active so the recipient can retry.
+		log.Printf("%s payment (withdraw_id=%s): %v", reason, withdrawID, err)
+		return nil, 0, claimPaymentError(err)
+	}
+
+	// Payment succeeded — deactivate the voucher.
+	emitClaimed(v, v.TotalPaidMsats, false)
+	tx, err := database.Begin()
+	if err != nil {
+		log.Printf("CRITICAL: voucher %s paid out but not deactivated: %v", payID, err)
+		return v, v.TotalPaidMsats, nil
+	}
+	defer tx.Rollback()
+	if err := DeactivateVoucherTx(tx, payID, reason, v.TotalPaidMsats); err != nil {
+		log.Printf("CRITICAL: voucher %s paid out but not deactivated: %v", payID, err)
+		return v, v.TotalPaidMsats, nil
+	}
+	if record != nil {
+		if err := record(tx, v, v.TotalPaidMsats); err != nil {
+			log.Printf("CRITICAL: voucher %s paid out but not deactivated: %v", payID, err)
+			return v, v.TotalPaidMsats, nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("CRITICAL: Commit deactivate for payID=%s failed: %v", payID, err)
+	}
+	return v, v.TotalPaidMsats, nil
+}
+
+// claimPaymentError translates a failed server-side claim payment for the recipient.
+func claimPaymentError(err error) error {
+	switch {
+	case errors.Is(err, ErrAmountNotSendable):
+		return claimError("the destination can't receive this amount")
+	case errors.Is(err, ErrInsufficientBalance):
+		return claimError("this voucher's balance has changed, please try again")
+	}
+	return claimError("payment failed, please try again")
+}
+
+// rerenderClaim shows the withdraw page again with a server-side claim error.
+func rerenderClaim(w http.ResponseWriter, withdrawID string, err error) {
+	v, vErr := database.GetVoucherByWithdrawID(withdrawID)
+	if vErr != nil {
+		http.Error(w, "voucher not found", http.StatusNotFound)
+		return
+	}
+	renderWithdrawInfo(w, v, claimHTMLFor(v, err.Error()))
 }
 
 // ── HTML templates ───────────────────────────────────────────────────────────
@@ -717,6 +2373,10 @@ hr{border:none;border-top:1px solid #eee;margin:1.25rem 0}
 .badge-ok{display:inline-block;background:#dcfce7;color:#16a34a;padding:4px 14px;border-radius:20px;font-weight:600;font-size:.88rem;margin-top:1rem}
 .badge-warn{display:inline-block;background:#fef9ec;color:#b45309;border:1px solid #fde68a;padding:4px 14px;border-radius:20px;font-weight:600;font-size:.88rem;margin-top:1rem}
 .err{color:#dc2626;font-size:.85rem;margin-top:.25rem}
+table{width:100%%;border-collapse:collapse;font-size:.85rem;margin-top:.5rem}
+th{text-align:left;color:#888;font-weight:600;padding:.35rem 0;border-bottom:1px solid #eee}
+td{padding:.4rem 0;border-bottom:1px solid #f5f5f5;vertical-align:top}
+.tags{font-size:.75rem;color:#888}
 </style>
 </head>
 <body>
@@ -750,6 +2410,12 @@ hr{border:none;border-top:1px solid #eee;margin:1.25rem 0}
 <div style="font-size:.8rem;color:#555;margin-top:2px">%d vouchers</div>
 </div>
 </div>
+%s
+%s
+%s
+%s
+%s
+%s
 %s%s
 </div>
 </body>
@@ -773,6 +2439,7 @@ h1{font-size:1.25rem;margin-bottom:1rem}
 .stats{display:grid;grid-template-columns:1fr 1fr;gap:1rem;margin:1.25rem 0}
 .stat-label{font-size:.75rem;color:#666;font-weight:600;text-transform:uppercase;letter-spacing:.06em;margin-bottom:2px}
 .stat-value{font-size:1.5rem;font-weight:700}
+.stat-sub{font-size:.85rem;color:#666}
 .orange{color:#f7931a}
 hr{border:none;border-top:1px solid #eee;margin:1.25rem 0}
 .section-label{font-size:.75rem;color:#666;font-weight:600;text-transform:uppercase;letter-spacing:.06em;margin-bottom:.5rem}
@@ -781,14 +2448,18 @@ th{text-align:left;color:#888;font-weight:600;padding:.35rem 0;border-bottom:1px
 td{padding:.4rem 0;border-bottom:1px solid #f5f5f5}
 .qr-wrap{display:flex;flex-direction:column;align-items:center;gap:.5rem;margin-top:1.25rem}
 .qr-hint{font-size:.82rem;color:#666;text-align:center}
+.batch{background:#fff4e5;border-radius:10px;padding:.75rem 1rem;margin-bottom:1rem}
+.batch-name{font-weight:700}
+.batch-msg{font-size:.9rem;color:#555;margin-top:2px}
 </style>
 </head>
 <body>
 <div class="card">
 <h1>⚡ TipMe Voucher</h1>
+%s
 <span class="badge %s">%s</span>
 <div class="stats">
-<div><div class="stat-label">Balance</div><div class="stat-value orange">%d sats</div></div>
+<div><div class="stat-label">Balance</div><div class="stat-value orange">%d sats</div>%s</div>
 %s
 </div>
 %s
@@ -817,6 +2488,7 @@ body{font-family:system-ui,-apple-system,sans-serif;background:#f5f5f5;color:#11
 .card{max-width:440px;margin:1rem auto;background:#fff;border-radius:14px;padding:1.5rem;box-shadow:0 2px 16px rgba(0,0,0,.09)}
 h1{font-size:1.25rem;margin-bottom:.25rem}
 .balance{font-size:2.5rem;font-weight:800;color:#f7931a;margin:.75rem 0 1.25rem}
+.balance .fiat{font-size:1rem;font-weight:600;color:#666}
 .step{display:flex;gap:1rem;margin-bottom:1.1rem;align-items:flex-start}
 .step-num{background:#f7931a;color:#fff;border-radius:50%%;width:28px;height:28px;display:flex;align-items:center;justify-content:center;font-weight:700;font-size:.9rem;flex-shrink:0;margin-top:2px}
 .step-text{line-height:1.5;font-size:.95rem}
@@ -826,13 +2498,32 @@ hr{border:none;border-top:1px solid #eee;margin:1.25rem 0}
 .qr-wrap{display:flex;flex-direction:column;align-items:center;gap:.5rem}
 .qr-hint{font-size:.82rem;color:#666;text-align:center}
 .note{font-size:.82rem;color:#666;background:#fef9ec;border:1px solid #fde68a;padding:.75rem;border-radius:8px;margin-top:1.25rem}
+.batch{background:#fff4e5;border-radius:10px;padding:.75rem 1rem;margin:.75rem 0}
+.batch-name{font-weight:700}
+.batch-msg{font-size:.9rem;color:#555;margin-top:2px}
+.pin-form{display:flex;flex-direction:column;gap:.6rem;font-size:.92rem}
+.pin-form input{padding:.6rem .75rem;border:1.5px solid #ddd;border-radius:8px;font-size:1.2rem;letter-spacing:.3em;text-align:center}
+.pin-form button{background:#f7931a;color:#fff;border:none;border-radius:9999px;padding:.65rem 1rem;font-size:.95rem;font-weight:700;cursor:pointer}
+.pin-err{color:#dc2626;font-size:.88rem}
+.countdown{text-align:center;display:flex;flex-direction:column;gap:.4rem}
+.countdown-label{font-weight:600}
+.countdown-value{font-size:1.75rem;font-weight:800;color:#f7931a;font-variant-numeric:tabular-nums}
+.alt-claim{display:flex;flex-direction:column;gap:.5rem}
+.alt-label{font-size:.88rem;color:#555;font-weight:600}
+.alt-claim button{width:100%%;background:#fff;color:#111;border:1.5px solid #ddd;border-radius:9999px;padding:.6rem 1rem;font-size:.92rem;font-weight:600;cursor:pointer}
+.alt-claim button:hover{border-color:#f7931a}
+.alt-claim input[type=text]{padding:.6rem .75rem;border:1.5px solid #ddd;border-radius:8px;font-size:.95rem;outline:none}
+.alt-claim input[type=text]:focus{border-color:#f7931a}
+.receipt{text-align:center;display:flex;flex-direction:column;gap:.5rem}
+.receipt-title{font-size:1.25rem;font-weight:800;color:#16a34a}
 </style>
 </head>
 <body>
 <div class="card">
 <h1>💸 Claim Your Sats</h1>
+%s
 <p style="color:#666;font-size:.9rem">This voucher is worth:</p>
-<div class="balance">%d sats</div>
+<div class="balance">%d sats%s</div>
 <div class="step">
 <div class="step-num">1</div>
 <div class="step-text"><strong>Download Blink Wallet</strong>Get the free <a href="https://blink.sv" target="_blank">Blink</a> app from <a href="https://blink.sv" target="_blank">blink.sv</a> — available on the App Store and Google Play.</div>
@@ -846,14 +2537,8 @@ hr{border:none;border-top:1px solid #eee;margin:1.25rem 0}
 <div class="step-text"><strong>Scan the QR code below</strong>In Blink, tap <strong>Receive</strong> then use the in-app scanner to scan this QR code. Your sats will arrive instantly.</div>
 </div>
 <hr>
-<div class="qr-wrap">
-<div id="qr"></div>
-<p class="qr-hint">Scan with Blink or any Lightning wallet to claim your sats</p>
-</div>
-<div class="note">⚠️ This voucher can only be claimed once. Have your wallet ready before scanning.</div>
+%s
+<div class="note">%s</div>
 </div>
-<script>
-new QRCode(document.getElementById('qr'),{text:%q,width:200,height:200,correctLevel:QRCode.CorrectLevel.M});
-</script>
 </body>
 </html>`
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestServer points the handlers at a migrated SQLite database, a fee
+// schedule without fees, a year's voucher lifetime, batches of up to ten and
+// a blitzi stand-in whose invoices are never paid, and returns the
+// stand-in's invoices by payment hash, newest last.
+func useTestServer(t *testing.T) func() []string {
+	t.Helper()
+	savedCfg, savedDB, savedFees, savedBlitzi := cfg, database, fees, blitziClient
+	t.Cleanup(func() { cfg, database, fees, blitziClient = savedCfg, savedDB, savedFees, savedBlitzi })
+
+	database = openTestDB(t)
+	if _, err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	fees = &FeeSchedule{}
+	cfg.VoucherAbsoluteExpirySecs = 365 * 86400
+	cfg.MaxVouchersPerRequest, cfg.TipJarInactivitySecs = 10, 2*365*86400
+
+	var mu sync.Mutex
+	var hashes []string
+	blitzi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/invoice" {
+			json.NewEncoder(w).Encode(map[string]any{"paid": false})
+			return
+		}
+		mu.Lock()
+		hash := fmt.Sprintf("%064x", len(hashes)+1)
+		hashes = append(hashes, hash)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"payment_hash": hash, "invoice": "lnbc1test" + hash})
+	}))
+	t.Cleanup(blitzi.Close)
+	blitziClient = NewBlitziClient(blitzi.URL, "")
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, hashes...)
+	}
+}
+
+// testDB is the test server's store, for tests that set up or inspect its
+// rows directly.
+func testDB() *DB {
+	return database.(*DB)
+}
+
+// testPayee is a LNURL-pay recipient on a local port, standing in for the
+// Lightning addresses the server pays out to.
+type testPayee struct {
+	LNURL       string       // the recipient's LNURL-pay link
+	Refuse      atomic.Bool  // answer invoice requests with an error
+	MinSendable atomic.Int64 // the least it accepts, in msats; 1000 if unset
+
+	mu      sync.Mutex
+	amounts []int64
+}
+
+// usePayee starts a testPayee. The test server's blitzi stand-in pays every
+// invoice, so the amounts it was asked to invoice are what it was paid.
+func usePayee(t *testing.T) *testPayee {
+	t.Helper()
+	p := &testPayee{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			json.NewEncoder(w).Encode(map[string]any{
+				"tag": "payRequest", "callback": "http://" + r.Host + "/callback",
+				"minSendable": max(p.MinSendable.Load(), 1000), "maxSendable": 100_000_000_000, "metadata": `[["text/plain","test payee"]]`,
+			})
+			return
+		}
+		if p.Refuse.Load() {
+			json.NewEncoder(w).Encode(map[string]string{"status": "ERROR", "reason": "refused"})
+			return
+		}
+		amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		p.mu.Lock()
+		p.amounts = append(p.amounts, amount)
+		n := len(p.amounts)
+		p.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"pr": fmt.Sprintf("lnbc1testpayee%dx%d", n, amount)})
+	}))
+	t.Cleanup(srv.Close)
+	lnurl, err := EncodeLNURL(srv.URL + "/lnurlp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.LNURL = lnurl
+	return p
+}
+
+// Amounts returns the amounts the payee has been paid, in msats, sorted.
+func (p *testPayee) Amounts() []int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	amounts := slices.Clone(p.amounts)
+	slices.Sort(amounts)
+	return amounts
+}
+
+// TestPayCallbackFiatAmounts checks LUD-21 amounts in the pay callback: they
+// are converted at the current rate, the quote is kept with the invoice, and
+// the sat limits apply to the converted amount.
+func TestPayCallbackFiatAmounts(t *testing.T) {
+	invoices := useTestServer(t)
+	useTestRates(t, testPrices)
+	cfg.Currencies = []string{"EUR", "USD", "GBP"} // no rate for GBP
+	cfg.MinVoucherPayAmountSats, cfg.MaxVoucherPayAmountSats = 100, 200_000
+	_, vouchers := createTestBatch(t, testDB(), 1)
+	payID := vouchers[0].PayID
+
+	for _, tc := range []struct {
+		amount    string
+		wantMsats int64  // 0 if the request must be refused
+		wantErr   string // part of the reason it is refused for
+	}{
+		{"5000.EUR", 100_000_000, ""},
+		{"100.eur", 2_000_000, ""},
+		{"5.EUR", 100_000, ""},           // exactly the minimum
+		{"10000.EUR", 200_000_000, ""},   // exactly the maximum
+		{"500.USD", 16_666_000, ""},      // rounded down to whole sats
+		{"4.EUR", 0, "between 100 and"},  // 80 sats
+		{"10001.EUR", 0, "and 200000"},   // 200020 sats
+		{"1.USD", 0, "between 100 and"},  // 33 sats
+		{"100.XYZ", 0, "invalid amount"}, // not a configured currency
+		{"100.GBP", 0, "no exchange rate available for GBP"},
+		{"0.EUR", 0, "invalid amount"},
+		{"-5.EUR", 0, "invalid amount"},
+		{"ten.EUR", 0, "invalid amount"},
+		{"150000", 150_000, ""}, // plain msats still work
+		{"99999", 0, "between 100 and"},
+	} {
+		t.Run(tc.amount, func(t *testing.T) {
+			before := len(invoices())
+			req := httptest.NewRequest(http.MethodGet, "/pay/"+payID+"/callback?amount="+url.QueryEscape(tc.amount), nil)
+			req.SetPathValue("pay_id", payID)
+			rec := httptest.NewRecorder()
+			handleLNURLPayCallback(rec, req)
+
+			var resp struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+				PR     string `json:"pr"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode %q: %v", rec.Body.String(), err)
+			}
+			if tc.wantMsats == 0 {
+				if resp.Status != "ERROR" || !strings.Contains(resp.Reason, tc.wantErr) {
+					t.Errorf("response %+v, want an error containing %q", resp, tc.wantErr)
+				}
+				if len(invoices()) != before {
+					t.Error("an invoice was created for a refused amount")
+				}
+				return
+			}
+			if resp.Status == "ERROR" || resp.PR == "" {
+				t.Fatalf("response %+v, want an invoice", resp)
+			}
+
+			all := invoices()
+			var msats, quoteAmount int64
+			var quoteCurrency string
+			var quotePrice float64
+			if err := testDB().QueryRow(
+				`SELECT amount_msats, quote_currency, quote_amount, quote_btc_price FROM pay_invoices WHERE payment_hash=?`,
+				all[len(all)-1],
+			).Scan(&msats, &quoteCurrency, &quoteAmount, &quotePrice); err != nil {
+				t.Fatal(err)
+			}
+			if msats != tc.wantMsats {
+				t.Errorf("invoice for %d msats, want %d", msats, tc.wantMsats)
+			}
+			value, code, isFiat := strings.Cut(tc.amount, ".")
+			code = strings.ToUpper(code)
+			if isFiat && (quoteCurrency != code || fmt.Sprint(quoteAmount) != value || quotePrice != testPrices[code]) {
+				t.Errorf("quote %d %s at %v stored, want %s %s at %v", quoteAmount, quoteCurrency, quotePrice, value, code, testPrices[code])
+			}
+			if !isFiat && quoteCurrency != "" {
+				t.Errorf("quote in %s stored for a msat amount", quoteCurrency)
+			}
+		})
+	}
+}
+
+// createBatch posts body to the voucher creation endpoint, which the test
+// server's fee-less schedule answers by filling the batch at once, and
+// returns the response.
+func createBatch(t *testing.T, body string) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleCreateInvoice(rec, httptest.NewRequest(http.MethodPost, "/api/vouchers/invoice", strings.NewReader(body)))
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create batch = %d %v", rec.Code, resp)
+	}
+	return resp
+}
+
+// TestUpdateBatchAllowlistKinds checks that a PATCH can only restrict the
+// payees of the kinds of batch creation allows it for.
+func TestUpdateBatchAllowlistKinds(t *testing.T) {
+	useTestServer(t)
+	for _, tc := range []struct {
+		kind string
+		ok   bool
+	}{
+		{"gift", true},
+		{"tipjar", true},
+		{"forward", false},
+		{"pool", false},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			body := `{"lightning_address":"owner@example.com","count":1,"kind":"` + tc.kind + `","expiry_seconds":86400`
+			if tc.kind == "pool" {
+				body += `,"pool_members":[{"address":"a@example.com","weight":1},{"address":"b@example.com","weight":1}]`
+			}
+			hash := createBatch(t, body+"}")["payment_hash"].(string)
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/batches/"+hash, strings.NewReader(`{"allowed_domains":["shop.example"]}`))
+			req.SetPathValue("payment_hash", hash)
+			rec := httptest.NewRecorder()
+			handleUpdateBatch(rec, req)
+			if ok := rec.Code == http.StatusOK; ok != tc.ok {
+				t.Errorf("PATCH allowed_domains on a %s batch = %d %s, want ok=%v", tc.kind, rec.Code, rec.Body.String(), tc.ok)
+			}
+		})
+	}
+}
+
+// TestBatchPINsKeptUntilShown checks that the status endpoint returns new
+// PINs until the creation page confirms it has shown them.
+func TestBatchPINsKeptUntilShown(t *testing.T) {
+	useTestServer(t)
+	hash := createBatch(t, `{"lightning_address":"owner@example.com","count":2,"expiry_seconds":86400,"pin_protected":true}`)["payment_hash"].(string)
+
+	pins := func() []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/vouchers/status/"+hash, nil)
+		req.SetPathValue("payment_hash", hash)
+		rec := httptest.NewRecorder()
+		handleVoucherStatus(rec, req)
+		var resp struct {
+			Vouchers []voucherResp `json:"vouchers"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		var pins []string
+		for _, v := range resp.Vouchers {
+			if !v.PinProtected {
+				t.Errorf("voucher %s is not PIN protected", v.PayID)
+			}
+			if v.Pin != "" {
+				pins = append(pins, v.Pin)
+			}
+		}
+		return pins
+	}
+	first := pins()
+	if len(first) != 2 {
+		t.Fatalf("first status shows %d PINs, want 2", len(first))
+	}
+	if again := pins(); !slices.Equal(again, first) {
+		t.Errorf("second status shows PINs %v, want %v again", again, first)
+	}
+
+	forget := func(hash string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/api/batches/"+hash+"/pins", nil)
+		req.SetPathValue("payment_hash", hash)
+		rec := httptest.NewRecorder()
+		handleForgetBatchPINs(rec, req)
+		return rec.Code
+	}
+	if code := forget(hash); code != http.StatusOK {
+		t.Fatalf("forget PINs = %d", code)
+	}
+	if after := pins(); len(after) != 0 {
+		t.Errorf("status shows PINs %v after they were shown", after)
+	}
+	if code := forget(strings.Repeat("0", 64)); code != http.StatusNotFound {
+		t.Errorf("forget PINs of an unknown batch = %d, want 404", code)
+	}
+}
+
+// lnurlWithdraw requests the LNURL-withdraw of withdrawID, as a wallet
+// scanning its claim QR does, and returns the response.
+func lnurlWithdraw(t *testing.T, withdrawID string) map[string]any {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/withdraw/"+withdrawID, nil)
+	req.SetPathValue("withdraw_id", withdrawID)
+	rec := httptest.NewRecorder()
+	handleLNURLWithdraw(rec, req)
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+// TestWithdrawTimeLocked checks that a time-locked voucher can only be
+// claimed from its release date.
+func TestWithdrawTimeLocked(t *testing.T) {
+	useTestServer(t)
+	release := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	hash := createBatch(t, `{"lightning_address":"owner@example.com","count":1,"expiry_seconds":86400,"claimable_after":"`+
+		release.Format(time.RFC3339)+`"}`)["payment_hash"].(string)
+	vouchers, err := database.GetVouchersByCreationHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vouchers[0]
+	if v.ClaimableAfter == nil || !v.ClaimableAfter.Equal(release) {
+		t.Fatalf("voucher claimable after %v, want %s", v.ClaimableAfter, release)
+	}
+	fundTestVoucher(t, testDB(), v.PayID, 10_000)
+
+	resp := lnurlWithdraw(t, v.WithdrawID)
+	if resp["status"] != "ERROR" || !strings.Contains(resp["reason"].(string), "can be claimed from") {
+		t.Errorf("withdraw before the release date = %v, want it refused", resp)
+	}
+	if _, err := testDB().Exec(
+		`UPDATE vouchers SET claimable_after=? WHERE pay_id=?`, time.Now().UTC().Add(-time.Minute), v.PayID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if resp := lnurlWithdraw(t, v.WithdrawID); resp["tag"] != "withdrawRequest" {
+		t.Errorf("withdraw after the release date = %v, want a withdraw request", resp)
+	}
+}
+
+// TestRekeyVoucher checks that only the batch owner or the admin can rekey
+// a voucher, and that its old claim QR stops working while its balance stays.
+func TestRekeyVoucher(t *testing.T) {
+	useTestServer(t)
+	cfg.AdminToken = "admin"
+	hash := createBatch(t, `{"lightning_address":"owner@example.com","count":1,"expiry_seconds":86400}`)["payment_hash"].(string)
+	vouchers, err := database.GetVouchersByCreationHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vouchers[0]
+	fundTestVoucher(t, testDB(), v.PayID, 10_000)
+
+	rekey := func(body, token string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/vouchers/"+v.PayID+"/rekey", strings.NewReader(body))
+		req.SetPathValue("pay_id", v.PayID)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handleRekeyVoucher(rec, req)
+		return rec.Code
+	}
+	if code := rekey("", ""); code != http.StatusNotFound {
+		t.Errorf("rekey without credentials = %d, want 404", code)
+	}
+	if code := rekey(`{"payment_hash":"`+strings.Repeat("0", 64)+`"}`, "wrong"); code != http.StatusNotFound {
+		t.Errorf("rekey with the wrong payment hash and token = %d, want 404", code)
+	}
+	if resp := lnurlWithdraw(t, v.WithdrawID); resp["tag"] != "withdrawRequest" {
+		t.Fatalf("withdraw after refused rekeys = %v, want the old QR still working", resp)
+	}
+
+	oldID := v.WithdrawID
+	for _, by := range []struct{ body, token string }{{`{"payment_hash":"` + hash + `"}`, ""}, {"", "admin"}} {
+		if code := rekey(by.body, by.token); code != http.StatusOK {
+			t.Fatalf("rekey %+v = %d, want 200", by, code)
+		}
+		rekeyed, err := database.GetVoucherByPayID(v.PayID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rekeyed.WithdrawID == oldID || rekeyed.TotalPaidMsats != 10_000 {
+			t.Errorf("after rekey: withdraw_id %s (was %s), balance %d; want a new withdraw_id and the balance kept",
+				rekeyed.WithdrawID, oldID, rekeyed.TotalPaidMsats)
+		}
+		if resp := lnurlWithdraw(t, oldID); resp["status"] != "ERROR" {
+			t.Errorf("withdraw with the old withdraw_id = %v, want it refused", resp)
+		}
+		if resp := lnurlWithdraw(t, rekeyed.WithdrawID); resp["tag"] != "withdrawRequest" {
+			t.Errorf("withdraw with the new withdraw_id = %v, want a withdraw request", resp)
+		}
+		oldID = rekeyed.WithdrawID
+	}
+
+	if err := database.DeactivateVoucher(v.PayID, "claimed", 10_000); err != nil {
+		t.Fatal(err)
+	}
+	if code := rekey("", "admin"); code != http.StatusConflict {
+		t.Errorf("rekey of a spent voucher = %d, want 409", code)
+	}
+}
+
+// TestRefundJobExpiryPolicies expires a voucher of a refunding, a donating
+// and a splitting batch, and checks where the refund job sends each balance.
+func TestRefundJobExpiryPolicies(t *testing.T) {
+	useTestServer(t)
+	owner := usePayee(t)
+	cfg.Charities = []Charity{{Name: "Trees", Address: "trees@example.com"}}
+
+	reasons := map[string]string{}
+	for policy, want := range map[string]string{
+		`"expiry_policy":"refund"`:                                      "refunded",
+		`"expiry_policy":"donate","charity":"Trees"`:                    "donated_on_expiry",
+		`"expiry_policy":"split","charity":"Trees","donate_percent":25`: "split_on_expiry",
+	} {
+		hash := createBatch(t, `{"lightning_address":"`+owner.LNURL+`","count":1,"expiry_seconds":86400,`+policy+`}`)["payment_hash"].(string)
+		vouchers, err := database.GetVouchersByCreationHash(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fundTestVoucher(t, testDB(), vouchers[0].PayID, 20_000)
+		if _, err := testDB().Exec(
+			`UPDATE vouchers SET last_funded_at=? WHERE pay_id=?`, time.Now().UTC().Add(-48*time.Hour), vouchers[0].PayID,
+		); err != nil {
+			t.Fatal(err)
+		}
+		reasons[vouchers[0].PayID] = want
+	}
+
+	if err := runRefundJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for payID, want := range reasons {
+		var active bool
+		var balance int64
+		var reason string
+		if err := testDB().QueryRow(
+			`SELECT active, total_paid_msats, deactivation_reason FROM vouchers WHERE pay_id=?`, payID,
+		).Scan(&active, &balance, &reason); err != nil {
+			t.Fatal(err)
+		}
+		if active || balance != 0 || reason != want {
+			t.Errorf("voucher after the refund job: active=%v balance=%d reason=%q; want it %s", active, balance, reason, want)
+		}
+	}
+	if got, want := owner.Amounts(), []int64{15_000, 20_000}; !slices.Equal(got, want) {
+		t.Errorf("owner refunded %v msats, want %v", got, want)
+	}
+	totals, err := database.GetCharityTotals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Charity != "Trees" || totals[0].ExpiryMsats != 25_000 || totals[0].PendingMsats != 25_000 {
+		t.Errorf("charity totals %+v, want 25000 msats from expiry pending for Trees", totals)
+	}
+	checkTestLedger(t, testDB())
+}
+
+// TestRefundJobFailedSplit checks that a split refund the owner's wallet
+// refuses leaves the voucher as it was, without the charity's share.
+func TestRefundJobFailedSplit(t *testing.T) {
+	useTestServer(t)
+	owner := usePayee(t)
+	owner.Refuse.Store(true)
+	cfg.Charities = []Charity{{Name: "Trees", Address: "trees@example.com"}}
+
+	hash := createBatch(t, `{"lightning_address":"`+owner.LNURL+`","count":1,"expiry_seconds":86400,`+
+		`"expiry_policy":"split","charity":"Trees","donate_percent":25}`)["payment_hash"].(string)
+	vouchers, err := database.GetVouchersByCreationHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payID := vouchers[0].PayID
+	fundTestVoucher(t, testDB(), payID, 20_000)
+	if _, err := testDB().Exec(
+		`UPDATE vouchers SET last_funded_at=? WHERE pay_id=?`, time.Now().UTC().Add(-48*time.Hour), payID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRefundJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	v, err := database.GetVoucherByPayID(payID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Active || v.TotalPaidMsats != 20_000 {
+		t.Errorf("voucher after a refused refund: active=%v balance=%d, want it active with 20000 msats", v.Active, v.TotalPaidMsats)
+	}
+	if totals, err := database.GetCharityTotals(); err != nil || len(totals) != 0 {
+		t.Errorf("charity totals %+v, %v; want the share cancelled", totals, err)
+	}
+	checkTestLedger(t, testDB())
+}
+
+// TestPayCallbackCharitySplit pays twice into a voucher of a batch passing
+// 10% of every payment on to a charity, and checks each payment is split
+// between the fee, the charity and the voucher once blitzi reports it paid.
+func TestPayCallbackCharitySplit(t *testing.T) {
+	useTestServer(t)
+	cfg.Charities = []Charity{{Name: "Trees", Address: "trees@example.com"}}
+	cfg.MinVoucherPayAmountSats, cfg.MaxVoucherPayAmountSats = 1, 1_000_000
+
+	hash := createBatch(t, `{"lightning_address":"tips@example.com","count":1,"expiry_seconds":86400,"funding_charity":"Trees","funding_donate_percent":10}`)["payment_hash"].(string)
+	vouchers, err := database.GetVouchersByCreationHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payID := vouchers[0].PayID
+	fees.Funding = FundingFees{Brackets: []FundingBracket{{BaseMsats: 1000}}}
+
+	// A blitzi stand-in reporting every invoice paid.
+	var n atomic.Int64
+	blitzi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/invoice" {
+			hash := fmt.Sprintf("%064x", 1000+n.Add(1))
+			json.NewEncoder(w).Encode(map[string]string{"payment_hash": hash, "invoice": "lnbc1test" + hash})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"paid": true})
+	}))
+	t.Cleanup(blitzi.Close)
+	blitziClient = NewBlitziClient(blitzi.URL, "")
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/pay/"+payID+"/callback?amount=100000", nil)
+		req.SetPathValue("pay_id", payID)
+		rec := httptest.NewRecorder()
+		handleLNURLPayCallback(rec, req)
+		if !strings.Contains(rec.Body.String(), `"pr"`) {
+			t.Fatalf("pay callback: %s", rec.Body.String())
+		}
+	}
+
+	// The fee comes off first: 1000 msats, then 10% of the 99000 left.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		v, err := database.GetVoucherByPayID(payID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.TotalPaidMsats == 2*89_100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("voucher holds %d msats, want %d", v.TotalPaidMsats, 2*89_100)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	totals, err := database.GetCharityTotals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Charity != "Trees" || totals[0].FundingMsats != 2*9900 || totals[0].PendingMsats != 2*9900 {
+		t.Errorf("charity totals %+v, want 19800 msats from funding pending for Trees", totals)
+	}
+	checkTestLedger(t, testDB())
+}
+
+// TestCharityPayouts checks that a charity's pending payouts are paid in
+// one payment, and stay pending when its wallet refuses the payment.
+func TestCharityPayouts(t *testing.T) {
+	useTestServer(t)
+	charity := usePayee(t)
+	cfg.Charities = []Charity{{Name: "Trees", Address: charity.LNURL}}
+
+	_, vouchers := createTestBatch(t, testDB(), 2)
+	for _, v := range vouchers {
+		tx, err := database.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := InsertCharityPayoutTx(tx, "Trees", v.PayID, "funding", "pending", 5000); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total := func() (paid, pending int64) {
+		t.Helper()
+		totals, err := database.GetCharityTotals()
+		if err != nil || len(totals) != 1 {
+			t.Fatalf("charity totals %+v, %v", totals, err)
+		}
+		return totals[0].PaidMsats, totals[0].PendingMsats
+	}
+
+	charity.Refuse.Store(true)
+	payCharityPayouts()
+	if paid, pending := total(); paid != 0 || pending != 10_000 {
+		t.Errorf("after a refused payout: %d msats paid, %d pending; want all 10000 pending", paid, pending)
+	}
+
+	charity.Refuse.Store(false)
+	payCharityPayouts()
+	if got := charity.Amounts(); !slices.Equal(got, []int64{10_000}) {
+		t.Errorf("charity paid %v msats, want a single payment of 10000", got)
+	}
+	if paid, pending := total(); paid != 10_000 || pending != 0 {
+		t.Errorf("after the payout: %d msats paid, %d pending; want all 10000 paid", paid, pending)
+	}
+	checkTestLedger(t, testDB())
+}
+
+// claimVoucher posts address to a voucher's withdraw page claim form and
+// returns the page it renders.
+func claimVoucher(t *testing.T, withdrawID, address string) string {
+	t.Helper()
+	form := url.Values{"address": {address}}
+	req := httptest.NewRequest(http.MethodPost, "/withdraw/"+withdrawID+"/claim", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetPathValue("withdraw_id", withdrawID)
+	rec := httptest.NewRecorder()
+	handleWithdrawClaim(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("claim = %d %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+// TestWithdrawClaim claims vouchers to a Lightning address from the withdraw
+// page: the whole balance is paid and the voucher spent once, and a refused
+// payment or a bad address leaves it as it was.
+func TestWithdrawClaim(t *testing.T) {
+	useTestServer(t)
+	useTestSessionTTL(t, 5*time.Minute)
+	payee := usePayee(t)
+	_, vouchers := createTestBatch(t, testDB(), 2)
+	for _, v := range vouchers {
+		fundTestVoucher(t, testDB(), v.PayID, 20_000)
+	}
+	check := func(v *Voucher, wantActive bool, wantMsats int64) {
+		t.Helper()
+		got, err := database.GetVoucherByPayID(v.PayID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Active != wantActive || got.TotalPaidMsats != wantMsats {
+			t.Errorf("voucher active=%v with %d msats, want active=%v with %d", got.Active, got.TotalPaidMsats, wantActive, wantMsats)
+		}
+	}
+
+	if page := claimVoucher(t, vouchers[0].WithdrawID, "not an address"); !strings.Contains(page, "enter a Lightning address") {
+		t.Errorf("claim to a bad address rendered no error: %s", page)
+	}
+	check(vouchers[0], true, 20_000)
+
+	payee.Refuse.Store(true)
+	if page := claimVoucher(t, vouchers[0].WithdrawID, payee.LNURL); !strings.Contains(page, "payment failed") {
+		t.Errorf("claim to a refusing wallet rendered no error: %s", page)
+	}
+	check(vouchers[0], true, 20_000)
+
+	payee.Refuse.Store(false)
+	if page := claimVoucher(t, vouchers[0].WithdrawID, payee.LNURL); !strings.Contains(page, "<strong>20 sats</strong>") {
+		t.Errorf("claim rendered no receipt for 20 sats: %s", page)
+	}
+	if page := claimVoucher(t, vouchers[0].WithdrawID, payee.LNURL); !strings.Contains(page, "no longer active") {
+		t.Errorf("second claim rendered no error: %s", page)
+	}
+	if got := payee.Amounts(); !slices.Equal(got, []int64{20_000}) {
+		t.Errorf("payee paid %v msats, want 20000 once", got)
+	}
+	var reason string
+	if err := testDB().QueryRow(`SELECT deactivation_reason FROM vouchers WHERE pay_id=?`, vouchers[0].PayID).Scan(&reason); err != nil || reason != "claimed" {
+		t.Errorf("deactivation reason %q, %v; want claimed", reason, err)
+	}
+	check(vouchers[0], false, 0)
+	check(vouchers[1], true, 20_000)
+	checkTestLedger(t, testDB())
+}
+
+// adminPage renders the admin page, with token as the bearer token if set.
+func adminPage(t *testing.T, token string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handleAdmin(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin page = %d %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+// TestAdminPageSections checks that the public admin page leaves out the
+// sections only the admin may see.
+func TestAdminPageSections(t *testing.T) {
+	useTestServer(t)
+	cfg.AdminToken = "admin"
+	_, vouchers := createTestBatch(t, testDB(), 1)
+	fundTestVoucher(t, testDB(), vouchers[0].PayID, 10_000)
+	hash := fmt.Sprintf("%064x", 99)
+	if err := database.SaveReconcileRun(&ReconcileRun{WindowStart: time.Now().Add(-time.Hour)}, []Discrepancy{{
+		Kind: DiscrepancyUnknownIncoming, Direction: "incoming", PaymentHash: hash, BackendMsats: 5000, PaymentAt: time.Now(),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InsertCreditAccount(&CreditAccount{ID: "corner-cafe", Name: "Corner Café"}, "key-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, section := range []string{"Ledger", "Reconciliation", "Operator Accounts"} {
+		title := `<div class="section-title">` + section + `</div>`
+		if strings.Contains(adminPage(t, ""), title) {
+			t.Errorf("public admin page shows the %s section", section)
+		}
+		if strings.Contains(adminPage(t, "wrong"), title) {
+			t.Errorf("admin page shows the %s section for a wrong token", section)
+		}
+		if !strings.Contains(adminPage(t, "admin"), title) {
+			t.Errorf("admin page hides the %s section from the admin", section)
+		}
+	}
+	if strings.Contains(adminPage(t, ""), hash) {
+		t.Error("public admin page shows a discrepancy's payment hash")
+	}
+	if strings.Contains(adminPage(t, ""), "Corner Café") {
+		t.Error("public admin page shows an account's name")
+	}
+}
+
+// TestCreateInvoicePromoCodes creates batches with promo codes: a discount
+// lowers the invoiced fee, and a code waiving it fills the batch at once,
+// without an invoice, exactly once.
+func TestCreateInvoicePromoCodes(t *testing.T) {
+	invoices := useTestServer(t)
+	fees.Creation.PerVoucherSats = 10
+	for _, p := range []*PromoCode{{Code: "HALF", DiscountPercent: 50}, {Code: "FREE", DiscountPercent: 100, Note: "for the Trees partners"}} {
+		if err := database.InsertPromoCode(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const batch = `{"lightning_address":"tips@example.com","count":2,"expiry_seconds":86400`
+
+	for _, tc := range []struct {
+		promo            string
+		wantFee, wantOff float64
+	}{
+		{"", 20, 0},
+		{`,"promo_code":" half "`, 10, 10},
+	} {
+		resp := createBatch(t, batch+tc.promo+`}`)
+		if resp["fee_sats"] != tc.wantFee || resp["promo_sats"] != tc.wantOff || resp["invoice"] == "" {
+			t.Errorf("batch with promo %q: %v; want an invoice for %v sats, %v off", tc.promo, resp, tc.wantFee, tc.wantOff)
+		}
+		creq, err := database.GetCreationRequest(resp["payment_hash"].(string))
+		if err != nil || creq.FeeMsats != int64(tc.wantFee)*1000 {
+			t.Errorf("creation request %+v, %v; want a fee of %v sats", creq, err, tc.wantFee)
+		}
+	}
+
+	before := len(invoices())
+	resp := createBatch(t, batch+`,"promo_code":"free"}`)
+	if resp["fee_sats"] != 0.0 || resp["promo_sats"] != 20.0 || resp["invoice"] != "" {
+		t.Errorf("batch with a waived fee: %v; want no invoice and 20 sats off", resp)
+	}
+	if len(invoices()) != before {
+		t.Error("an invoice was created for a waived fee")
+	}
+	vouchers, err := database.GetVouchersByCreationHash(resp["payment_hash"].(string))
+	if err != nil || len(vouchers) != 2 {
+		t.Errorf("batch with a waived fee has %d vouchers, %v; want 2", len(vouchers), err)
+	}
+	if p, err := database.GetPromoCode("FREE"); err != nil || p.Uses != 1 || p.Vouchers != 2 {
+		t.Errorf("promo code %+v, %v; want one use for 2 vouchers", p, err)
+	}
+	if page := adminPage(t, ""); strings.Contains(page, "FREE") || strings.Contains(page, "Trees partners") {
+		t.Error("public admin page shows promo codes")
+	}
+}
+
+// TestCreateInvoiceFailedFill checks that a batch which can't be filled on
+// the fee-less path is reported as failed, and gives its promo code use back.
+func TestCreateInvoiceFailedFill(t *testing.T) {
+	useTestServer(t)
+	if err := database.InsertPromoCode(&PromoCode{Code: "FREE", DiscountPercent: 100, MaxUses: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB().Exec(`CREATE TRIGGER no_vouchers BEFORE INSERT ON vouchers BEGIN SELECT RAISE(FAIL, 'no vouchers'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleCreateInvoice(rec, httptest.NewRequest(http.MethodPost, "/api/vouchers/invoice", strings.NewReader(
+		`{"lightning_address":"tips@example.com","count":2,"expiry_seconds":86400,"promo_code":"FREE"}`)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("create batch = %d %s, want 500", rec.Code, rec.Body.String())
+	}
+	if p, err := database.GetPromoCode("FREE"); err != nil || p.Uses != 0 {
+		t.Errorf("promo code %+v, %v; want its use given back", p, err)
+	}
+}
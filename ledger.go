@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ── Ledger checks ────────────────────────────────────────────────────────────
+//
+// Every balance change is posted to the ledger (see db.go); these compare the
+// stored balances with the ones the ledger derives.
+
+// checkLedger logs every balance that disagrees with the ledger.
+func checkLedger() {
+	mismatches, err := database.CheckLedger()
+	if err != nil {
+		log.Printf("ledger: CheckLedger: %v", err)
+		return
+	}
+	for _, m := range mismatches {
+		log.Printf("CRITICAL: ledger: %s is %d msats in the ledger but %d msats stored",
+			m.Account, m.LedgerMsats, m.StoredMsats)
+	}
+}
+
+// ── GET /api/admin/ledger ────────────────────────────────────────────────────
+
+// handleAdminLedger returns the ledger's account balances, the volume posted
+// under each kind, and any stored balances that disagree with it.
+func handleAdminLedger(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	accounts, err := database.GetLedgerSummary()
+	if err != nil {
+		log.Printf("GetLedgerSummary: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	kinds, err := database.GetLedgerKindTotals()
+	if err != nil {
+		log.Printf("GetLedgerKindTotals: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	mismatches, err := database.CheckLedger()
+	if err != nil {
+		log.Printf("CheckLedger: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"accounts":   orEmptySlice(accounts),
+		"kinds":      orEmptySlice(kinds),
+		"mismatches": orEmptySlice(mismatches),
+	})
+}
+
+// orEmptySlice returns s, or an empty slice if it is nil, so it encodes as [].
+func orEmptySlice[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// ledgerHTML renders the admin page's ledger section.
+func ledgerHTML() (string, error) {
+	accounts, err := database.GetLedgerSummary()
+	if err != nil {
+		return "", err
+	}
+	mismatches, err := database.CheckLedger()
+	if err != nil {
+		return "", err
+	}
+	if len(accounts) == 0 {
+		return "", nil
+	}
+	var rows strings.Builder
+	for _, a := range accounts {
+		rows.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%d sats</td></tr>`, html.EscapeString(a.Account), a.Msats/1000))
+	}
+	badge := `<div class="badge-ok">✓ All balances match the ledger</div>`
+	if len(mismatches) > 0 {
+		badge = fmt.Sprintf(`<div class="badge-warn">⚠ %d balance(s) disagree with the ledger</div>`, len(mismatches))
+	}
+	return fmt.Sprintf(`<hr><div class="section-title">Ledger</div>%s<table><thead><tr><th>Account</th><th>Balance (debit − credit)</th></tr></thead><tbody>%s</tbody></table>`,
+		badge, rows.String()), nil
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -212,30 +215,46 @@ func GetInvoiceFromCallback(callbackURL string, amountMsats int64) (string, erro
 	return result.PR, nil
 }
 
-// RefundToLightningAddress sends amountMsats to a Lightning address or LNURL-Pay link.
-func RefundToLightningAddress(address string, amountMsats int64) error {
-	var params *LNURLPayParams
-	var err error
+// resolvePayParams fetches LNURL-Pay params for a Lightning address or LNURL-Pay link.
+func resolvePayParams(address string) (*LNURLPayParams, error) {
 	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(address)), "lnurl1") {
-		params, err = ResolveLNURLPay(address)
+		params, err := ResolveLNURLPay(address)
 		if err != nil {
-			return fmt.Errorf("resolve lnurl: %w", err)
+			return nil, fmt.Errorf("resolve lnurl: %w", err)
 		}
-	} else {
-		params, err = ResolveLightningAddress(address)
+		return params, nil
+	}
+	params, err := ResolveLightningAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("resolve address: %w", err)
+	}
+	return params, nil
+}
+
+// payTargetDomain returns the lowercase host serving a Lightning address or LNURL-Pay link.
+func payTargetDomain(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if strings.HasPrefix(strings.ToLower(address), "lnurl1") {
+		rawURL, err := DecodeLNURL(address)
 		if err != nil {
-			return fmt.Errorf("resolve address: %w", err)
+			return "", err
 		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			return "", fmt.Errorf("invalid URL in LNURL")
+		}
+		return strings.ToLower(u.Hostname()), nil
 	}
-
-	// Skip dust that falls below the target's minimum.
-	if amountMsats < params.MinSendable {
-		return fmt.Errorf("refund amount %d msats is below target minSendable %d msats (dust)", amountMsats, params.MinSendable)
-	}
-	if amountMsats > params.MaxSendable {
-		amountMsats = params.MaxSendable // cap to max
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return "", fmt.Errorf("invalid Lightning address")
 	}
+	return strings.ToLower(address[at+1:]), nil
+}
 
+// payViaCallback fetches an invoice for amountMsats, rounded down to whole
+// sats, and pays it. ref names what the payment is for, as in payInvoice.
+func payViaCallback(params *LNURLPayParams, amountMsats int64, ref string) error {
 	// Round down to whole sats — some wallets reject sub-sat msats amounts.
 	amountMsats = (amountMsats / 1000) * 1000
 
@@ -246,5 +265,83 @@ func RefundToLightningAddress(address string, amountMsats int64) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
-	return blitziClient.PayInvoice(ctx, invoice)
+	return payInvoice(ctx, invoice, ref)
+}
+
+// payInvoice pays a BOLT-11 invoice through blitzi and books the routing fee
+// it reports in the ledger. The payment is recorded under ref, the record it
+// settles (e.g. "claim:<pay_id>" or "withdrawal:<id>"), so reconciliation can
+// match it against the backend's payment history.
+func payInvoice(ctx context.Context, bolt11, ref string) error {
+	paymentHash, err := bolt11PaymentHash(bolt11)
+	if err != nil {
+		log.Printf("bolt11PaymentHash (ref=%s): %v", ref, err)
+	} else {
+		amountMsats, _ := bolt11AmountMsats(bolt11)
+		if err := database.StartOutgoingPayment(paymentHash, ref, amountMsats); err != nil {
+			log.Printf("StartOutgoingPayment (payment_hash=%s, ref=%s): %v", paymentHash, ref, err)
+		}
+	}
+
+	feeMsats, payErr := blitziClient.PayInvoice(ctx, bolt11)
+	// A timed-out payment stays pending until reconciliation finds its outcome.
+	if paymentHash != "" && !errors.Is(payErr, context.DeadlineExceeded) && !errors.Is(payErr, context.Canceled) {
+		if err := database.SettleOutgoingPayment(paymentHash, feeMsats, payErr); err != nil {
+			log.Printf("SettleOutgoingPayment (payment_hash=%s): %v", paymentHash, err)
+		}
+	}
+	if payErr != nil {
+		return payErr
+	}
+	bookRoutingFee(paymentHash, feeMsats)
+	return nil
+}
+
+// bookRoutingFee posts the routing fee paid for an outgoing payment.
+func bookRoutingFee(paymentHash string, feeMsats int64) {
+	if feeMsats <= 0 {
+		return
+	}
+	if err := database.PostLedger(LedgerRoutingFee, paymentHash,
+		LedgerEntry{AccountRouting, feeMsats},
+		LedgerEntry{AccountLightning, -feeMsats},
+	); err != nil {
+		log.Printf("PostLedger routing fee (payment_hash=%s, %d msats): %v", paymentHash, feeMsats, err)
+	}
+}
+
+// RefundToLightningAddress sends amountMsats to a Lightning address or LNURL-Pay link.
+func RefundToLightningAddress(address string, amountMsats int64, ref string) error {
+	params, err := resolvePayParams(address)
+	if err != nil {
+		return err
+	}
+
+	// Skip dust that falls below the target's minimum.
+	if amountMsats < params.MinSendable {
+		return fmt.Errorf("refund amount %d msats is below target minSendable %d msats (dust)", amountMsats, params.MinSendable)
+	}
+	if amountMsats > params.MaxSendable {
+		amountMsats = params.MaxSendable // cap to max
+	}
+
+	return payViaCallback(params, amountMsats, ref)
+}
+
+// ErrAmountNotSendable is returned when a payment target won't accept the amount.
+var ErrAmountNotSendable = errors.New("amount not accepted by recipient")
+
+// PayLightningAddress sends exactly amountMsats (rounded down to whole sats)
+// to a Lightning address or LNURL-Pay link, failing rather than capping if the
+// target cannot accept that amount.
+func PayLightningAddress(address string, amountMsats int64, ref string) error {
+	params, err := resolvePayParams(address)
+	if err != nil {
+		return err
+	}
+	if amountMsats < params.MinSendable || amountMsats > params.MaxSendable {
+		return fmt.Errorf("%w: %d msats is outside the target's range of %d-%d msats",
+			ErrAmountNotSendable, amountMsats, params.MinSendable, params.MaxSendable)
+	}
+	return payViaCallback(params, amountMsats, ref)
 }
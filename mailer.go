@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ── Email Notifications ──────────────────────────────────────────────────────
+//
+// Batch owners who give an email address at creation are told when their
+// batch is ready, when a voucher is first funded, claimed, about to expire,
+// and what happened to its balance on expiry. Notifications are rendered
+// from the same events as webhooks, in the same transaction, into
+// email_outbox; the mail worker sends them over SMTP with retries.
+
+// maxEmailAttempts is how many times an email is tried before it is dropped.
+const maxEmailAttempts = 10
+
+// emailLease is how long a claimed email is left to its worker before another
+// may take it over. It outlasts a run of the worker.
+const emailLease = 30 * time.Minute
+
+// mailEnabled reports whether an SMTP server is configured.
+func mailEnabled() bool {
+	return cfg.SMTPHost != ""
+}
+
+// checkMailConfig validates the SMTP settings at startup.
+func checkMailConfig() error {
+	if !mailEnabled() {
+		return nil
+	}
+	if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+		return fmt.Errorf("invalid SMTP_FROM %q: %w", cfg.SMTPFrom, err)
+	}
+	return nil
+}
+
+// emailData is what the notification templates can use.
+type emailData struct {
+	BatchName      string
+	BatchURL       string // reopens the batch to download its PDF
+	PayInfoURL     string // the voucher's page, for voucher events
+	PayInfoURLs    []string
+	AmountSats     int64
+	BalanceSats    int64
+	DonatedSats    int64
+	Address        string
+	ExpiresAt      string
+	UnsubscribeURL string
+}
+
+const emailFooter = `{{define "footer"}}
+--
+You are receiving this because this address was given when the batch was
+created. To stop these emails: {{.UnsubscribeURL}}
+{{end}}`
+
+var emailTemplates = map[string]*template.Template{
+	"batch_ready": parseEmailTemplate(`{{define "subject"}}Your TipMe vouchers are ready: {{.BatchName}}{{end}}
+{{define "body"}}Your batch "{{.BatchName}}" has been paid for and its vouchers are ready.
+
+Download the printable PDF with every voucher's QR codes here (keep this
+link private, it gives access to the claim codes):
+{{.BatchURL}}
+
+Anyone can top up a voucher from its page:
+{{range .PayInfoURLs}}  {{.}}
+{{end}}{{template "footer" .}}{{end}}`),
+
+	"funded": parseEmailTemplate(`{{define "subject"}}A voucher in {{.BatchName}} received its first tip{{end}}
+{{define "body"}}A voucher in "{{.BatchName}}" was just funded with {{.AmountSats}} sats.
+
+Balance: {{.BalanceSats}} sats
+{{.PayInfoURL}}
+{{template "footer" .}}{{end}}`),
+
+	"claimed": parseEmailTemplate(`{{define "subject"}}A voucher in {{.BatchName}} was claimed{{end}}
+{{define "body"}}{{.AmountSats}} sats were claimed from a voucher in "{{.BatchName}}".
+
+{{.PayInfoURL}}
+{{template "footer" .}}{{end}}`),
+
+	"expiring": parseEmailTemplate(`{{define "subject"}}A voucher in {{.BatchName}} expires soon{{end}}
+{{define "body"}}A voucher in "{{.BatchName}}" still holds {{.BalanceSats}} sats and expires
+on {{.ExpiresAt}}. If it isn't claimed by then, its balance is
+handled by the batch's expiry policy.
+
+{{.PayInfoURL}}
+{{template "footer" .}}{{end}}`),
+
+	"refunded": parseEmailTemplate(`{{define "subject"}}Expired voucher refunded: {{.BatchName}}{{end}}
+{{define "body"}}A voucher in "{{.BatchName}}" expired unclaimed. {{.AmountSats}} sats were refunded
+to {{.Address}}{{if .DonatedSats}} and {{.DonatedSats}} sats donated to charity{{end}}.
+
+{{.PayInfoURL}}
+{{template "footer" .}}{{end}}`),
+
+	"donated": parseEmailTemplate(`{{define "subject"}}Expired voucher donated: {{.BatchName}}{{end}}
+{{define "body"}}A voucher in "{{.BatchName}}" expired unclaimed. As the batch's expiry policy asks,
+its {{.AmountSats}} sats were donated to charity.
+
+{{.PayInfoURL}}
+{{template "footer" .}}{{end}}`),
+}
+
+func parseEmailTemplate(text string) *template.Template {
+	return template.Must(template.Must(template.New("").Parse(emailFooter)).Parse(text))
+}
+
+// emailTemplateFor picks the notification for an event, if it warrants one.
+func emailTemplateFor(eventType string, data map[string]any) string {
+	switch eventType {
+	case EventBatchCompleted:
+		return "batch_ready"
+	case EventVoucherFunded:
+		if first, _ := data["first_funding"].(bool); first {
+			return "funded"
+		}
+	case EventVoucherClaimed:
+		if partial, _ := data["partial"].(bool); !partial {
+			return "claimed"
+		}
+	case EventVoucherExpiring:
+		return "expiring"
+	case EventVoucherRefunded:
+		return "refunded"
+	case EventVoucherDeactivated:
+		if data["reason"] == "donated_on_expiry" {
+			return "donated"
+		}
+	}
+	return ""
+}
+
+// queueOwnerEmailTx renders the notification for an event, if any, for the
+// batch owner and adds it to the outbox.
+func queueOwnerEmailTx(tx *Tx, eventType, batchID, payID string, data map[string]any) error {
+	if !mailEnabled() || batchID == "" {
+		return nil
+	}
+	name := emailTemplateFor(eventType, data)
+	if name == "" {
+		return nil
+	}
+	rcpt, err := getEmailRecipientTx(tx, batchID)
+	if err != nil {
+		return err
+	}
+	if rcpt.Address == "" || rcpt.OptedOut {
+		return nil
+	}
+
+	d := emailData{
+		BatchName:      rcpt.BatchName,
+		BatchURL:       cfg.BaseURL + "/?batch=" + url.QueryEscape(rcpt.CreationHash),
+		UnsubscribeURL: cfg.BaseURL + "/email/unsubscribe?token=" + url.QueryEscape(rcpt.Token),
+	}
+	if d.BatchName == "" {
+		d.BatchName = "Untitled batch"
+	}
+	if payID != "" {
+		d.PayInfoURL = payInfoURL(payID)
+	}
+	if payIDs, ok := data["pay_ids"].([]string); ok {
+		for _, id := range payIDs {
+			d.PayInfoURLs = append(d.PayInfoURLs, payInfoURL(id))
+		}
+	}
+	for key, dst := range map[string]*int64{
+		"amount_msats": &d.AmountSats, "refund_msats": &d.AmountSats,
+		"balance_msats": &d.BalanceSats, "donated_msats": &d.DonatedSats,
+	} {
+		if msats, ok := data[key].(int64); ok {
+			*dst = msats / 1000
+		}
+	}
+	d.Address, _ = data["address"].(string)
+	if at, ok := data["expires_at"].(time.Time); ok {
+		d.ExpiresAt = at.UTC().Format("2 Jan 2006 15:04 UTC")
+	}
+
+	var subject, body bytes.Buffer
+	t := emailTemplates[name]
+	if err := t.ExecuteTemplate(&subject, "subject", d); err != nil {
+		return err
+	}
+	if err := t.ExecuteTemplate(&body, "body", d); err != nil {
+		return err
+	}
+	return insertEmailTx(tx, &OutboxEmail{
+		BatchID:        batchID,
+		To:             rcpt.Address,
+		Subject:        subject.String(),
+		Body:           body.String(),
+		UnsubscribeURL: d.UnsubscribeURL,
+	})
+}
+
+// payInfoURL is the public page of the voucher payID.
+func payInfoURL(payID string) string {
+	lnurl, err := EncodeLNURL(fmt.Sprintf("%s/pay/%s", cfg.BaseURL, payID))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/pay/info?lightning=%s", cfg.BaseURL, lnurl)
+}
+
+// ── Mail worker ──────────────────────────────────────────────────────────────
+
+// mailNudge wakes the mail worker early, e.g. right after an email is queued.
+var mailNudge = make(chan struct{}, 1)
+
+// nudgeMailer asks the mail worker to run soon without blocking.
+func nudgeMailer() {
+	select {
+	case mailNudge <- struct{}{}:
+	default:
+	}
+}
+
+func runMailLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		sendEmails()
+		select {
+		case <-ticker.C:
+		case <-mailNudge:
+		}
+	}
+}
+
+// sendEmails sends every email that is due.
+func sendEmails() {
+	emails, err := database.ClaimDueEmails(50, emailLease)
+	if err != nil {
+		log.Printf("mailer: ClaimDueEmails: %v", err)
+		return
+	}
+	for _, e := range emails {
+		if err := sendEmail(e); err != nil {
+			attempts := e.Attempts + 1
+			var retryAt *time.Time
+			if attempts < maxEmailAttempts {
+				at := time.Now().Add(min(time.Minute<<min(attempts-1, 10), 6*time.Hour))
+				retryAt = &at
+				log.Printf("mailer: email %d to %s failed %d time(s), retrying after %s: %v",
+					e.ID, e.To, attempts, at.UTC().Format(time.RFC3339), err)
+			} else {
+				log.Printf("mailer: email %d to %s failed %d times, giving up: %v", e.ID, e.To, attempts, err)
+			}
+			if err := database.MarkEmailFailed(e.ID, err.Error(), retryAt); err != nil {
+				log.Printf("mailer: MarkEmailFailed id=%d: %v", e.ID, err)
+			}
+			continue
+		}
+		if err := database.MarkEmailSent(e.ID); err != nil {
+			log.Printf("mailer: MarkEmailSent id=%d: %v", e.ID, err)
+		}
+	}
+}
+
+// buildEmail renders the complete message: headers and a quoted-printable body.
+func buildEmail(e OutboxEmail) ([]byte, error) {
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(e.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	from, _ := mail.ParseAddress(cfg.SMTPFrom)
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", from.String()},
+		{"To", e.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.Subject)},
+		{"Date", time.Now().UTC().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + uuid.New().String() + "@" + from.Address[strings.LastIndexByte(from.Address, '@')+1:] + ">"},
+		{"List-Unsubscribe", "<" + e.UnsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendEmail delivers one email to the configured SMTP server. Port 465 uses
+// implicit TLS; otherwise STARTTLS is used when the server offers it.
+func sendEmail(e OutboxEmail) error {
+	msg, err := buildEmail(e)
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(cfg.SMTPFrom)
+
+	addr := net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	tlsConfig := &tls.Config{ServerName: cfg.SMTPHost}
+	var conn net.Conn
+	if cfg.SMTPPort == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && cfg.SMTPPort != "465" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(e.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ── GET/POST /email/unsubscribe ──────────────────────────────────────────────
+
+// handleEmailUnsubscribePage asks for confirmation before unsubscribing, as
+// mail scanners and link previews follow links in emails on their own.
+func handleEmailUnsubscribePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, unsubscribeHTML, fmt.Sprintf(`<p>Stop all emails about this batch?</p>
+<form method="POST" action="/email/unsubscribe?token=%s">
+<button type="submit">Unsubscribe</button>
+</form>`, html.EscapeString(url.QueryEscape(r.URL.Query().Get("token")))))
+}
+
+// handleEmailUnsubscribe stops a batch's notifications. It serves both the
+// confirmation form and one-click unsubscribes from mail clients (RFC 8058),
+// which POST "List-Unsubscribe=One-Click" to the List-Unsubscribe URL.
+func handleEmailUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	msg := "You won't receive any more emails about this batch."
+	if err := database.UnsubscribeBatchEmail(token); errors.Is(err, sql.ErrNoRows) {
+		msg = "This unsubscribe link is not valid."
+	} else if err != nil {
+		log.Printf("UnsubscribeBatchEmail: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, unsubscribeHTML, "<p>"+msg+"</p>")
+}
+
+const unsubscribeHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>TipMe Emails</title>
+<style>
+body{font-family:system-ui,-apple-system,sans-serif;background:#f5f5f5;color:#111;padding:1rem}
+.card{max-width:440px;margin:1rem auto;background:#fff;border-radius:14px;padding:1.5rem;box-shadow:0 2px 16px rgba(0,0,0,.09)}
+h1{font-size:1.25rem;margin-bottom:1rem}
+button{margin-top:1rem;padding:.6rem 1.2rem;border:0;border-radius:8px;background:#f7931a;color:#fff;font-size:1rem;cursor:pointer}
+</style>
+</head>
+<body>
+<div class="card">
+<h1>⚡ TipMe Emails</h1>
+%s
+</div>
+</body>
+</html>`
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var testEmail = OutboxEmail{
+	To:             "owner@example.com",
+	Subject:        "Your TipMe vouchers are ready: Café",
+	Body:           "Line one, with a long enough line to need a soft break in quoted-printable encoding.\nLine two\n",
+	UnsubscribeURL: "https://tipme.example/email/unsubscribe?token=abc",
+}
+
+func useTestSMTP(t *testing.T, host, port string) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPFrom = host, port, "TipMe <noreply@tipme.example>"
+	cfg.SMTPUsername, cfg.SMTPPassword = "", ""
+}
+
+// checkTestMessage parses msg and checks it carries testEmail.
+func checkTestMessage(t *testing.T, msg []byte) {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != testEmail.Subject {
+		t.Errorf("Subject = %q, %v; want %q", subject, err, testEmail.Subject)
+	}
+	for header, want := range map[string]string{
+		"From":                  `"TipMe" <noreply@tipme.example>`,
+		"To":                    testEmail.To,
+		"List-Unsubscribe":      "<" + testEmail.UnsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		"Content-Type":          "text/plain; charset=utf-8",
+	} {
+		if got := m.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if id := m.Header.Get("Message-Id"); !strings.HasSuffix(id, "@tipme.example>") {
+		t.Errorf("Message-ID = %q, want one on the sender's domain", id)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(testEmail.Body, "\n", "\r\n"); string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestBuildEmail(t *testing.T) {
+	useTestSMTP(t, "localhost", "25")
+	msg, err := buildEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(msg), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line longer than 78 characters: %q", line)
+		}
+	}
+	checkTestMessage(t, msg)
+}
+
+// smtpStandIn accepts one SMTP session on a local port, answering every
+// command with 250 except those in reject, and returns the port and a
+// channel that receives the envelope and message once the session ends.
+func smtpStandIn(t *testing.T, reject map[string]string) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan []string, 1)
+	go func() {
+		var got []string
+		defer func() { done <- got }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 stand-in ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			if answer, ok := reject[verb]; ok {
+				reply(answer)
+				continue
+			}
+			switch verb {
+			case "EHLO":
+				reply("250 stand-in")
+			case "MAIL", "RCPT":
+				got = append(got, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					msg.WriteString(strings.TrimPrefix(l, "."))
+				}
+				got = append(got, msg.String())
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port, done
+}
+
+func TestSendEmail(t *testing.T) {
+	port, done := smtpStandIn(t, nil)
+	useTestSMTP(t, "127.0.0.1", port)
+	if err := sendEmail(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	got := <-done
+	if len(got) != 3 {
+		t.Fatalf("session = %q, want MAIL, RCPT and a message", got)
+	}
+	if got[0] != "MAIL FROM:<noreply@tipme.example>" || got[1] != "RCPT TO:<owner@example.com>" {
+		t.Errorf("envelope = %q", got[:2])
+	}
+	checkTestMessage(t, []byte(got[2]))
+}
+
+func TestSendEmailRejected(t *testing.T) {
+	port, _ := smtpStandIn(t, map[string]string{"RCPT": "550 no such user"})
+	useTestSMTP(t, "127.0.0.1", port)
+	if err := sendEmail(testEmail); err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("sendEmail = %v, want the server's rejection", err)
+	}
+}
+
+// TestEmailUnsubscribe checks that following the link only asks, and that
+// the form and one-click POSTs unsubscribe.
+func TestEmailUnsubscribe(t *testing.T) {
+	useTestServer(t)
+	token := uuid.New().String()
+	b := &Batch{
+		ID:               uuid.New().String(),
+		LightningAddress: "owner@example.com",
+		Count:            1,
+		ExpirySeconds:    86400,
+		ExpiryPolicy:     "refund",
+		OwnerEmail:       "owner@example.com",
+		EmailToken:       token,
+	}
+	if err := database.InsertCreationRequest(uuid.New().String(), b, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	optedOut := func() bool {
+		t.Helper()
+		var out bool
+		if err := testDB().QueryRow(`SELECT email_opt_out FROM batches WHERE id=?`, b.ID).Scan(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	rec := httptest.NewRecorder()
+	handleEmailUnsubscribePage(rec, httptest.NewRequest(http.MethodGet, "/email/unsubscribe?token="+token, nil))
+	if !strings.Contains(rec.Body.String(), `<form method="POST" action="/email/unsubscribe?token=`+token+`">`) {
+		t.Errorf("GET page has no confirmation form: %s", rec.Body.String())
+	}
+	if optedOut() {
+		t.Fatal("GET unsubscribed the owner")
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/email/unsubscribe?token="+token, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handleEmailUnsubscribe(rec, req)
+	if !optedOut() || !strings.Contains(rec.Body.String(), "won't receive any more emails") {
+		t.Errorf("one-click POST didn't unsubscribe: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handleEmailUnsubscribe(rec, httptest.NewRequest(http.MethodPost, "/email/unsubscribe?token=nope", nil))
+	if !strings.Contains(rec.Body.String(), "not valid") {
+		t.Errorf("POST with an unknown token: %s", rec.Body.String())
+	}
+}
@@ -20,24 +20,61 @@ type Charity struct {
 
 // Config holds all server configuration loaded from environment variables.
 type Config struct {
-	BaseURL                   string
-	BlitziURL                 string
-	BlitziToken               string
-	DBPath                    string
-	Port                      string
-	FeePerVoucherSats         int64
-	FundingFeeMinMsats        int64
-	FundingFeePercent         float64
-	MaxVouchersPerRequest     int
-	VoucherAbsoluteExpirySecs int64
-	MinVoucherPayAmountSats   int64
-	MaxVoucherPayAmountSats   int64
-	Charities                 []Charity
+	BaseURL                      string
+	BlitziURL                    string
+	BlitziToken                  string
+	DBPath                       string
+	DatabaseURL                  string // PostgreSQL; DBPath is ignored if set
+	MigrateOnStart               bool   // apply pending schema migrations at startup
+	AdminToken                   string
+	Port                         string
+	FeePerVoucherSats            int64
+	TipJarFeeSats                int64
+	TipJarInactivitySecs         int64
+	ForwardIntervalSecs          int64
+	PoolDistributionIntervalSecs int64
+	FundingFeeMinMsats           int64
+	FundingFeePercent            float64
+	FeeScheduleFile              string // JSON fee schedule; overrides the flat fees above
+	MaxVouchersPerRequest        int
+	VoucherAbsoluteExpirySecs    int64
+	MinVoucherPayAmountSats      int64
+	MaxVoucherPayAmountSats      int64
+	PinMaxAttempts               int
+	PinLockoutSecs               int64
+	PinMaxLockoutSecs            int64
+	PinSessionSecs               int64
+	WithdrawSessionSecs          int64
+	CharityPayoutIntervalSecs    int64
+	BoltcardDailyLimitSats       int64
+	WebhookPollSecs              int64
+	WebhookMaxAttempts           int
+	WebhookRetryBaseSecs         int64
+	WebhookAllowPrivateNetworks  bool
+	ReminderLeadTimes            []time.Duration // before expiry, shortest first
+	ReminderIntervalSecs         int64
+	ReconcileEnabled             bool
+	ReconcileIntervalSecs        int64
+	ReconcileWindowSecs          int64
+	AccountLowBalanceSats        int64 // default low-balance threshold for operator accounts
+	AccountSessionSecs           int64
+	MaxAccountTopupSats          int64
+	SMTPHost                     string // empty disables email notifications
+	SMTPPort                     string
+	SMTPUsername                 string
+	SMTPPassword                 string
+	SMTPFrom                     string
+	Charities                    []Charity
+	Currencies                   []string // display currencies batches may choose
+	RatesURL                     string
+	RatesFile                    string
+	RatesCacheSecs               int64
 }
 
 var cfg Config
-var database *DB
+var database Store
 var blitziClient *BlitziClient
+var rates RateProvider
 
 func loadDotEnv() {
 	data, err := os.ReadFile(".env")
@@ -65,14 +102,61 @@ func loadConfig() {
 	cfg.BlitziURL = envStr("BLITZI_URL", "http://localhost:3000")
 	cfg.BlitziToken = envStr("BLITZI_TOKEN", "")
 	cfg.DBPath = envStr("DB_PATH", "./tipme.db")
+	cfg.DatabaseURL = envStr("DATABASE_URL", "")
+	cfg.MigrateOnStart = envStr("MIGRATE_ON_START", "true") != "false"
+	cfg.AdminToken = envStr("ADMIN_TOKEN", "")
 	cfg.Port = envStr("PORT", "8080")
 	cfg.FeePerVoucherSats = envInt64("FEE_PER_VOUCHER_SATS", 10)
+	cfg.TipJarFeeSats = envInt64("TIPJAR_FEE_SATS", 100)
+	cfg.TipJarInactivitySecs = envInt64("TIPJAR_INACTIVITY_SECS", 63072000)
+	cfg.ForwardIntervalSecs = envInterval("FORWARD_INTERVAL_SECS", 60)
+	cfg.PoolDistributionIntervalSecs = envInterval("POOL_DISTRIBUTION_INTERVAL_SECS", 86400)
 	cfg.FundingFeeMinMsats = envInt64("FUNDING_FEE_MIN_MSATS", 2000)
 	cfg.FundingFeePercent = envFloat64("FUNDING_FEE_PERCENT", 0.004)
+	cfg.FeeScheduleFile = envStr("FEE_SCHEDULE_FILE", "")
 	cfg.MaxVouchersPerRequest = int(envInt64("MAX_VOUCHERS_PER_REQUEST", 10))
 	cfg.VoucherAbsoluteExpirySecs = envInt64("VOUCHER_ABSOLUTE_EXPIRY_SECS", 31536000)
 	cfg.MinVoucherPayAmountSats = envInt64("MIN_VOUCHER_PAY_AMOUNT_SATS", 100)
 	cfg.MaxVoucherPayAmountSats = envInt64("MAX_VOUCHER_PAY_AMOUNT_SATS", 200000)
+	cfg.PinMaxAttempts = int(envInt64("PIN_MAX_ATTEMPTS", 5))
+	cfg.PinLockoutSecs = envInt64("PIN_LOCKOUT_SECS", 3600)
+	cfg.PinMaxLockoutSecs = envInt64("PIN_MAX_LOCKOUT_SECS", 604800)
+	if cfg.PinMaxLockoutSecs < cfg.PinLockoutSecs {
+		log.Fatalf("invalid PIN_MAX_LOCKOUT_SECS: must be at least PIN_LOCKOUT_SECS (%d), got %d", cfg.PinLockoutSecs, cfg.PinMaxLockoutSecs)
+	}
+	cfg.PinSessionSecs = envInt64("PIN_SESSION_SECS", 300)
+	cfg.WithdrawSessionSecs = envInt64("WITHDRAW_SESSION_SECS", 3600)
+	cfg.CharityPayoutIntervalSecs = envInterval("CHARITY_PAYOUT_INTERVAL_SECS", 3600)
+	cfg.BoltcardDailyLimitSats = envInt64("BOLTCARD_DAILY_LIMIT_SATS", 100000)
+	cfg.WebhookPollSecs = envInterval("WEBHOOK_POLL_SECS", 5)
+	cfg.WebhookMaxAttempts = int(envInt64("WEBHOOK_MAX_ATTEMPTS", 12))
+	cfg.WebhookRetryBaseSecs = envInt64("WEBHOOK_RETRY_BASE_SECS", 30)
+	cfg.WebhookAllowPrivateNetworks = envStr("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+	leads, err := parseLeadTimes(envStr("EXPIRY_REMINDER_LEAD_TIMES", "7d,1d"))
+	if err != nil {
+		log.Fatalf("invalid EXPIRY_REMINDER_LEAD_TIMES: %v", err)
+	}
+	cfg.ReminderLeadTimes = leads
+	cfg.ReminderIntervalSecs = envInterval("EXPIRY_REMINDER_INTERVAL_SECS", 3600)
+	cfg.ReconcileEnabled = envStr("RECONCILE_ENABLED", "true") != "false"
+	cfg.ReconcileIntervalSecs = envInterval("RECONCILE_INTERVAL_SECS", 3600)
+	cfg.ReconcileWindowSecs = envInt64("RECONCILE_WINDOW_SECS", 172800)
+	cfg.AccountLowBalanceSats = envInt64("ACCOUNT_LOW_BALANCE_SATS", 10000)
+	cfg.AccountSessionSecs = envInt64("ACCOUNT_SESSION_SECS", 86400)
+	cfg.MaxAccountTopupSats = envInt64("MAX_ACCOUNT_TOPUP_SATS", 10000000)
+	cfg.SMTPHost = envStr("SMTP_HOST", "")
+	cfg.SMTPPort = envStr("SMTP_PORT", "587")
+	cfg.SMTPUsername = envStr("SMTP_USERNAME", "")
+	cfg.SMTPPassword = envStr("SMTP_PASSWORD", "")
+	cfg.SMTPFrom = envStr("SMTP_FROM", "")
+	cfg.RatesURL = envStr("RATES_URL", "https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=%s")
+	cfg.RatesFile = envStr("RATES_FILE", "")
+	cfg.RatesCacheSecs = envInt64("RATES_CACHE_SECS", 300)
+	for _, c := range strings.Split(envStr("FIAT_CURRENCIES", "EUR,USD,GBP,ZAR"), ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			cfg.Currencies = append(cfg.Currencies, c)
+		}
+	}
 
 	count := int(envInt64("CHARITY_COUNT", 0))
 	for i := 1; i <= count; i++ {
@@ -107,6 +191,16 @@ func envInt64(key string, def int64) int64 {
 	return def
 }
 
+// envInterval reads the period, in seconds, of a background job's ticker,
+// which must be positive.
+func envInterval(key string, def int64) int64 {
+	n := envInt64(key, def)
+	if n <= 0 {
+		log.Fatalf("invalid %s: must be a positive number of seconds, got %d", key, n)
+	}
+	return n
+}
+
 func envFloat64(key string, def float64) float64 {
 	if v := os.Getenv(key); v != "" {
 		f, err := strconv.ParseFloat(v, 64)
@@ -122,30 +216,110 @@ func main() {
 	loadDotEnv()
 	loadConfig()
 
+	if len(os.Args) > 1 {
+		if os.Args[1] != "migrate" {
+			log.Fatalf("unknown command %q; usage: tipme [migrate status|up]", os.Args[1])
+		}
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+
 	var err error
-	database, err = initDB(cfg.DBPath)
+	database, err = initDB(cfg.MigrateOnStart)
 	if err != nil {
 		log.Fatalf("failed to init db: %v", err)
 	}
 	defer database.Close()
 
+	if err := checkMailConfig(); err != nil {
+		log.Fatalf("failed to init mail: %v", err)
+	}
+
 	blitziClient = NewBlitziClient(cfg.BlitziURL, cfg.BlitziToken)
+	rates, err = newRateProvider()
+	if err != nil {
+		log.Fatalf("failed to init exchange rates: %v", err)
+	}
+	fees, err = newFeeSchedule()
+	if err != nil {
+		log.Fatalf("failed to load fee schedule: %v", err)
+	}
+	importBatchFeeOverrides()
+
+	checkLedger()
 
 	// Run refund job at startup and then daily.
 	go runRefundJobLoop()
+	go runCharityPayoutLoop()
+	go runForwardLoop()
+	go runPoolLoop()
+	go runWebhookLoop()
+	go runReminderLoop()
+	if cfg.ReconcileEnabled {
+		go runReconcileLoop()
+	}
+	go runSweepLoop()
+	if mailEnabled() {
+		go runMailLoop()
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /{$}", serveIndex)
 	mux.HandleFunc("GET /api/config", handleConfig)
+	mux.HandleFunc("GET /api/fees/quote", handleFeeQuote)
 	mux.HandleFunc("GET /admin", handleAdmin)
 	mux.HandleFunc("POST /api/vouchers/invoice", handleCreateInvoice)
 	mux.HandleFunc("GET /api/vouchers/status/{payment_hash}", handleVoucherStatus)
+	mux.HandleFunc("POST /api/vouchers/{pay_id}/rekey", handleRekeyVoucher)
+	mux.HandleFunc("POST /api/vouchers/{pay_id}/boltcards", handleCreateBoltcard)
+	mux.HandleFunc("DELETE /api/vouchers/{pay_id}/boltcards/{card_id}", handleDisableBoltcard)
+	mux.HandleFunc("GET /api/batches/{payment_hash}", handleGetBatch)
+	mux.HandleFunc("PATCH /api/batches/{payment_hash}", handleUpdateBatch)
+	mux.HandleFunc("GET /api/batches/{payment_hash}/pool", handleGetBatchPool)
+	mux.HandleFunc("DELETE /api/batches/{payment_hash}/pins", handleForgetBatchPINs)
+	mux.HandleFunc("GET /api/batches/{payment_hash}/webhooks", handleListBatchWebhooks)
+	mux.HandleFunc("POST /api/batches/{payment_hash}/webhooks", handleCreateBatchWebhook)
+	mux.HandleFunc("DELETE /api/batches/{payment_hash}/webhooks/{id}", handleDeleteBatchWebhook)
+	mux.HandleFunc("GET /api/account", handleGetAccount)
+	mux.HandleFunc("GET /api/account/statement", handleAccountStatement)
+	mux.HandleFunc("POST /api/account/topups", handleCreateAccountTopup)
+	mux.HandleFunc("GET /api/account/topups/{payment_hash}", handleAccountTopupStatus)
+	mux.HandleFunc("POST /api/account/login", handleStartAccountLogin)
+	mux.HandleFunc("GET /api/account/login/{k1}", handleAccountLoginStatus)
+	mux.HandleFunc("POST /api/account/link", handleStartAccountLink)
+	mux.HandleFunc("GET /lnurl-auth", handleLNURLAuth)
+	mux.HandleFunc("GET /email/unsubscribe", handleEmailUnsubscribePage)
+	mux.HandleFunc("POST /email/unsubscribe", handleEmailUnsubscribe)
+	mux.HandleFunc("GET /api/admin/webhooks", handleListGlobalWebhooks)
+	mux.HandleFunc("POST /api/admin/webhooks", handleCreateGlobalWebhook)
+	mux.HandleFunc("DELETE /api/admin/webhooks/{id}", handleDeleteGlobalWebhook)
+	mux.HandleFunc("GET /api/admin/promo-codes", handleListPromoCodes)
+	mux.HandleFunc("POST /api/admin/promo-codes", handleCreatePromoCode)
+	mux.HandleFunc("GET /api/admin/promo-codes/{code}", handleListPromoRedemptions)
+	mux.HandleFunc("DELETE /api/admin/promo-codes/{code}", handleDisablePromoCode)
+	mux.HandleFunc("GET /api/admin/accounts", handleListCreditAccounts)
+	mux.HandleFunc("POST /api/admin/accounts", handleCreateCreditAccount)
+	mux.HandleFunc("POST /api/admin/accounts/{id}/api-key", handleRotateAccountAPIKey)
+	mux.HandleFunc("GET /api/admin/fee-overrides", handleListFeeOverrides)
+	mux.HandleFunc("GET /api/admin/batches/{id}/fees", handleGetBatchFees)
+	mux.HandleFunc("PUT /api/admin/batches/{id}/fees", handleSetBatchFees)
+	mux.HandleFunc("DELETE /api/admin/batches/{id}/fees", handleDeleteBatchFees)
+	mux.HandleFunc("GET /api/admin/ledger", handleAdminLedger)
+	mux.HandleFunc("GET /api/admin/reconciliation", handleAdminReconciliation)
+	mux.HandleFunc("POST /api/admin/reconciliation/run", handleRunReconciliation)
+	mux.HandleFunc("POST /api/admin/reconciliation/discrepancies/{id}/dismiss", handleDismissDiscrepancy)
+	mux.HandleFunc("GET /api/admin/webhooks/deliveries", handleListWebhookDeliveries)
+	mux.HandleFunc("POST /api/admin/webhooks/deliveries/{id}/replay", handleReplayWebhookDelivery)
 	mux.HandleFunc("GET /pay/info", handlePayInfo)
 	mux.HandleFunc("GET /pay/{pay_id}/callback", handleLNURLPayCallback)
 	mux.HandleFunc("GET /pay/{pay_id}", handleLNURLPay)
 	mux.HandleFunc("GET /withdraw/info", handleWithdrawInfo)
+	mux.HandleFunc("POST /withdraw/{withdraw_id}/pin", handleWithdrawPIN)
+	mux.HandleFunc("POST /withdraw/{withdraw_id}/claim", handleWithdrawClaim)
+	mux.HandleFunc("POST /withdraw/{withdraw_id}/donate", handleWithdrawDonate)
 	mux.HandleFunc("GET /withdraw/{withdraw_id}/callback", handleLNURLWithdrawCallback)
 	mux.HandleFunc("GET /withdraw/{withdraw_id}", handleLNURLWithdraw)
+	mux.HandleFunc("GET /boltcard/{card_id}/callback", handleBoltcardCallback)
+	mux.HandleFunc("GET /boltcard/{card_id}", handleBoltcardTap)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -164,14 +338,69 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 
 func runRefundJobLoop() {
 	ctx := context.Background()
-	if err := runRefundJob(ctx); err != nil {
-		log.Printf("startup refund job error: %v", err)
-	}
+	runJob("refund", func() {
+		if err := runRefundJob(ctx); err != nil {
+			log.Printf("startup refund job error: %v", err)
+		}
+	})
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 	for range ticker.C {
-		if err := runRefundJob(ctx); err != nil {
-			log.Printf("daily refund job error: %v", err)
-		}
+		runJob("refund", func() {
+			if err := runRefundJob(ctx); err != nil {
+				log.Printf("daily refund job error: %v", err)
+			}
+		})
+	}
+}
+
+func runCharityPayoutLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.CharityPayoutIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		runJob("charity payout", payCharityPayouts)
+	}
+}
+
+// runSweepLoop deletes expired withdraw sessions and login challenges and
+// returns withdrawals that never started paying, every hour.
+func runSweepLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		runJob("sweep", sweepExpired)
+	}
+}
+
+func sweepExpired() {
+	n, err := database.DeleteExpiredWithdrawSessions(time.Duration(cfg.WithdrawSessionSecs) * time.Second)
+	if err != nil {
+		log.Printf("sweep: DeleteExpiredWithdrawSessions: %v", err)
+	} else if n > 0 {
+		log.Printf("sweep: deleted %d expired withdraw session(s)", n)
+	}
+	n, err = database.DeleteExpiredAccountLogins(accountLoginTTL)
+	if err != nil {
+		log.Printf("sweep: DeleteExpiredAccountLogins: %v", err)
+	} else if n > 0 {
+		log.Printf("sweep: deleted %d expired login challenge(s)", n)
+	}
+	if err := returnUnsentWithdrawals(); err != nil {
+		log.Printf("sweep: %v", err)
+	}
+}
+
+// runJob runs background job name unless another instance sharing the
+// database is running it, in which case this run is skipped.
+func runJob(name string, job func()) {
+	release, ok, err := database.TryJobLock(name)
+	if err != nil {
+		log.Printf("%s job: lock: %v", name, err)
+		return
+	}
+	if !ok {
+		return
 	}
+	defer release()
+	job()
 }
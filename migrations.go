@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ── Schema Migrations ────────────────────────────────────────────────────────
+//
+// The schema is built by numbered migrations, applied in order, each in a
+// transaction of its own that also records it in schema_migrations. A
+// migration that fails leaves the database as it found it. Append new
+// migrations to the end of the list; never edit, renumber or remove one that
+// has been released, as databases out there have already applied it.
+//
+// Every dialect runs the same migrations. Write their SQL with SQLite column
+// types, which dialect.ddl translates, and add columns with addColumn.
+//
+// The server applies pending migrations at startup unless MIGRATE_ON_START is
+// false, in which case they are left to `tipme migrate up`. Either way it
+// refuses to run against a schema newer than it knows, such as one migrated
+// by a later release before a rollback.
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *Tx) error
+}
+
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "voucher_seq", migrateVoucherSeq},
+	{3, "pin_hashes", migratePinHashes},
+	{4, "batch_fee_overrides", migrateBatchFeeOverrides},
+	{5, "batch_kinds", migrateBatchKinds},
+}
+
+// latestSchemaVersion is the version this build migrates databases to.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// AppliedMigration is a row of schema_migrations.
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func (db *DB) createMigrationsTable() error {
+	_, err := db.Exec(db.dialect.ddl(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`))
+	return err
+}
+
+// AppliedMigrations returns the migrations recorded in the database, oldest
+// first.
+func (db *DB) AppliedMigrations() ([]AppliedMigration, error) {
+	if err := db.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []AppliedMigration
+	for rows.Next() {
+		var m AppliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// SchemaVersion returns the version of the newest migration applied, or 0
+// for a database that has none.
+func (db *DB) SchemaVersion() (int, error) {
+	if err := db.createMigrationsTable(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// CheckSchema fails unless the database is at exactly the version this
+// build expects.
+func (db *DB) CheckSchema() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch latest := latestSchemaVersion(); {
+	case version > latest:
+		return fmt.Errorf("%w: at version %d, this build knows up to %d", ErrSchemaTooNew, version, latest)
+	case version < latest:
+		return fmt.Errorf("database schema is at version %d, %d is current; run `tipme migrate up`", version, latest)
+	}
+	return nil
+}
+
+// Migrate applies the migrations the database hasn't had yet and returns
+// how many there were. It applies none to a schema newer than this build.
+func (db *DB) Migrate() (int, error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if latest := latestSchemaVersion(); version > latest {
+		return 0, fmt.Errorf("%w: at version %d, this build knows up to %d", ErrSchemaTooNew, version, latest)
+	}
+	n := 0
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		applied, err := db.applyMigration(m)
+		if err != nil {
+			return n, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if applied {
+			log.Printf("schema: applied migration %d (%s)", m.version, m.name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// applyMigration applies m unless another instance sharing the database
+// got there first, and reports whether it did.
+func (db *DB) applyMigration(m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if tx.dialect.lockMigrations != "" {
+		if _, err := tx.Exec(tx.dialect.lockMigrations); err != nil {
+			return false, err
+		}
+		var done bool
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) > 0 FROM schema_migrations WHERE version=?`, m.version,
+		).Scan(&done); err != nil || done {
+			return false, err
+		}
+	}
+	if err := m.up(tx); err != nil {
+		return false, err
+	}
+	// The primary key stops two instances applying the same migration.
+	if _, err := tx.Exec(
+		`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// migrateVoucherSeq numbers vouchers in the order they were created, which
+// SQLite only kept as the rowid. Postgres has no rowid; vouchers it already
+// holds keep 0 and fall back to pay_id order.
+func migrateVoucherSeq(tx *Tx) error {
+	if err := addColumn(tx, "vouchers", "seq", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if tx.dialect == sqliteDialect {
+		_, err := tx.Exec(`UPDATE vouchers SET seq=rowid`)
+		return err
+	}
+	return nil
+}
+
+// migratePinHashes replaces claim PINs, which were kept as they are, with
+// salted hashes. It also adds the columns that escalating lockouts need, and
+// the one that keeps new PINs until their owner has been shown them.
+func migratePinHashes(tx *Tx) error {
+	if err := addColumn(tx, "vouchers", "pin_lockouts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "vouchers", "pin_reveal", "TEXT"); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT pay_id, pin FROM vouchers WHERE pin IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	pins := map[string]string{}
+	for rows.Next() {
+		var payID, pin string
+		if err := rows.Scan(&payID, &pin); err != nil {
+			rows.Close()
+			return err
+		}
+		pins[payID] = pin
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for payID, pin := range pins {
+		hash, err := hashPIN(pin)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE vouchers SET pin=? WHERE pay_id=?`, hash, payID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateBatchFeeOverrides adds the funding fees an admin can set for a
+// batch in place of the schedule's, as JSON; empty for none.
+func migrateBatchFeeOverrides(tx *Tx) error {
+	return addColumn(tx, "batches", "fee_override", "TEXT NOT NULL DEFAULT ''")
+}
+
+// migrateBatchKinds records the kind of a batch's vouchers on the batch, so
+// it is known before they are created. Existing batches take it from their
+// vouchers, or are pools if they have members.
+func migrateBatchKinds(tx *Tx) error {
+	if err := addColumn(tx, "batches", "kind", "TEXT NOT NULL DEFAULT 'gift'"); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`UPDATE batches SET kind=(SELECT MIN(kind) FROM vouchers WHERE vouchers.batch_id=batches.id)
+		 WHERE EXISTS (SELECT 1 FROM vouchers WHERE vouchers.batch_id=batches.id)`,
+		`UPDATE batches SET kind='pool' WHERE id IN (SELECT batch_id FROM pool_members)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ── tipme migrate ────────────────────────────────────────────────────────────
+
+// runMigrateCommand runs `tipme migrate status|up` against the configured
+// store and returns the exit code.
+func runMigrateCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		fmt.Fprintln(os.Stderr, "usage: tipme migrate status|up")
+		return 2
+	}
+	db, err := openStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if args[0] == "up" {
+		n, err := db.Migrate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("applied %d migration(s); schema is at version %d\n", n, latestSchemaVersion())
+		return 0
+	}
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		status := "pending"
+		if t, ok := appliedAt[m.version]; ok {
+			status = t.UTC().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.version, m.name, status)
+	}
+	for _, m := range applied {
+		if m.Version > latestSchemaVersion() {
+			fmt.Fprintf(w, "%d\t%s\t%s (unknown to this build)\n", m.Version, m.Name, m.AppliedAt.UTC().Format(time.DateTime))
+		}
+	}
+	w.Flush()
+	return 0
+}
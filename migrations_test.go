@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := openSQLite(filepath.Join(t.TempDir(), "tipme.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schemaColumns maps each table to its column names, sorted, as columns
+// added by ALTER TABLE come last whatever their place in CREATE TABLE.
+func schemaColumns(t *testing.T, db *DB) map[string][]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	schema := make(map[string][]string, len(tables))
+	for _, table := range tables {
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var col string
+			if err := rows.Scan(&col); err != nil {
+				t.Fatal(err)
+			}
+			schema[table] = append(schema[table], col)
+		}
+		rows.Close()
+		slices.Sort(schema[table])
+	}
+	return schema
+}
+
+func countRows(t *testing.T, db *DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t)
+	n, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", n, len(migrations))
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Errorf("CheckSchema after Migrate: %v", err)
+	}
+	if n, err := db.Migrate(); err != nil || n != 0 {
+		t.Errorf("second Migrate = %d, %v; want 0, nil", n, err)
+	}
+}
+
+// TestMigrateBaselineSnapshot upgrades a database written by the last
+// release before migrations were versioned.
+func TestMigrateBaselineSnapshot(t *testing.T) {
+	snapshot, err := os.ReadFile("testdata/baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	if _, err := db.Exec(string(snapshot)); err != nil {
+		t.Fatalf("load snapshot: %v", err)
+	}
+	before := map[string]int{}
+	for _, table := range []string{"vouchers", "voucher_creation_requests", "pay_invoices"} {
+		before[table] = countRows(t, db, table)
+	}
+	if before["vouchers"] == 0 {
+		t.Fatal("snapshot has no vouchers")
+	}
+
+	if err := db.CheckSchema(); err == nil {
+		t.Error("CheckSchema passed before migrating")
+	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if version, err := db.SchemaVersion(); err != nil || version != latestSchemaVersion() {
+		t.Errorf("SchemaVersion = %d, %v; want %d", version, err, latestSchemaVersion())
+	}
+	for table, n := range before {
+		if got := countRows(t, db, table); got != n {
+			t.Errorf("%s has %d rows after migrating, want %d", table, got, n)
+		}
+	}
+
+	// The snapshot holds 21000 msats on one voucher, which the ledger opens with.
+	for account, want := range map[string]int64{
+		voucherAccount("c54944da-4656-40e2-af70-e8d6a78fce75"): -21_000,
+		voucherAccount("73f1d3a7-b409-4be4-86c5-487c6aa54e5f"): 0,
+		AccountLightning: 21_000,
+	} {
+		if got, err := db.LedgerBalance(account); err != nil || got != want {
+			t.Errorf("LedgerBalance(%s) = %d, %v; want %d", account, got, err, want)
+		}
+	}
+	checkTestLedger(t, db)
+
+	fresh := openTestDB(t)
+	if _, err := fresh.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	want, got := schemaColumns(t, fresh), schemaColumns(t, db)
+	for table, cols := range want {
+		if !slices.Equal(got[table], cols) {
+			t.Errorf("table %s: upgraded columns %v, fresh %v", table, got[table], cols)
+		}
+	}
+	for table := range got {
+		if _, ok := want[table]; !ok {
+			t.Errorf("upgraded database has table %s, fresh one doesn't", table)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(
+		`INSERT INTO schema_migrations (version, name) VALUES (?, 'from_the_future')`, latestSchemaVersion()+1,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Migrate = %v, want ErrSchemaTooNew", err)
+	}
+	if err := db.CheckSchema(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("CheckSchema = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	failing := errors.New("backfill failed")
+	migrations = append(slices.Clone(saved), migration{latestSchemaVersion() + 1, "broken", func(tx *Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE half_done (id INTEGER PRIMARY KEY)`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`ALTER TABLE batches RENAME COLUMN owner_note TO note`); err != nil {
+			return err
+		}
+		return failing
+	}})
+
+	if _, err := db.Migrate(); !errors.Is(err, failing) {
+		t.Fatalf("Migrate = %v, want %v", err, failing)
+	}
+	if version, _ := db.SchemaVersion(); version != saved[len(saved)-1].version {
+		t.Errorf("SchemaVersion = %d after failed migration, want %d", version, saved[len(saved)-1].version)
+	}
+	cols := schemaColumns(t, db)
+	if _, ok := cols["half_done"]; ok {
+		t.Error("table from failed migration was kept")
+	}
+	if !slices.Contains(cols["batches"], "owner_note") {
+		t.Error("column rename from failed migration was kept")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ── Tip Pools ────────────────────────────────────────────────────────────────
+//
+// Pool vouchers collect tips for a group. On every run the distribution job
+// allocates each pool's balance to its members by weight, then pays every
+// member whose owed balance their Lightning address will accept. Anything
+// too small to send, or whose payment failed, waits for the next run.
+
+func runPoolLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.PoolDistributionIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		runJob("pool distribution", distributePools)
+	}
+}
+
+// distributePools allocates every pool's balance and pays out its members.
+func distributePools() {
+	pools, err := database.GetDistributablePools()
+	if err != nil {
+		log.Printf("pool job: GetDistributablePools: %v", err)
+		return
+	}
+	for _, v := range pools {
+		allocated, err := database.AllocatePool(v.PayID)
+		if err != nil {
+			log.Printf("pool job: AllocatePool pay_id=%s: %v", v.PayID, err)
+			continue
+		}
+		if allocated > 0 {
+			log.Printf("pool job: allocated %d of %d msats from pay_id=%s", allocated, v.TotalPaidMsats, v.PayID)
+		}
+	}
+
+	members, err := database.GetPayablePoolMembers()
+	if err != nil {
+		log.Printf("pool job: GetPayablePoolMembers: %v", err)
+		return
+	}
+	for _, m := range members {
+		if err := payPoolMember(m); err != nil {
+			log.Printf("pool job: paying member %d (%s): %v", m.ID, m.Address, err)
+		}
+	}
+}
+
+// payPoolMember sends as much of a member's owed balance as their address accepts.
+func payPoolMember(m PoolMember) error {
+	params, err := resolvePayParams(m.Address)
+	if err != nil {
+		return err
+	}
+	msats := min(m.OwedMsats, params.MaxSendable) / 1000 * 1000
+	if msats == 0 || msats < params.MinSendable {
+		return nil // keep accumulating
+	}
+
+	id, err := database.StartPoolPayout(m.ID, msats)
+	if err != nil {
+		return err
+	}
+	log.Printf("pool job: paying %d msats to %s (member %d)", msats, m.Address, m.ID)
+	if err := payViaCallback(params, msats, fmt.Sprintf("pool_payout:%d", id)); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			log.Printf("CRITICAL: pool payout %d timed out for member %d (%d msats), assuming paid: %v",
+				id, m.ID, msats, err)
+			return nil
+		}
+		if settleErr := database.SettlePoolPayout(id, err); settleErr != nil {
+			log.Printf("CRITICAL: failed to return %d msats to pool member %d: %v", msats, m.ID, settleErr)
+		}
+		return err
+	}
+	if err := database.SettlePoolPayout(id, nil); err != nil {
+		log.Printf("SettlePoolPayout (id=%d): %v", id, err)
+	}
+	return nil
+}
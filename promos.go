@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ── Promo Codes ──────────────────────────────────────────────────────────────
+//
+// The admin hands out promo codes to partners under /api/admin/promo-codes.
+// A code given in createInvoiceRequest.PromoCode discounts the batch's
+// creation fee; a batch whose fee it brings to zero is created at once,
+// without an invoice (see handleCreateInvoice).
+
+var promoCodeRE = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// normalizePromoCode uppercases a code as entered, so codes are case-insensitive.
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// promoDiscount checks that code can be used for a batch of count vouchers
+// and returns the redemption taking its discount off feeSats, or nil if
+// there is no fee to discount. The error is fit to show the creator.
+func promoDiscount(code string, count int, feeSats int64) (*PromoRedemption, error) {
+	p, err := database.GetPromoCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPromoInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if err := p.Check(count); err != nil {
+		return nil, err
+	}
+	discount := p.Discount(feeSats)
+	if discount == 0 {
+		return nil, nil
+	}
+	return &PromoRedemption{Code: p.Code, VoucherCount: count, DiscountMsats: discount * 1000}, nil
+}
+
+// isPromoError reports whether err says a promo code can't be used, rather
+// than that something went wrong.
+func isPromoError(err error) bool {
+	return errors.Is(err, ErrPromoInvalid) || errors.Is(err, ErrPromoExpired) || errors.Is(err, ErrPromoUsedUp)
+}
+
+// ── /api/admin/promo-codes ───────────────────────────────────────────────────
+
+type promoCodeRequest struct {
+	Code            string `json:"code"`
+	DiscountPercent int64  `json:"discount_percent"`
+	DiscountSats    int64  `json:"discount_sats"`
+	MaxUses         int    `json:"max_uses"`
+	MaxVouchers     int    `json:"max_vouchers"`
+	ExpiresAt       string `json:"expires_at"` // RFC 3339; empty for never
+	Note            string `json:"note"`
+}
+
+func handleCreatePromoCode(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req promoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	p := &PromoCode{
+		Code:            normalizePromoCode(req.Code),
+		DiscountPercent: req.DiscountPercent,
+		DiscountSats:    req.DiscountSats,
+		MaxUses:         req.MaxUses,
+		MaxVouchers:     req.MaxVouchers,
+		Note:            strings.TrimSpace(req.Note),
+		Active:          true,
+	}
+	if !promoCodeRE.MatchString(p.Code) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "code must be 3 to 32 letters, digits, dashes or underscores",
+		})
+		return
+	}
+	if p.DiscountPercent < 0 || p.DiscountPercent > 100 || p.DiscountSats < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "discount_percent must be between 0 and 100 and discount_sats must not be negative",
+		})
+		return
+	}
+	if p.DiscountPercent == 0 && p.DiscountSats == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "a promo code needs a discount_percent or discount_sats"})
+		return
+	}
+	if p.MaxUses < 0 || p.MaxVouchers < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "max_uses and max_vouchers must not be negative"})
+		return
+	}
+	if len(p.Note) > 500 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "note must be at most 500 characters"})
+		return
+	}
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil || !t.After(time.Now()) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expires_at must be a future RFC 3339 timestamp"})
+			return
+		}
+		t = t.UTC()
+		p.ExpiresAt = &t
+	}
+	if _, err := database.GetPromoCode(p.Code); err == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a promo code with that name already exists"})
+		return
+	}
+	if err := database.InsertPromoCode(p); err != nil {
+		log.Printf("InsertPromoCode: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("promo: code %s created", p.Code)
+	p.CreatedAt = time.Now().UTC()
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// handleListPromoCodes returns every code with its redemption totals.
+func handleListPromoCodes(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	codes, err := database.GetPromoCodes()
+	if err != nil {
+		log.Printf("GetPromoCodes: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmptySlice(codes))
+}
+
+// handleListPromoRedemptions returns the batches created with a code.
+func handleListPromoRedemptions(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	code := normalizePromoCode(r.PathValue("code"))
+	p, err := database.GetPromoCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("GetPromoCode: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	redemptions, err := database.GetPromoRedemptions(code)
+	if err != nil {
+		log.Printf("GetPromoRedemptions: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"promo_code":  p,
+		"redemptions": orEmptySlice(redemptions),
+	})
+}
+
+// handleDisablePromoCode stops a code from being redeemed. Batches already
+// created with it are unaffected.
+func handleDisablePromoCode(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	code := normalizePromoCode(r.PathValue("code"))
+	if err := database.DisablePromoCode(code); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("DisablePromoCode: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("promo: code %s disabled", code)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "disabled"})
+}
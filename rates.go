@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Exchange Rates ───────────────────────────────────────────────────────────
+//
+// Amounts are always held in msats; fiat is for display only, plus the fiat
+// value of each funding, locked in at the rate when its invoice was created.
+
+// RateProvider quotes the price of one bitcoin in a fiat currency (ISO 4217 code).
+type RateProvider interface {
+	BTCPrice(ctx context.Context, currency string) (float64, error)
+}
+
+// newRateProvider returns the file provider if RATES_FILE is set, otherwise the HTTP provider.
+func newRateProvider() (RateProvider, error) {
+	if cfg.RatesFile != "" {
+		return newStaticRateProvider(cfg.RatesFile)
+	}
+	return newHTTPRateProvider(cfg.RatesURL, time.Duration(cfg.RatesCacheSecs)*time.Second), nil
+}
+
+// staticRateProvider serves fixed prices, e.g. for offline testing.
+type staticRateProvider map[string]float64
+
+// newStaticRateProvider loads prices from a JSON file such as {"EUR": 60000, "ZAR": 1200000}.
+func newStaticRateProvider(path string) (staticRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prices map[string]float64
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	p := staticRateProvider{}
+	for currency, price := range prices {
+		p[strings.ToUpper(currency)] = price
+	}
+	return p, nil
+}
+
+func (p staticRateProvider) BTCPrice(_ context.Context, currency string) (float64, error) {
+	price, ok := p[strings.ToUpper(currency)]
+	if !ok || price <= 0 {
+		return 0, fmt.Errorf("no rate for %s", currency)
+	}
+	return price, nil
+}
+
+// httpRateProvider fetches prices from a CoinGecko-compatible simple price
+// endpoint and caches them for ttl. If a refresh fails, the last known price
+// is served instead.
+type httpRateProvider struct {
+	url    string // with a %s placeholder for the lowercase currency code
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedRate
+}
+
+type cachedRate struct {
+	price     float64
+	fetchedAt time.Time
+}
+
+func newHTTPRateProvider(url string, ttl time.Duration) *httpRateProvider {
+	return &httpRateProvider{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  map[string]cachedRate{},
+	}
+}
+
+func (p *httpRateProvider) BTCPrice(ctx context.Context, currency string) (float64, error) {
+	currency = strings.ToUpper(currency)
+	p.mu.Lock()
+	cached, ok := p.cache[currency]
+	p.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < p.ttl {
+		return cached.price, nil
+	}
+
+	price, err := p.fetch(ctx, currency)
+	if err != nil {
+		if ok {
+			log.Printf("rates: refreshing %s failed, using price from %s: %v",
+				currency, cached.fetchedAt.UTC().Format(time.RFC3339), err)
+			return cached.price, nil
+		}
+		return 0, err
+	}
+	p.mu.Lock()
+	p.cache[currency] = cachedRate{price: price, fetchedAt: time.Now()}
+	p.mu.Unlock()
+	return price, nil
+}
+
+func (p *httpRateProvider) fetch(ctx context.Context, currency string) (float64, error) {
+	code := strings.ToLower(currency)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(p.url, code), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("fetch rate: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetch rate: HTTP %d: %s", resp.StatusCode, body)
+	}
+	var result map[string]map[string]float64
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("parse rate: %w", err)
+	}
+	price := result["bitcoin"][code]
+	if price <= 0 {
+		return 0, fmt.Errorf("no rate for %s", currency)
+	}
+	return price, nil
+}
+
+// ── Fiat formatting ──────────────────────────────────────────────────────────
+
+var currencySymbols = map[string]string{"EUR": "€", "USD": "$", "GBP": "£", "ZAR": "R", "JPY": "¥"}
+
+var currencyNames = map[string]string{
+	"EUR": "Euro", "USD": "US Dollar", "GBP": "British Pound", "ZAR": "South African Rand", "JPY": "Japanese Yen",
+}
+
+// isSupportedCurrency reports whether currency is one of the configured display currencies.
+func isSupportedCurrency(currency string) bool {
+	return slices.Contains(cfg.Currencies, currency)
+}
+
+// fiatCents converts msats to hundredths of currency at the current rate.
+func fiatCents(msats int64, currency string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	price, err := rates.BTCPrice(ctx, currency)
+	if err != nil {
+		return 0, err
+	}
+	// 1 BTC = 1e11 msats.
+	return int64(float64(msats)*price/1e9 + 0.5), nil
+}
+
+// formatFiat renders an amount in hundredths of currency, e.g. "€12.34".
+func formatFiat(cents int64, currency string) string {
+	amount := fmt.Sprintf("%d.%02d", cents/100, cents%100)
+	if sym, ok := currencySymbols[currency]; ok {
+		return sym + amount
+	}
+	return amount + " " + currency
+}
+
+// fiatEquivalent formats msats in currency at the current rate, or returns ""
+// if there is no currency or no rate.
+func fiatEquivalent(msats int64, currency string) string {
+	if currency == "" {
+		return ""
+	}
+	cents, err := fiatCents(msats, currency)
+	if err != nil {
+		log.Printf("fiatCents %s: %v", currency, err)
+		return ""
+	}
+	return formatFiat(cents, currency)
+}
+
+// ── LUD-21 currencies ────────────────────────────────────────────────────────
+//
+// Pay requests advertise the display currencies with their current rates, and
+// the callback accepts amount=<hundredths>.<CODE>, converted at a quote that
+// is stored with the invoice.
+
+// lud21Currencies lists the configured currencies that have a rate, with
+// preferred (e.g. the batch currency) first. Amounts are in hundredths.
+func lud21Currencies(preferred string) []map[string]any {
+	codes := slices.Clone(cfg.Currencies)
+	if i := slices.Index(codes, preferred); i > 0 {
+		codes = append(append([]string{preferred}, codes[:i]...), codes[i+1:]...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var result []map[string]any
+	for _, code := range codes {
+		price, err := rates.BTCPrice(ctx, code)
+		if err != nil {
+			log.Printf("lud21Currencies %s: %v", code, err)
+			continue
+		}
+		multiplier := 1e9 / price // msats per hundredth
+		name := currencyNames[code]
+		if name == "" {
+			name = code
+		}
+		result = append(result, map[string]any{
+			"code":       code,
+			"name":       name,
+			"symbol":     currencySymbols[code],
+			"decimals":   2,
+			"multiplier": multiplier,
+			"convertible": map[string]int64{
+				"min": int64(math.Ceil(float64(cfg.MinVoucherPayAmountSats*1000) / multiplier)),
+				"max": int64(math.Floor(float64(cfg.MaxVoucherPayAmountSats*1000) / multiplier)),
+			},
+		})
+	}
+	return result
+}
+
+// quoteFiat converts hundredths of currency to msats at the current rate,
+// rounded down to whole sats.
+func quoteFiat(cents int64, currency string) (*PayQuote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	price, err := rates.BTCPrice(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+	msats := int64(float64(cents)*1e9/price) / 1000 * 1000
+	return &PayQuote{Currency: currency, Amount: cents, BTCPrice: price, Msats: msats}, nil
+}
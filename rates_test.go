@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+// useTestRates serves fixed prices for the rest of a test.
+func useTestRates(t *testing.T, prices staticRateProvider) {
+	saved := rates
+	t.Cleanup(func() { rates = saved })
+	rates = prices
+}
+
+var testPrices = staticRateProvider{"EUR": 50_000, "USD": 30_000, "ZAR": 1_000_000}
+
+func TestFiatCents(t *testing.T) {
+	useTestRates(t, testPrices)
+	for _, tc := range []struct {
+		msats    int64
+		currency string
+		want     int64
+	}{
+		{100_000_000, "EUR", 5_000}, // 0.001 BTC
+		{100_000_000, "eur", 5_000},
+		{100_000_000, "ZAR", 100_000},
+		{0, "EUR", 0},
+		{10_000, "EUR", 1}, // half a cent rounds up
+		{9_999, "EUR", 0},
+		{30_000, "EUR", 2}, // 1.5 cents
+		{1_000, "USD", 0},
+	} {
+		got, err := fiatCents(tc.msats, tc.currency)
+		if err != nil || got != tc.want {
+			t.Errorf("fiatCents(%d, %s) = %d, %v; want %d", tc.msats, tc.currency, got, err, tc.want)
+		}
+	}
+	if got, err := fiatCents(100_000_000, "XYZ"); err == nil {
+		t.Errorf("fiatCents in an unsupported currency = %d, want an error", got)
+	}
+}
+
+func TestQuoteFiat(t *testing.T) {
+	useTestRates(t, testPrices)
+	for _, tc := range []struct {
+		cents    int64
+		currency string
+		want     int64
+	}{
+		{5_000, "EUR", 100_000_000},
+		{1, "EUR", 20_000},
+		{1, "USD", 33_000}, // 33333.3 msats, rounded down to whole sats
+		{100, "USD", 3_333_000},
+		{0, "EUR", 0},
+	} {
+		q, err := quoteFiat(tc.cents, tc.currency)
+		if err != nil {
+			t.Errorf("quoteFiat(%d, %s): %v", tc.cents, tc.currency, err)
+			continue
+		}
+		if q.Msats != tc.want || q.Amount != tc.cents || q.Currency != tc.currency || q.BTCPrice != testPrices[tc.currency] {
+			t.Errorf("quoteFiat(%d, %s) = %+v, want %d msats", tc.cents, tc.currency, *q, tc.want)
+		}
+	}
+	if q, err := quoteFiat(100, "XYZ"); err == nil {
+		t.Errorf("quoteFiat in an unsupported currency = %+v, want an error", *q)
+	}
+}
+
+func TestFormatFiat(t *testing.T) {
+	for _, tc := range []struct {
+		cents    int64
+		currency string
+		want     string
+	}{
+		{1_234, "EUR", "€12.34"},
+		{5, "USD", "$0.05"},
+		{0, "GBP", "£0.00"},
+		{100_000, "ZAR", "R1000.00"},
+		{1_234, "CHF", "12.34 CHF"},
+	} {
+		if got := formatFiat(tc.cents, tc.currency); got != tc.want {
+			t.Errorf("formatFiat(%d, %s) = %q, want %q", tc.cents, tc.currency, got, tc.want)
+		}
+	}
+}
+
+func TestFiatEquivalent(t *testing.T) {
+	useTestRates(t, testPrices)
+	for _, tc := range []struct {
+		msats    int64
+		currency string
+		want     string
+	}{
+		{100_000_000, "EUR", "€50.00"},
+		{100_000_000, "", ""},
+		{100_000_000, "XYZ", ""},
+	} {
+		if got := fiatEquivalent(tc.msats, tc.currency); got != tc.want {
+			t.Errorf("fiatEquivalent(%d, %q) = %q, want %q", tc.msats, tc.currency, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Reconciliation ───────────────────────────────────────────────────────────
+//
+// The solvency badge only says whether blitzi holds enough to cover the
+// vouchers; reconciliation explains a gap. Each run lists the payments blitzi
+// made and received over a trailing window and matches them to the records
+// here: incoming payments to creation requests, funding invoices and account
+// top-ups, outgoing
+// ones to the claims, withdrawals, refunds and payouts payInvoice recorded.
+// It also checks the reverse, for money credited or sent here that blitzi
+// never saw. Whatever disagrees is kept as a discrepancy for the admin report
+// until a later run finds it settled or an admin dismisses it.
+
+const (
+	DiscrepancyUnknownIncoming = "unknown_incoming"    // received, but matches no invoice here
+	DiscrepancyUncredited      = "uncredited_incoming" // received for an invoice that was never credited
+	DiscrepancyMissingIncoming = "missing_incoming"    // credited here, but never received
+	DiscrepancyUnknownOutgoing = "unknown_outgoing"    // sent, but not recorded here
+	DiscrepancyMissingOutgoing = "missing_outgoing"    // recorded as sent, but unknown to blitzi
+	DiscrepancyStatusMismatch  = "status_mismatch"     // sent or failed, but recorded the other way
+	DiscrepancyAmountMismatch  = "amount_mismatch"
+)
+
+// reconcileSlack widens the backend query past the window, so a payment that
+// settled just before the window but was recorded just inside it isn't
+// reported missing.
+const reconcileSlack = 10 * time.Minute
+
+// reconcileInFlight is how long a recorded payment may stay pending before
+// it is taken to have timed out rather than still be on its way.
+const reconcileInFlight = 5 * time.Minute
+
+// reconcileMu keeps the job and admin-triggered runs from overlapping;
+// the "reconcile" job lock does the same across instances.
+var reconcileMu sync.Mutex
+
+// errReconcileBusy is returned when another instance is reconciling.
+var errReconcileBusy = errors.New("another instance is reconciling")
+
+// errReconcileDisabled is returned when RECONCILE_ENABLED is false.
+var errReconcileDisabled = errors.New("reconciliation is disabled (RECONCILE_ENABLED=false)")
+
+// runReconcileLoop reconciles every interval. It stops for good if blitzi
+// turns out to have no payment history to reconcile against; the stored
+// run says why on the admin page.
+func runReconcileLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.ReconcileIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		_, err := runReconciliation()
+		if errors.Is(err, ErrNoPaymentHistory) {
+			log.Printf("reconcile: stopping: %v; set RECONCILE_ENABLED=false to skip reconciliation", err)
+			return
+		}
+		if err != nil && !errors.Is(err, errReconcileBusy) {
+			log.Printf("reconcile: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// runReconciliation reconciles the configured window and stores the run. A
+// run that could not list blitzi's payments is stored with its error; if
+// blitzi has no payment history at all, it is also returned along with
+// ErrNoPaymentHistory.
+func runReconciliation() (*ReconcileRun, error) {
+	if !cfg.ReconcileEnabled {
+		return nil, errReconcileDisabled
+	}
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	release, ok, err := database.TryJobLock("reconcile")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errReconcileBusy
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	run := &ReconcileRun{WindowStart: time.Now().Add(-time.Duration(cfg.ReconcileWindowSecs) * time.Second)}
+	found, runErr := reconcile(ctx, run)
+	if runErr != nil {
+		run.Error, found = runErr.Error(), nil
+		if !errors.Is(runErr, ErrNoPaymentHistory) {
+			log.Printf("reconcile: %v", runErr)
+			runErr = nil
+		}
+	}
+	if err := database.SaveReconcileRun(run, found); err != nil {
+		return nil, fmt.Errorf("SaveReconcileRun: %w", err)
+	}
+	if len(found) > 0 {
+		log.Printf("reconcile: %d discrepancy(ies) in %d incoming and %d outgoing payment(s)",
+			len(found), run.Incoming, run.Outgoing)
+	}
+	return run, runErr
+}
+
+// reconcile matches blitzi's payments since run.WindowStart against the
+// database, filling in run's counts and returning the discrepancies.
+func reconcile(ctx context.Context, run *ReconcileRun) ([]Discrepancy, error) {
+	payments, err := blitziClient.ListPayments(ctx, run.WindowStart.Add(-reconcileSlack))
+	if errors.Is(err, ErrNoPaymentHistory) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("ListPayments: %w", err)
+	}
+
+	var found []Discrepancy
+	seen := map[string]bool{} // direction + ":" + payment hash of settled payments
+	for _, p := range latestAttempts(payments) {
+		var d *Discrepancy
+		switch {
+		case p.Direction == "incoming" && p.Status == "succeeded":
+			run.Incoming++
+			d, err = matchIncoming(p)
+		case p.Direction == "outgoing" && p.Status != "pending":
+			run.Outgoing++
+			d, err = matchOutgoing(p)
+		default:
+			continue // unpaid invoices and payments still in flight
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.Status == "succeeded" {
+			seen[p.Direction+":"+p.PaymentHash] = true
+		}
+		if d == nil {
+			run.Matched++
+			continue
+		}
+		d.Direction, d.PaymentHash, d.BackendMsats = p.Direction, p.PaymentHash, p.AmountMsats
+		d.PaymentAt = time.Unix(p.CreatedAt, 0).UTC()
+		found = append(found, *d)
+	}
+
+	recorded, err := database.SettledPaymentsSince(run.WindowStart)
+	if err != nil {
+		return nil, fmt.Errorf("SettledPaymentsSince: %w", err)
+	}
+	for _, r := range recorded {
+		if seen[r.Direction+":"+r.PaymentHash] {
+			continue
+		}
+		kind := DiscrepancyMissingIncoming
+		if r.Direction == "outgoing" {
+			kind = DiscrepancyMissingOutgoing
+		}
+		found = append(found, Discrepancy{
+			Kind:          kind,
+			Direction:     r.Direction,
+			PaymentHash:   r.PaymentHash,
+			Ref:           r.Ref,
+			RecordedMsats: r.AmountMsats,
+			Detail:        fmt.Sprintf("recorded as %s, but blitzi has no settled payment", r.Status),
+			PaymentAt:     r.At,
+		})
+	}
+	run.Discrepancies = len(found)
+	return found, nil
+}
+
+// settleTimedOutWithdrawal settles the withdrawal paid by the outgoing
+// payment with ref if it timed out and was left to reconciliation, and
+// reports whether it was.
+func settleTimedOutWithdrawal(ref string, paid bool) (bool, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(ref, "withdrawal:"), 10, 64)
+	if err != nil || !strings.HasPrefix(ref, "withdrawal:") {
+		return false, nil
+	}
+	settled, err := database.SettleUnknownWithdrawal(id, paid)
+	if err != nil {
+		return false, fmt.Errorf("SettleUnknownWithdrawal: %w", err)
+	}
+	return settled, nil
+}
+
+// returnUnsentWithdrawals gives back to their vouchers the withdrawals that
+// timed out before a payment for them was even started, so they never left.
+// It needs no payment history from blitzi, so it runs with the sweep job
+// whether or not reconciliation does.
+func returnUnsentWithdrawals() error {
+	unsent, err := database.GetUnsentWithdrawals(time.Now().Add(-reconcileInFlight))
+	if err != nil {
+		return fmt.Errorf("GetUnsentWithdrawals: %w", err)
+	}
+	for _, id := range unsent {
+		if _, err := database.SettleUnknownWithdrawal(id, false); err != nil {
+			return fmt.Errorf("SettleUnknownWithdrawal: %w", err)
+		}
+		log.Printf("withdrawal %d timed out before paying; returned to its voucher", id)
+	}
+	return nil
+}
+
+// latestAttempts keeps one entry per payment: an invoice retried after a
+// failed attempt is listed once for each attempt, and only a successful one
+// counts.
+func latestAttempts(payments []BlitziPayment) []BlitziPayment {
+	var result []BlitziPayment
+	index := map[string]int{}
+	for _, p := range payments {
+		key := p.Direction + ":" + p.PaymentHash
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, p)
+		} else if result[i].Status != "succeeded" {
+			result[i] = p
+		}
+	}
+	return result
+}
+
+// matchIncoming checks a received payment against the creation request,
+// funding invoice or account top-up it paid, returning nil if they agree.
+func matchIncoming(p BlitziPayment) (*Discrepancy, error) {
+	rec, err := database.FindIncomingPayment(p.PaymentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Discrepancy{
+			Kind:   DiscrepancyUnknownIncoming,
+			Detail: "received, but no creation request, funding invoice or top-up has this payment hash",
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FindIncomingPayment: %w", err)
+	}
+	d := &Discrepancy{Ref: rec.Ref, RecordedMsats: rec.AmountMsats}
+	switch {
+	case !rec.Settled:
+		d.Kind, d.Detail = DiscrepancyUncredited, fmt.Sprintf("received, but the invoice is %s", rec.Status)
+	case p.AmountMsats != rec.AmountMsats:
+		d.Kind, d.Detail = DiscrepancyAmountMismatch, "received a different amount than the invoice was for"
+	default:
+		return nil, nil
+	}
+	return d, nil
+}
+
+// matchOutgoing checks a sent or failed payment against the one payInvoice
+// recorded, returning nil if they agree. A payment that timed out and was
+// assumed paid is confirmed here once blitzi reports it succeeded.
+func matchOutgoing(p BlitziPayment) (*Discrepancy, error) {
+	rec, err := database.GetOutgoingPayment(p.PaymentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		if p.Status != "succeeded" {
+			return nil, nil // nothing left the wallet
+		}
+		return &Discrepancy{Kind: DiscrepancyUnknownOutgoing, Detail: "sent, but not by this server"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetOutgoingPayment: %w", err)
+	}
+	if rec.Status == "pending" && time.Since(rec.At) < reconcileInFlight {
+		return nil, nil // payInvoice will settle it
+	}
+	d := &Discrepancy{Ref: rec.Ref, RecordedMsats: rec.AmountMsats}
+	switch {
+	case p.Status == "succeeded" && rec.Status == "pending":
+		if err := database.SettleOutgoingPayment(p.PaymentHash, p.FeeMsats, nil); err != nil {
+			return nil, fmt.Errorf("SettleOutgoingPayment: %w", err)
+		}
+		bookRoutingFee(p.PaymentHash, p.FeeMsats)
+		if _, err := settleTimedOutWithdrawal(rec.Ref, true); err != nil {
+			return nil, err
+		}
+		log.Printf("reconcile: payment %s (%s) confirmed after timing out", p.PaymentHash, rec.Ref)
+	case p.Status == "succeeded" && rec.Status == "failed":
+		d.Kind, d.Detail = DiscrepancyStatusMismatch, "recorded as failed and returned to its owner, but it was sent"
+		return d, nil
+	case p.Status == "failed" && rec.Status == "pending":
+		// A timed-out withdrawal's amount goes back to its voucher.
+		returned, err := settleTimedOutWithdrawal(rec.Ref, false)
+		if err != nil {
+			return nil, err
+		}
+		if !returned {
+			d.Kind, d.Detail = DiscrepancyStatusMismatch, "assumed paid after timing out, but it failed"
+			return d, nil
+		}
+		if err := database.SettleOutgoingPayment(p.PaymentHash, 0, errors.New(p.Status)); err != nil {
+			return nil, fmt.Errorf("SettleOutgoingPayment: %w", err)
+		}
+		log.Printf("reconcile: payment %s (%s) failed after timing out; returned to its voucher", p.PaymentHash, rec.Ref)
+		return nil, nil
+	case p.Status == "failed" && rec.Status == "succeeded":
+		d.Kind, d.Detail = DiscrepancyStatusMismatch, "recorded as sent, but it failed"
+		return d, nil
+	}
+	// Amountless invoices are recorded with no amount to compare.
+	if p.Status == "succeeded" && rec.AmountMsats > 0 && p.AmountMsats != rec.AmountMsats {
+		d.Kind, d.Detail = DiscrepancyAmountMismatch, "sent a different amount than the invoice was for"
+		return d, nil
+	}
+	return nil, nil
+}
+
+// ── /api/admin/reconciliation ────────────────────────────────────────────────
+
+// handleAdminReconciliation returns the last run and the open discrepancies.
+func handleAdminReconciliation(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	run, err := database.GetLastReconcileRun()
+	if errors.Is(err, sql.ErrNoRows) {
+		run, err = nil, nil
+	}
+	if err != nil {
+		log.Printf("GetLastReconcileRun: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeReconciliationReport(w, run)
+}
+
+// handleRunReconciliation runs the reconciliation job now and returns the report.
+func handleRunReconciliation(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	run, err := runReconciliation()
+	if errors.Is(err, errReconcileBusy) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errReconcileDisabled) {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil && !errors.Is(err, ErrNoPaymentHistory) {
+		log.Printf("runReconciliation: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeReconciliationReport(w, run)
+}
+
+func writeReconciliationReport(w http.ResponseWriter, run *ReconcileRun) {
+	discrepancies, err := database.GetOpenDiscrepancies()
+	if err != nil {
+		log.Printf("GetOpenDiscrepancies: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"last_run":      run,
+		"discrepancies": orEmptySlice(discrepancies),
+	})
+}
+
+// handleDismissDiscrepancy hides a discrepancy an admin has dealt with.
+func handleDismissDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err := database.DismissDiscrepancy(id); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("DismissDiscrepancy: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("reconcile: discrepancy %d dismissed", id)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "dismissed"})
+}
+
+// reconciliationHTML renders the admin page's reconciliation section.
+func reconciliationHTML() (string, error) {
+	run, err := database.GetLastReconcileRun()
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	discrepancies, err := database.GetOpenDiscrepancies()
+	if err != nil {
+		return "", err
+	}
+	var badge string
+	switch {
+	case run.Error != "":
+		badge = fmt.Sprintf(`<div class="badge-warn">⚠ Last run failed: %s</div>`, html.EscapeString(run.Error))
+	case len(discrepancies) > 0:
+		badge = fmt.Sprintf(`<div class="badge-warn">⚠ %d open discrepancy(ies)</div>`, len(discrepancies))
+	default:
+		badge = fmt.Sprintf(`<div class="badge-ok">✓ %d payment(s) since %s match</div>`,
+			run.Matched, run.WindowStart.UTC().Format("2 Jan 15:04"))
+	}
+	var rows strings.Builder
+	for _, d := range discrepancies {
+		msats := d.BackendMsats
+		if msats == 0 {
+			msats = d.RecordedMsats
+		}
+		rows.WriteString(fmt.Sprintf(`<tr><td title="%s">%s</td><td>%s</td><td>%d sats</td><td>%s</td></tr>`,
+			html.EscapeString(d.PaymentHash), html.EscapeString(d.Kind),
+			html.EscapeString(d.Ref), msats/1000, html.EscapeString(d.Detail)))
+	}
+	var table string
+	if len(discrepancies) > 0 {
+		table = fmt.Sprintf(`<table><thead><tr><th>Discrepancy</th><th>Ref</th><th>Amount</th><th>Detail</th></tr></thead><tbody>%s</tbody></table>`, rows.String())
+	}
+	return fmt.Sprintf(`<hr><div class="section-title">Reconciliation</div>%s%s`, badge, table), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestReconcileWithoutPaymentHistory runs reconciliation against a blitzi
+// that answers 404 for its payment history, as builds without it do.
+func TestReconcileWithoutPaymentHistory(t *testing.T) {
+	useTestServer(t)
+	cfg.ReconcileEnabled, cfg.ReconcileWindowSecs, cfg.AdminToken = true, 86400, "admin"
+	blitzi := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(blitzi.Close)
+	blitziClient = NewBlitziClient(blitzi.URL, "")
+
+	run, err := runReconciliation()
+	if !errors.Is(err, ErrNoPaymentHistory) {
+		t.Fatalf("runReconciliation = %v, want ErrNoPaymentHistory", err)
+	}
+	stored, err := database.GetLastReconcileRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != run.ID || stored.Error != ErrNoPaymentHistory.Error() {
+		t.Errorf("stored run %+v, want run %d with the missing history as its error", *stored, run.ID)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/reconciliation/run", nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	handleRunReconciliation(rec, req)
+	var report struct {
+		LastRun *ReconcileRun `json:"last_run"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil || rec.Code != http.StatusOK || report.LastRun == nil {
+		t.Errorf("admin run = %d %s, want the report of the failed run", rec.Code, rec.Body.String())
+	}
+
+	cfg.ReconcileEnabled = false
+	if _, err := runReconciliation(); !errors.Is(err, errReconcileDisabled) {
+		t.Errorf("runReconciliation while disabled = %v, want errReconcileDisabled", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Expiry reminders ─────────────────────────────────────────────────────────
+//
+// Before a voucher's balance lapses to its batch's expiry policy, a
+// voucher.expiring event is emitted at each configured lead time, feeding
+// webhooks and owner emails. Reminders are recorded per voucher, lead time
+// and expiry date, so each is sent once, and a voucher whose expiry moves
+// (e.g. after a new tip) is reminded again for the new date.
+
+func runReminderLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.ReminderIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		runJob("reminder", sendExpiryReminders)
+		<-ticker.C
+	}
+}
+
+// sendExpiryReminders emits a reminder for every voucher that has crossed a
+// lead time before its expiry. Only the shortest lead time crossed counts, so
+// a voucher that is already a day from expiry isn't also told it has a week.
+func sendExpiryReminders() {
+	if len(cfg.ReminderLeadTimes) == 0 {
+		return
+	}
+	vouchers, err := database.GetVouchersWithBalance()
+	if err != nil {
+		log.Printf("reminders: GetVouchersWithBalance: %v", err)
+		return
+	}
+	now := time.Now()
+	sent := 0
+	for _, v := range vouchers {
+		// Forward and pool vouchers pay out on their own.
+		if v.IsAutoPayout() {
+			continue
+		}
+		expiresAt := v.ExpiresAt().UTC().Truncate(time.Second)
+		if !now.Before(expiresAt) {
+			continue // the refund job handles it
+		}
+		// A lead time only applies if the balance was already there when it
+		// was crossed, so a fresh tip doesn't trigger a reminder at once.
+		since := v.CreatedAt
+		if v.LastFundedAt != nil {
+			since = *v.LastFundedAt
+		}
+		lead, ok := dueLeadTime(expiresAt.Sub(now), expiresAt.Sub(since))
+		if !ok {
+			continue
+		}
+		emitted, err := database.RecordExpiryReminder(v, int64(lead/time.Second), expiresAt)
+		if err != nil {
+			log.Printf("reminders: RecordExpiryReminder pay_id=%s: %v", v.PayID, err)
+			continue
+		}
+		if emitted {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("reminders: sent %d expiry reminder(s)", sent)
+		nudgeWebhooks()
+		nudgeMailer()
+	}
+}
+
+// dueLeadTime returns the shortest configured lead time that remaining has
+// crossed, provided it is shorter than window, the time the balance has been
+// waiting to expire.
+func dueLeadTime(remaining, window time.Duration) (time.Duration, bool) {
+	for _, lead := range cfg.ReminderLeadTimes { // shortest first
+		if remaining <= lead {
+			return lead, lead < window
+		}
+	}
+	return 0, false
+}
+
+// parseLeadTimes parses a comma-separated list of durations such as "7d,1d"
+// or "36h", sorted shortest first. Days are written with a d suffix.
+func parseLeadTimes(s string) ([]time.Duration, error) {
+	var leads []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		var d time.Duration
+		if days, ok := strings.CutSuffix(f, "d"); ok {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lead time %q", f)
+			}
+			d = time.Duration(n) * 24 * time.Hour
+		} else {
+			var err error
+			if d, err = time.ParseDuration(f); err != nil {
+				return nil, fmt.Errorf("invalid lead time %q", f)
+			}
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid lead time %q", f)
+		}
+		leads = append(leads, d)
+	}
+	slices.Sort(leads)
+	return slices.Compact(leads), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseLeadTimes(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []time.Duration // nil if it must be refused
+	}{
+		{"7d,1d", []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}},
+		{" 36h , 1d ,36h", []time.Duration{24 * time.Hour, 36 * time.Hour}},
+		{"", nil},
+		{"1w", nil},
+		{"0h", nil},
+		{"-1d", nil},
+	} {
+		got, err := parseLeadTimes(tc.in)
+		if tc.want == nil && tc.in != "" {
+			if err == nil {
+				t.Errorf("parseLeadTimes(%q) = %v, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("parseLeadTimes(%q) = %v, %v; want %v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+// TestSendExpiryReminders funds vouchers expiring a day later at different
+// times in the past and checks which reminders each gets, and that each is
+// sent once per expiry date.
+func TestSendExpiryReminders(t *testing.T) {
+	useTestServer(t)
+	cfg.ReminderLeadTimes = []time.Duration{time.Hour, 6 * time.Hour}
+	_, vouchers := createTestBatch(t, testDB(), 5)
+	now := time.Now().UTC()
+	fundedAgo := func(v *Voucher, ago time.Duration) {
+		t.Helper()
+		if _, err := testDB().Exec(`UPDATE vouchers SET last_funded_at=? WHERE pay_id=?`, now.Add(-ago), v.PayID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, v := range vouchers {
+		fundTestVoucher(t, testDB(), v.PayID, 10_000)
+		fundedAgo(v, []time.Duration{20 * time.Hour, 23*time.Hour + 30*time.Minute, 2 * time.Hour, 48 * time.Hour, 0}[i])
+	}
+	// The last voucher expires an hour after a fresh tip: it has crossed the
+	// hour's lead time, but the balance wasn't there when it did.
+	if _, err := testDB().Exec(`UPDATE vouchers SET expiry_seconds=3600 WHERE pay_id=?`, vouchers[4].PayID); err != nil {
+		t.Fatal(err)
+	}
+	reminders := func() map[string][]int64 {
+		t.Helper()
+		rows, err := testDB().Query(`SELECT pay_id, lead_seconds FROM voucher_reminders ORDER BY expires_at`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		got := map[string][]int64{}
+		for rows.Next() {
+			var payID string
+			var lead int64
+			if err := rows.Scan(&payID, &lead); err != nil {
+				t.Fatal(err)
+			}
+			got[payID] = append(got[payID], lead)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	sendExpiryReminders()
+	sendExpiryReminders()
+	want := map[string][]int64{
+		vouchers[0].PayID: {6 * 3600}, // 4h left
+		vouchers[1].PayID: {3600},     // 30m left; not also told it has 6h
+	}
+	if got := reminders(); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("reminders %v, want %v", got, want)
+	}
+
+	// A new tip moves the expiry date, which is reminded of again.
+	fundedAgo(vouchers[0], 19*time.Hour)
+	sendExpiryReminders()
+	want[vouchers[0].PayID] = []int64{6 * 3600, 6 * 3600}
+	if got := reminders(); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("reminders after a new tip %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ── Store ────────────────────────────────────────────────────────────────────
+//
+// Store is everything the server keeps, behind one interface so it can live
+// in SQLite (one process, DB_PATH) or PostgreSQL (several app instances
+// sharing DATABASE_URL). Both are served by DB: queries and migrations are
+// written once, in the SQL the two have in common with ? placeholders and
+// SQLite column types, and DB's dialect rebinds them and fills in the few
+// fragments that differ.
+//
+// Methods that change several rows run in one transaction. Read-modify-write
+// transactions lock the rows they read (dialect.lockRows); SQLite needs no
+// row locks, as its single connection already serialises transactions.
+// Background jobs take a job lock (TryJobLock) so only one instance runs each
+// at a time, and outbox workers claim their rows, so they can run everywhere.
+
+type Store interface {
+	Begin() (*Tx, error)
+	Close() error
+	TryJobLock(name string) (release func(), ok bool, err error)
+
+	// Schema
+	AppliedMigrations() ([]AppliedMigration, error)
+	SchemaVersion() (int, error)
+	CheckSchema() error
+	Migrate() (int, error)
+
+	// Creation requests and batches
+	InsertCreationRequest(paymentHash string, b *Batch, members []PoolMember, promo *PromoRedemption) error
+	UpdateCreationRequestStatus(paymentHash, status string) error
+	GetCreationRequest(paymentHash string) (*VoucherCreationRequest, error)
+	GetBatch(id string) (*Batch, error)
+	UpdateBatchDetails(b *Batch) error
+	GetRecentBatchStats(limit int) ([]*BatchStats, error)
+	SetBatchFeeOverride(id string, f *FundingFees) error
+	GetBatchFeeOverrides() ([]*Batch, error)
+	ImportBatchFeeOverrides(overrides map[string]FundingFees) (int, error)
+
+	// Vouchers
+	InsertVouchers(creationHash string, vouchers []*Voucher) error
+	GetVouchersByCreationHash(hash string) ([]*Voucher, error)
+	ForgetRevealedPINs(creationHash string) error
+	GetVoucherByPayID(payID string) (*Voucher, error)
+	GetVoucherByWithdrawID(withdrawID string) (*Voucher, error)
+	RekeyVoucher(payID, oldWithdrawID, newWithdrawID string) error
+	DeactivateVoucher(payID, reason string, msats int64) error
+	DebitVoucher(payID string, msats int64) (int64, error)
+	DebitVoucherByCard(payID, cardID string, msats, limitMsats int64) (int64, error)
+	SettleWithdrawal(id int64, paid bool) error
+	MarkWithdrawalUnknown(id int64) error
+	SettleUnknownWithdrawal(id int64, paid bool) (bool, error)
+	GetUnsentWithdrawals(cutoff time.Time) ([]int64, error)
+	GetExpiredVouchersForRefund() ([]*Voucher, error)
+	GetVouchersWithBalance() ([]*Voucher, error)
+	GetForwardableVouchers() ([]*Voucher, error)
+	SetForwardRetry(payID string, failures int, retryAt *time.Time) error
+
+	// Tip pools
+	GetPoolMembers(batchID string) ([]PoolMember, error)
+	GetPayablePoolMembers() ([]PoolMember, error)
+	GetDistributablePools() ([]*Voucher, error)
+	AllocatePool(payID string) (int64, error)
+	StartPoolPayout(memberID, msats int64) (int64, error)
+	SettlePoolPayout(id int64, payErr error) error
+	GetPoolPayouts(batchID string, limit int) ([]PoolPayout, error)
+
+	// Audit and charity payouts
+	GetAuditStats() (*AuditStats, error)
+	PendingCharityPayouts() (map[string][]int64, error)
+	SetCharityPayoutsStatus(ids []int64, from, to string) (int64, error)
+	GetCharityTotals() ([]*CharityTotals, error)
+
+	// Funding invoices, withdraw sessions and boltcards
+	GetPaidInvoicesByPayID(payID string) ([]*PayInvoice, error)
+	InsertPayInvoice(id, payID, paymentHash string, amountMsats, creditedMsats, charityMsats, fiatCents int64, quote *PayQuote) error
+	InsertWithdrawSession(k1, withdrawID string) error
+	DeleteExpiredWithdrawSessions(ttl time.Duration) (int64, error)
+	CheckVoucherPIN(withdrawID, pin, k1 string, maxAttempts int, lockout, maxLockout time.Duration) (ok bool, attemptsLeft int, err error)
+	GetPinSession(k1, withdrawID string, ttl time.Duration) (bool, error)
+	InsertBoltcardSession(k1, withdrawID, cardID string) error
+	ValidateAndUseWithdrawSession(k1, withdrawID, cardID string) (payID string, err error)
+	InsertBoltcard(c *Boltcard) error
+	GetBoltcard(cardID string) (*Boltcard, error)
+	DisableBoltcard(payID, cardID string) error
+	RecordBoltcardTap(cardID, uid string, counter uint32) error
+	BoltcardSpent(cardID string) (int64, error)
+
+	// Webhooks, reminders and email
+	InsertWebhookSubscription(s *WebhookSubscription) error
+	GetWebhookSubscriptions(batchID string) ([]WebhookSubscription, error)
+	DeleteWebhookSubscription(id, batchID string) error
+	EnqueueEvent(eventType, batchID, payID string, data map[string]any) error
+	ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+	PostponeWebhookDeliveries(ids []int64, at time.Time) error
+	GetWebhookDeliveries(status string, limit int) ([]WebhookDelivery, error)
+	MarkWebhookDelivered(id int64, httpStatus int) error
+	MarkWebhookFailed(id int64, httpStatus int, errMsg string, retryAt *time.Time) error
+	ReplayWebhookDelivery(id int64) error
+	GetWebhookDeliveryCounts() (map[string]int, error)
+	RecordExpiryReminder(v *Voucher, leadSecs int64, expiresAt time.Time) (bool, error)
+	ClaimDueEmails(limit int, lease time.Duration) ([]OutboxEmail, error)
+	MarkEmailSent(id int64) error
+	MarkEmailFailed(id int64, errMsg string, retryAt *time.Time) error
+	UnsubscribeBatchEmail(token string) error
+
+	// Ledger and reconciliation
+	PostLedger(kind, ref string, entries ...LedgerEntry) error
+	LedgerBalance(account string) (int64, error)
+	GetLedgerSummary() ([]LedgerAccountBalance, error)
+	GetLedgerKindTotals() ([]LedgerKindTotal, error)
+	CheckLedger() ([]LedgerMismatch, error)
+	StartOutgoingPayment(paymentHash, ref string, amountMsats int64) error
+	SettleOutgoingPayment(paymentHash string, feeMsats int64, payErr error) error
+	FindIncomingPayment(paymentHash string) (*RecordedPayment, error)
+	GetOutgoingPayment(paymentHash string) (*RecordedPayment, error)
+	SettledPaymentsSince(since time.Time) ([]RecordedPayment, error)
+	SaveReconcileRun(run *ReconcileRun, found []Discrepancy) error
+	GetLastReconcileRun() (*ReconcileRun, error)
+	GetOpenDiscrepancies() ([]Discrepancy, error)
+	DismissDiscrepancy(id int64) error
+
+	// Promo codes
+	InsertPromoCode(p *PromoCode) error
+	GetPromoCode(code string) (*PromoCode, error)
+	GetPromoCodes() ([]*PromoCode, error)
+	DisablePromoCode(code string) error
+	GetPromoRedemptions(code string) ([]PromoRedemption, error)
+
+	// Operator accounts
+	InsertCreditAccount(a *CreditAccount, apiKeyHash string) error
+	SetAccountAPIKey(id, apiKeyHash string) error
+	GetCreditAccount(id string) (*CreditAccount, error)
+	GetCreditAccountByAPIKey(apiKeyHash string) (*CreditAccount, error)
+	GetCreditAccountBySession(tokenHash string) (*CreditAccount, error)
+	GetCreditAccounts() ([]*CreditAccount, error)
+	GetAccountStatement(accountID string, limit int) ([]AccountEntry, error)
+	InsertAccountTopup(paymentHash, accountID string, msats int64) error
+	GetAccountTopupStatus(paymentHash, accountID string) (string, error)
+	SettleAccountTopup(paymentHash string, paid bool) error
+	PayCreationFromAccount(accountID, paymentHash string) error
+	RefundCreationToAccount(paymentHash string) error
+	PrefundVouchers(accountID string, payIDs []string, charity string, q FundingQuote) error
+	InsertAccountLogin(k1, accountID, action string) error
+	GetAccountLogin(k1 string) (*AccountLogin, error)
+	VerifyAccountLogin(k1, linkingKey string) error
+	ClaimAccountSession(k1, tokenHash string, expiresAt time.Time) (string, error)
+	DeleteExpiredAccountLogins(ttl time.Duration) (int64, error)
+}
+
+var _ Store = (*DB)(nil)
+
+// openStore opens the configured store: PostgreSQL if DATABASE_URL is set,
+// otherwise SQLite at DB_PATH.
+func openStore() (Store, error) {
+	var db *DB
+	var err error
+	if cfg.DatabaseURL != "" {
+		db, err = openPostgres(cfg.DatabaseURL)
+	} else {
+		db, err = openSQLite(cfg.DBPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// ── SQL Dialects ─────────────────────────────────────────────────────────────
+
+type dialect struct {
+	name string
+	// numbered placeholders ($1, $2, …) replace ?.
+	numbered bool
+	// lockRows follows a SELECT whose rows the transaction goes on to update.
+	lockRows string
+	// deferForeignKeys lets a transaction break foreign keys until it commits.
+	deferForeignKeys string
+	// skipLocked follows a SELECT that claims rows, passing over those
+	// another transaction has locked.
+	skipLocked string
+	// lockMigrations keeps other instances from migrating until the
+	// transaction ends.
+	lockMigrations string
+	// countColumn counts the columns of a table (first argument) with a
+	// name (second argument).
+	countColumn string
+	// types turns the SQLite column types of a schema statement into the
+	// dialect's.
+	types *strings.Replacer
+}
+
+var (
+	sqliteDialect = &dialect{
+		name:             "sqlite",
+		deferForeignKeys: `PRAGMA defer_foreign_keys = ON`,
+		countColumn:      `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`,
+		types:            strings.NewReplacer(),
+	}
+	postgresDialect = &dialect{
+		name:             "postgres",
+		numbered:         true,
+		lockRows:         " FOR UPDATE",
+		deferForeignKeys: `SET CONSTRAINTS ALL DEFERRED`,
+		skipLocked:       " FOR UPDATE SKIP LOCKED",
+		lockMigrations:   `SELECT pg_advisory_xact_lock(7311)`,
+		countColumn: `SELECT COUNT(*) FROM information_schema.columns
+		 WHERE table_schema=current_schema() AND table_name=? AND column_name=?`,
+		// BIGINT as msat amounts overflow int4. Earlier pairs win.
+		types: strings.NewReplacer(
+			"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+			"INTEGER", "BIGINT",
+			"DATETIME", "TIMESTAMPTZ",
+			"REAL", "DOUBLE PRECISION",
+		),
+	}
+)
+
+// rebind rewrites the ? placeholders in query for the dialect, leaving those
+// in string literals alone.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n, quoted := 0, false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// args adapts query arguments to the dialect. Flags are INTEGER columns in
+// both schemas; Postgres won't take a bool for one.
+func (d *dialect) args(args []any) []any {
+	if !d.numbered {
+		return args
+	}
+	var out []any
+	for i, a := range args {
+		if v, ok := a.(bool); ok {
+			if out == nil {
+				out = slices.Clone(args)
+			}
+			out[i] = 0
+			if v {
+				out[i] = 1
+			}
+		}
+	}
+	if out == nil {
+		return args
+	}
+	return out
+}
+
+// epoch returns the SQL for expr, a timestamp, in Unix seconds.
+func (d *dialect) epoch(expr string) string {
+	if d == postgresDialect {
+		return "CAST(EXTRACT(EPOCH FROM " + expr + ") AS BIGINT)"
+	}
+	return "CAST(strftime('%s', " + expr + ") AS INTEGER)"
+}
+
+// greatest returns the SQL for the largest of exprs.
+func (d *dialect) greatest(exprs ...string) string {
+	fn := "MAX"
+	if d == postgresDialect {
+		fn = "GREATEST"
+	}
+	return fn + "(" + strings.Join(exprs, ", ") + ")"
+}
+
+// ddl adapts a schema statement written with SQLite column types.
+func (d *dialect) ddl(stmt string) string {
+	return d.types.Replace(stmt)
+}
+
+// appendOnly returns the statements that make table refuse updates and
+// deletes.
+func (d *dialect) appendOnly(table string) []string {
+	if d == postgresDialect {
+		return []string{
+			`CREATE OR REPLACE FUNCTION ` + table + `_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+			 BEGIN RAISE EXCEPTION '` + table + ` is append-only'; END $$`,
+			`CREATE OR REPLACE TRIGGER ` + table + `_no_change BEFORE UPDATE OR DELETE ON ` + table + `
+			 FOR EACH ROW EXECUTE FUNCTION ` + table + `_append_only()`,
+		}
+	}
+	return []string{
+		`CREATE TRIGGER IF NOT EXISTS ` + table + `_no_update BEFORE UPDATE ON ` + table + `
+		 BEGIN SELECT RAISE(ABORT, '` + table + ` is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS ` + table + `_no_delete BEFORE DELETE ON ` + table + `
+		 BEGIN SELECT RAISE(ABORT, '` + table + ` is append-only'); END`,
+	}
+}
+
+// ── Queries in the Store's Dialect ───────────────────────────────────────────
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), db.dialect.args(args)...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), db.dialect.args(args)...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), db.dialect.args(args)...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx, db.dialect}, nil
+}
+
+// Tx is a transaction on the store, speaking its dialect.
+type Tx struct {
+	*sql.Tx
+	dialect *dialect
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), tx.dialect.args(args)...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), tx.dialect.args(args)...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), tx.dialect.args(args)...)
+}
+
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.rebind(query))
+}
+
+// lockRow locks the row of table whose key column is value until tx ends,
+// for a transaction that checks the row's state before acting on it.
+func lockRow(tx *Tx, table, key string, value any) error {
+	if tx.dialect.lockRows == "" {
+		return nil
+	}
+	_, err := tx.Exec(`SELECT 1 FROM `+table+` WHERE `+key+`=?`+tx.dialect.lockRows, value)
+	return err
+}
+
+// addColumn adds column, with type and constraints def, to table unless a
+// database created after the column was already has it.
+func addColumn(tx *Tx, table, column, def string) error {
+	var n int
+	if err := tx.QueryRow(tx.dialect.countColumn, table, column).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	_, err := tx.Exec(tx.dialect.ddl(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + def))
+	return err
+}
+
+// ── Job Locks ────────────────────────────────────────────────────────────────
+
+// TryJobLock takes the lock of background job name unless another instance
+// holds it, and reports whether it did; release gives it back. A lock dies
+// with the connection holding it, so a crashed instance doesn't keep it.
+// SQLite serves a single instance, which always gets the lock.
+func (db *DB) TryJobLock(name string) (release func(), ok bool, err error) {
+	if db.dialect != postgresDialect {
+		return func() {}, true, nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte("tipme job " + name))
+	key := int64(h.Sum64())
+
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			// Closing a connection that may still hold the lock would return it
+			// to the pool, so drop it instead.
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, true, nil
+}
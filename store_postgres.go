@@ -0,0 +1,32 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+// ── PostgreSQL ───────────────────────────────────────────────────────────────
+//
+// Several app instances may share one PostgreSQL database. Its schema comes
+// from the same migrations as SQLite's, with Postgres column types
+// (dialect.ddl).
+
+// postgresMaxConns bounds each instance's connection pool.
+const postgresMaxConns = 10
+
+// openPostgres opens the PostgreSQL database at dsn, a URL or key=value
+// connection string, without touching its schema.
+func openPostgres(dsn string) (*DB, error) {
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(postgresMaxConns)
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return &DB{sqlDB, postgresDialect}, nil
+}
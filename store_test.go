@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The store contract: every test here runs against SQLite and, when
+// TIPME_TEST_POSTGRES_URL points at a local instance, PostgreSQL, each in
+// a schema of its own that is dropped afterwards.
+
+func forEachStore(t *testing.T, test func(t *testing.T, s *DB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := openSQLite(filepath.Join(t.TempDir(), "tipme.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if _, err := db.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TIPME_TEST_POSTGRES_URL")
+		if dsn == "" {
+			t.Skip("TIPME_TEST_POSTGRES_URL not set")
+		}
+		test(t, openTestPostgres(t, dsn))
+	})
+}
+
+func openTestPostgres(t *testing.T, dsn string) *DB {
+	t.Helper()
+	admin, err := openPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "tipme_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("drop schema %s: %v", schema, err)
+		}
+	})
+
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestBatch stores a paid batch of count gift vouchers and returns
+// them with its creation payment hash.
+func createTestBatch(t *testing.T, s *DB, count int) (string, []*Voucher) {
+	t.Helper()
+	paymentHash := strings.ReplaceAll(uuid.New().String(), "-", "")
+	b := &Batch{
+		ID:               uuid.New().String(),
+		LightningAddress: "owner@example.com",
+		Count:            count,
+		ExpirySeconds:    86400,
+		Kind:             KindGift,
+		ExpiryPolicy:     "refund",
+	}
+	if err := s.InsertCreationRequest(paymentHash, b, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	vouchers := make([]*Voucher, count)
+	for i := range vouchers {
+		vouchers[i] = &Voucher{
+			PayID:            uuid.New().String(),
+			WithdrawID:       uuid.New().String(),
+			BatchID:          b.ID,
+			LightningAddress: b.LightningAddress,
+			ExpirySeconds:    b.ExpirySeconds,
+			Kind:             b.Kind,
+		}
+	}
+	if err := s.InsertVouchers(paymentHash, vouchers); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateCreationRequestStatus(paymentHash, "complete"); err != nil {
+		t.Fatal(err)
+	}
+	return paymentHash, vouchers
+}
+
+// fundTestVoucher pays msats into a voucher through a funding invoice.
+func fundTestVoucher(t *testing.T, s *DB, payID string, msats int64) {
+	t.Helper()
+	paymentHash := strings.ReplaceAll(uuid.New().String(), "-", "")
+	if err := s.InsertPayInvoice(uuid.New().String(), payID, paymentHash, msats, msats, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := CreditVoucherTx(tx, payID, msats, paymentHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTestLedger(t *testing.T, s *DB) {
+	t.Helper()
+	mismatches, err := s.CheckLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Errorf("ledger mismatch: %+v", m)
+	}
+}
+
+func TestStoreVouchers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		paymentHash, vouchers := createTestBatch(t, s, 3)
+		fundTestVoucher(t, s, vouchers[1].PayID, 21_000)
+
+		stored, err := s.GetVouchersByCreationHash(paymentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != len(vouchers) {
+			t.Fatalf("got %d vouchers, want %d", len(stored), len(vouchers))
+		}
+		for i, v := range stored {
+			if v.PayID != vouchers[i].PayID {
+				t.Errorf("voucher %d is %s, want %s (insertion order)", i, v.PayID, vouchers[i].PayID)
+			}
+		}
+
+		v, err := s.GetVoucherByWithdrawID(vouchers[1].WithdrawID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.TotalPaidMsats != 21_000 || v.LastFundedAt == nil {
+			t.Errorf("funded voucher has %d msats, last funded %v", v.TotalPaidMsats, v.LastFundedAt)
+		}
+
+		stats, err := s.GetAuditStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalVoucherCount != 3 || stats.FundedVoucherCount != 1 || stats.TotalLockedMsats != 21_000 {
+			t.Errorf("audit stats %+v", stats)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+// useTestSessionTTL sets the withdraw session lifetime for a test.
+func useTestSessionTTL(t *testing.T, ttl time.Duration) {
+	saved := cfg.WithdrawSessionSecs
+	t.Cleanup(func() { cfg.WithdrawSessionSecs = saved })
+	cfg.WithdrawSessionSecs = int64(ttl / time.Second)
+}
+
+func TestStoreWithdrawSessionIsSingleUse(t *testing.T) {
+	useTestSessionTTL(t, time.Hour)
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		if err := s.InsertWithdrawSession("k1", v.WithdrawID); err != nil {
+			t.Fatal(err)
+		}
+		payID, err := s.ValidateAndUseWithdrawSession("k1", v.WithdrawID, "")
+		if err != nil || payID != v.PayID {
+			t.Fatalf("first use = %q, %v; want %q", payID, err, v.PayID)
+		}
+		if _, err := s.ValidateAndUseWithdrawSession("k1", v.WithdrawID, ""); err == nil {
+			t.Error("withdraw session used twice")
+		}
+	})
+}
+
+// TestStoreVoucherPIN checks that PINs are kept hashed, shown to the owner
+// once, and that wrong guesses lock the voucher for longer each time, up to
+// the longest lockout, but never for good.
+func TestStoreVoucherPIN(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		paymentHash := strings.ReplaceAll(uuid.New().String(), "-", "")
+		b := &Batch{ID: uuid.New().String(), LightningAddress: "owner@example.com", Count: 1, ExpiryPolicy: "refund"}
+		if err := s.InsertCreationRequest(paymentHash, b, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		withdrawID := uuid.New().String()
+		if err := s.InsertVouchers(paymentHash, []*Voucher{{
+			PayID: uuid.New().String(), WithdrawID: withdrawID, BatchID: b.ID,
+			LightningAddress: b.LightningAddress, Kind: KindGift, Pin: "1234",
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.GetVoucherByWithdrawID(withdrawID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.HasPIN() || strings.Contains(v.PinHash, "1234") || !pinMatches(v.PinHash, "1234") {
+			t.Errorf("PIN stored as %q", v.PinHash)
+		}
+		if v.Pin != "1234" {
+			t.Errorf("PIN to show the owner is %q, want 1234", v.Pin)
+		}
+		if err := s.ForgetRevealedPINs(paymentHash); err != nil {
+			t.Fatal(err)
+		}
+		if v, err = s.GetVoucherByWithdrawID(withdrawID); err != nil || v.Pin != "" {
+			t.Errorf("PIN still shown after it was revealed: %q, %v", v.Pin, err)
+		}
+
+		const lockout = time.Hour
+		check := func(pin string) (bool, error) {
+			ok, _, err := s.CheckVoucherPIN(withdrawID, pin, uuid.New().String(), 2, lockout, 3*lockout)
+			return ok, err
+		}
+		if ok, err := check("1234"); !ok || err != nil {
+			t.Fatalf("right PIN = %v, %v", ok, err)
+		}
+		for i, want := range []time.Duration{lockout, 2 * lockout, 3 * lockout, 3 * lockout, 3 * lockout} {
+			if ok, err := check("0000"); ok || err != nil {
+				t.Fatalf("lockout %d: first wrong PIN = %v, %v", i+1, ok, err)
+			}
+			_, err := check("0000")
+			if !errors.Is(err, ErrPinLocked) {
+				t.Fatalf("lockout %d: %v, want ErrPinLocked", i+1, err)
+			}
+			v, err := s.GetVoucherByWithdrawID(withdrawID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Until(*v.PinLockedUntil); d < want-time.Minute || d > want {
+				t.Errorf("lockout %d lasts %v, want %v", i+1, d, want)
+			}
+			if _, err := check("1234"); !errors.Is(err, ErrPinLocked) {
+				t.Errorf("right PIN while locked out: %v, want ErrPinLocked", err)
+			}
+			if _, err := s.Exec(`UPDATE vouchers SET pin_locked_until=NULL WHERE withdraw_id=?`, withdrawID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ok, err := check("1234"); !ok || err != nil {
+			t.Errorf("right PIN after the lockouts = %v, %v", ok, err)
+		}
+	})
+}
+
+// TestStoreWithdrawSessionExpiry checks that old sessions can't be spent and
+// are swept away, while live ones stay.
+func TestStoreWithdrawSessionExpiry(t *testing.T) {
+	useTestSessionTTL(t, time.Hour)
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		for _, k1 := range []string{"old", "live"} {
+			if err := s.InsertWithdrawSession(k1, v.WithdrawID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.Exec(
+			`UPDATE withdraw_sessions SET created_at=? WHERE k1='old'`, time.Now().UTC().Add(-2*time.Hour),
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ValidateAndUseWithdrawSession("old", v.WithdrawID, ""); err == nil {
+			t.Error("expired withdraw session was accepted")
+		}
+		n, err := s.DeleteExpiredWithdrawSessions(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("swept %d sessions, want 1", n)
+		}
+		if _, err := s.ValidateAndUseWithdrawSession("live", v.WithdrawID, ""); err != nil {
+			t.Errorf("live session after sweep: %v", err)
+		}
+	})
+}
+
+// TestStoreAccountLoginExpiry checks that the sweep deletes old login
+// challenges and keeps open ones.
+func TestStoreAccountLoginExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		for _, k1 := range []string{"old", "open"} {
+			if err := s.InsertAccountLogin(k1, "", AccountLoginAction); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.Exec(
+			`UPDATE account_logins SET created_at=? WHERE k1='old'`, time.Now().UTC().Add(-2*accountLoginTTL),
+		); err != nil {
+			t.Fatal(err)
+		}
+		n, err := s.DeleteExpiredAccountLogins(accountLoginTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("swept %d login challenges, want 1", n)
+		}
+		if _, err := s.GetAccountLogin("old"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expired challenge after sweep: %v", err)
+		}
+		if _, err := s.GetAccountLogin("open"); err != nil {
+			t.Errorf("open challenge after sweep: %v", err)
+		}
+	})
+}
+
+// TestStoreConcurrentDebits races more withdrawals than a voucher can pay
+// for; row locking must let exactly as many through as it holds.
+func TestStoreConcurrentDebits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		fundTestVoucher(t, s, v.PayID, 10_000)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		debited := 0
+		for range 25 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.DebitVoucher(v.PayID, 1_000)
+				if errors.Is(err, ErrInsufficientBalance) {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				debited++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if debited != 10 {
+			t.Errorf("%d debits went through, want 10", debited)
+		}
+		after, err := s.GetVoucherByPayID(v.PayID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.TotalPaidMsats != 0 {
+			t.Errorf("balance %d after debits, want 0", after.TotalPaidMsats)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+// TestStoreConcurrentDeactivation races several instances' jobs to deactivate
+// the same voucher; only the first may move its balance.
+func TestStoreConcurrentDeactivation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		fundTestVoucher(t, s, v.PayID, 10_000)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		deactivated := 0
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tx, err := s.Begin()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer tx.Rollback()
+				err = LockVoucherTx(tx, v.PayID, 10_000)
+				if err == nil {
+					err = DeactivateVoucherTx(tx, v.PayID, "refunded", 10_000)
+				}
+				if err == nil {
+					err = tx.Commit()
+				}
+				if errors.Is(err, ErrVoucherChanged) {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				deactivated++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if deactivated != 1 {
+			t.Errorf("%d deactivations went through, want 1", deactivated)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+// TestStoreOutboxClaims runs several workers over the webhook and email
+// outboxes at once; each row must be handed to exactly one of them.
+func TestStoreOutboxClaims(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		batchID := vouchers[0].BatchID
+		if err := s.InsertWebhookSubscription(&WebhookSubscription{
+			ID: uuid.New().String(), URL: "https://example.com/hook", Secret: "secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := s.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		for i := range 20 {
+			if err := EnqueueEventTx(tx, EventVoucherFunded, "", "", map[string]any{"i": i}); err != nil {
+				t.Fatal(err)
+			}
+			if err := insertEmailTx(tx, &OutboxEmail{BatchID: batchID, To: "owner@example.com", Subject: "s", Body: "b"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		webhooks, emails := map[int64]int{}, map[int64]int{}
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				deliveries, err := s.ClaimDueWebhookDeliveries(5, time.Hour)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				queued, err := s.ClaimDueEmails(5, time.Hour)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for _, d := range deliveries {
+					webhooks[d.ID]++
+				}
+				for _, e := range queued {
+					emails[e.ID]++
+				}
+			}()
+		}
+		wg.Wait()
+		for name, claimed := range map[string]map[int64]int{"webhook deliveries": webhooks, "emails": emails} {
+			if len(claimed) != 20 {
+				t.Errorf("%d %s claimed, want 20", len(claimed), name)
+			}
+			for id, n := range claimed {
+				if n != 1 {
+					t.Errorf("%s %d claimed %d times", name, id, n)
+				}
+			}
+		}
+
+		if d, err := s.ClaimDueWebhookDeliveries(100, time.Hour); err != nil || len(d) != 0 {
+			t.Errorf("claimed %d leased deliveries (err %v), want none", len(d), err)
+		}
+		if e, err := s.ClaimDueEmails(100, time.Hour); err != nil || len(e) != 0 {
+			t.Errorf("claimed %d leased emails (err %v), want none", len(e), err)
+		}
+	})
+}
+
+// TestStoreUnknownWithdrawal checks that a withdrawal whose payment timed
+// out waits for reconciliation, which settles it once.
+func TestStoreUnknownWithdrawal(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		fundTestVoucher(t, s, v.PayID, 10_000)
+
+		for _, paid := range []bool{true, false} {
+			id, err := s.DebitVoucher(v.PayID, 4_000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.MarkWithdrawalUnknown(id); err != nil {
+				t.Fatal(err)
+			}
+			unsent, err := s.GetUnsentWithdrawals(time.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(unsent, id) {
+				t.Errorf("withdrawal %d with no payment is not unsent: %v", id, unsent)
+			}
+			if settled, err := s.SettleUnknownWithdrawal(id, paid); !settled || err != nil {
+				t.Fatalf("SettleUnknownWithdrawal(%d, %v) = %v, %v", id, paid, settled, err)
+			}
+			if settled, err := s.SettleUnknownWithdrawal(id, paid); settled || err != nil {
+				t.Errorf("withdrawal %d settled twice (err %v)", id, err)
+			}
+		}
+		after, err := s.GetVoucherByPayID(v.PayID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.TotalPaidMsats != 6_000 {
+			t.Errorf("balance %d, want 6000 (one paid, one returned)", after.TotalPaidMsats)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+func TestStoreBoltcardDailyLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		fundTestVoucher(t, s, v.PayID, 10_000)
+		card := &Boltcard{CardID: uuid.New().String(), PayID: v.PayID, DailyLimitMsats: 3_000, Enabled: true}
+		if err := s.InsertBoltcard(card); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := s.DebitVoucherByCard(v.PayID, card.CardID, 1_000, card.DailyLimitMsats); err != nil {
+				t.Fatalf("debit %d: %v", i, err)
+			}
+		}
+		if _, err := s.DebitVoucherByCard(v.PayID, card.CardID, 1_000, card.DailyLimitMsats); !errors.Is(err, ErrDailyLimit) {
+			t.Errorf("debit past the limit = %v, want ErrDailyLimit", err)
+		}
+		if spent, err := s.BoltcardSpent(card.CardID); err != nil || spent != 3_000 {
+			t.Errorf("BoltcardSpent = %d, %v; want 3000", spent, err)
+		}
+	})
+}
+
+// TestStoreRekeyVoucher moves a voucher whose withdraw_id open sessions
+// still reference, which needs foreign keys deferred to commit.
+func TestStoreRekeyVoucher(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		if err := s.InsertWithdrawSession("k1", v.WithdrawID); err != nil {
+			t.Fatal(err)
+		}
+		newID := uuid.New().String()
+		if err := s.RekeyVoucher(v.PayID, v.WithdrawID, newID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetVoucherByWithdrawID(newID); err != nil {
+			t.Errorf("voucher not found under its new withdraw_id: %v", err)
+		}
+		if _, err := s.ValidateAndUseWithdrawSession("k1", newID, ""); err == nil {
+			t.Error("session issued before the rekey is still usable")
+		}
+	})
+}
+
+func TestStoreExpiredVouchersForRefund(t *testing.T) {
+	saved := cfg.VoucherAbsoluteExpirySecs
+	t.Cleanup(func() { cfg.VoucherAbsoluteExpirySecs = saved })
+	cfg.VoucherAbsoluteExpirySecs = 365 * 86400
+
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 2)
+		for _, v := range vouchers {
+			fundTestVoucher(t, s, v.PayID, 5_000)
+		}
+		tx, err := s.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(
+			`UPDATE vouchers SET last_funded_at=? WHERE pay_id=?`, time.Now().UTC().Add(-48*time.Hour), vouchers[0].PayID,
+		); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		expired, err := s.GetExpiredVouchersForRefund()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expired) != 1 || expired[0].PayID != vouchers[0].PayID {
+			var ids []string
+			for _, v := range expired {
+				ids = append(ids, v.PayID)
+			}
+			t.Errorf("expired vouchers %v, want [%s]", ids, vouchers[0].PayID)
+		}
+	})
+}
+
+// TestStoreTimeLockedRefund checks that the refund job leaves a time-locked
+// voucher alone until a full relative expiry after its release date, however
+// long ago it was funded.
+func TestStoreTimeLockedRefund(t *testing.T) {
+	saved := cfg.VoucherAbsoluteExpirySecs
+	t.Cleanup(func() { cfg.VoucherAbsoluteExpirySecs = saved })
+	cfg.VoucherAbsoluteExpirySecs = 365 * 86400
+
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1) // expires a day after its last funding
+		payID := vouchers[0].PayID
+		fundTestVoucher(t, s, payID, 5_000)
+		now := time.Now().UTC()
+		for _, tc := range []struct {
+			name           string
+			claimableAfter any
+			want           bool
+		}{
+			{"not released yet", now.Add(24 * time.Hour), false},
+			{"released 12 hours ago", now.Add(-12 * time.Hour), false},
+			{"released 25 hours ago", now.Add(-25 * time.Hour), true},
+			{"no time lock", nil, true},
+		} {
+			if _, err := s.Exec(
+				`UPDATE vouchers SET last_funded_at=?, claimable_after=? WHERE pay_id=?`, now.Add(-48*time.Hour), tc.claimableAfter, payID,
+			); err != nil {
+				t.Fatal(err)
+			}
+			expired, err := s.GetExpiredVouchersForRefund()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(expired) == 1; got != tc.want {
+				t.Errorf("%s: refundable = %v, want %v", tc.name, got, tc.want)
+			}
+			v, err := s.GetVoucherByPayID(payID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := !v.ExpiresAt().After(time.Now()); got != tc.want {
+				t.Errorf("%s: ExpiresAt %s, want expired=%v", tc.name, v.ExpiresAt(), tc.want)
+			}
+		}
+	})
+}
+
+func TestStorePromoCodeUses(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		p := &PromoCode{Code: "LAUNCH", DiscountPercent: 100, MaxUses: 1, Active: true}
+		if err := s.InsertPromoCode(p); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []error{nil, ErrPromoUsedUp} {
+			b := &Batch{
+				ID: uuid.New().String(), LightningAddress: "owner@example.com",
+				Count: 1, ExpirySeconds: 86400, ExpiryPolicy: "refund",
+			}
+			promo := &PromoRedemption{Code: p.Code, VoucherCount: 1, DiscountMsats: 10_000}
+			err := s.InsertCreationRequest(fmt.Sprintf("hash%d", i), b, nil, promo)
+			if !errors.Is(err, want) {
+				t.Errorf("redemption %d = %v, want %v", i+1, err, want)
+			}
+		}
+		got, err := s.GetPromoCode(p.Code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Uses != 1 {
+			t.Errorf("promo code used %d times, want 1", got.Uses)
+		}
+	})
+}
+
+func TestStoreLedgerPostings(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		v := vouchers[0]
+		fundTestVoucher(t, s, v.PayID, 10_000)
+		for _, paid := range []bool{true, false} {
+			id, err := s.DebitVoucher(v.PayID, 4_000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SettleWithdrawal(id, paid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rows, err := s.Query(`SELECT txn_id, kind, SUM(amount_msats) FROM ledger_entries GROUP BY txn_id, kind`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		kinds := map[string]int{}
+		for rows.Next() {
+			var txnID, kind string
+			var sum int64
+			if err := rows.Scan(&txnID, &kind, &sum); err != nil {
+				t.Fatal(err)
+			}
+			if sum != 0 {
+				t.Errorf("%s posting %s is off by %d msats", kind, txnID, sum)
+			}
+			kinds[kind]++
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{LedgerFunding: 1, LedgerWithdrawal: 2, LedgerWithdrawalReversal: 1}; !maps.Equal(kinds, want) {
+			t.Errorf("postings by kind = %v, want %v", kinds, want)
+		}
+
+		if msats, err := s.LedgerBalance(voucherAccount(v.PayID)); err != nil || msats != -6_000 {
+			t.Errorf("voucher account balance = %d, %v; want -6000", msats, err)
+		}
+		summary, err := s.GetLedgerSummary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, a := range summary {
+			total += a.Msats
+		}
+		if total != 0 {
+			t.Errorf("ledger accounts sum to %d msats, want 0: %+v", total, summary)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+func TestStoreLedgerRejectsUnbalancedPostings(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		err := s.PostLedger(LedgerRoutingFee, "test",
+			LedgerEntry{AccountRouting, 1_000},
+			LedgerEntry{AccountLightning, -999},
+		)
+		if err == nil || !strings.Contains(err.Error(), "off by 1 msats") {
+			t.Errorf("PostLedger = %v, want an unbalanced posting error", err)
+		}
+		if err := s.PostLedger(LedgerRoutingFee, "test", LedgerEntry{AccountRouting, 1_000}); err == nil {
+			t.Error("single-entry posting accepted")
+		}
+		var n int
+		if err := s.QueryRow(`SELECT COUNT(*) FROM ledger_entries`).Scan(&n); err != nil || n != 0 {
+			t.Errorf("%d ledger entries written (err %v), want none", n, err)
+		}
+	})
+}
+
+func TestStoreCheckLedgerCatchesCorruption(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 2)
+		fundTestVoucher(t, s, vouchers[0].PayID, 10_000)
+		checkTestLedger(t, s)
+
+		// A balance changed without a posting.
+		if _, err := s.Exec(`UPDATE vouchers SET total_paid_msats=12000 WHERE pay_id=?`, vouchers[0].PayID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Exec(`UPDATE vouchers SET total_paid_msats=500 WHERE pay_id=?`, vouchers[1].PayID); err != nil {
+			t.Fatal(err)
+		}
+		// An entry written outside PostLedgerTx, so its posting doesn't balance.
+		if _, err := s.Exec(
+			`INSERT INTO ledger_entries (txn_id, kind, account, amount_msats, ref) VALUES ('stray', ?, ?, 7, '')`,
+			LedgerRoutingFee, AccountRouting,
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		mismatches, err := s.CheckLedger()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []LedgerMismatch{
+			{voucherAccount(vouchers[0].PayID), 10_000, 12_000},
+			{voucherAccount(vouchers[1].PayID), 0, 500},
+			{"txn:stray", 7, 0},
+		}
+		sortMismatches := func(m []LedgerMismatch) {
+			slices.SortFunc(m, func(a, b LedgerMismatch) int { return strings.Compare(a.Account, b.Account) })
+		}
+		sortMismatches(mismatches)
+		sortMismatches(want)
+		if !slices.Equal(mismatches, want) {
+			t.Errorf("CheckLedger = %+v, want %+v", mismatches, want)
+		}
+
+		if _, err := s.Exec(`UPDATE ledger_entries SET amount_msats=0 WHERE txn_id='stray'`); err == nil {
+			t.Error("a ledger entry was updated in place")
+		}
+	})
+}
+
+func TestStoreBatchFeeOverride(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		_, vouchers := createTestBatch(t, s, 1)
+		_, others := createTestBatch(t, s, 1)
+		id, otherID := vouchers[0].BatchID, others[0].BatchID
+		free := &FundingFees{Brackets: []FundingBracket{{Rate: 0}}}
+		if err := s.SetBatchFeeOverride(id, free); err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.GetBatch(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.FeeOverride == nil || len(b.FeeOverride.Brackets) != 1 || b.FeeOverride.Brackets[0].Rate != 0 {
+			t.Fatalf("FeeOverride = %+v, want the free override", b.FeeOverride)
+		}
+		schedule := &FeeSchedule{Funding: FundingFees{Brackets: []FundingBracket{{BaseMsats: 2_000, Rate: 0.01}}}}
+		if q := schedule.FundingFee(b, 100_000); q.FeeMsats != 0 || q.CreditedMsats != 100_000 {
+			t.Errorf("FundingFee with the override = %+v, want no fee", q)
+		}
+
+		// The file's overrides only fill in batches without one.
+		imported, err := s.ImportBatchFeeOverrides(map[string]FundingFees{
+			id:      {Brackets: []FundingBracket{{Rate: 0.5}}},
+			otherID: {Brackets: []FundingBracket{{BaseMsats: 1_000}}},
+			"gone":  {Brackets: []FundingBracket{{Rate: 0}}},
+		})
+		if err != nil || imported != 1 {
+			t.Errorf("ImportBatchFeeOverrides = %d, %v; want 1", imported, err)
+		}
+		listed, err := s.GetBatchFeeOverrides()
+		if err != nil {
+			t.Fatal(err)
+		}
+		overrides := map[string]FundingFees{}
+		for _, b := range listed {
+			overrides[b.ID] = *b.FeeOverride
+		}
+		if len(overrides) != 2 || overrides[id].Brackets[0].Rate != 0 || overrides[otherID].Brackets[0].BaseMsats != 1_000 {
+			t.Errorf("GetBatchFeeOverrides = %+v", overrides)
+		}
+
+		if err := s.SetBatchFeeOverride(id, nil); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.GetBatch(id); err != nil || b.FeeOverride != nil {
+			t.Errorf("override after removal = %+v, %v; want none", b.FeeOverride, err)
+		}
+		if err := s.SetBatchFeeOverride("gone", free); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("SetBatchFeeOverride on a missing batch = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+// TestStorePrefundVouchers checks that prefunding a batch from an account
+// funds every voucher or none.
+func TestStorePrefundVouchers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		account := &CreditAccount{ID: uuid.New().String(), Name: "operator"}
+		if err := s.InsertCreditAccount(account, "key-hash"); err != nil {
+			t.Fatal(err)
+		}
+		topup := strings.ReplaceAll(uuid.New().String(), "-", "")
+		if err := s.InsertAccountTopup(topup, account.ID, 25_000); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SettleAccountTopup(topup, true); err != nil {
+			t.Fatal(err)
+		}
+		_, vouchers := createTestBatch(t, s, 3)
+		payIDs := []string{vouchers[0].PayID, vouchers[1].PayID, vouchers[2].PayID}
+		balances := func() []int64 {
+			t.Helper()
+			var result []int64
+			for _, payID := range payIDs {
+				v, err := s.GetVoucherByPayID(payID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result = append(result, v.TotalPaidMsats)
+			}
+			a, err := s.GetCreditAccount(account.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(result, a.BalanceMsats)
+		}
+
+		// The balance covers two vouchers but not the third.
+		q := FundingQuote{AmountMsats: 10_000, FeeMsats: 1_000, CreditedMsats: 9_000}
+		if err := s.PrefundVouchers(account.ID, payIDs, "", q); !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("PrefundVouchers past the balance = %v, want ErrInsufficientBalance", err)
+		}
+		if got, want := balances(), []int64{0, 0, 0, 25_000}; !slices.Equal(got, want) {
+			t.Errorf("balances after a failed prefund = %v, want %v", got, want)
+		}
+
+		q = FundingQuote{AmountMsats: 8_000, FeeMsats: 500, CreditedMsats: 7_500}
+		if err := s.PrefundVouchers(account.ID, payIDs, "", q); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := balances(), []int64{7_500, 7_500, 7_500, 1_000}; !slices.Equal(got, want) {
+			t.Errorf("balances after prefunding = %v, want %v", got, want)
+		}
+		checkTestLedger(t, s)
+	})
+}
+
+func TestStorePoolAllocation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *DB) {
+		paymentHash := strings.ReplaceAll(uuid.New().String(), "-", "")
+		b := &Batch{
+			ID:               uuid.New().String(),
+			LightningAddress: "owner@example.com",
+			Count:            1,
+			ExpirySeconds:    86400,
+			Kind:             KindPool,
+			ExpiryPolicy:     "refund",
+		}
+		members := []PoolMember{{Address: "a@example.com", Weight: 1}, {Address: "b@example.com", Weight: 2}, {Address: "c@example.com", Weight: 4}}
+		if err := s.InsertCreationRequest(paymentHash, b, members, nil); err != nil {
+			t.Fatal(err)
+		}
+		v := &Voucher{PayID: uuid.New().String(), WithdrawID: uuid.New().String(), BatchID: b.ID,
+			LightningAddress: b.LightningAddress, ExpirySeconds: b.ExpirySeconds, Kind: KindPool}
+		if err := s.InsertVouchers(paymentHash, []*Voucher{v}); err != nil {
+			t.Fatal(err)
+		}
+		owed := func() []int64 {
+			t.Helper()
+			members, err := s.GetPoolMembers(b.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var owed []int64
+			for _, m := range members {
+				owed = append(owed, m.OwedMsats)
+				if msats, err := s.LedgerBalance(poolMemberAccount(m.ID)); err != nil || msats != -m.OwedMsats {
+					t.Errorf("member %s ledger balance = %d, %v; want %d", m.Address, msats, err, -m.OwedMsats)
+				}
+			}
+			return owed
+		}
+
+		// 10000 msats split 1:2:4 leaves a msat over for the next distribution.
+		fundTestVoucher(t, s, v.PayID, 10_000)
+		if allocated, err := s.AllocatePool(v.PayID); err != nil || allocated != 9_999 {
+			t.Fatalf("AllocatePool = %d, %v; want 9999", allocated, err)
+		}
+		if got, want := owed(), []int64{1_428, 2_857, 5_714}; !slices.Equal(got, want) {
+			t.Errorf("owed %v msats, want %v", got, want)
+		}
+		fundTestVoucher(t, s, v.PayID, 6)
+		if allocated, err := s.AllocatePool(v.PayID); err != nil || allocated != 7 {
+			t.Fatalf("AllocatePool = %d, %v; want the remainder and the new 6 msats", allocated, err)
+		}
+		if allocated, err := s.AllocatePool(v.PayID); err != nil || allocated != 0 {
+			t.Fatalf("AllocatePool of an empty pool = %d, %v; want 0", allocated, err)
+		}
+		if got, want := owed(), []int64{1_429, 2_859, 5_718}; !slices.Equal(got, want) {
+			t.Errorf("owed %v msats, want %v", got, want)
+		}
+		if got, err := s.GetVoucherByPayID(v.PayID); err != nil || got.TotalPaidMsats != 0 {
+			t.Errorf("pool voucher holds %+v, %v; want it emptied", got, err)
+		}
+		var distributions [][3]int64
+		rows, err := s.Query(`SELECT balance_msats, allocated_msats, remainder_msats FROM pool_distributions WHERE pay_id=? ORDER BY id`, v.PayID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d [3]int64
+			if err := rows.Scan(&d[0], &d[1], &d[2]); err != nil {
+				t.Fatal(err)
+			}
+			distributions = append(distributions, d)
+		}
+		if want := [][3]int64{{10_000, 9_999, 1}, {7, 7, 0}}; !slices.Equal(distributions, want) {
+			t.Errorf("distributions %v, want %v", distributions, want)
+		}
+
+		// A failed payout goes back to the member; a paid one doesn't.
+		members, err = s.GetPoolMembers(b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := members[2]
+		if _, err := s.StartPoolPayout(m.ID, 6_000); !errors.Is(err, ErrInsufficientBalance) {
+			t.Errorf("payout of more than owed: err = %v, want ErrInsufficientBalance", err)
+		}
+		failed, err := s.StartPoolPayout(m.ID, 5_000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := owed(); got[2] != 718 {
+			t.Errorf("owed %d msats during a payout, want 718", got[2])
+		}
+		if err := s.SettlePoolPayout(failed, errors.New("no route")); err != nil {
+			t.Fatal(err)
+		}
+		if got := owed(); got[2] != 5_718 {
+			t.Errorf("owed %d msats after a failed payout, want 5718", got[2])
+		}
+		paid, err := s.StartPoolPayout(m.ID, 5_000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SettlePoolPayout(paid, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := owed(); got[2] != 718 {
+			t.Errorf("owed %d msats after a payout, want 718", got[2])
+		}
+		payouts, err := s.GetPoolPayouts(b.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payouts) != 2 || payouts[0].ID != paid || payouts[0].Status != "paid" ||
+			payouts[1].ID != failed || payouts[1].Status != "failed" || payouts[1].Error != "no route" {
+			t.Errorf("payouts %+v, want the paid one and the failed one with its error", payouts)
+		}
+		checkTestLedger(t, s)
+	})
+}
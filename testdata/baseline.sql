@@ -0,0 +1,49 @@
+PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE voucher_creation_requests (
+			payment_hash      TEXT PRIMARY KEY,
+			lightning_address TEXT NOT NULL,
+			count             INTEGER NOT NULL,
+			expiry_seconds    INTEGER NOT NULL,
+			fee_msats         INTEGER NOT NULL,
+			status            TEXT NOT NULL DEFAULT 'pending',
+			created_at        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+INSERT INTO voucher_creation_requests VALUES('57dbfcccaa6f2af9fc87857d6d08c39f614d620a9ed1d9c8a631ea6021d1ed3a','owner@example.com',3,86400,3000,'complete','2026-10-18 14:54:06');
+CREATE TABLE vouchers (
+			pay_id                TEXT PRIMARY KEY,
+			withdraw_id           TEXT NOT NULL UNIQUE,
+			creation_request_hash TEXT REFERENCES voucher_creation_requests(payment_hash),
+			lightning_address     TEXT NOT NULL,
+			total_paid_msats      INTEGER NOT NULL DEFAULT 0,
+			last_funded_at        DATETIME,
+			expiry_seconds        INTEGER NOT NULL,
+			active                INTEGER NOT NULL DEFAULT 1,
+			created_at            DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		, deactivation_reason TEXT, deactivated_msats INTEGER NOT NULL DEFAULT 0);
+INSERT INTO vouchers VALUES('c54944da-4656-40e2-af70-e8d6a78fce75','658338ab-d958-4de8-9e99-5f3f68e05409','57dbfcccaa6f2af9fc87857d6d08c39f614d620a9ed1d9c8a631ea6021d1ed3a','owner@example.com',21000,'2026-10-18 14:54:06',86400,1,'2026-10-18 14:54:06',NULL,0);
+INSERT INTO vouchers VALUES('73f1d3a7-b409-4be4-86c5-487c6aa54e5f','5719540e-9890-4270-a87d-b59b91113275','57dbfcccaa6f2af9fc87857d6d08c39f614d620a9ed1d9c8a631ea6021d1ed3a','owner@example.com',0,'2026-10-18 14:54:06',86400,0,'2026-10-18 14:54:06','claimed',5000);
+INSERT INTO vouchers VALUES('0b6f3d2e-9a51-4c8e-8d47-2f1e6a9b3c70','e2a4c6d8-1b3f-4e5a-9c7d-6f8e0a2b4c6d','57dbfcccaa6f2af9fc87857d6d08c39f614d620a9ed1d9c8a631ea6021d1ed3a','owner@example.com',0,NULL,86400,1,'2026-10-18 14:54:06',NULL,0);
+CREATE TABLE pay_invoices (
+			id             TEXT PRIMARY KEY,
+			pay_id         TEXT NOT NULL REFERENCES vouchers(pay_id),
+			payment_hash   TEXT NOT NULL UNIQUE,
+			amount_msats   INTEGER NOT NULL,
+			credited_msats INTEGER NOT NULL,
+			paid           INTEGER NOT NULL DEFAULT 0,
+			created_at     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			paid_at        DATETIME
+		);
+INSERT INTO pay_invoices VALUES('inv-aa','c54944da-4656-40e2-af70-e8d6a78fce75','aa11111111111111111111111111111111111111111111111111111111111111',21000,21000,1,'2026-10-18 14:54:06','2026-10-18 14:54:06');
+INSERT INTO pay_invoices VALUES('inv-bb','73f1d3a7-b409-4be4-86c5-487c6aa54e5f','bb11111111111111111111111111111111111111111111111111111111111111',5000,5000,1,'2026-10-18 14:54:06','2026-10-18 14:54:06');
+CREATE TABLE withdraw_sessions (
+			k1          TEXT PRIMARY KEY,
+			withdraw_id TEXT NOT NULL REFERENCES vouchers(withdraw_id),
+			created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			used        INTEGER NOT NULL DEFAULT 0,
+			used_at     DATETIME
+		);
+CREATE INDEX idx_vouchers_withdraw_id ON vouchers(withdraw_id);
+CREATE INDEX idx_vouchers_creation_hash ON vouchers(creation_request_hash);
+CREATE INDEX idx_vouchers_refund ON vouchers(active, total_paid_msats, last_funded_at, created_at);
+COMMIT;
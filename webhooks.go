@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ── Webhooks ─────────────────────────────────────────────────────────────────
+//
+// Subscribers receive voucher lifecycle events as JSON POSTs. Each request is
+// signed with the subscription's secret:
+//
+//	X-TipMe-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// Deliveries that fail are retried with exponential backoff and, after
+// WEBHOOK_MAX_ATTEMPTS, kept as dead letters that the admin can replay.
+
+const (
+	EventBatchPaid          = "batch.paid"
+	EventBatchCompleted     = "batch.completed"
+	EventVoucherFunded      = "voucher.funded"
+	EventVoucherClaimed     = "voucher.claimed"
+	EventVoucherRefunded    = "voucher.refunded"
+	EventVoucherDeactivated = "voucher.deactivated"
+	EventVoucherExpiring    = "voucher.expiring"
+	EventAccountLowBalance  = "account.low_balance" // global subscriptions only
+)
+
+var webhookEvents = []string{
+	EventBatchPaid, EventBatchCompleted, EventVoucherFunded,
+	EventVoucherClaimed, EventVoucherRefunded, EventVoucherDeactivated,
+	EventVoucherExpiring, EventAccountLowBalance,
+}
+
+const maxWebhooksPerBatch = 5
+
+// emitEvent queues an event that isn't part of a database transaction.
+func emitEvent(eventType, batchID, payID string, data map[string]any) {
+	if err := database.EnqueueEvent(eventType, batchID, payID, data); err != nil {
+		log.Printf("EnqueueEvent %s (batch=%s pay_id=%s): %v", eventType, batchID, payID, err)
+		return
+	}
+	nudgeWebhooks()
+	nudgeMailer()
+}
+
+// emitClaimed queues a voucher.claimed event for msats paid out of v.
+func emitClaimed(v *Voucher, msats int64, partial bool) {
+	emitEvent(EventVoucherClaimed, v.BatchID, v.PayID, map[string]any{
+		"amount_msats": msats,
+		"partial":      partial,
+	})
+}
+
+// webhookNudge wakes the webhook worker early, e.g. right after an event.
+var webhookNudge = make(chan struct{}, 1)
+
+// nudgeWebhooks asks the webhook worker to run soon without blocking.
+func nudgeWebhooks() {
+	select {
+	case webhookNudge <- struct{}{}:
+	default:
+	}
+}
+
+func runWebhookLoop() {
+	ticker := time.NewTicker(time.Duration(cfg.WebhookPollSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		deliverWebhooks()
+		select {
+		case <-ticker.C:
+		case <-webhookNudge:
+		}
+	}
+}
+
+// webhookClient only connects to public addresses (see webhookDialControl)
+// and ignores proxy settings, which would hide the address it connects to.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	},
+}
+
+// webhookDialControl refuses connections to loopback, link-local, private
+// and other non-public addresses, so that a subscriber can't point webhooks
+// into the server's own network. It sees the address actually dialled, after
+// DNS resolution and on every redirect, so a name that resolves differently
+// later can't get around it. WEBHOOK_ALLOW_PRIVATE_NETWORKS turns it off for
+// installations whose subscribers are all trusted.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if cfg.WebhookAllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !isPublicAddr(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// nonPublicPrefixes are the special-purpose ranges netip has no predicate for.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can reach any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+}
+
+// isPublicAddr reports whether ip is a unicast address on the internet.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookLease is how long a claimed delivery is left to its worker before
+// another may take it over. It outlasts a run of the worker.
+const webhookLease = 30 * time.Minute
+
+// webhookWorkers is how many endpoints are delivered to at once.
+const webhookWorkers = 8
+
+// deliverWebhooks sends every delivery that is due. Deliveries to the same
+// host go out one at a time and in order, while up to webhookWorkers hosts
+// are served at once, so a slow endpoint only holds up its own deliveries.
+func deliverWebhooks() {
+	deliveries, err := database.ClaimDueWebhookDeliveries(100, webhookLease)
+	if err != nil {
+		log.Printf("webhooks: ClaimDueWebhookDeliveries: %v", err)
+		return
+	}
+	var hosts []string
+	byHost := map[string][]WebhookDelivery{}
+	for _, d := range deliveries {
+		host := d.URL
+		if u, err := url.Parse(d.URL); err == nil {
+			host = u.Host
+		}
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], d)
+	}
+
+	queue := make(chan []WebhookDelivery)
+	var wg sync.WaitGroup
+	for range min(webhookWorkers, len(hosts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				deliverWebhookGroup(group)
+			}
+		}()
+	}
+	for _, host := range hosts {
+		queue <- byHost[host]
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// deliverWebhookGroup sends deliveries to one host in order. If the host
+// can't be reached at all, the rest wait for the same retry time without
+// using up an attempt, rather than each waiting out a timeout of its own.
+func deliverWebhookGroup(group []WebhookDelivery) {
+	for i, d := range group {
+		retryAt, unreachable := deliverWebhook(d)
+		if !unreachable {
+			continue
+		}
+		rest := make([]int64, 0, len(group)-i-1)
+		for _, r := range group[i+1:] {
+			rest = append(rest, r.ID)
+		}
+		if len(rest) == 0 {
+			return
+		}
+		if retryAt == nil {
+			now := time.Now()
+			retryAt = &now
+		}
+		if err := database.PostponeWebhookDeliveries(rest, *retryAt); err != nil {
+			log.Printf("webhooks: PostponeWebhookDeliveries: %v", err)
+		}
+		return
+	}
+}
+
+// deliverWebhook sends one delivery and records the outcome. It returns when
+// the delivery will be retried, if it failed and will be, and whether the
+// endpoint couldn't be reached at all.
+func deliverWebhook(d WebhookDelivery) (retryAt *time.Time, unreachable bool) {
+	status, err := postWebhook(d)
+	if err == nil {
+		if err := database.MarkWebhookDelivered(d.ID, status); err != nil {
+			log.Printf("webhooks: MarkWebhookDelivered id=%d: %v", d.ID, err)
+		}
+		return nil, false
+	}
+
+	attempts := d.Attempts + 1
+	if attempts < cfg.WebhookMaxAttempts {
+		backoff := time.Duration(cfg.WebhookRetryBaseSecs) * time.Second << min(attempts-1, 10)
+		at := time.Now().Add(min(backoff, 6*time.Hour))
+		retryAt = &at
+		log.Printf("webhooks: delivery %d (%s to %s) failed %d time(s), retrying after %s: %v",
+			d.ID, d.EventType, d.URL, attempts, at.UTC().Format(time.RFC3339), err)
+	} else {
+		log.Printf("webhooks: delivery %d (%s to %s) failed %d times, giving up: %v",
+			d.ID, d.EventType, d.URL, attempts, err)
+	}
+	if err := database.MarkWebhookFailed(d.ID, status, err.Error(), retryAt); err != nil {
+		log.Printf("webhooks: MarkWebhookFailed id=%d: %v", d.ID, err)
+	}
+	return retryAt, status == 0
+}
+
+// postWebhook sends one delivery, returning the HTTP status if there was one.
+func postWebhook(d WebhookDelivery) (int, error) {
+	ts := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TipMe-Webhooks/1")
+	req.Header.Set("X-TipMe-Event", d.EventType)
+	req.Header.Set("X-TipMe-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-TipMe-Signature", fmt.Sprintf("t=%d,v1=%s", ts, signWebhook(d.Secret, ts, d.Payload)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<ts>.<body>" under secret.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ── Subscriptions ────────────────────────────────────────────────────────────
+//
+// Global subscriptions are managed by the admin under /api/admin/webhooks;
+// a batch owner manages their batch's under /api/batches/:payment_hash/webhooks.
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // empty for all
+}
+
+// newWebhookSubscription validates a subscription request and gives it an
+// ID and a signing secret.
+func newWebhookSubscription(r *http.Request, batchID string) (*WebhookSubscription, error) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid JSON")
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an http(s) URL")
+	}
+	if !cfg.WebhookAllowPrivateNetworks {
+		// Names are checked again on every connection; this only catches the
+		// obvious cases early, with a clearer error.
+		host := u.Hostname()
+		if ip, err := netip.ParseAddr(host); (err == nil && !isPublicAddr(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return nil, fmt.Errorf("url must point to a public address")
+		}
+	}
+	events := []string{}
+	for _, e := range req.Events {
+		if !slices.Contains(webhookEvents, e) {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+		if !slices.Contains(events, e) {
+			events = append(events, e)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &WebhookSubscription{
+		ID:        uuid.New().String(),
+		BatchID:   batchID,
+		URL:       u.String(),
+		Secret:    hex.EncodeToString(secret),
+		Events:    events,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// createWebhook stores a new subscription and returns it, secret included;
+// this is the only time the secret is shown.
+func createWebhook(w http.ResponseWriter, r *http.Request, batchID string) {
+	sub, err := newWebhookSubscription(r, batchID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if batchID != "" {
+		existing, err := database.GetWebhookSubscriptions(batchID)
+		if err != nil {
+			log.Printf("GetWebhookSubscriptions: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+			return
+		}
+		if len(existing) >= maxWebhooksPerBatch {
+			writeJSON(w, http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("a batch may have at most %d webhooks", maxWebhooksPerBatch),
+			})
+			return
+		}
+	}
+	if err := database.InsertWebhookSubscription(sub); err != nil {
+		log.Printf("InsertWebhookSubscription: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+func listWebhooks(w http.ResponseWriter, batchID string) {
+	subs, err := database.GetWebhookSubscriptions(batchID)
+	if err != nil {
+		log.Printf("GetWebhookSubscriptions: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func deleteWebhook(w http.ResponseWriter, id, batchID string) {
+	if err := database.DeleteWebhookSubscription(id, batchID); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("DeleteWebhookSubscription: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// ── /api/batches/:payment_hash/webhooks ──────────────────────────────────────
+
+func handleCreateBatchWebhook(w http.ResponseWriter, r *http.Request) {
+	if batch := batchForPaymentHash(w, r.PathValue("payment_hash")); batch != nil {
+		createWebhook(w, r, batch.ID)
+	}
+}
+
+func handleListBatchWebhooks(w http.ResponseWriter, r *http.Request) {
+	if batch := batchForPaymentHash(w, r.PathValue("payment_hash")); batch != nil {
+		listWebhooks(w, batch.ID)
+	}
+}
+
+func handleDeleteBatchWebhook(w http.ResponseWriter, r *http.Request) {
+	if batch := batchForPaymentHash(w, r.PathValue("payment_hash")); batch != nil {
+		deleteWebhook(w, r.PathValue("id"), batch.ID)
+	}
+}
+
+// ── /api/admin/webhooks ──────────────────────────────────────────────────────
+
+// requireAdmin writes a 401 and returns false unless the request is the admin's.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return false
+	}
+	return true
+}
+
+func handleCreateGlobalWebhook(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) {
+		createWebhook(w, r, "")
+	}
+}
+
+func handleListGlobalWebhooks(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) {
+		listWebhooks(w, "")
+	}
+}
+
+func handleDeleteGlobalWebhook(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) {
+		deleteWebhook(w, r.PathValue("id"), "")
+	}
+}
+
+// handleListWebhookDeliveries returns recent deliveries, e.g. ?status=dead
+// for the dead letters.
+func handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "delivered" && status != "dead" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "status must be pending, delivered or dead"})
+		return
+	}
+	deliveries, err := database.GetWebhookDeliveries(status, 200)
+	if err != nil {
+		log.Printf("GetWebhookDeliveries: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// handleReplayWebhookDelivery sends a delivery again, whatever its status.
+func handleReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err := database.ReplayWebhookDelivery(id); errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	} else if err != nil {
+		log.Printf("ReplayWebhookDelivery: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		return
+	}
+	log.Printf("webhooks: delivery %d queued for replay", id)
+	nudgeWebhooks()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "pending"})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"::ffff:1.1.1.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fe80::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::a00:1", false}, // 10.0.0.1 through NAT64
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+// TestWebhookClientRefusesPrivateAddresses connects to a local server by a
+// name, which only the check at connect time can catch.
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	cfg.WebhookAllowPrivateNetworks = false
+	if _, err := webhookClient.Get("http://localhost:" + port); err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("request to localhost = %v, want it refused", err)
+	}
+	cfg.WebhookAllowPrivateNetworks = true
+	if resp, err := webhookClient.Get("http://localhost:" + port); err != nil {
+		t.Errorf("request with private networks allowed: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestNewWebhookSubscriptionRefusesPrivateURLs(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.WebhookAllowPrivateNetworks = false
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/tipme", true},
+		{"https://1.1.1.1/tipme", true},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://127.0.0.1:8080/", false},
+		{"http://[::1]/", false},
+		{"http://localhost/", false},
+		{"http://api.localhost/", false},
+		{"http://10.0.0.5/", false},
+		{"ftp://hooks.example.com/", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(`{"url":"`+tc.url+`"}`))
+		if _, err := newWebhookSubscription(req, ""); (err == nil) != tc.ok {
+			t.Errorf("newWebhookSubscription(%s): %v, want ok=%v", tc.url, err, tc.ok)
+		}
+	}
+}
+
+// TestDeliverWebhooksPerEndpoint checks that an endpoint that can't be
+// reached costs one attempt per run, not one per delivery, and doesn't stop
+// deliveries to other endpoints.
+func TestDeliverWebhooksPerEndpoint(t *testing.T) {
+	useTestServer(t)
+	cfg.WebhookAllowPrivateNetworks = true
+	cfg.WebhookMaxAttempts, cfg.WebhookRetryBaseSecs = 12, 30
+
+	var received atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { received.Add(1) }))
+	t.Cleanup(up.Close)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	for _, u := range []string{up.URL, down.URL} {
+		sub := &WebhookSubscription{ID: uuid.New().String(), URL: u, Secret: "secret", Events: []string{}}
+		if err := database.InsertWebhookSubscription(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 3 {
+		if err := database.EnqueueEvent(EventAccountLowBalance, "", "", map[string]any{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	deliverWebhooks()
+	if received.Load() != 3 {
+		t.Errorf("reachable endpoint got %d deliveries, want 3", received.Load())
+	}
+	deliveries, err := database.GetWebhookDeliveries("pending", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("%d deliveries pending, want the 3 to the unreachable endpoint", len(deliveries))
+	}
+	attempts := 0
+	for _, d := range deliveries {
+		attempts += d.Attempts
+		if d.URL != down.URL || !d.NextAttemptAt.After(start.Add(20*time.Second)) {
+			t.Errorf("delivery %d to %s due at %s, want a retry of the unreachable endpoint later", d.ID, d.URL, d.NextAttemptAt)
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("unreachable endpoint used %d attempts, want 1", attempts)
+	}
+}